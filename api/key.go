@@ -12,6 +12,7 @@ import (
 type Authorizer interface {
 	NewToken(id string) (string, error)
 	Valid(req *http.Request) (bool, string)
+	ValidToken(str string) (bool, string)
 }
 
 // AlwaysValid is used to disable authentication
@@ -25,6 +26,11 @@ func (AlwaysValid) Valid(*http.Request) (bool, string) {
 	return true, ""
 }
 
+// ValidToken stub
+func (AlwaysValid) ValidToken(string) (bool, string) {
+	return true, ""
+}
+
 // Key provides a key for signing authentication tokens.
 type Key struct {
 	bytes []byte
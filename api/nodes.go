@@ -36,16 +36,16 @@ type Nodes struct {
 	check     RequestValidator
 	nc        *nats.Conn
 	authToken string
+	access    *client.AccessCache
 }
 
 // NewNodesHandler returns a new node handler
 func NewNodesHandler(v RequestValidator, authToken string,
-	nc *nats.Conn) http.Handler {
-	return &Nodes{v, nc, authToken}
+	nc *nats.Conn, access *client.AccessCache) http.Handler {
+	return &Nodes{v, nc, authToken, access}
 }
 
 // Top level handler for http requests in the coap-server process
-// TODO need to add node auth
 func (h *Nodes) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 
 	var id string
@@ -70,6 +70,11 @@ func (h *Nodes) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	if id == "" {
 		switch req.Method {
 		case http.MethodGet:
+			if req.URL.Query().Has("query") {
+				h.queryNodes(res, req.URL.Query().Get("query"), userID)
+				return
+			}
+
 			if !validUser {
 				http.Error(res, "invalid user", http.StatusMethodNotAllowed)
 				return
@@ -116,6 +121,10 @@ func (h *Nodes) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 
 			parent := string(body)
 
+			if !h.authorized(res, userID, []string{id}, nil) {
+				return
+			}
+
 			node, err := client.GetNodes(h.nc, parent, id, "", false)
 			if err != nil {
 				http.Error(res, err.Error(), http.StatusNotFound)
@@ -134,6 +143,10 @@ func (h *Nodes) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 				return
 			}
 
+			if !h.authorized(res, userID, nil, []string{nodeDelete.Parent}) {
+				return
+			}
+
 			err := client.DeleteNode(h.nc, id, nodeDelete.Parent, userID)
 
 			if err != nil {
@@ -154,6 +167,9 @@ func (h *Nodes) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 
 	case "samples", "points":
 		if req.Method == http.MethodPost {
+			if !h.authorized(res, userID, nil, []string{id}) {
+				return
+			}
 			h.processPoints(res, req, id, userID)
 			return
 		}
@@ -161,6 +177,27 @@ func (h *Nodes) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		http.Error(res, "only POST allowed", http.StatusMethodNotAllowed)
 		return
 
+	case "revisions":
+		if req.Method != http.MethodGet {
+			http.Error(res, "only GET allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !h.authorized(res, userID, []string{id}, nil) {
+			return
+		}
+
+		revisions, err := client.GetRevisions(h.nc, id)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		err = encode(res, revisions)
+		if err != nil {
+			http.Error(res, "encoding error", http.StatusMethodNotAllowed)
+		}
+
 	case "parents":
 		switch req.Method {
 		case http.MethodPost:
@@ -170,6 +207,11 @@ func (h *Nodes) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 				return
 			}
 
+			if !h.authorized(res, userID, nil,
+				[]string{nodeMove.OldParent, nodeMove.NewParent}) {
+				return
+			}
+
 			err := client.MoveNode(h.nc, id, nodeMove.OldParent,
 				nodeMove.NewParent, userID)
 
@@ -192,6 +234,17 @@ func (h *Nodes) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 				return
 			}
 
+			// mirroring a node gives the users of the new parent
+			// access to it, so the node must be writable
+			writable := []string{nodeCopy.NewParent}
+			if !nodeCopy.Duplicate {
+				writable = append(writable, id)
+			}
+
+			if !h.authorized(res, userID, []string{id}, writable) {
+				return
+			}
+
 			if !nodeCopy.Duplicate {
 				err := client.MirrorNode(h.nc, id, nodeCopy.NewParent, userID)
 
@@ -231,19 +284,68 @@ func (h *Nodes) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 				return
 			}
 
-			not.ID = uuid.New().String()
+			if !h.authorized(res, userID, nil, []string{id}) {
+				return
+			}
 
-			d, err := not.ToPb()
+			// the notification client sends it to the users of the
+			// closest group and upstream users. A new notification is
+			// not created while one for the node and subject is open.
+			parent, err := client.NotificationParent(h.nc, id)
+			if err != nil {
+				http.Error(res, err.Error(), http.StatusNotFound)
+				return
+			}
+
+			_, err = client.SendNotification(h.nc, client.Notification{
+				Parent:      parent,
+				Description: not.Subject,
+				Subject:     not.Subject,
+				Message:     not.Message,
+				SourceNode:  id,
+			}, 0, userID)
 
 			if err != nil {
 				http.Error(res, err.Error(), http.StatusBadRequest)
 				return
 			}
 
-			err = h.nc.Publish("node."+id+".not", d)
+			en := json.NewEncoder(res)
+			err = en.Encode(data.StandardResponse{Success: true, ID: id})
+			if err != nil {
+				http.Error(res, "encoding error", http.StatusMethodNotAllowed)
+			}
+		default:
+			http.Error(res, "invalid method", http.StatusMethodNotAllowed)
+		}
+
+	case "ack":
+		switch req.Method {
+		case http.MethodPost:
+			// users who can see a notification can acknowledge it
+			if !h.authorized(res, userID, []string{id}, nil) {
+				return
+			}
 
+			nodes, err := client.GetNodes(h.nc, "all", id, "", false)
 			if err != nil {
-				http.Error(res, err.Error(), http.StatusBadRequest)
+				http.Error(res, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if len(nodes) < 1 || nodes[0].Type != data.NodeTypeNotification {
+				http.Error(res, "notification not found", http.StatusNotFound)
+				return
+			}
+
+			ackUser := userID
+			if ackUser == "" {
+				ackUser = "api"
+			}
+
+			err = client.AckNotification(h.nc, id, ackUser)
+			if err != nil {
+				http.Error(res, err.Error(), http.StatusInternalServerError)
 				return
 			}
 
@@ -263,6 +365,78 @@ type RequestValidator interface {
 	Valid(req *http.Request) (bool, string)
 }
 
+// authorized checks that a user can read and write the given nodes, and
+// writes an error response if not. Requests without a user (auth token or
+// auth disabled) can access all nodes.
+func (h *Nodes) authorized(res http.ResponseWriter, userID string, read, write []string) bool {
+	if userID == "" {
+		return true
+	}
+
+	access, err := h.access.Get(userID)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	for _, id := range read {
+		if !access.CanRead(id) {
+			http.Error(res, "Forbidden", http.StatusForbidden)
+			return false
+		}
+	}
+
+	for _, id := range write {
+		if !access.CanWrite(id) {
+			http.Error(res, "Forbidden", http.StatusForbidden)
+			return false
+		}
+	}
+
+	return true
+}
+
+// queryNodes returns nodes that match a node query. Users only get the nodes
+// they can read.
+func (h *Nodes) queryNodes(res http.ResponseWriter, query, userID string) {
+	q, err := data.ParseNodeQuery(query)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	nodes, err := client.QueryNodes(h.nc, q)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if userID != "" {
+		access, err := h.access.Get(userID)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		allowed := []data.NodeEdge{}
+		for _, n := range nodes {
+			if access.CanRead(n.ID) {
+				allowed = append(allowed, n)
+			}
+		}
+		nodes = allowed
+	}
+
+	if nodes == nil {
+		nodes = []data.NodeEdge{}
+	}
+
+	err = encode(res, nodes)
+	if err != nil {
+		http.Error(res, "encoding error", http.StatusMethodNotAllowed)
+	}
+}
+
 func (h *Nodes) insertNode(res http.ResponseWriter, req *http.Request, userID string) {
 	var node data.NodeEdge
 	if err := decode(req.Body, &node); err != nil {
@@ -270,8 +444,23 @@ func (h *Nodes) insertNode(res http.ResponseWriter, req *http.Request, userID st
 		return
 	}
 
+	if !h.authorized(res, userID, nil, []string{node.Parent}) {
+		return
+	}
+
 	if node.ID == "" {
 		node.ID = uuid.New().String()
+	} else if userID != "" {
+		// users can't add existing nodes they can't write to their tree
+		existing, err := client.GetNodes(h.nc, "all", node.ID, "", true)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(existing) > 0 && !h.authorized(res, userID, nil, []string{node.ID}) {
+			return
+		}
 	}
 
 	// populate origin for all points
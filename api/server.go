@@ -9,6 +9,7 @@ import (
 
 	"github.com/koding/websocketproxy"
 	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/client"
 )
 
 // App is a struct that implements http.Handler interface
@@ -80,6 +81,8 @@ type ServerArgs struct {
 	AuthToken  string
 	NatsWSPort int
 	Nc         *nats.Conn
+	// Access caches user access for authorization checks
+	Access *client.AccessCache
 }
 
 // Server represents the HTTP API server
@@ -0,0 +1,207 @@
+package client
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// Access describes which nodes a user can read and write. A user can access
+// the subtree under each group (parent node) the user node belongs to. The
+// role point on the user edge determines if the subtree can be written.
+type Access struct {
+	// Nodes maps node IDs the user can read to true if the node can also
+	// be written
+	Nodes map[string]bool
+	// Parents maps node IDs the user can write to the parents they are
+	// written under. An edge can only be written if both the node and the
+	// parent can be written.
+	Parents map[string][]string
+}
+
+// CanRead returns true if the node can be read
+func (a Access) CanRead(id string) bool {
+	_, ok := a.Nodes[id]
+	return ok
+}
+
+// CanWrite returns true if the node can be written
+func (a Access) CanWrite(id string) bool {
+	return a.Nodes[id]
+}
+
+// CanWriteEdge returns true if the edge between a node and parent can be
+// written
+func (a Access) CanWriteEdge(id, parent string) bool {
+	return slices.Contains(a.Parents[id], parent)
+}
+
+// roleCanWrite returns true if a user edge role grants write access
+func roleCanWrite(role string) bool {
+	return role != data.PointValueRoleRead
+}
+
+// GetUserAccess walks the node tree to determine which nodes a user can read
+// and write
+func GetUserAccess(nc *nats.Conn, userID string) (Access, error) {
+	ret := Access{Nodes: make(map[string]bool), Parents: make(map[string][]string)}
+
+	userNodes, err := GetNodes(nc, "all", userID, "", false)
+	if err != nil {
+		return ret, err
+	}
+
+	for _, un := range userNodes {
+		role, _ := un.EdgePoints.Text(data.PointTypeRole, "")
+		err := ret.walk(nc, un.Parent, "", roleCanWrite(role))
+		if err != nil {
+			return ret, fmt.Errorf("Error getting user access: %v", err)
+		}
+	}
+
+	return ret, nil
+}
+
+// GetNodeAccess returns write access to a node and its descendants. This is
+// used for plugins, which can only access the plugin node subtree.
+func GetNodeAccess(nc *nats.Conn, id string) (Access, error) {
+	ret := Access{Nodes: make(map[string]bool), Parents: make(map[string][]string)}
+
+	err := ret.walk(nc, id, "", true)
+	if err != nil {
+		return ret, fmt.Errorf("Error getting node access: %v", err)
+	}
+
+	return ret, nil
+}
+
+// walk adds the access to a node reached from parent and its descendants
+func (a Access) walk(nc *nats.Conn, id, parent string, write bool) error {
+	if write && parent != "" && !a.CanWriteEdge(id, parent) {
+		a.Parents[id] = append(a.Parents[id], parent)
+	}
+
+	if w, ok := a.Nodes[id]; ok && (w || !write) {
+		// already visited with at least this access
+		return nil
+	}
+
+	a.Nodes[id] = write
+
+	children, err := GetNodes(nc, id, "all", "", false)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range children {
+		err := a.walk(nc, c.ID, id, write)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AccessCache caches the access of users so that the node tree is not walked
+// for every request. The cache is cleared when the node tree changes.
+type AccessCache struct {
+	nc        *nats.Conn
+	stopWatch func()
+	changed   func()
+
+	lock   sync.Mutex
+	access map[string]Access
+	// nodes caches access to node subtrees (plugins)
+	nodes map[string]Access
+	// gen is incremented each time the cache is cleared so that access
+	// read while the tree changes is not cached
+	gen int
+}
+
+// NewAccessCache creates an access cache. If changed is set, it is called
+// after the cache is cleared because the node tree changed.
+func NewAccessCache(nc *nats.Conn, changed func()) (*AccessCache, error) {
+	ac := &AccessCache{
+		nc:      nc,
+		changed: changed,
+		access:  make(map[string]Access),
+		nodes:   make(map[string]Access),
+	}
+
+	var err error
+	ac.stopWatch, err = WatchNodeEvents(nc, nil, func(data.NodeEvent) {
+		ac.clear()
+		if ac.changed != nil {
+			ac.changed()
+		}
+	})
+
+	return ac, err
+}
+
+// Get returns the access of a user
+func (ac *AccessCache) Get(userID string) (Access, error) {
+	ac.lock.Lock()
+	access, ok := ac.access[userID]
+	gen := ac.gen
+	ac.lock.Unlock()
+
+	if ok {
+		return access, nil
+	}
+
+	access, err := GetUserAccess(ac.nc, userID)
+	if err != nil {
+		return access, err
+	}
+
+	ac.lock.Lock()
+	if gen == ac.gen {
+		ac.access[userID] = access
+	}
+	ac.lock.Unlock()
+
+	return access, nil
+}
+
+// GetNode returns the access to a node and its descendants
+func (ac *AccessCache) GetNode(id string) (Access, error) {
+	ac.lock.Lock()
+	access, ok := ac.nodes[id]
+	gen := ac.gen
+	ac.lock.Unlock()
+
+	if ok {
+		return access, nil
+	}
+
+	access, err := GetNodeAccess(ac.nc, id)
+	if err != nil {
+		return access, err
+	}
+
+	ac.lock.Lock()
+	if gen == ac.gen {
+		ac.nodes[id] = access
+	}
+	ac.lock.Unlock()
+
+	return access, nil
+}
+
+func (ac *AccessCache) clear() {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	ac.access = make(map[string]Access)
+	ac.nodes = make(map[string]Access)
+	ac.gen++
+}
+
+// Stop stops watching the node tree
+func (ac *AccessCache) Stop() {
+	ac.stopWatch()
+}
@@ -1,10 +1,14 @@
 package client
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"time"
 
 	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
 )
 
 // AdminStoreVerify can be used verify the store
@@ -34,3 +38,83 @@ func AdminStoreMaint(nc *nats.Conn) error {
 
 	return nil
 }
+
+// AdminStoreBackup requests a consistent snapshot of the store and writes it
+// to w. The server can keep running while the backup is taken.
+func AdminStoreBackup(nc *nats.Conn, w io.Writer) error {
+	inbox := nc.NewInbox()
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+
+	err = nc.PublishRequest("admin.storeBackup", inbox, nil)
+	if err != nil {
+		return err
+	}
+
+	var seq int32
+
+	for {
+		// the first chunk is sent after the snapshot is created, which
+		// may take a while for large stores
+		msg, err := sub.NextMsg(time.Minute * 5)
+		if err != nil {
+			return err
+		}
+
+		done, err := ReceiveFileChunk(msg, w, seq)
+
+		reply := "OK"
+		if err != nil {
+			reply = err.Error()
+		}
+
+		if e := msg.Respond([]byte(reply)); e != nil && err == nil {
+			err = e
+		}
+
+		if err != nil || done {
+			return err
+		}
+
+		seq++
+	}
+}
+
+// AdminStoreRestore sends a snapshot created by AdminStoreBackup to the store.
+// The store validates the snapshot before replacing all data with it.
+func AdminStoreRestore(nc *nats.Conn, r io.Reader) error {
+	return SendFileChunks(nc, "admin.storeRestore", r, "restore", time.Minute*5)
+}
+
+// AdminStoreGC purges deleted nodes and points that are older than retention
+// from the store and compacts it. If retention is zero, the retention
+// configured in the store is used.
+func AdminStoreGC(nc *nats.Conn, retention time.Duration) (data.GCResults, error) {
+	var req []byte
+	if retention > 0 {
+		req = []byte(retention.String())
+	}
+
+	var results data.GCResults
+
+	resp, err := nc.Request("admin.storeGC", req, time.Minute*5)
+	if err != nil {
+		return results, err
+	}
+
+	err = json.Unmarshal(resp.Data, &results)
+	if err != nil {
+		return results, fmt.Errorf("Error decoding gc results: %v", err)
+	}
+
+	if results.ErrorMessage != "" {
+		return results, errors.New(results.ErrorMessage)
+	}
+
+	return results, nil
+}
@@ -1,10 +1,12 @@
 package client_test
 
 import (
+	"bytes"
 	"testing"
 	"time"
 
 	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
 	"github.com/simpleiot/simpleiot/server"
 )
 
@@ -43,3 +45,142 @@ func TestAdminStoreMaint(t *testing.T) {
 		t.Fatal("Maint failed: ", err)
 	}
 }
+
+func TestAdminStoreBackupRestore(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	err = client.SendNodePoint(nc, root.ID, data.Point{Type: data.PointTypeDescription,
+		Text: "before"}, true)
+	if err != nil {
+		t.Fatal("Error sending point: ", err)
+	}
+
+	var backup bytes.Buffer
+	err = client.AdminStoreBackup(nc, &backup)
+	if err != nil {
+		t.Fatal("Backup failed: ", err)
+	}
+
+	if backup.Len() <= 0 {
+		t.Fatal("Backup is empty")
+	}
+
+	err = client.SendNodePoint(nc, root.ID, data.Point{Type: data.PointTypeDescription,
+		Text: "after"}, true)
+	if err != nil {
+		t.Fatal("Error sending point: ", err)
+	}
+
+	// invalid snapshots must not be restored
+	err = client.AdminStoreRestore(nc, bytes.NewReader([]byte("garbage")))
+	if err == nil {
+		t.Fatal("Restoring garbage should fail")
+	}
+
+	events := make(chan data.NodeEvent, 10)
+	stopWatch, err := client.WatchNodeEvents(nc, nil, func(e data.NodeEvent) {
+		events <- e
+	})
+	if err != nil {
+		t.Fatal("Error watching events: ", err)
+	}
+	defer stopWatch()
+
+	err = client.AdminStoreRestore(nc, bytes.NewReader(backup.Bytes()))
+	if err != nil {
+		t.Fatal("Restore failed: ", err)
+	}
+
+	// client managers rescan after a restore
+	select {
+	case e := <-events:
+		if e.Type != data.NodeEventRescan {
+			t.Fatal("expected rescan event, got: ", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for rescan event")
+	}
+
+	nodes, err := client.GetNodes(nc, "root", root.ID, "", false)
+	if err != nil || len(nodes) < 1 {
+		t.Fatal("Error getting root node: ", err)
+	}
+
+	desc, _ := nodes[0].Points.Text(data.PointTypeDescription, "")
+	if desc != "before" {
+		t.Fatal("Restore did not restore description, got: ", desc)
+	}
+
+	err = client.AdminStoreVerify(nc)
+	if err != nil {
+		t.Fatal("Verify after restore failed: ", err)
+	}
+}
+
+func TestAdminStoreGC(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	_, err = client.AdminStoreGC(nc, 0)
+	if err == nil {
+		t.Fatal("gc without retention should fail")
+	}
+
+	v := data.NodeEdge{ID: "var1", Parent: root.ID, Type: data.NodeTypeVariable}
+	err = client.SendNode(nc, v, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	err = client.SendEdgePoint(nc, v.ID, root.ID, data.Point{Type: data.PointTypeTombstone,
+		Value: 1}, true)
+	if err != nil {
+		t.Fatal("Error deleting node: ", err)
+	}
+
+	time.Sleep(time.Millisecond * 10)
+
+	// watchers are told to rescan after nodes are purged
+	events := make(chan data.NodeEvent, 10)
+	stopWatch, err := client.WatchNodeEvents(nc, []string{data.NodeTypeVariable}, func(e data.NodeEvent) {
+		events <- e
+	})
+	if err != nil {
+		t.Fatal("Error watching events: ", err)
+	}
+	defer stopWatch()
+
+	results, err := client.AdminStoreGC(nc, time.Millisecond)
+	if err != nil {
+		t.Fatal("gc failed: ", err)
+	}
+
+	select {
+	case e := <-events:
+		if e.Type != data.NodeEventRescan {
+			t.Fatal("expected rescan event, got: ", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for rescan event")
+	}
+
+	if results.Nodes != 1 || results.Edges != 1 {
+		t.Fatalf("gc results not correct: %+v", results)
+	}
+
+	err = client.AdminStoreVerify(nc)
+	if err != nil {
+		t.Fatal("Verify failed after gc: ", err)
+	}
+}
@@ -1,8 +1,10 @@
 package client
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"reflect"
 	"sync"
 	"time"
 
@@ -17,6 +19,10 @@ type clientState[T any] struct {
 	nec  data.NodeEdgeChildren
 
 	client Client
+	// start is when the client was started
+	start time.Time
+	// err is set if the client exited with an error without being stopped
+	err error
 
 	stopOnce sync.Once
 	chStop   chan struct{}
@@ -25,21 +31,15 @@ type clientState[T any] struct {
 func newClientState[T any](nc *nats.Conn, construct func(*nats.Conn, T) Client,
 	n data.NodeEdge) (*clientState[T], error) {
 
-	c, err := GetNodes(nc, n.ID, "all", "", false)
+	var config T
+
+	ncc, err := getChildren(nc, n.ID, reflect.TypeOf(config))
 	if err != nil {
 		return nil, fmt.Errorf("Error getting children: %v", err)
 	}
 
-	ncc := make([]data.NodeEdgeChildren, len(c))
-
-	for i, nci := range c {
-		ncc[i] = data.NodeEdgeChildren{NodeEdge: nci, Children: nil}
-	}
-
 	nec := data.NodeEdgeChildren{NodeEdge: n, Children: ncc}
 
-	var config T
-
 	err = data.Decode(nec, &config)
 	if err != nil {
 		return nil, fmt.Errorf("Error decoding node: %w", err)
@@ -58,26 +58,107 @@ func newClientState[T any](nc *nats.Conn, construct func(*nats.Conn, T) Client,
 	return ret, nil
 }
 
-func (cs *clientState[T]) run() (err error) {
+// getChildren returns the children of a node. Children are loaded
+// recursively for child types that have child fields in the config struct t
+// (for example rule condition groups).
+func getChildren(nc *nats.Conn, id string, t reflect.Type) ([]data.NodeEdgeChildren, error) {
+	c, err := GetNodes(nc, id, "all", "", false)
+	if err != nil {
+		return nil, err
+	}
 
-	chClientStopped := make(chan struct{})
+	ret := make([]data.NodeEdgeChildren, len(c))
 
-	go func() {
-		// the following blocks until client exits
-		err := cs.client.Run()
+	for i, nci := range c {
+		ret[i] = data.NodeEdgeChildren{NodeEdge: nci, Children: nil}
+
+		ct := childStructType(t, nci.Type)
+		if ct == nil {
+			continue
+		}
+
+		ret[i].Children, err = getChildren(nc, nci.ID, ct)
 		if err != nil {
-			log.Printf("Client Run %v %v returned error: %v\n",
-				cs.node.Type, cs.node.ID, err)
+			return nil, err
 		}
-		close(chClientStopped)
+	}
+
+	return ret, nil
+}
+
+// childStructType returns the struct type of the child field for nodeType in
+// t if that struct has child fields itself, otherwise nil.
+func childStructType(t reflect.Type, nodeType string) reflect.Type {
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.Tag.Get("child") != nodeType || sf.Type.Kind() != reflect.Slice {
+			continue
+		}
+
+		ct := sf.Type.Elem()
+		if ct.Kind() != reflect.Struct {
+			return nil
+		}
+
+		for j := 0; j < ct.NumField(); j++ {
+			if ct.Field(j).Tag.Get("child") != "" {
+				return ct
+			}
+		}
+
+		return nil
+	}
+
+	return nil
+}
+
+// clientStartupTime is how long a client must run before it is considered
+// started. Clients that fail to open a port or connect typically return from
+// Run within this time.
+var clientStartupTime = 500 * time.Millisecond
+
+// run runs the client until it is stopped, or it exits on its own. An error
+// is returned if the client exits without being stopped. started is called
+// once the client has run for clientStartupTime without exiting.
+func (cs *clientState[T]) run(started func()) error {
+	chClientStopped := make(chan error, 1)
+
+	go func() {
+		// the following blocks until client exits
+		chClientStopped <- cs.client.Run()
 	}()
 
-	<-cs.chStop
+	startupTimer := time.NewTimer(clientStartupTime)
+	defer startupTimer.Stop()
+
+done:
+	for {
+		select {
+		case err := <-chClientStopped:
+			if err == nil {
+				err = errors.New("client exited")
+			}
+			return err
+		case <-startupTimer.C:
+			started()
+		case <-cs.chStop:
+			break done
+		}
+	}
+
 	cs.client.Stop(nil)
 
 	select {
-	case <-chClientStopped:
+	case err := <-chClientStopped:
 		// everything is OK
+		if err != nil {
+			log.Printf("Client Run %v %v returned error: %v\n",
+				cs.node.Type, cs.node.ID, err)
+		}
 	case <-time.After(5 * time.Second):
 		log.Println("Timeout stopping client:", cs.node.Type, cs.node.ID)
 	}
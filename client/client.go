@@ -23,8 +23,22 @@ type Client interface {
 	EdgePoints(string, string, []data.Point)
 }
 
+// Options configures the default clients. Clients that run programs on the
+// server are disabled unless they are configured by the admin.
+type Options struct {
+	// PluginDir is the directory plugin executables are started from. If
+	// blank, plugins are disabled.
+	PluginDir string
+	// RuleCommands are the executables rule command actions can run. If
+	// empty, command actions are disabled.
+	RuleCommands []string
+	// RulePublishPrefix is the subject prefix rule publish actions can
+	// publish to. If blank, DefaultRulePublishPrefix is used.
+	RulePublishPrefix string
+}
+
 // DefaultClients returns an actor for the default group of built in clients
-func DefaultClients(nc *nats.Conn) (*Group, error) {
+func DefaultClients(nc *nats.Conn, o Options) (*Group, error) {
 	g := NewGroup("Default clients")
 
 	sc := NewManager(nc, NewSerialDevClient, nil)
@@ -33,9 +47,17 @@ func DefaultClients(nc *nats.Conn) (*Group, error) {
 	cb := NewManager(nc, NewCanBusClient, nil)
 	g.Add(cb)
 
-	rc := NewManager(nc, NewRuleClient, nil)
+	rc := NewManager(nc, func(nc *nats.Conn, config Rule) Client {
+		return NewRuleClient(nc, config, o)
+	}, nil)
 	g.Add(rc)
 
+	rb := NewRuleBacktester(nc)
+	g.Add(rb)
+
+	not := NewManager(nc, NewNotificationClient, nil)
+	g.Add(not)
+
 	db := NewManager(nc, NewDbClient, nil)
 	g.Add(db)
 
@@ -66,5 +88,10 @@ func DefaultClients(nc *nats.Conn) (*Group, error) {
 	up := NewManager(nc, NewUpdateClient, nil)
 	g.Add(up)
 
+	plugin := NewManager(nc, func(nc *nats.Conn, config Plugin) Client {
+		return NewPluginClient(nc, config, o.PluginDir)
+	}, nil)
+	g.Add(plugin)
+
 	return g, nil
 }
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cron is a parsed cron expression with the standard 5 fields:
+// minute hour day-of-month month day-of-week. Fields support *, lists (1,15),
+// ranges (1-5), steps (*/10, 0-30/5), and month and weekday names (JAN, MON).
+// Day of week 0 and 7 are Sunday. As in other cron implementations, if both
+// day of month and day of week are restricted, a time matches if either
+// matches.
+type cron struct {
+	minute  map[int]bool
+	hour    map[int]bool
+	dom     map[int]bool
+	month   map[int]bool
+	dow     map[int]bool
+	domStar bool
+	dowStar bool
+}
+
+var cronMonths = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug",
+	"sep", "oct", "nov", "dec"}
+
+var cronWeekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func parseCron(expr string) (*cron, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression must have 5 fields: %v", expr)
+	}
+
+	var c cron
+	var err error
+
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("cron minute: %w", err)
+	}
+
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("cron hour: %w", err)
+	}
+
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("cron day of month: %w", err)
+	}
+
+	if c.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, fmt.Errorf("cron month: %w", err)
+	}
+
+	if c.dow, err = parseCronField(fields[4], 0, 7, cronWeekdays); err != nil {
+		return nil, fmt.Errorf("cron day of week: %w", err)
+	}
+
+	if c.dow[7] {
+		c.dow[0] = true
+	}
+
+	c.domStar = fields[2] == "*"
+	c.dowStar = fields[4] == "*"
+
+	return &c, nil
+}
+
+// parseCronField parses a cron field into the set of matching values. names
+// are the names of values starting at min.
+func parseCronField(field string, min, max int, names []string) (map[int]bool, error) {
+	ret := make(map[int]bool)
+
+	value := func(s string) (int, error) {
+		for i, n := range names {
+			if strings.EqualFold(s, n) {
+				return min + i, nil
+			}
+		}
+
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value: %v", s)
+		}
+
+		if v < min || v > max {
+			return 0, fmt.Errorf("value out of range: %v", s)
+		}
+
+		return v, nil
+	}
+
+	for _, part := range strings.Split(field, ",") {
+		rng, stepS, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepS)
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step: %v", part)
+			}
+		}
+
+		start, end := min, max
+
+		if rng != "*" {
+			startS, endS, isRange := strings.Cut(rng, "-")
+
+			var err error
+			start, err = value(startS)
+			if err != nil {
+				return nil, err
+			}
+
+			end = start
+			if isRange {
+				end, err = value(endS)
+				if err != nil {
+					return nil, err
+				}
+			} else if hasStep {
+				end = max
+			}
+
+			if end < start {
+				return nil, fmt.Errorf("invalid range: %v", part)
+			}
+		}
+
+		for v := start; v <= end; v += step {
+			ret[v] = true
+		}
+	}
+
+	return ret, nil
+}
+
+// match returns true if the minute of t matches the cron expression
+func (c *cron) match(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+
+	dom := c.dom[t.Day()]
+	dow := c.dow[int(t.Weekday())]
+
+	switch {
+	case c.domStar && c.dowStar:
+		return true
+	case c.domStar:
+		return dow
+	case c.dowStar:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// activeForTime returns true if t is within duration after a time matching the
+// cron expression. Times are matched in the location of t.
+func (c *cron) activeForTime(t time.Time, duration time.Duration) bool {
+	m := t.Truncate(time.Minute)
+
+	for m.Add(duration).After(t) {
+		if c.match(m) {
+			return true
+		}
+		m = m.Add(-time.Minute)
+	}
+
+	return false
+}
@@ -0,0 +1,53 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCron(t *testing.T) {
+	tests := []struct {
+		expr     string
+		t        time.Time
+		expected bool
+	}{
+		{"* * * * *", time.Date(2023, 5, 1, 13, 7, 0, 0, time.UTC), true},
+		{"*/15 * * * *", time.Date(2023, 5, 1, 13, 30, 0, 0, time.UTC), true},
+		{"*/15 * * * *", time.Date(2023, 5, 1, 13, 31, 0, 0, time.UTC), false},
+		{"5,10 8-17 * * *", time.Date(2023, 5, 1, 17, 10, 0, 0, time.UTC), true},
+		{"5,10 8-17 * * *", time.Date(2023, 5, 1, 18, 10, 0, 0, time.UTC), false},
+		// 2023-05-01 is a Monday
+		{"0 6 * * MON-FRI", time.Date(2023, 5, 1, 6, 0, 0, 0, time.UTC), true},
+		{"0 6 * * mon-fri", time.Date(2023, 4, 30, 6, 0, 0, 0, time.UTC), false},
+		{"0 6 * * 7", time.Date(2023, 4, 30, 6, 0, 0, 0, time.UTC), true},
+		{"0 0 1 jan *", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		{"0 0 1 jan *", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), false},
+		// day of month or day of week
+		{"0 0 15 * 1", time.Date(2023, 5, 15, 0, 0, 0, 0, time.UTC), true},
+		{"0 0 15 * 1", time.Date(2023, 5, 8, 0, 0, 0, 0, time.UTC), true},
+		{"0 0 15 * 1", time.Date(2023, 5, 9, 0, 0, 0, 0, time.UTC), false},
+		{"0-30/10 * * * *", time.Date(2023, 5, 1, 0, 20, 0, 0, time.UTC), true},
+		{"0-30/10 * * * *", time.Date(2023, 5, 1, 0, 40, 0, 0, time.UTC), false},
+		{"30/10 * * * *", time.Date(2023, 5, 1, 0, 50, 0, 0, time.UTC), true},
+	}
+
+	for _, test := range tests {
+		c, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("%v: parse error: %v", test.expr, err)
+			continue
+		}
+
+		if c.match(test.t) != test.expected {
+			t.Errorf("%v: expected %v for %v", test.expr, test.expected, test.t)
+		}
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "* 24 * * *",
+		"* * 0 * *", "* * * 13 *", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+		_, err := parseCron(expr)
+		if err == nil {
+			t.Errorf("%v: expected parse error", expr)
+		}
+	}
+}
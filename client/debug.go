@@ -107,13 +107,6 @@ func Log(natsServer, authToken string) {
 		}
 	})
 
-	_, _ = nc.Subscribe("node.*.not", func(msg *nats.Msg) {
-		err := Dump(nc, msg)
-		if err != nil {
-			log.Println("Error dumping nats msg:", err)
-		}
-	})
-
 	_, _ = nc.Subscribe("node.*.msg", func(msg *nats.Msg) {
 		err := Dump(nc, msg)
 		if err != nil {
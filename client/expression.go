@@ -0,0 +1,437 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// exprValue is a value in a rule expression. Variables hold both the value and
+// text of a point, and the text is used when compared with a string.
+type exprValue struct {
+	num    float64
+	text   string
+	isText bool
+}
+
+func (v exprValue) bool() bool {
+	if v.isText {
+		return v.text != ""
+	}
+	return v.num != 0
+}
+
+func exprBool(b bool) exprValue {
+	if b {
+		return exprValue{num: 1}
+	}
+	return exprValue{}
+}
+
+// exprFunc evaluates a compiled expression
+type exprFunc func(vars map[string]exprValue) (exprValue, error)
+
+// expression is a compiled rule expression. Expressions support numbers,
+// strings, true/false, variables, the operators (in order of precedence)
+// `||`, `&&`, `== != < <= > >=`, `+ -`, `* / %`, unary `! -`, parentheses,
+// and the functions abs, min, and max.
+type expression struct {
+	src  string
+	eval exprFunc
+	// variables used by the expression
+	vars []string
+}
+
+// compileExpression compiles an expression. If names is not nil, all variables
+// must be in names.
+func compileExpression(src string, names map[string]bool) (*expression, error) {
+	tokens, err := exprTokenize(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens, names: names, vars: make(map[string]bool)}
+
+	eval, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+
+	ret := &expression{src: src, eval: eval}
+	for v := range p.vars {
+		ret.vars = append(ret.vars, v)
+	}
+
+	return ret, nil
+}
+
+const (
+	exprTokNumber = iota
+	exprTokString
+	exprTokIdent
+	exprTokOp
+)
+
+type exprToken struct {
+	typ  int
+	text string
+	num  float64
+}
+
+var exprOps = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "+", "-", "*",
+	"/", "%", "!", "(", ")", ","}
+
+func exprTokenize(src string) ([]exprToken, error) {
+	var ret []exprToken
+
+	r := []rune(src)
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || (c == '.' && i+1 < len(r) && unicode.IsDigit(r[i+1])):
+			start := i
+			for i < len(r) && (unicode.IsDigit(r[i]) || r[i] == '.' || r[i] == 'e' ||
+				((r[i] == '-' || r[i] == '+') && (r[i-1] == 'e'))) {
+				i++
+			}
+			num, err := strconv.ParseFloat(string(r[start:i]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number: %v", string(r[start:i]))
+			}
+			ret = append(ret, exprToken{typ: exprTokNumber, text: string(r[start:i]), num: num})
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(r) && (unicode.IsLetter(r[i]) || unicode.IsDigit(r[i]) || r[i] == '_') {
+				i++
+			}
+			ret = append(ret, exprToken{typ: exprTokIdent, text: string(r[start:i])})
+		case c == '"' || c == '\'':
+			var text strings.Builder
+			i++
+			for ; i < len(r) && r[i] != c; i++ {
+				if r[i] == '\\' && i+1 < len(r) {
+					i++
+				}
+				text.WriteRune(r[i])
+			}
+			if i >= len(r) {
+				return nil, errors.New("unterminated string")
+			}
+			i++
+			ret = append(ret, exprToken{typ: exprTokString, text: text.String()})
+		default:
+			found := false
+			for _, op := range exprOps {
+				if strings.HasPrefix(string(r[i:]), op) {
+					ret = append(ret, exprToken{typ: exprTokOp, text: op})
+					i += len([]rune(op))
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	names  map[string]bool
+	vars   map[string]bool
+}
+
+// accept consumes the next token if it is one of the operators
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].typ != exprTokOp {
+		return "", false
+	}
+
+	for _, op := range ops {
+		if p.tokens[p.pos].text == op {
+			p.pos++
+			return op, true
+		}
+	}
+
+	return "", false
+}
+
+// binary parses a left associative binary expression
+func (p *exprParser) binary(next func() (exprFunc, error), ops []string,
+	apply func(op string, a, b exprValue) (exprValue, error)) (exprFunc, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op, ok := p.accept(ops...)
+		if !ok {
+			return left, nil
+		}
+
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		left = func(vars map[string]exprValue) (exprValue, error) {
+			a, err := l(vars)
+			if err != nil {
+				return a, err
+			}
+			// short circuit logical operators
+			switch {
+			case op == "&&" && !a.bool():
+				return exprBool(false), nil
+			case op == "||" && a.bool():
+				return exprBool(true), nil
+			}
+			b, err := right(vars)
+			if err != nil {
+				return b, err
+			}
+			return apply(op, a, b)
+		}
+	}
+}
+
+func (p *exprParser) parseOr() (exprFunc, error) {
+	return p.binary(p.parseAnd, []string{"||"}, exprLogical)
+}
+
+func (p *exprParser) parseAnd() (exprFunc, error) {
+	return p.binary(p.parseCompare, []string{"&&"}, exprLogical)
+}
+
+func (p *exprParser) parseCompare() (exprFunc, error) {
+	return p.binary(p.parseSum, []string{"==", "!=", "<=", ">=", "<", ">"}, exprCompare)
+}
+
+func (p *exprParser) parseSum() (exprFunc, error) {
+	return p.binary(p.parseProduct, []string{"+", "-"}, exprArith)
+}
+
+func (p *exprParser) parseProduct() (exprFunc, error) {
+	return p.binary(p.parseUnary, []string{"*", "/", "%"}, exprArith)
+}
+
+func (p *exprParser) parseUnary() (exprFunc, error) {
+	op, ok := p.accept("!", "-")
+	if !ok {
+		return p.parsePrimary()
+	}
+
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(vars map[string]exprValue) (exprValue, error) {
+		v, err := operand(vars)
+		if err != nil {
+			return v, err
+		}
+		if op == "!" {
+			return exprBool(!v.bool()), nil
+		}
+		if v.isText {
+			return v, errors.New("can't negate text")
+		}
+		return exprValue{num: -v.num}, nil
+	}, nil
+}
+
+func (p *exprParser) parsePrimary() (exprFunc, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("unexpected end of expression")
+	}
+
+	t := p.tokens[p.pos]
+	p.pos++
+
+	switch t.typ {
+	case exprTokNumber:
+		v := exprValue{num: t.num}
+		return func(map[string]exprValue) (exprValue, error) { return v, nil }, nil
+	case exprTokString:
+		v := exprValue{text: t.text, isText: true}
+		return func(map[string]exprValue) (exprValue, error) { return v, nil }, nil
+	case exprTokIdent:
+		if _, ok := p.accept("("); ok {
+			return p.parseCall(t.text)
+		}
+
+		switch t.text {
+		case "true":
+			return func(map[string]exprValue) (exprValue, error) { return exprBool(true), nil }, nil
+		case "false":
+			return func(map[string]exprValue) (exprValue, error) { return exprBool(false), nil }, nil
+		}
+
+		name := t.text
+		if p.names != nil && !p.names[name] {
+			return nil, fmt.Errorf("undefined variable: %v", name)
+		}
+		p.vars[name] = true
+
+		return func(vars map[string]exprValue) (exprValue, error) {
+			v, ok := vars[name]
+			if !ok {
+				return v, fmt.Errorf("no value for variable: %v", name)
+			}
+			return v, nil
+		}, nil
+	}
+
+	if t.text == "(" {
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			return nil, errors.New("missing )")
+		}
+		return e, nil
+	}
+
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+func (p *exprParser) parseCall(name string) (exprFunc, error) {
+	var args []exprFunc
+
+	if _, ok := p.accept(")"); !ok {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+
+			if _, ok := p.accept(")"); ok {
+				break
+			}
+			if _, ok := p.accept(","); !ok {
+				return nil, fmt.Errorf("missing ) in call to %v", name)
+			}
+		}
+	}
+
+	var f func([]float64) float64
+
+	switch name {
+	case "abs":
+		if len(args) != 1 {
+			return nil, errors.New("abs takes 1 argument")
+		}
+		f = func(a []float64) float64 { return math.Abs(a[0]) }
+	case "min", "max":
+		if len(args) < 1 {
+			return nil, fmt.Errorf("%v takes at least 1 argument", name)
+		}
+		f = func(a []float64) float64 {
+			ret := a[0]
+			for _, v := range a[1:] {
+				if (name == "min") == (v < ret) {
+					ret = v
+				}
+			}
+			return ret
+		}
+	default:
+		return nil, fmt.Errorf("unknown function: %v", name)
+	}
+
+	return func(vars map[string]exprValue) (exprValue, error) {
+		a := make([]float64, len(args))
+		for i, arg := range args {
+			v, err := arg(vars)
+			if err != nil {
+				return v, err
+			}
+			if v.isText {
+				return v, fmt.Errorf("%v: argument is text", name)
+			}
+			a[i] = v.num
+		}
+		return exprValue{num: f(a)}, nil
+	}, nil
+}
+
+func exprLogical(op string, a, b exprValue) (exprValue, error) {
+	if op == "&&" {
+		return exprBool(a.bool() && b.bool()), nil
+	}
+	return exprBool(a.bool() || b.bool()), nil
+}
+
+func exprCompare(op string, a, b exprValue) (exprValue, error) {
+	if a.isText || b.isText {
+		switch op {
+		case "==":
+			return exprBool(a.text == b.text), nil
+		case "!=":
+			return exprBool(a.text != b.text), nil
+		}
+		return exprValue{}, fmt.Errorf("can't compare text with %v", op)
+	}
+
+	switch op {
+	case "==":
+		return exprBool(a.num == b.num), nil
+	case "!=":
+		return exprBool(a.num != b.num), nil
+	case "<":
+		return exprBool(a.num < b.num), nil
+	case "<=":
+		return exprBool(a.num <= b.num), nil
+	case ">":
+		return exprBool(a.num > b.num), nil
+	default:
+		return exprBool(a.num >= b.num), nil
+	}
+}
+
+func exprArith(op string, a, b exprValue) (exprValue, error) {
+	if a.isText || b.isText {
+		if op == "+" {
+			return exprValue{text: a.text + b.text, isText: true}, nil
+		}
+		return exprValue{}, fmt.Errorf("can't use %v with text", op)
+	}
+
+	switch op {
+	case "+":
+		return exprValue{num: a.num + b.num}, nil
+	case "-":
+		return exprValue{num: a.num - b.num}, nil
+	case "*":
+		return exprValue{num: a.num * b.num}, nil
+	case "/":
+		if b.num == 0 {
+			return exprValue{}, errors.New("division by zero")
+		}
+		return exprValue{num: a.num / b.num}, nil
+	default:
+		if b.num == 0 {
+			return exprValue{}, errors.New("division by zero")
+		}
+		return exprValue{num: math.Mod(a.num, b.num)}, nil
+	}
+}
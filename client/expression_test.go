@@ -0,0 +1,98 @@
+package client
+
+import (
+	"testing"
+)
+
+func TestExpression(t *testing.T) {
+	vars := map[string]exprValue{
+		"supplyTemp": {num: 70},
+		"returnTemp": {num: 62.5},
+		"pumpOn":     {num: 1},
+		"mode":       {num: 0, text: "auto"},
+	}
+
+	tests := []struct {
+		expr     string
+		expected float64
+	}{
+		{"supplyTemp - returnTemp > 5 && pumpOn", 1},
+		{"supplyTemp - returnTemp > 10 && pumpOn", 0},
+		{"supplyTemp - returnTemp > 10 || !pumpOn", 0},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"-2 * -3", 6},
+		{"10 % 4", 2},
+		{"1.5e2 / 3", 50},
+		{"abs(returnTemp - supplyTemp)", 7.5},
+		{"min(supplyTemp, returnTemp, 100)", 62.5},
+		{"max(supplyTemp, returnTemp, 100)", 100},
+		{"mode == 'auto' && true", 1},
+		{`mode != "auto"`, 0},
+		{"0 && 1 / 0", 0},
+	}
+
+	names := map[string]bool{}
+	for name := range vars {
+		names[name] = true
+	}
+
+	for _, test := range tests {
+		e, err := compileExpression(test.expr, names)
+		if err != nil {
+			t.Errorf("%v: compile error: %v", test.expr, err)
+			continue
+		}
+
+		v, err := e.eval(vars)
+		if err != nil {
+			t.Errorf("%v: eval error: %v", test.expr, err)
+			continue
+		}
+
+		if v.num != test.expected {
+			t.Errorf("%v: expected %v, got %v", test.expr, test.expected, v.num)
+		}
+	}
+}
+
+func TestExpressionErrors(t *testing.T) {
+	names := map[string]bool{"a": true}
+
+	compileErrors := []string{
+		"a >",
+		"(a + 1",
+		"a + b",
+		"a $ 1",
+		"foo(a)",
+		"abs(a, a)",
+		"'abc",
+		"a 1",
+	}
+
+	for _, expr := range compileErrors {
+		_, err := compileExpression(expr, names)
+		if err == nil {
+			t.Errorf("%v: expected compile error", expr)
+		}
+	}
+
+	evalErrors := []string{
+		"a / 0",
+		"'x' < 1",
+		"-'x'",
+	}
+
+	for _, expr := range evalErrors {
+		e, err := compileExpression(expr, names)
+		if err != nil {
+			t.Errorf("%v: compile error: %v", expr, err)
+			continue
+		}
+
+		_, err = e.eval(map[string]exprValue{"a": {num: 1}})
+		if err == nil {
+			t.Errorf("%v: expected eval error", expr)
+		}
+	}
+}
@@ -160,3 +160,88 @@ func SendFile(nc *nats.Conn, deviceID string, reader io.Reader, name string, cal
 
 	return nil
 }
+
+// SendFileChunks sends a file in chunks to a NATS subject without retries.
+// Each chunk is sent as a request, and the receiver responds with "OK", or an
+// error message which is returned. If reading fails, an error chunk with the
+// error message is sent to the receiver.
+func SendFileChunks(nc *nats.Conn, subject string, reader io.Reader, name string,
+	timeout time.Duration) error {
+	seq := int32(0)
+
+	for {
+		data := make([]byte, 50*1024)
+		count, readErr := io.ReadFull(reader, data)
+		data = data[:count]
+
+		chunk := &pb.FileChunk{Seq: seq, Data: data}
+
+		if seq == 0 {
+			chunk.FileName = name
+		}
+
+		done := false
+
+		if readErr != nil {
+			done = true
+			if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+				chunk.State = pb.FileChunk_DONE
+			} else {
+				chunk.State = pb.FileChunk_ERROR
+				chunk.Data = []byte(readErr.Error())
+			}
+		}
+
+		out, err := proto.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+
+		msg, err := nc.Request(subject, out, timeout)
+		if err != nil {
+			return err
+		}
+
+		if string(msg.Data) != "OK" {
+			return errors.New(string(msg.Data))
+		}
+
+		if chunk.State == pb.FileChunk_ERROR {
+			return readErr
+		}
+
+		if done {
+			return nil
+		}
+
+		seq++
+	}
+}
+
+// ReceiveFileChunk processes a chunk sent by SendFileChunks and writes the
+// data to w. seq is the sequence number expected next. Returns true when the
+// transfer is done.
+func ReceiveFileChunk(msg *nats.Msg, w io.Writer, seq int32) (bool, error) {
+	chunk := &pb.FileChunk{}
+
+	err := proto.Unmarshal(msg.Data, chunk)
+	if err != nil {
+		return true, fmt.Errorf("Error decoding file chunk: %v", err)
+	}
+
+	if chunk.Seq != seq {
+		return true, fmt.Errorf("Seq # error in file transfer, expected %v, got %v",
+			seq, chunk.Seq)
+	}
+
+	if chunk.State == pb.FileChunk_ERROR {
+		return true, fmt.Errorf("Sender error: %v", string(chunk.Data))
+	}
+
+	_, err = w.Write(chunk.Data)
+	if err != nil {
+		return true, err
+	}
+
+	return chunk.State == pb.FileChunk_DONE, nil
+}
@@ -31,9 +31,11 @@ type Manager[T any] struct {
 	// keep track of clients
 	clientStates map[string]*clientState[T]
 	clientUpSub  map[string]*nats.Subscription
+	// failures of clients that are waiting to be restarted
+	clientStatus map[string]*clientStatus
 
-	// subscription to listen for new points
-	upSub *nats.Subscription
+	// stops watching node events
+	stopEvents func()
 }
 
 // NewManager takes constructor for a node client and returns a Manager for that client
@@ -57,9 +59,27 @@ func NewManager[T any](nc *nats.Conn,
 		chDeleteCS:   make(chan string),
 		clientStates: make(map[string]*clientState[T]),
 		clientUpSub:  make(map[string]*nats.Subscription),
+		clientStatus: make(map[string]*clientStatus),
 	}
 }
 
+// managerRescanPeriod is how often managers rescan the node tree in case node
+// events were missed
+var managerRescanPeriod = 5 * time.Minute
+
+// clientRestartMax is the maximum time a failed client waits before it is
+// restarted
+var clientRestartMax = 5 * time.Minute
+
+// clientStatus tracks client failures so clients can be restarted with backoff
+type clientStatus struct {
+	// total number of restarts after failures
+	restarts int
+	// consecutive failures, used to calculate the backoff
+	failures  int
+	restartAt time.Time
+}
+
 // Run node manager. This function looks for children of a certain node type.
 // When new nodes are found, the data is decoded into the client type config, and the
 // constructor for the node client is called. This call blocks until Stop is called.
@@ -75,20 +95,18 @@ func (m *Manager[T]) Run() error {
 
 	m.root = nodes[0].ID
 
-	// TODO: it may make sense at some point to have a special topic
-	// for new nodes so that all client managers don't have to listen
-	// to all points
-	m.upSub, err = m.nc.Subscribe("up.root.>", func(msg *nats.Msg) {
-		points, err := data.PbDecodePoints(msg.Data)
-		if err != nil {
-			log.Println("Error decoding points")
+	// rescan when nodes of the managed type, or nodes that may contain
+	// them, are created, deleted, or moved, or the store asks for a
+	// rescan
+	nodeTypes := append([]string{m.nodeType}, m.parentTypes...)
+	m.stopEvents, err = WatchNodeEvents(m.nc, nodeTypes, func(event data.NodeEvent) {
+		if event.Type == data.NodeEventEdgeChanged {
 			return
 		}
 
-		for _, p := range points {
-			if p.Type == data.PointTypeNodeType {
-				m.chScan <- struct{}{}
-			}
+		select {
+		case m.chScan <- struct{}{}:
+		case <-m.stop:
 		}
 	})
 
@@ -107,8 +125,34 @@ func (m *Manager[T]) Run() error {
 	restartTimer := time.NewTimer(time.Hour)
 	restartTimer.Stop()
 
+	// events can be lost (for instance while reconnecting to NATS), so
+	// also rescan periodically
+	rescanTicker := time.NewTicker(managerRescanPeriod)
+	defer rescanTicker.Stop()
+
 	stopping := false
 
+	// restartTimer fires when the next failed client should be restarted
+	armRestart := func() {
+		if !restartTimer.Stop() {
+			select {
+			case <-restartTimer.C:
+			default:
+			}
+		}
+
+		var next time.Time
+		for _, s := range m.clientStatus {
+			if !s.restartAt.IsZero() && (next.IsZero() || s.restartAt.Before(next)) {
+				next = s.restartAt
+			}
+		}
+
+		if !next.IsZero() {
+			restartTimer.Reset(time.Until(next))
+		}
+	}
+
 	scan := func() {
 		if stopping {
 			return
@@ -118,6 +162,8 @@ func (m *Manager[T]) Run() error {
 		if err != nil {
 			log.Println("Error scanning for new nodes:", err)
 		}
+
+		armRestart()
 	}
 
 done:
@@ -125,7 +171,7 @@ done:
 		select {
 		case <-m.stop:
 			stopping = true
-			_ = m.upSub.Unsubscribe()
+			m.stopEvents()
 			if len(m.clientStates) > 0 {
 				for _, c := range m.clientStates {
 					c.stop(err)
@@ -136,10 +182,12 @@ done:
 			}
 		case f := <-m.chAction:
 			f()
-		case <-time.After(time.Minute):
-			scan()
 		case <-m.chScan:
 			scan()
+		case <-restartTimer.C:
+			scan()
+		case <-rescanTicker.C:
+			scan()
 		case key := <-m.chCSStopped:
 			// TODO: the following can be used to wait until all messages
 			// have been drained, but have not been able to get this to
@@ -162,6 +210,18 @@ done:
 
 			m.chDeleteCS <- key
 		case key := <-m.chDeleteCS:
+			// Clients that are stopped because their node was removed
+			// or a child node changed don't get a stopped status. The
+			// node may be deleted, and a restarted client reports
+			// running again.
+			if cs := m.clientStates[key]; stopping {
+				m.sendStatus(cs.node.ID, data.Points{
+					{Type: data.PointTypeClientState, Text: data.PointValueClientStateStopped},
+				})
+			} else if cs.err != nil {
+				m.failed(key, cs.node.ID, cs.start, cs.err)
+			}
+
 			err = m.clientUpSub[key].Unsubscribe()
 			if err != nil {
 				log.Println("Error unsubscribing subscription:", err)
@@ -245,29 +305,25 @@ func (m *Manager[T]) scan(id string) error {
 			continue
 		}
 
-		// Need to create a new client
-		cs, err := newClientState(m.nc, m.construct, n)
-
-		if err != nil {
-			log.Printf("Error starting client %v: %v", n, err)
+		status := m.clientStatus[key]
+		if status != nil && time.Now().Before(status.restartAt) {
+			// failed client is waiting to be restarted
+			continue
 		}
 
-		go func() {
-			err := cs.run()
+		// Set up subscriptions before the client state loads the
+		// children so that children added meanwhile are not missed.
+		// Messages wait until the client state is created.
+		var cs *clientState[T]
+		ready := make(chan struct{})
+		subject := fmt.Sprintf("up.%v.>", n.ID)
 
-			if err != nil {
-				log.Printf("clientState error %v: %v\n", m.nodeType, err)
+		upSub, err := m.nc.Subscribe(subject, func(msg *nats.Msg) {
+			<-ready
+			if cs == nil {
+				return
 			}
 
-			m.chDeleteCS <- key
-		}()
-
-		m.clientStates[key] = cs
-
-		// Set up subscriptions
-		subject := fmt.Sprintf("up.%v.>", cs.node.ID)
-
-		m.clientUpSub[key], err = cs.nc.Subscribe(subject, func(msg *nats.Msg) {
 			points, err := data.PbDecodePoints(msg.Data)
 			if err != nil {
 				log.Println("Error decoding points")
@@ -373,6 +429,57 @@ func (m *Manager[T]) scan(id string) error {
 			return err
 		}
 
+		// Need to create a new client
+		start := time.Now()
+		cs, err = newClientState(m.nc, m.construct, n)
+		close(ready)
+
+		if err != nil {
+			log.Printf("Error starting client %v: %v", n, err)
+			if err := upSub.Unsubscribe(); err != nil {
+				log.Println("Error unsubscribing subscription:", err)
+			}
+			m.failed(key, n.ID, start, err)
+			continue
+		}
+
+		cs.start = start
+
+		restarts := 0
+		if status != nil {
+			restarts = status.restarts
+			status.restartAt = time.Time{}
+		}
+
+		id := n.ID
+
+		go func() {
+			// only report the client as running once it has started
+			// successfully
+			err := cs.run(func() {
+				m.sendStatus(id, data.Points{
+					{Type: data.PointTypeClientState, Text: data.PointValueClientStateRunning},
+					{Type: data.PointTypeClientStart, Value: float64(start.Unix())},
+					{Type: data.PointTypeClientRestarts, Value: float64(restarts)},
+				})
+			})
+
+			if err != nil {
+				log.Printf("clientState error %v: %v\n", m.nodeType, err)
+				cs.err = err
+			}
+
+			m.chDeleteCS <- key
+		}()
+
+		m.clientStates[key] = cs
+		m.clientUpSub[key] = upSub
+	}
+
+	for key := range m.clientStatus {
+		if !found[key] {
+			delete(m.clientStatus, key)
+		}
 	}
 
 	// remove nodes that have been deleted
@@ -389,6 +496,46 @@ func (m *Manager[T]) scan(id string) error {
 	return nil
 }
 
+// failed records a client failure, sends the error to the client node, and
+// schedules a restart with exponential backoff. The backoff is reset if the
+// client ran longer than the maximum backoff.
+func (m *Manager[T]) failed(key, id string, start time.Time, err error) {
+	status := m.clientStatus[key]
+	if status == nil {
+		status = &clientStatus{}
+		m.clientStatus[key] = status
+	}
+
+	if time.Since(start) > clientRestartMax {
+		status.failures = 0
+	}
+
+	status.failures++
+	status.restarts++
+	status.restartAt = time.Now().Add(ExpBackoff(status.failures, clientRestartMax))
+
+	log.Printf("Client %v %v failed, restarting at %v: %v", m.nodeType, id,
+		status.restartAt.Format(time.RFC3339), err)
+
+	m.sendStatus(id, data.Points{
+		{Type: data.PointTypeClientState, Text: data.PointValueClientStateError},
+		{Type: data.PointTypeClientError, Text: err.Error()},
+	})
+}
+
+// sendStatus sends client status points to a managed node
+func (m *Manager[T]) sendStatus(id string, points data.Points) {
+	now := time.Now()
+	for i := range points {
+		points[i].Time = now
+	}
+
+	err := SendNodePoints(m.nc, id, points, false)
+	if err != nil {
+		log.Println("Error sending client status:", err)
+	}
+}
+
 func mapKey(node data.NodeEdge) string {
 	return node.Parent + "-" + node.ID
 }
@@ -1,6 +1,7 @@
 package client_test
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
@@ -632,3 +633,247 @@ func TestManagerLotsChildren(t *testing.T) {
 	}
 
 }
+
+type testFail struct {
+	ID          string `node:"id"`
+	Parent      string `node:"parent"`
+	Description string `point:"description"`
+}
+
+// testFailClient returns err from Run, or runs until stopped if err is nil
+type testFailClient struct {
+	err  error
+	stop chan struct{}
+}
+
+func (tfc *testFailClient) Run() error {
+	if tfc.err != nil {
+		return tfc.err
+	}
+
+	<-tfc.stop
+	return nil
+}
+
+func (tfc *testFailClient) Stop(_ error) {
+	close(tfc.stop)
+}
+
+func (tfc *testFailClient) Points(_ string, _ []data.Point) {}
+
+func (tfc *testFailClient) EdgePoints(_, _ string, _ []data.Point) {}
+
+func TestManagerRestart(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	testConfig := testFail{"ID-fail", root.ID, "failing node"}
+
+	err = client.SendNodeType(nc, testConfig, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	// the first client fails, the second runs
+	started := make(chan struct{}, 2)
+	count := 0
+
+	newTestFailClient := func(_ *nats.Conn, _ testFail) client.Client {
+		count++
+		started <- struct{}{}
+		if count == 1 {
+			return &testFailClient{err: errors.New("port not found"),
+				stop: make(chan struct{})}
+		}
+		return &testFailClient{stop: make(chan struct{})}
+	}
+
+	m := client.NewManager(nc, newTestFailClient, nil)
+
+	managerStopped := make(chan struct{})
+
+	go func() {
+		err := m.Run()
+		if err != nil {
+			t.Error("manager run returned error: ", err)
+		}
+
+		close(managerStopped)
+	}()
+
+	start := time.Now()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timeout waiting for client to start: ", i)
+		}
+	}
+
+	// the restart is delayed by the backoff
+	if time.Since(start) < time.Second*2 {
+		t.Error("Client was restarted without backoff: ", time.Since(start))
+	}
+
+	// wait for status points
+	var n data.Node
+	for {
+		nodes, err := client.GetNodes(nc, root.ID, testConfig.ID, "", false)
+		if err != nil || len(nodes) < 1 {
+			t.Fatal("Error getting node: ", err)
+		}
+
+		n = nodes[0].ToNode()
+		state, _ := n.Points.Text(data.PointTypeClientState, "")
+		if state == data.PointValueClientStateRunning {
+			break
+		}
+
+		if time.Since(start) > 15*time.Second {
+			t.Fatal("Timeout waiting for running state")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	restarts, _ := n.Points.Value(data.PointTypeClientRestarts, "")
+	if restarts != 1 {
+		t.Error("Expected 1 restart, got: ", restarts)
+	}
+
+	clientErr, _ := n.Points.Text(data.PointTypeClientError, "")
+	if clientErr != "port not found" {
+		t.Error("Client error not recorded, got: ", clientErr)
+	}
+
+	clientStart, _ := n.Points.Value(data.PointTypeClientStart, "")
+	if clientStart < float64(start.Unix()) {
+		t.Error("Client start time not set, got: ", clientStart)
+	}
+
+	m.Stop(nil)
+
+	select {
+	case <-managerStopped:
+	case <-time.After(time.Second * 6):
+		t.Fatal("manager did not stop")
+	}
+
+	// status points are sent without an ack
+	stopped := time.Now()
+	for {
+		nodes, err := client.GetNodes(nc, root.ID, testConfig.ID, "", false)
+		if err != nil || len(nodes) < 1 {
+			t.Fatal("Error getting node: ", err)
+		}
+
+		n = nodes[0].ToNode()
+		state, _ := n.Points.Text(data.PointTypeClientState, "")
+		if state == data.PointValueClientStateStopped {
+			break
+		}
+
+		if time.Since(stopped) > 5*time.Second {
+			t.Fatal("Timeout waiting for stopped state, got: ", state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestManagerRemoveStatus(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	testConfig := testFail{"ID-remove", root.ID, "removed node"}
+
+	err = client.SendNodeType(nc, testConfig, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	clientStopped := make(chan struct{})
+
+	newTestFailClient := func(_ *nats.Conn, _ testFail) client.Client {
+		return &testFailClient{stop: clientStopped}
+	}
+
+	m := client.NewManager(nc, newTestFailClient, nil)
+
+	managerStopped := make(chan struct{})
+
+	go func() {
+		err := m.Run()
+		if err != nil {
+			t.Error("manager run returned error: ", err)
+		}
+
+		close(managerStopped)
+	}()
+
+	start := time.Now()
+	for {
+		nodes, err := client.GetNodes(nc, root.ID, testConfig.ID, "", false)
+		if err != nil || len(nodes) < 1 {
+			t.Fatal("Error getting node: ", err)
+		}
+
+		state, _ := nodes[0].Points.Text(data.PointTypeClientState, "")
+		if state == data.PointValueClientStateRunning {
+			break
+		}
+
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Timeout waiting for running state")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	states := make(chan string, 10)
+	stopSub, err := client.SubscribePoints(nc, testConfig.ID, func(points []data.Point) {
+		for _, p := range points {
+			if p.Type == data.PointTypeClientState {
+				states <- p.Text
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal("Error subscribing to points: ", err)
+	}
+	defer stopSub()
+
+	err = client.DeleteNode(nc, testConfig.ID, root.ID, "test")
+	if err != nil {
+		t.Fatal("Error deleting node: ", err)
+	}
+
+	select {
+	case <-clientStopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client was not stopped")
+	}
+
+	// no status is written to the removed node
+	select {
+	case state := <-states:
+		t.Fatal("status written to removed node: ", state)
+	case <-time.After(time.Second):
+	}
+
+	m.Stop(nil)
+
+	select {
+	case <-managerStopped:
+	case <-time.After(time.Second * 6):
+		t.Fatal("manager did not stop")
+	}
+}
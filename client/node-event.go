@@ -0,0 +1,57 @@
+package client
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// WatchNodeEvents calls callback for each node event the store publishes when
+// nodes are created, deleted, moved, or edge points change. If nodeTypes is
+// set, only events for nodes of these types, and rescan events, are returned.
+// The callback may be called concurrently for different node types. stop()
+// can be called to stop watching.
+func WatchNodeEvents(nc *nats.Conn, nodeTypes []string,
+	callback func(data.NodeEvent)) (stop func(), err error) {
+	subjects := []string{SubjectNodeEvent("*", "*", "*")}
+	if len(nodeTypes) > 0 {
+		subjects = []string{SubjectNodeEvent(data.NodeEventRescan, "*", "*")}
+		for _, t := range nodeTypes {
+			subjects = append(subjects, SubjectNodeEvent("*", t, "*"))
+		}
+	}
+
+	var subs []*nats.Subscription
+
+	stop = func() {
+		for _, sub := range subs {
+			err := sub.Unsubscribe()
+			if err != nil {
+				log.Println("Unsubscribe node events error:", err)
+			}
+		}
+	}
+
+	for _, subject := range subjects {
+		sub, err := nc.Subscribe(subject, func(msg *nats.Msg) {
+			var event data.NodeEvent
+			err := json.Unmarshal(msg.Data, &event)
+			if err != nil {
+				log.Println("Error decoding node event:", err)
+				return
+			}
+
+			callback(event)
+		})
+		if err != nil {
+			stop()
+			return nil, err
+		}
+
+		subs = append(subs, sub)
+	}
+
+	return stop, nil
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -319,9 +320,12 @@ func MoveNode(nc *nats.Conn, id, oldParent, newParent, origin string) error {
 		return err
 	}
 
+	// the tombstone text is set to the new parent so the store can report
+	// a move instead of a delete
 	err = SendEdgePoint(nc, id, oldParent, data.Point{
 		Type:  data.PointTypeTombstone,
 		Value: 1,
+		Text:  newParent,
 	}, true)
 
 	if err != nil {
@@ -697,3 +701,30 @@ func ReplaceIDs(nodes *data.NodeEdgeChildren, parent string) {
 
 	replaceHelper(nodes, parent)
 }
+
+// QueryNodes returns the nodes that match a query. Maps to the `nodes.query`
+// NATS API. A query can be parsed from text with [data.ParseNodeQuery].
+func QueryNodes(nc *nats.Conn, query data.NodeQuery) ([]data.NodeEdge, error) {
+	reqData, err := json.Marshal(query)
+	if err != nil {
+		return nil, fmt.Errorf("Error encoding query: %v", err)
+	}
+
+	msg, err := nc.Request("nodes.query", reqData, time.Second*20)
+	if err != nil {
+		return nil, err
+	}
+
+	var results data.NodeQueryResults
+
+	err = json.Unmarshal(msg.Data, &results)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding query results: %v", err)
+	}
+
+	if results.ErrorMessage != "" {
+		return nil, errors.New(results.ErrorMessage)
+	}
+
+	return results.Nodes, nil
+}
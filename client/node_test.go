@@ -2,6 +2,7 @@ package client_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/goccy/go-yaml"
 	"github.com/simpleiot/simpleiot/client"
@@ -301,3 +302,125 @@ func TestReplaceIDs(t *testing.T) {
 		t.Fatal("child parent not correct")
 	}
 }
+
+func TestQueryNodes(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	v := data.NodeEdge{ID: "var1", Parent: root.ID, Type: data.NodeTypeVariable,
+		Points: data.Points{{Type: data.PointTypeValue, Value: 20}}}
+
+	err = client.SendNode(nc, v, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	q, err := data.ParseNodeQuery("type=variable value>10")
+	if err != nil {
+		t.Fatal("Error parsing query: ", err)
+	}
+
+	nodes, err := client.QueryNodes(nc, q)
+	if err != nil {
+		t.Fatal("Error querying nodes: ", err)
+	}
+
+	if len(nodes) != 1 || nodes[0].ID != v.ID || nodes[0].Parent != root.ID {
+		t.Fatalf("query returned wrong nodes: %+v", nodes)
+	}
+
+	q.Points[0].Value = 30
+
+	nodes, err = client.QueryNodes(nc, q)
+	if err != nil {
+		t.Fatal("Error querying nodes: ", err)
+	}
+
+	if len(nodes) != 0 {
+		t.Fatal("query should not have returned nodes: ", len(nodes))
+	}
+
+	_, err = client.QueryNodes(nc, data.NodeQuery{Points: []data.PointQuery{{Type: "value",
+		Op: "~"}}})
+	if err == nil {
+		t.Fatal("invalid query should return error")
+	}
+}
+
+func TestWatchNodeEvents(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	events := make(chan data.NodeEvent, 10)
+
+	stopWatch, err := client.WatchNodeEvents(nc, []string{data.NodeTypeVariable}, func(e data.NodeEvent) {
+		events <- e
+	})
+	if err != nil {
+		t.Fatal("Error watching events: ", err)
+	}
+	defer stopWatch()
+
+	expEvent := func(typ data.NodeEventType, parent, oldParent string) {
+		t.Helper()
+		select {
+		case e := <-events:
+			if e.Type != typ || e.ID != "v1" || e.Parent != parent ||
+				e.OldParent != oldParent || e.NodeType != data.NodeTypeVariable {
+				t.Fatalf("expected %v event, parent %v, got %+v", typ, parent, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for event: ", typ)
+		}
+	}
+
+	// events for other node types are not returned
+	err = client.SendNode(nc, data.NodeEdge{ID: "g1", Type: data.NodeTypeGroup,
+		Parent: root.ID}, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	err = client.SendNode(nc, data.NodeEdge{ID: "v1", Type: data.NodeTypeVariable,
+		Parent: root.ID}, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+	expEvent(data.NodeEventCreated, root.ID, "")
+
+	err = client.SendEdgePoint(nc, "v1", root.ID, data.Point{Type: data.PointTypeRole,
+		Text: "user", Origin: "test"}, true)
+	if err != nil {
+		t.Fatal("Error sending edge point: ", err)
+	}
+	expEvent(data.NodeEventEdgeChanged, root.ID, "")
+
+	err = client.MoveNode(nc, "v1", root.ID, "g1", "test")
+	if err != nil {
+		t.Fatal("Error moving node: ", err)
+	}
+	expEvent(data.NodeEventCreated, "g1", "")
+	expEvent(data.NodeEventMoved, "g1", root.ID)
+
+	err = client.DeleteNode(nc, "v1", "g1", "test")
+	if err != nil {
+		t.Fatal("Error deleting node: ", err)
+	}
+	expEvent(data.NodeEventDeleted, "g1", "")
+
+	select {
+	case e := <-events:
+		t.Fatal("unexpected event: ", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,565 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/msg"
+)
+
+// notifyRetry is how long a notification waits before trying again if the
+// users could not be found
+const notifyRetry = time.Minute
+
+// Notification is a message that is sent to users. Users are found by walking
+// up the tree from the notification parent. The users of the parent are
+// notified first, and if Escalate is set, the users of the next group up are
+// notified each time Escalate minutes expire without an acknowledgement.
+type Notification struct {
+	ID          string `node:"id"`
+	Parent      string `node:"parent"`
+	Description string `point:"description"`
+	Subject     string `point:"subject"`
+	Message     string `point:"message"`
+	// SourceNode is the node that triggered the notification, and
+	// SourceAction the rule action that created it
+	SourceNode   string `point:"sourceNode"`
+	SourceAction string `point:"sourceAction"`
+	// Created is the Unix time the notification was created
+	Created float64 `point:"created"`
+	// Escalate is in minutes. If not set, the users of all groups up the
+	// tree are notified at once.
+	Escalate float64 `point:"escalate"`
+	// Level is the number of groups up the tree that were notified, and
+	// Notified the Unix time the last group was notified
+	Level    int     `point:"level"`
+	Notified float64 `point:"notified"`
+	// Ack is the ID of the user who acknowledged the notification
+	Ack   string `point:"ack"`
+	Error string `point:"error"`
+}
+
+// NotificationClient sends a notification to users until it is acknowledged
+type NotificationClient struct {
+	nc            *nats.Conn
+	config        Notification
+	stop          chan struct{}
+	newPoints     chan NewPoints
+	newEdgePoints chan NewPoints
+	escalateTimer *time.Timer
+}
+
+// NewNotificationClient constructor ...
+func NewNotificationClient(nc *nats.Conn, config Notification) Client {
+	return &NotificationClient{
+		nc:            nc,
+		config:        config,
+		stop:          make(chan struct{}),
+		newPoints:     make(chan NewPoints),
+		newEdgePoints: make(chan NewPoints),
+		escalateTimer: newStoppedTimer(),
+	}
+}
+
+// AckNotification acknowledges a notification so it is not escalated further
+func AckNotification(nc *nats.Conn, id, userID string) error {
+	return SendNodePoint(nc, id, data.Point{
+		Type:   data.PointTypeAck,
+		Text:   userID,
+		Origin: userID,
+	}, true)
+}
+
+// NotificationParent returns the node notifications about node id are
+// created under. The notification client manager only finds notifications in
+// the root node and the groups below it, so this is the last node on the path
+// from the root node to id that is the root node or a group.
+func NotificationParent(nc *nats.Conn, id string) (string, error) {
+	// path from id up to the root node
+	var path []data.NodeEdge
+	seen := make(map[string]bool)
+
+	for cur := id; cur != "root"; {
+		if seen[cur] {
+			return "", fmt.Errorf("loop in tree above node %v", id)
+		}
+		seen[cur] = true
+
+		nodes, err := GetNodes(nc, "all", cur, "", false)
+		if err != nil {
+			return "", err
+		}
+
+		if len(nodes) < 1 {
+			return "", fmt.Errorf("node not found: %v", cur)
+		}
+
+		path = append(path, nodes[0])
+		cur = nodes[0].Parent
+	}
+
+	ret := path[len(path)-1].ID
+	for i := len(path) - 2; i >= 0 && path[i].Type == data.NodeTypeGroup; i-- {
+		ret = path[i].ID
+	}
+
+	return ret, nil
+}
+
+// sameSource returns true if notifications were created by the same rule
+// action, or if not created by a rule, for the same node and subject
+func (n Notification) sameSource(o Notification) bool {
+	if n.SourceAction != "" || o.SourceAction != "" {
+		return n.SourceAction == o.SourceAction
+	}
+
+	return n.SourceNode == o.SourceNode && n.Subject == o.Subject
+}
+
+// SendNotification creates a notification unless a notification from the same
+// source in the same parent is still open (not acknowledged), or was created
+// less than repeat ago. Acknowledged notifications from the source are
+// deleted when a new one is created. Returns true if the notification was
+// created.
+func SendNotification(nc *nats.Conn, not Notification, repeat time.Duration,
+	origin string) (bool, error) {
+	if not.Created == 0 {
+		not.Created = float64(time.Now().Unix())
+	}
+
+	now := time.Unix(int64(not.Created), 0)
+
+	nots, err := GetNodesType[Notification](nc, not.Parent, "all")
+	if err != nil {
+		return false, fmt.Errorf("Error getting notifications: %w", err)
+	}
+
+	var acked []Notification
+	for _, n := range nots {
+		if !n.sameSource(not) {
+			continue
+		}
+
+		if n.Ack == "" || now.Before(time.Unix(int64(n.Created), 0).Add(repeat)) {
+			return false, nil
+		}
+
+		acked = append(acked, n)
+	}
+
+	if not.ID == "" {
+		not.ID = uuid.New().String()
+	}
+
+	err = SendNodeType(nc, not, origin)
+	if err != nil {
+		return false, fmt.Errorf("Error creating notification: %w", err)
+	}
+
+	for _, n := range acked {
+		err := DeleteNode(nc, n.ID, n.Parent, origin)
+		if err != nil {
+			log.Println("Error deleting notification:", err)
+		}
+	}
+
+	return true, nil
+}
+
+// Run the notification client
+func (n *NotificationClient) Run() error {
+	n.notify()
+
+	for {
+		select {
+		case <-n.stop:
+			n.escalateTimer.Stop()
+			return nil
+		case <-n.escalateTimer.C:
+			n.notify()
+		case pts := <-n.newPoints:
+			err := data.MergePoints(pts.ID, pts.Points, &n.config)
+			if err != nil {
+				log.Println("error merging notification points:", err)
+			}
+			// stop escalating if acknowledged
+			n.notify()
+		case pts := <-n.newEdgePoints:
+			err := data.MergeEdgePoints(pts.ID, pts.Parent, pts.Points, &n.config)
+			if err != nil {
+				log.Println("error merging notification edge points:", err)
+			}
+		}
+	}
+}
+
+// Stop sends a signal to the Run function to exit
+func (n *NotificationClient) Stop(_ error) {
+	close(n.stop)
+}
+
+// Points is called by the Manager when new points for this
+// node are received.
+func (n *NotificationClient) Points(nodeID string, points []data.Point) {
+	n.newPoints <- NewPoints{nodeID, "", points}
+}
+
+// EdgePoints is called by the Manager when new edge points for this
+// node are received.
+func (n *NotificationClient) EdgePoints(nodeID, parentID string, points []data.Point) {
+	n.newEdgePoints <- NewPoints{nodeID, parentID, points}
+}
+
+// notify sends the notification to the users of the groups that are due, and
+// arms the escalation timer for the next group
+func (n *NotificationClient) notify() {
+	n.escalateTimer.Stop()
+
+	if n.config.Ack != "" {
+		return
+	}
+
+	levels, err := ancestorLevels(n.nc, n.config.Parent)
+	if err != nil {
+		n.setError(fmt.Errorf("Error finding users: %w", err))
+		n.escalateTimer.Reset(notifyRetry)
+		return
+	}
+
+	if n.config.Level >= len(levels) {
+		// all groups were notified
+		return
+	}
+
+	if n.config.Level > 0 && n.config.Escalate > 0 {
+		at := time.Unix(int64(n.config.Notified), 0).Add(minutes(n.config.Escalate))
+		if time.Now().Before(at) {
+			n.escalateTimer.Reset(time.Until(at))
+			return
+		}
+	}
+
+	var errs []string
+	sent := make(map[string]bool)
+
+	for n.config.Level < len(levels) {
+		var users []User
+		for _, id := range levels[n.config.Level] {
+			u, err := GetNodesType[User](n.nc, id, "all")
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+			users = append(users, u...)
+		}
+
+		n.config.Level++
+
+		for _, u := range users {
+			if sent[u.ID] || (u.Email == "" && u.Phone == "") {
+				continue
+			}
+			sent[u.ID] = true
+
+			err := n.sendMessage(u)
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+
+		// groups without users are skipped, otherwise the next group
+		// is notified if this one does not acknowledge
+		if n.config.Escalate > 0 && len(sent) > 0 {
+			break
+		}
+	}
+
+	n.config.Notified = float64(time.Now().Unix())
+
+	err = SendNodePoints(n.nc, n.config.ID, data.Points{
+		{Type: data.PointTypeLevel, Value: float64(n.config.Level)},
+		{Type: data.PointTypeNotified, Value: n.config.Notified},
+	}, false)
+	if err != nil {
+		log.Println("Error sending notification points:", err)
+	}
+
+	if len(errs) > 0 {
+		n.setError(errors.New(strings.Join(errs, "; ")))
+	} else {
+		n.setError(nil)
+	}
+
+	if n.config.Escalate > 0 && n.config.Level < len(levels) {
+		n.escalateTimer.Reset(minutes(n.config.Escalate))
+	}
+}
+
+// sendMessage sends the notification to a user through the message services
+// found by walking up the tree from the user's group. The message is also
+// published to node.<userId>.msg so it can be recorded.
+func (n *NotificationClient) sendMessage(u User) error {
+	subject := n.config.Subject
+	if subject == "" {
+		subject = n.config.Description
+	}
+
+	m := data.Message{
+		ID:             uuid.New().String(),
+		UserID:         u.ID,
+		ParentID:       u.Parent,
+		NotificationID: n.config.ID,
+		Email:          u.Email,
+		Phone:          u.Phone,
+		Subject:        subject,
+		Message:        n.config.Message,
+	}
+
+	d, err := m.ToPb()
+	if err != nil {
+		return err
+	}
+
+	err = n.nc.Publish("node."+u.ID+".msg", d)
+	if err != nil {
+		return err
+	}
+
+	services, err := msgServices(n.nc, u.Parent)
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, svc := range services {
+		err := n.sendServiceMessage(svc, m, u)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", svc.Service, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Error sending message to %v %v: %v", u.FirstName,
+			u.LastName, strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// setError sets or clears the notification error point
+func (n *NotificationClient) setError(err error) {
+	errS := ""
+	if err != nil {
+		errS = err.Error()
+		log.Printf("Notification %v: %v\n", n.config.Description, errS)
+	}
+
+	if errS == n.config.Error {
+		return
+	}
+
+	n.config.Error = errS
+
+	err = SendNodePoint(n.nc, n.config.ID, data.Point{
+		Type: data.PointTypeError,
+		Text: errS,
+	}, false)
+	if err != nil {
+		log.Println("Error sending notification point:", err)
+	}
+}
+
+// ancestorLevels returns id and the nodes above it, grouped by distance from
+// id. Nodes with several parents have all their parents in the next level.
+func ancestorLevels(nc *nats.Conn, id string) ([][]string, error) {
+	levels := [][]string{{id}}
+	seen := map[string]bool{id: true}
+
+	for {
+		var next []string
+
+		for _, id := range levels[len(levels)-1] {
+			nodes, err := GetNodes(nc, "all", id, "", false)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, ne := range nodes {
+				if ne.Parent == "" || ne.Parent == "root" || ne.Parent == "none" ||
+					seen[ne.Parent] {
+					continue
+				}
+				seen[ne.Parent] = true
+				next = append(next, ne.Parent)
+			}
+		}
+
+		if len(next) == 0 {
+			return levels, nil
+		}
+
+		levels = append(levels, next)
+	}
+}
+
+// msgServices returns the message service nodes in group id and the groups
+// above it
+func msgServices(nc *nats.Conn, id string) ([]data.MsgService, error) {
+	levels, err := ancestorLevels(nc, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []data.MsgService
+	seen := make(map[string]bool)
+
+	for _, level := range levels {
+		for _, id := range level {
+			nodes, err := GetNodes(nc, id, "all", data.NodeTypeMsgService, false)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, ne := range nodes {
+				if seen[ne.ID] {
+					continue
+				}
+				seen[ne.ID] = true
+
+				svc, err := data.NodeToMsgService(ne.ToNode())
+				if err != nil {
+					return nil, err
+				}
+				ret = append(ret, svc)
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// emailTemplateData is the data used to render email templates. ID,
+// Description, and Ios are from the node that triggered the notification.
+type emailTemplateData struct {
+	Subject     string
+	Message     string
+	FirstName   string
+	LastName    string
+	ID          string
+	Description string
+	Ios         map[string]float64
+}
+
+// emailTemplateData returns the data used to render email templates for a
+// message to user u
+func (n *NotificationClient) emailTemplateData(m data.Message, u User) (emailTemplateData, error) {
+	ret := emailTemplateData{
+		Subject:   m.Subject,
+		Message:   m.Message,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		ID:        n.config.SourceNode,
+		Ios:       make(map[string]float64),
+	}
+
+	if n.config.SourceNode == "" {
+		return ret, nil
+	}
+
+	nodes, err := GetNodes(n.nc, "all", n.config.SourceNode, "", false)
+	if err != nil {
+		return ret, err
+	}
+
+	if len(nodes) > 0 {
+		ret.Description = nodes[0].Desc()
+		for _, p := range nodes[0].Points {
+			if p.Type != "" {
+				ret.Ios[p.Type] = p.Value
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// renderEmailTemplate renders a Go template for an email body. HTML templates
+// escape the values they insert.
+func renderEmailTemplate(tmpl string, html bool, td emailTemplateData) (string, error) {
+	var t interface {
+		Execute(io.Writer, any) error
+	}
+	var err error
+
+	if html {
+		t, err = htmltemplate.New("email").Parse(tmpl)
+	} else {
+		t, err = template.New("email").Parse(tmpl)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	buf := new(bytes.Buffer)
+
+	err = t.Execute(buf, td)
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// sendServiceMessage sends a message to user u through a message service.
+// Services that can not reach the user, for example SMS to a user without a
+// phone number, are skipped.
+func (n *NotificationClient) sendServiceMessage(svc data.MsgService, m data.Message, u User) error {
+	switch svc.Service {
+	case data.PointValueTwilio:
+		if m.Phone == "" {
+			return nil
+		}
+		return msg.NewTwilio(svc.SID, svc.AuthToken, svc.From).SendSMS(m.Phone, m.Message)
+	case data.PointValueSMTP:
+		if m.Email == "" {
+			return nil
+		}
+
+		td, err := n.emailTemplateData(m, u)
+		if err != nil {
+			return fmt.Errorf("Error getting notification node: %w", err)
+		}
+
+		textTemplate := svc.Template
+		if textTemplate == "" {
+			textTemplate = "{{.Message}}"
+		}
+
+		text, err := renderEmailTemplate(textTemplate, false, td)
+		if err != nil {
+			return fmt.Errorf("Error rendering email template: %w", err)
+		}
+
+		var html string
+		if svc.HTMLTemplate != "" {
+			html, err = renderEmailTemplate(svc.HTMLTemplate, true, td)
+			if err != nil {
+				return fmt.Errorf("Error rendering email HTML template: %w", err)
+			}
+		}
+
+		return msg.NewSMTP(svc.Server, svc.Port, svc.Username, svc.Password,
+			svc.From, svc.TLS).SendEmail(m.Email, m.Subject, text, html)
+	default:
+		return fmt.Errorf("unsupported message service: %v", svc.Service)
+	}
+}
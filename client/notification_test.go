@@ -0,0 +1,302 @@
+package client_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/server"
+)
+
+func TestNotification(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	// company
+	//   boss
+	//   plant
+	//     joe
+	//     temp
+	//     rule
+	groups := []data.NodeEdge{
+		{ID: "ID-company", Parent: root.ID, Type: data.NodeTypeGroup},
+		{ID: "ID-plant", Parent: "ID-company", Type: data.NodeTypeGroup},
+	}
+
+	for _, g := range groups {
+		err = client.SendNode(nc, g, "test")
+		if err != nil {
+			t.Fatal("Error sending node: ", err)
+		}
+	}
+
+	users := []client.User{
+		{ID: "ID-boss", Parent: "ID-company", FirstName: "boss", Email: "boss@example.com"},
+		{ID: "ID-joe", Parent: "ID-plant", FirstName: "joe", Phone: "+15555550100"},
+	}
+
+	for _, u := range users {
+		err = client.SendNodeType(nc, u, "test")
+		if err != nil {
+			t.Fatal("Error sending node: ", err)
+		}
+	}
+
+	msgs := make(chan data.Message, 10)
+	sub, err := nc.Subscribe("node.*.msg", func(msg *nats.Msg) {
+		m, err := data.PbDecodeMessage(msg.Data)
+		if err != nil {
+			t.Error("Error decoding message: ", err)
+			return
+		}
+		msgs <- m
+	})
+	if err != nil {
+		t.Fatal("Error subscribing: ", err)
+	}
+	defer sub.Unsubscribe()
+
+	vin := client.Variable{ID: "ID-temp", Parent: "ID-plant", Description: "temp"}
+
+	err = client.SendNodeType(nc, vin, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	r := client.Rule{
+		ID:          "ID-rule",
+		Parent:      "ID-plant",
+		Description: "temp high",
+	}
+
+	err = client.SendNodeType(nc, r, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	c := client.Condition{
+		ID:            "ID-condition",
+		Parent:        r.ID,
+		ConditionType: data.PointValuePointValue,
+		NodeID:        vin.ID,
+		PointType:     data.PointTypeValue,
+		ValueType:     data.PointValueNumber,
+		Operator:      data.PointValueGreaterThan,
+		Value:         50,
+	}
+
+	err = client.SendNodeType(nc, c, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	a := client.Action{
+		ID:       "ID-action",
+		Parent:   r.ID,
+		Action:   data.PointValueNotify,
+		Escalate: 0.01,
+	}
+
+	err = client.SendNodeType(nc, a, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	// wait for rule to get set up
+	time.Sleep(250 * time.Millisecond)
+
+	sendTemp := func(value float64) {
+		err := client.SendNodePoint(nc, vin.ID, data.Point{Type: data.PointTypeValue,
+			Value: value, Origin: "test"}, true)
+		if err != nil {
+			t.Fatal("Error sending point: ", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	getMsg := func(timeout time.Duration) (data.Message, bool) {
+		select {
+		case m := <-msgs:
+			return m, true
+		case <-time.After(timeout):
+			return data.Message{}, false
+		}
+	}
+
+	notifications := func() []client.Notification {
+		nots, err := client.GetNodesType[client.Notification](nc, "ID-plant", "all")
+		if err != nil {
+			t.Fatal("Error getting notifications: ", err)
+		}
+		return nots
+	}
+
+	sendTemp(60)
+
+	// joe in the plant is notified first
+	m, ok := getMsg(time.Second)
+	if !ok {
+		t.Fatal("Timeout waiting for message")
+	}
+
+	if m.UserID != "ID-joe" || m.Phone != "+15555550100" ||
+		m.Subject != "temp high" || m.Message != "temp high fired at temp" {
+		t.Fatalf("wrong message: %+v", m)
+	}
+
+	// the rule firing again does not send another notification while the
+	// first one is not acknowledged
+	sendTemp(40)
+	sendTemp(60)
+
+	if nots := notifications(); len(nots) != 1 {
+		t.Fatal("expected one notification, got: ", len(nots))
+	}
+
+	// then it is escalated to the boss of the company
+	m, ok = getMsg(2 * time.Second)
+	if !ok {
+		t.Fatal("Timeout waiting for escalation")
+	}
+
+	if m.UserID != "ID-boss" || m.Email != "boss@example.com" {
+		t.Fatalf("wrong escalation message: %+v", m)
+	}
+
+	err = client.AckNotification(nc, notifications()[0].ID, "ID-boss")
+	if err != nil {
+		t.Fatal("Error acknowledging notification: ", err)
+	}
+
+	// the root admin is not notified after the acknowledgement
+	if m, ok := getMsg(1500 * time.Millisecond); ok {
+		t.Fatalf("message sent after acknowledgement: %+v", m)
+	}
+
+	// the next time the rule fires, the acknowledged notification is
+	// replaced
+	sendTemp(40)
+	sendTemp(60)
+
+	m, ok = getMsg(time.Second)
+	if !ok || m.UserID != "ID-joe" {
+		t.Fatalf("new notification not sent: %+v", m)
+	}
+
+	nots := notifications()
+	if len(nots) != 1 || nots[0].Ack != "" || nots[0].ID != m.NotificationID {
+		t.Fatalf("acknowledged notification was not replaced: %+v", nots)
+	}
+}
+
+func TestNotificationAPI(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	// plant
+	//   joe
+	//   device
+	nodes := []data.NodeEdge{
+		{ID: "ID-plant", Parent: root.ID, Type: data.NodeTypeGroup},
+		{ID: "ID-device", Parent: "ID-plant", Type: data.NodeTypeDevice},
+	}
+
+	for _, n := range nodes {
+		err = client.SendNode(nc, n, "test")
+		if err != nil {
+			t.Fatal("Error sending node: ", err)
+		}
+	}
+
+	joe := client.User{ID: "ID-joe", Parent: "ID-plant", FirstName: "joe",
+		Phone: "+15555550100"}
+
+	err = client.SendNodeType(nc, joe, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	msgs := make(chan data.Message, 10)
+	sub, err := nc.Subscribe("node.*.msg", func(msg *nats.Msg) {
+		m, err := data.PbDecodeMessage(msg.Data)
+		if err != nil {
+			t.Error("Error decoding message: ", err)
+			return
+		}
+		msgs <- m
+	})
+	if err != nil {
+		t.Fatal("Error subscribing: ", err)
+	}
+	defer sub.Unsubscribe()
+
+	post := func() {
+		body := `{"subject":"door open","message":"the door is open"}`
+		resp, err := http.Post("http://localhost:"+server.TestServerOptions.HTTPPort+
+			"/v1/nodes/ID-device/not", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal("Error posting notification: ", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("Error posting notification: ", resp.Status)
+		}
+	}
+
+	post()
+
+	// notifications for nodes that are not groups are created in the
+	// closest group so the notification client finds them. The root
+	// admin is also notified as escalate is not set.
+	var notID string
+	select {
+	case m := <-msgs:
+		if m.UserID != joe.ID || m.Subject != "door open" ||
+			m.Message != "the door is open" {
+			t.Fatalf("wrong message: %+v", m)
+		}
+		notID = m.NotificationID
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for message")
+	}
+
+	// a second notification is not sent while the first is open
+	post()
+
+	timeout := time.After(500 * time.Millisecond)
+done:
+	for {
+		select {
+		case m := <-msgs:
+			if m.NotificationID != notID {
+				t.Fatalf("message sent for open notification: %+v", m)
+			}
+		case <-timeout:
+			break done
+		}
+	}
+
+	nots, err := client.GetNodesType[client.Notification](nc, "ID-plant", "all")
+	if err != nil {
+		t.Fatal("Error getting notifications: ", err)
+	}
+
+	if len(nots) != 1 || nots[0].SourceNode != "ID-device" {
+		t.Fatalf("expected one notification for the device, got: %+v", nots)
+	}
+}
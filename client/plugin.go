@@ -0,0 +1,292 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// Environment variables set when a plugin executable is started
+const (
+	// PluginEnvNatsServer is the NATS server URI
+	PluginEnvNatsServer = "SIOT_NATS_SERVER"
+	// PluginEnvAuthToken is the NATS auth token. The token only grants
+	// access to the plugin node and its children (see PluginToken).
+	PluginEnvAuthToken = "SIOT_AUTH_TOKEN"
+	// PluginEnvNode is the plugin node (data.NodeEdge) encoded in JSON
+	PluginEnvNode = "SIOT_PLUGIN_NODE"
+)
+
+// pluginEnvInherit are the server environment variables passed on to plugin
+// executables. The rest of the server environment can contain secrets (store
+// credentials, API keys, etc.), so it is not passed on.
+var pluginEnvInherit = []string{"PATH", "HOME"}
+
+// ErrPluginsDisabled is returned when a plugin is started and no plugin
+// directory is configured
+var ErrPluginsDisabled = errors.New("plugins are disabled, plugin directory is not set")
+
+// Plugin is a client that runs in its own process. The server starts the
+// executable at Path (relative to the plugin directory), and restarts it if
+// it exits.
+type Plugin struct {
+	ID          string   `node:"id"`
+	Parent      string   `node:"parent"`
+	Description string   `point:"description"`
+	Path        string   `point:"path"`
+	Args        []string `point:"arg"`
+	Disabled    bool     `point:"disabled"`
+}
+
+// SubjectPluginPoints is the NATS subject used to forward node points to a
+// plugin
+func SubjectPluginPoints(pluginID, nodeID string) string {
+	return fmt.Sprintf("plugin.%v.p.%v", pluginID, nodeID)
+}
+
+// SubjectPluginEdgePoints is the NATS subject used to forward edge points to a
+// plugin
+func SubjectPluginEdgePoints(pluginID, nodeID, parentID string) string {
+	return fmt.Sprintf("plugin.%v.p.%v.%v", pluginID, nodeID, parentID)
+}
+
+// pluginTokenPrefix is the prefix of plugin auth tokens
+const pluginTokenPrefix = "plugin:"
+
+// PluginToken returns the NATS auth token passed to a plugin. The token is
+// derived from the server auth token, and the server only grants it access to
+// the plugin node and its children. If authToken is blank (no auth), the
+// plugin token is also blank.
+func PluginToken(authToken, pluginID string) string {
+	if authToken == "" {
+		return ""
+	}
+
+	return pluginTokenPrefix + pluginID + ":" + pluginTokenMAC(authToken, pluginID)
+}
+
+// PluginTokenID returns the plugin ID of a plugin token, and false if token
+// is not a valid plugin token.
+func PluginTokenID(authToken, token string) (string, bool) {
+	if authToken == "" || !strings.HasPrefix(token, pluginTokenPrefix) {
+		return "", false
+	}
+
+	token = strings.TrimPrefix(token, pluginTokenPrefix)
+	i := strings.LastIndex(token, ":")
+	if i < 1 {
+		return "", false
+	}
+
+	id, mac := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(mac), []byte(pluginTokenMAC(authToken, id))) {
+		return "", false
+	}
+
+	return id, true
+}
+
+func pluginTokenMAC(authToken, pluginID string) string {
+	mac := hmac.New(sha256.New, []byte(authToken))
+	mac.Write([]byte(pluginID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// PluginClient starts and stops a plugin process. Points for the plugin node
+// and its children are forwarded to the plugin over NATS.
+type PluginClient struct {
+	nc        *nats.Conn
+	config    Plugin
+	dir       string
+	stop      chan struct{}
+	done      chan struct{}
+	newPoints chan NewPoints
+}
+
+// NewPluginClient returns a new plugin client. Plugin executables are only
+// started from dir, which is set by the admin. If dir is blank, plugins are
+// disabled.
+func NewPluginClient(nc *nats.Conn, config Plugin, dir string) Client {
+	return &PluginClient{
+		nc:        nc,
+		config:    config,
+		dir:       dir,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		newPoints: make(chan NewPoints),
+	}
+}
+
+// Run starts the plugin process and returns an error if the process exits
+// before Stop is called.
+func (pc *PluginClient) Run() error {
+	defer close(pc.done)
+
+	for {
+		var cmd *exec.Cmd
+		exited := make(chan error, 1)
+
+		if !pc.config.Disabled {
+			var err error
+			cmd, err = pc.start()
+			if err != nil {
+				return err
+			}
+
+			go func() {
+				exited <- cmd.Wait()
+			}()
+		}
+
+		restart := false
+
+		for !restart {
+			select {
+			case <-pc.stop:
+				pc.kill(cmd, exited)
+				return nil
+			case err := <-exited:
+				if err == nil {
+					err = errors.New("exited")
+				}
+				return fmt.Errorf("Plugin %v: %v", pc.config.Path, err)
+			case pts := <-pc.newPoints:
+				err := data.MergePoints(pts.ID, pts.Points, &pc.config)
+				if err != nil {
+					log.Println("Plugin error merging new points:", err)
+				}
+
+				for _, p := range pts.Points {
+					switch p.Type {
+					case data.PointTypePath, data.PointTypeArg,
+						data.PointTypeDisabled:
+						restart = true
+					}
+				}
+			}
+		}
+
+		pc.kill(cmd, exited)
+	}
+}
+
+// start starts the plugin executable
+func (pc *PluginClient) start() (*exec.Cmd, error) {
+	node, err := data.Encode(pc.config)
+	if err != nil {
+		return nil, fmt.Errorf("Plugin error encoding node: %v", err)
+	}
+
+	nodeJSON, err := json.Marshal(node)
+	if err != nil {
+		return nil, fmt.Errorf("Plugin error encoding node: %v", err)
+	}
+
+	path, err := pc.path()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(path, pc.config.Args...)
+	cmd.Env = []string{
+		PluginEnvNatsServer + "=" + pc.nc.ConnectedUrl(),
+		PluginEnvAuthToken + "=" + PluginToken(pc.nc.Opts.Token, pc.config.ID),
+		PluginEnvNode + "=" + string(nodeJSON),
+	}
+	for _, k := range pluginEnvInherit {
+		if v, ok := os.LookupEnv(k); ok {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("Plugin error starting %v: %v", pc.config.Path, err)
+	}
+
+	log.Printf("Plugin %v started, pid: %v", pc.config.Path, cmd.Process.Pid)
+
+	return cmd, nil
+}
+
+// path returns the path of the plugin executable. Plugins can only be
+// started from the plugin directory.
+func (pc *PluginClient) path() (string, error) {
+	if pc.dir == "" {
+		return "", ErrPluginsDisabled
+	}
+
+	if !filepath.IsLocal(pc.config.Path) {
+		return "", fmt.Errorf("Plugin path must be in the plugin directory: %v",
+			pc.config.Path)
+	}
+
+	return filepath.Join(pc.dir, pc.config.Path), nil
+}
+
+// kill asks the plugin process to exit, and kills it if it does not exit
+// within 5s
+func (pc *PluginClient) kill(cmd *exec.Cmd, exited chan error) {
+	if cmd == nil {
+		return
+	}
+
+	err := cmd.Process.Signal(os.Interrupt)
+	if err != nil {
+		log.Println("Plugin error stopping process:", err)
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		log.Println("Plugin did not exit, killing:", pc.config.Path)
+		err := cmd.Process.Kill()
+		if err != nil {
+			log.Println("Plugin error killing process:", err)
+		}
+		<-exited
+	}
+}
+
+// Stop stops the plugin process
+func (pc *PluginClient) Stop(_ error) {
+	close(pc.stop)
+}
+
+// Points forwards node points to the plugin
+func (pc *PluginClient) Points(nodeID string, points []data.Point) {
+	err := SendPoints(pc.nc, SubjectPluginPoints(pc.config.ID, nodeID), points, false)
+	if err != nil {
+		log.Println("Plugin error forwarding points:", err)
+	}
+
+	if nodeID == pc.config.ID {
+		select {
+		case pc.newPoints <- NewPoints{ID: nodeID, Points: points}:
+		case <-pc.done:
+		}
+	}
+}
+
+// EdgePoints forwards edge points to the plugin
+func (pc *PluginClient) EdgePoints(nodeID, parentID string, points []data.Point) {
+	err := SendPoints(pc.nc, SubjectPluginEdgePoints(pc.config.ID, nodeID, parentID),
+		points, false)
+	if err != nil {
+		log.Println("Plugin error forwarding edge points:", err)
+	}
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// OriginRevert is the origin of points sent by RevertNode
+const OriginRevert = "revert"
+
+// GetRevisions returns the recorded revisions of a node, newest first
+func GetRevisions(nc *nats.Conn, id string) ([]data.Revision, error) {
+	msg, err := nc.Request("revisions."+id, nil, time.Second*20)
+	if err != nil {
+		return nil, err
+	}
+
+	var results data.RevisionResults
+
+	err = json.Unmarshal(msg.Data, &results)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding revisions: %v", err)
+	}
+
+	if results.ErrorMessage != "" {
+		return nil, errors.New(results.ErrorMessage)
+	}
+
+	return results.Revisions, nil
+}
+
+// RevertNode reverts a node to the state it was in before revision was
+// applied. The previous values of all points changed in this or later
+// revisions are sent again. Points that did not exist before are
+// tombstoned. Passwords are not reverted.
+func RevertNode(nc *nats.Conn, id string, revision int64) error {
+	revisions, err := GetRevisions(nc, id)
+	if err != nil {
+		return err
+	}
+
+	var found bool
+	var points data.Points
+	// index of points by type and key
+	index := make(map[string]int)
+	now := time.Now()
+
+	// revisions are newest first, so the oldest previous value of each
+	// point is the one that is kept
+	for _, rev := range revisions {
+		if rev.ID < revision {
+			break
+		}
+
+		if rev.ID == revision {
+			found = true
+		}
+
+		for _, prev := range rev.Previous {
+			if prev.Type == data.PointTypePass {
+				continue
+			}
+
+			if prev.Time.IsZero() {
+				prev.Tombstone = 1
+			}
+
+			prev.Time = now
+			prev.Origin = OriginRevert
+
+			k := prev.Type + "." + prev.Key
+			if i, ok := index[k]; ok {
+				points[i] = prev
+			} else {
+				index[k] = len(points)
+				points = append(points, prev)
+			}
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("revision %v not found for node %v", revision, id)
+	}
+
+	if len(points) <= 0 {
+		return nil
+	}
+
+	return SendNodePoints(nc, id, points, true)
+}
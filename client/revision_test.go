@@ -0,0 +1,70 @@
+package client_test
+
+import (
+	"testing"
+
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+	"github.com/simpleiot/simpleiot/server"
+)
+
+func TestRevertNode(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	send := func(desc string) {
+		err := client.SendNodePoint(nc, root.ID, data.Point{Type: data.PointTypeDescription,
+			Text: desc, Origin: "test"}, true)
+		if err != nil {
+			t.Fatal("Error sending point: ", err)
+		}
+	}
+
+	send("one")
+	send("two")
+	send("three")
+
+	revs, err := client.GetRevisions(nc, root.ID)
+	if err != nil {
+		t.Fatal("Error getting revisions: ", err)
+	}
+
+	if len(revs) != 3 {
+		t.Fatal("Expected 3 revisions, got: ", len(revs))
+	}
+
+	// revert to before "two" was sent
+	err = client.RevertNode(nc, root.ID, revs[1].ID)
+	if err != nil {
+		t.Fatal("Error reverting node: ", err)
+	}
+
+	nodes, err := client.GetNodes(nc, "root", root.ID, "", false)
+	if err != nil || len(nodes) < 1 {
+		t.Fatal("Error getting root node: ", err)
+	}
+
+	desc, _ := nodes[0].Points.Text(data.PointTypeDescription, "")
+	if desc != "one" {
+		t.Fatal("Revert failed, description: ", desc)
+	}
+
+	revs, err = client.GetRevisions(nc, root.ID)
+	if err != nil {
+		t.Fatal("Error getting revisions: ", err)
+	}
+
+	if len(revs) != 4 || revs[0].Origin != client.OriginRevert {
+		t.Fatal("Revert was not recorded as a revision")
+	}
+
+	err = client.RevertNode(nc, root.ID, 12345)
+	if err == nil {
+		t.Fatal("Reverting unknown revision should fail")
+	}
+}
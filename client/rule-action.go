@@ -0,0 +1,272 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+	"golang.org/x/exp/maps"
+)
+
+// ruleActionTimeout is used for webhook and command actions without a timeout
+const ruleActionTimeout = 10 * time.Second
+
+// actionTemplateData is the data used to render action templates
+type actionTemplateData struct {
+	// rule
+	ID          string
+	Description string
+	Active      bool
+	Time        time.Time
+	// node and point that triggered the rule
+	NodeID string
+	Point  data.Point
+	// last value seen by each condition, indexed by condition description
+	Conditions map[string]actionTemplateCondition
+}
+
+type actionTemplateCondition struct {
+	Value  float64
+	Text   string
+	Active bool
+}
+
+// actionResult is the result of an action that runs in the background
+type actionResult struct {
+	id  string
+	err error
+}
+
+var actionTemplateFuncs = template.FuncMap{
+	// json encodes a value, for example a text point in a JSON body
+	"json": func(v any) (string, error) {
+		d, err := json.Marshal(v)
+		return string(d), err
+	},
+}
+
+// actionTemplateData returns the data used to render templates for actions
+// triggered by points from triggerNodeID
+func (rc *RuleClient) actionTemplateData(triggerNodeID string, triggerPoints data.Points) actionTemplateData {
+	ret := actionTemplateData{
+		ID:          rc.config.ID,
+		Description: rc.config.Description,
+		Active:      rc.config.Active,
+		Time:        rc.now(),
+		NodeID:      triggerNodeID,
+		Conditions:  make(map[string]actionTemplateCondition),
+	}
+
+	if len(triggerPoints) > 0 {
+		ret.Point = triggerPoints[0]
+	}
+
+	for _, c := range rc.conditions() {
+		tc := actionTemplateCondition{Active: c.Active}
+		if st := rc.condStates[c.ID]; st != nil {
+			tc.Value = st.value
+			tc.Text = st.text
+		}
+		ret.Conditions[c.Description] = tc
+	}
+
+	return ret
+}
+
+// renderActionTemplate renders a Go text template for an action
+func renderActionTemplate(tmpl string, td actionTemplateData) (string, error) {
+	t, err := template.New("action").Funcs(actionTemplateFuncs).Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+
+	buf := new(bytes.Buffer)
+
+	err = t.Execute(buf, td)
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// actionTimeout returns the action timeout
+func actionTimeout(a Action) time.Duration {
+	if a.Timeout <= 0 {
+		return ruleActionTimeout
+	}
+	return seconds(a.Timeout)
+}
+
+// runWebhook posts body to the action URL in the background. The request is
+// retried Retries times if it fails or returns a status other than 2xx. The
+// result is sent to the rule Run loop.
+func (rc *RuleClient) runWebhook(a Action, body string) {
+	client := &http.Client{Timeout: actionTimeout(a)}
+	// the config may be merged while the request runs
+	a.Headers = maps.Clone(a.Headers)
+
+	post := func() error {
+		req, err := http.NewRequest(http.MethodPost, a.URL, strings.NewReader(body))
+		if err != nil {
+			return err
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range a.Headers {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		_, _ = io.Copy(io.Discard, resp.Body)
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("webhook returned status: %v", resp.Status)
+		}
+
+		return nil
+	}
+
+	go func() {
+		var err error
+
+		for attempt := 0; ; attempt++ {
+			err = post()
+			if err == nil || attempt >= a.Retries {
+				break
+			}
+
+			select {
+			case <-time.After(ExpBackoff(attempt, time.Minute)):
+			case <-rc.stop:
+				return
+			}
+		}
+
+		rc.sendActionResult(a.ID, err)
+	}()
+}
+
+// runCommand runs the action command in the background and sends the result to
+// the rule Run loop. The command is not run in a shell.
+func (rc *RuleClient) runCommand(a Action, args []string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), actionTimeout(a))
+		defer cancel()
+
+		out, err := exec.CommandContext(ctx, a.Command, args...).CombinedOutput()
+		if err != nil {
+			// the end of the output usually has the error message
+			o := strings.TrimSpace(string(out))
+			if len(o) > 200 {
+				o = o[len(o)-200:]
+			}
+			if o != "" {
+				err = fmt.Errorf("%w: %v", err, o)
+			}
+		}
+
+		rc.sendActionResult(a.ID, err)
+	}()
+}
+
+// notify creates a notification node next to the rule. A notification is not
+// created while the last one from the action is not acknowledged, or within
+// the action repeat interval. Acknowledged notifications from the action are
+// deleted when a new one is created.
+func (rc *RuleClient) notify(a *Action, triggerNodeID string, triggerPoints data.Points) error {
+	if triggerNodeID == "" {
+		triggerNodeID = rc.config.ID
+	}
+
+	nodes, err := GetNodes(rc.nc, "all", triggerNodeID, "", false)
+	if err != nil {
+		return err
+	}
+
+	if len(nodes) < 1 {
+		return errors.New("trigger node not found")
+	}
+
+	message := rc.config.Description + " fired at " + nodes[0].Desc()
+
+	if a.Template != "" {
+		message, err = renderActionTemplate(a.Template,
+			rc.actionTemplateData(triggerNodeID, triggerPoints))
+		if err != nil {
+			return fmt.Errorf("Error rendering notify template: %w", err)
+		}
+	}
+
+	_, err = SendNotification(rc.nc, Notification{
+		Parent:       rc.config.Parent,
+		Description:  rc.config.Description,
+		Subject:      rc.config.Description,
+		Message:      message,
+		SourceNode:   triggerNodeID,
+		SourceAction: a.ID,
+		Created:      float64(rc.now().Unix()),
+		Escalate:     a.Escalate,
+	}, minutes(a.Repeat), rc.config.ID)
+
+	return err
+}
+
+func (rc *RuleClient) sendActionResult(id string, err error) {
+	select {
+	case rc.actionResults <- actionResult{id, err}:
+	case <-rc.stop:
+	}
+}
+
+// actionResult sets or clears the error point of an action that ran in the
+// background
+func (rc *RuleClient) actionResult(r actionResult) {
+	errS := ""
+	if r.err != nil {
+		errS = r.err.Error()
+	}
+
+	for _, actions := range [][]Action{rc.config.Actions, rc.config.ActionsInactive} {
+		for i := range actions {
+			a := &actions[i]
+			if a.ID != r.id || a.Error == errS {
+				continue
+			}
+
+			if errS != "" {
+				log.Printf("Rule action error %v:%v:%v\n", rc.config.Description,
+					a.Description, errS)
+			}
+
+			p := data.Point{
+				Type: data.PointTypeError,
+				Time: rc.now(),
+				Text: errS,
+			}
+
+			err := rc.sendPoint(a.ID, p)
+			if err != nil {
+				log.Println("Rule error sending point:", err)
+			} else {
+				a.Error = errS
+			}
+			rc.processError(errS)
+		}
+	}
+}
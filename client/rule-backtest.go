@@ -0,0 +1,465 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// RuleBacktester answers rule backtest requests on the rule.backtest subject.
+// A backtest replays the history of the points used by a rule through the
+// same code the RuleClient uses, and returns when the rule, its conditions,
+// and condition groups would have changed state, and which actions would
+// have run. Nothing is written to the store and no actions are run.
+type RuleBacktester struct {
+	nc   *nats.Conn
+	stop chan struct{}
+}
+
+// NewRuleBacktester constructor
+func NewRuleBacktester(nc *nats.Conn) *RuleBacktester {
+	return &RuleBacktester{
+		nc:   nc,
+		stop: make(chan struct{}),
+	}
+}
+
+// Run subscribes to backtest requests and blocks until stopped
+func (rb *RuleBacktester) Run() error {
+	sub, err := rb.nc.Subscribe("rule.backtest", rb.handleBacktest)
+	if err != nil {
+		return fmt.Errorf("Rule backtest subscribe error: %w", err)
+	}
+
+	<-rb.stop
+
+	return sub.Unsubscribe()
+}
+
+// Stop stops the backtester
+func (rb *RuleBacktester) Stop(_ error) {
+	close(rb.stop)
+}
+
+func (rb *RuleBacktester) handleBacktest(msg *nats.Msg) {
+	var query data.RuleBacktestQuery
+	var results data.RuleBacktestResults
+
+	err := json.Unmarshal(msg.Data, &query)
+	if err != nil {
+		results.ErrorMessage = "parsing query: " + err.Error()
+	} else {
+		results, err = ruleBacktest(rb.nc, query)
+		if err != nil {
+			results.ErrorMessage = err.Error()
+		}
+	}
+
+	res, err := json.Marshal(results)
+	if err != nil {
+		res = []byte(`{"error":"error encoding response"}`)
+	}
+
+	err = msg.Respond(res)
+	if err != nil {
+		log.Println("Error responding to rule backtest:", err)
+	}
+}
+
+// RuleBacktest replays history from start to stop through a rule and returns
+// the rule, condition, and action events. See [RuleBacktester].
+func RuleBacktest(nc *nats.Conn, query data.RuleBacktestQuery) (data.RuleBacktestResults, error) {
+	var results data.RuleBacktestResults
+
+	req, err := json.Marshal(query)
+	if err != nil {
+		return results, err
+	}
+
+	resp, err := nc.Request("rule.backtest", req, time.Minute*5)
+	if err != nil {
+		return results, err
+	}
+
+	err = json.Unmarshal(resp.Data, &results)
+	if err != nil {
+		return results, fmt.Errorf("Error decoding backtest results: %v", err)
+	}
+
+	if results.ErrorMessage != "" {
+		return results, errors.New(results.ErrorMessage)
+	}
+
+	return results, nil
+}
+
+func ruleBacktest(nc *nats.Conn, query data.RuleBacktestQuery) (data.RuleBacktestResults, error) {
+	var results data.RuleBacktestResults
+
+	if query.RuleID == "" {
+		return results, errors.New("rule ID must be set")
+	}
+
+	if !query.Stop.After(query.Start) {
+		return results, errors.New("stop must be after start")
+	}
+
+	nodes, err := GetNodes(nc, "all", query.RuleID, "", false)
+	if err != nil {
+		return results, fmt.Errorf("Error getting rule: %w", err)
+	}
+
+	if len(nodes) < 1 || nodes[0].Type != data.NodeTypeRule {
+		return results, fmt.Errorf("rule %v not found", query.RuleID)
+	}
+
+	var config Rule
+
+	children, err := getChildren(nc, query.RuleID, reflect.TypeOf(config))
+	if err != nil {
+		return results, fmt.Errorf("Error getting rule children: %w", err)
+	}
+
+	err = data.Decode(data.NodeEdgeChildren{NodeEdge: nodes[0], Children: children}, &config)
+	if err != nil {
+		return results, fmt.Errorf("Error decoding rule: %w", err)
+	}
+
+	historyID := query.History
+	if historyID == "" {
+		root, err := GetRootNode(nc)
+		if err != nil {
+			return results, fmt.Errorf("Error getting root node: %w", err)
+		}
+		historyID = root.ID
+	}
+
+	// actions are not run in a backtest, so no options are needed
+	rc := NewRuleClient(nc, config, Options{}).(*RuleClient)
+	rc.dryRun = newRuleDryRun(&rc.config, query.Start)
+
+	points, err := rc.backtestHistory(historyID, query.Start, query.Stop)
+	if err != nil {
+		return results, err
+	}
+
+	rc.replay(query.Stop, points)
+
+	results.Points = len(points)
+	results.Events = rc.dryRun.events
+
+	return results, nil
+}
+
+// ruleDryRun records what a rule would have done during a backtest
+type ruleDryRun struct {
+	start time.Time
+	now   time.Time
+	nodes map[string]*ruleDryRunNode
+	// action node types indexed by action ID
+	actions map[string]string
+	events  []data.RuleBacktestEvent
+}
+
+// ruleDryRunNode is the state of a rule, condition, or condition group
+type ruleDryRunNode struct {
+	typ    string
+	desc   string
+	active bool
+	err    string
+}
+
+// newRuleDryRun clears the active and error state of the rule so the backtest
+// starts from an inactive rule
+func newRuleDryRun(config *Rule, start time.Time) *ruleDryRun {
+	d := &ruleDryRun{
+		start:   start,
+		now:     start,
+		nodes:   make(map[string]*ruleDryRunNode),
+		actions: make(map[string]string),
+	}
+
+	add := func(id, typ, desc string) {
+		d.nodes[id] = &ruleDryRunNode{typ: typ, desc: desc}
+	}
+
+	config.Active = false
+	config.Error = ""
+	add(config.ID, data.NodeTypeRule, config.Description)
+
+	var walk func(conds []Condition, groups []ConditionGroup)
+	walk = func(conds []Condition, groups []ConditionGroup) {
+		for i := range conds {
+			conds[i].Active = false
+			conds[i].Error = ""
+			add(conds[i].ID, data.NodeTypeCondition, conds[i].Description)
+		}
+		for i := range groups {
+			groups[i].Active = false
+			groups[i].Error = ""
+			add(groups[i].ID, data.NodeTypeConditionGroup, groups[i].Description)
+			walk(groups[i].Conditions, groups[i].Groups)
+		}
+	}
+
+	walk(config.Conditions, config.ConditionGroups)
+
+	for i := range config.Actions {
+		config.Actions[i].Active = false
+		config.Actions[i].Error = ""
+		d.actions[config.Actions[i].ID] = data.NodeTypeAction
+	}
+
+	for i := range config.ActionsInactive {
+		config.ActionsInactive[i].Active = false
+		config.ActionsInactive[i].Error = ""
+		d.actions[config.ActionsInactive[i].ID] = data.NodeTypeActionInactive
+	}
+
+	return d
+}
+
+// point records active and error points sent to the rule, conditions, and
+// condition groups
+func (d *ruleDryRun) point(id string, p data.Point) {
+	n, ok := d.nodes[id]
+	if !ok {
+		return
+	}
+
+	switch p.Type {
+	case data.PointTypeActive:
+		n.active = p.Value != 0
+	case data.PointTypeError:
+		n.err = p.Text
+	default:
+		return
+	}
+
+	d.events = append(d.events, data.RuleBacktestEvent{
+		Time:        d.now,
+		NodeID:      id,
+		NodeType:    n.typ,
+		Description: n.desc,
+		Active:      n.active,
+		Error:       n.err,
+	})
+}
+
+// action records an action that would have run
+func (d *ruleDryRun) action(a Action) {
+	e := data.RuleBacktestEvent{
+		Time:         d.now,
+		NodeID:       a.ID,
+		NodeType:     d.actions[a.ID],
+		Description:  a.Description,
+		Active:       true,
+		Action:       a.Action,
+		TargetNodeID: a.NodeID,
+	}
+
+	if a.Action == data.PointValueSetValue {
+		e.Point = &data.Point{
+			Time:  d.now,
+			Type:  a.PointType,
+			Value: a.Value,
+			Text:  a.ValueText,
+		}
+	}
+
+	d.events = append(d.events, e)
+}
+
+// backtestPoint is a history point replayed through a rule
+type backtestPoint struct {
+	nodeID string
+	point  data.Point
+}
+
+// backtestHistory queries the history of all points used by the rule
+// conditions. Points of conditions without a node ID are limited to
+// descendants of the rule parent, as the rule only sees those points.
+func (rc *RuleClient) backtestHistory(historyID string, start, stop time.Time) ([]backtestPoint, error) {
+	// queries indexed by a string of the filters to remove duplicates
+	queries := make(map[string]data.TagFilters)
+	anyNode := false
+
+	add := func(nodeID, typ, key string) {
+		f := make(data.TagFilters)
+		if nodeID != "" {
+			f["node.id"] = nodeID
+		} else {
+			anyNode = true
+		}
+		if typ != "" {
+			f["type"] = typ
+		}
+		if key != "" {
+			f["key"] = key
+		}
+		queries[fmt.Sprint(f)] = f
+	}
+
+	for _, c := range rc.conditions() {
+		switch c.ConditionType {
+		case data.PointValuePointValue:
+			add(c.NodeID, c.PointType, c.PointKey)
+		case data.PointValueStale:
+			add(c.NodeID, c.PointType, c.PointKey)
+		case data.PointValueExpression:
+			for _, v := range c.Variables {
+				add(parseExprVariable(v))
+			}
+		}
+	}
+
+	var descendants map[string]bool
+	if anyNode {
+		descendants = make(map[string]bool)
+		err := ruleDescendants(rc.nc, rc.config.Parent, rc.config.ID, descendants)
+		if err != nil {
+			return nil, fmt.Errorf("Error getting rule parent descendants: %w", err)
+		}
+	}
+
+	var ret []backtestPoint
+	seen := make(map[string]bool)
+
+	for _, f := range queries {
+		hps, err := historyPoints(rc.nc, historyID, data.HistoryQuery{
+			Start:      start,
+			Stop:       stop,
+			TagFilters: f,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, hp := range hps {
+			nodeID := hp.NodeTags["node.id"]
+
+			if f["node.id"] == "" && !descendants[nodeID] {
+				continue
+			}
+
+			k := fmt.Sprintf("%v.%v.%v.%v", nodeID, hp.Type, hp.Key,
+				hp.Time.UnixNano())
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+
+			ret = append(ret, backtestPoint{nodeID, data.Point{
+				Time:  hp.Time,
+				Type:  hp.Type,
+				Key:   hp.Key,
+				Value: hp.Value,
+				Text:  hp.Text,
+			}})
+		}
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].point.Time.Before(ret[j].point.Time)
+	})
+
+	return ret, nil
+}
+
+// historyPoints sends a history query to the node with historyID
+func historyPoints(nc *nats.Conn, historyID string, query data.HistoryQuery) ([]data.HistoryPoint, error) {
+	req, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := nc.Request("history."+historyID, req, time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying history: %w", err)
+	}
+
+	var results data.HistoryResults
+
+	err = json.Unmarshal(resp.Data, &results)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding history: %w", err)
+	}
+
+	if results.ErrorMessage != "" {
+		return nil, fmt.Errorf("History query error: %v", results.ErrorMessage)
+	}
+
+	return results.Points, nil
+}
+
+// ruleDescendants adds all descendants of id to ids, except the rule and its
+// children, as the rule does not watch its own points
+func ruleDescendants(nc *nats.Conn, id, ruleID string, ids map[string]bool) error {
+	children, err := GetNodes(nc, id, "all", "", false)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range children {
+		if c.ID == ruleID || ids[c.ID] {
+			continue
+		}
+
+		ids[c.ID] = true
+
+		err := ruleDescendants(nc, c.ID, ruleID, ids)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replay runs points through the rule until stop. The schedule ticker and
+// delay timer are simulated so schedule, delay, and stale conditions change
+// at the same times they would when the rule runs.
+func (rc *RuleClient) replay(stop time.Time, points []backtestPoint) {
+	rc.trigger()
+
+	schedule := rc.hasConditionType(data.PointValueSchedule)
+	nextTick := rc.dryRun.start.Add(ruleScheduleTick)
+
+	for i := 0; ; {
+		next := stop
+		if i < len(points) && points[i].point.Time.Before(next) {
+			next = points[i].point.Time
+		}
+		if schedule && nextTick.Before(next) {
+			next = nextTick
+		}
+		if !rc.delayAt.IsZero() && rc.delayAt.Before(next) {
+			next = rc.delayAt
+		}
+
+		if !next.Before(stop) {
+			break
+		}
+
+		rc.dryRun.now = next
+
+		switch {
+		case i < len(points) && !points[i].point.Time.After(next):
+			rc.run(points[i].nodeID, data.Points{points[i].point})
+			i++
+		case !rc.delayAt.IsZero() && !rc.delayAt.After(next):
+			rc.delayAt = time.Time{}
+			rc.trigger()
+		default:
+			nextTick = nextTick.Add(ruleScheduleTick)
+			rc.trigger()
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// ruleRampStep is how often a ramp sends a value if RampStep is not set
+const ruleRampStep = time.Second
+
+// kinds of pending action steps
+const (
+	// a delayed action
+	pendingStart = iota
+	// the end of a pulse
+	pendingPulseEnd
+	// the next value of a ramp
+	pendingRamp
+	// the timeout of an action waiting for a confirming point
+	pendingConfirm
+)
+
+// pendingAction is an action step that runs later
+type pendingAction struct {
+	kind int
+	at   time.Time
+	id   string
+	// actions that run after this action is confirmed
+	rest          []string
+	triggerNodeID string
+	triggerPoints data.Points
+	// the point sent when a pulse ends
+	nodeID string
+	point  data.Point
+	// ramp start value and time
+	from  float64
+	start time.Time
+}
+
+// actionOrder returns action IDs sorted by Index
+func actionOrder(actions []Action) []string {
+	sorted := append([]Action{}, actions...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Index < sorted[j].Index
+	})
+
+	ret := make([]string, len(sorted))
+	for i, a := range sorted {
+		ret[i] = a.ID
+	}
+
+	return ret
+}
+
+// action returns the active or inactive action with id, or nil if it was
+// deleted
+func (rc *RuleClient) action(id string) *Action {
+	for _, actions := range [][]Action{rc.config.Actions, rc.config.ActionsInactive} {
+		for i := range actions {
+			if actions[i].ID == id {
+				return &actions[i]
+			}
+		}
+	}
+	return nil
+}
+
+// runActionSteps runs actions in order. Delayed actions are scheduled, and if
+// an action waits for a confirming point, the actions after it run when the
+// point arrives.
+func (rc *RuleClient) runActionSteps(ids []string, triggerNodeID string, triggerPoints data.Points) error {
+	for i, id := range ids {
+		a := rc.action(id)
+		if a == nil {
+			continue
+		}
+
+		var rest []string
+		if a.ConfirmPointType != "" {
+			rest = ids[i+1:]
+		}
+
+		if a.Delay > 0 {
+			rc.addPendingAction(pendingAction{
+				kind:          pendingStart,
+				at:            rc.now().Add(seconds(a.Delay)),
+				id:            id,
+				rest:          rest,
+				triggerNodeID: triggerNodeID,
+				triggerPoints: triggerPoints,
+			})
+		} else {
+			err := rc.runActionStep(a, rest, triggerNodeID, triggerPoints)
+			if err != nil {
+				return err
+			}
+		}
+
+		if a.ConfirmPointType != "" {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// runActionStep runs an action, and waits for the confirming point if the
+// action has one. rest runs after the point arrives.
+func (rc *RuleClient) runActionStep(a *Action, rest []string, triggerNodeID string, triggerPoints data.Points) error {
+	err := rc.runAction(a, triggerNodeID, triggerPoints)
+
+	if a.ConfirmPointType != "" {
+		rc.addPendingAction(pendingAction{
+			kind:          pendingConfirm,
+			at:            rc.now().Add(actionTimeout(*a)),
+			id:            a.ID,
+			rest:          rest,
+			triggerNodeID: triggerNodeID,
+			triggerPoints: triggerPoints,
+		})
+	}
+
+	return err
+}
+
+// startPulse schedules the end of a setValue pulse
+func (rc *RuleClient) startPulse(a *Action) {
+	rc.addPendingAction(pendingAction{
+		kind:   pendingPulseEnd,
+		at:     rc.now().Add(seconds(a.Pulse)),
+		id:     a.ID,
+		nodeID: a.NodeID,
+		point: data.Point{
+			Type:   a.PointType,
+			Value:  a.PulseValue,
+			Origin: a.ID,
+		},
+	})
+}
+
+// endPulse sends the point that ends a pulse
+func (rc *RuleClient) endPulse(p pendingAction) {
+	p.point.Time = rc.now()
+
+	err := rc.sendPoint(p.nodeID, p.point)
+	if err != nil {
+		log.Println("Error sending rule action point:", err)
+	}
+
+	if a := rc.action(p.id); a != nil {
+		rc.traceAction(*a, &p.point)
+	}
+}
+
+// startRamp starts moving the action point from the current value of the
+// node to the action value
+func (rc *RuleClient) startRamp(a *Action) error {
+	nodes, err := GetNodes(rc.nc, "all", a.NodeID, "", false)
+	if err != nil {
+		return fmt.Errorf("Error getting ramp start value: %w", err)
+	}
+
+	if len(nodes) < 1 {
+		return errors.New("action node not found")
+	}
+
+	from, _ := nodes[0].Points.Value(a.PointType, "")
+
+	now := rc.now()
+
+	rc.addPendingAction(pendingAction{
+		kind:  pendingRamp,
+		at:    now.Add(rampStep(a)),
+		id:    a.ID,
+		from:  from,
+		start: now,
+	})
+
+	return nil
+}
+
+// rampStep returns how often a ramp sends a value
+func rampStep(a *Action) time.Duration {
+	if a.RampStep <= 0 {
+		return ruleRampStep
+	}
+	return seconds(a.RampStep)
+}
+
+// nextRampValue sends the next value of a ramp, and schedules the one after
+// it until the ramp is done
+func (rc *RuleClient) nextRampValue(p pendingAction) {
+	a := rc.action(p.id)
+	if a == nil {
+		return
+	}
+
+	now := rc.now()
+	ramp := seconds(a.Ramp)
+	elapsed := now.Sub(p.start)
+
+	value := a.Value
+	if elapsed < ramp {
+		value = p.from + (a.Value-p.from)*float64(elapsed)/float64(ramp)
+	}
+
+	pt := data.Point{
+		Time:   now,
+		Type:   a.PointType,
+		Value:  value,
+		Origin: a.ID,
+	}
+
+	err := rc.sendPoint(a.NodeID, pt)
+	if err != nil {
+		log.Println("Error sending rule action point:", err)
+	}
+
+	rc.traceAction(*a, &pt)
+
+	if elapsed >= ramp {
+		return
+	}
+
+	p.at = now.Add(rampStep(a))
+	if end := p.start.Add(ramp); p.at.After(end) {
+		p.at = end
+	}
+
+	rc.addPendingAction(p)
+}
+
+// confirmActions runs the actions that wait for points from nodeID to be
+// confirmed
+func (rc *RuleClient) confirmActions(nodeID string, points data.Points) {
+	var confirmed []pendingAction
+
+	pending := rc.pendingActions[:0]
+	for _, p := range rc.pendingActions {
+		if p.kind == pendingConfirm {
+			a := rc.action(p.id)
+			if a != nil && a.NodeID == nodeID && confirmPoint(a, points) {
+				confirmed = append(confirmed, p)
+				continue
+			}
+		}
+		pending = append(pending, p)
+	}
+
+	if len(confirmed) == 0 {
+		return
+	}
+
+	rc.pendingActions = pending
+
+	for _, p := range confirmed {
+		err := rc.runActionSteps(p.rest, p.triggerNodeID, p.triggerPoints)
+		if err != nil {
+			log.Println("Error running rule actions:", err)
+		}
+	}
+
+	rc.armActionTimer()
+}
+
+// confirmPoint returns true if points contain the confirming point of an action
+func confirmPoint(a *Action, points data.Points) bool {
+	for _, p := range points {
+		if p.Type == a.ConfirmPointType && p.Value == a.ConfirmValue {
+			return true
+		}
+	}
+	return false
+}
+
+// runPendingActions runs the action steps that are due
+func (rc *RuleClient) runPendingActions() {
+	now := rc.now()
+
+	var due []pendingAction
+
+	pending := rc.pendingActions[:0]
+	for _, p := range rc.pendingActions {
+		if p.at.After(now) {
+			pending = append(pending, p)
+		} else {
+			due = append(due, p)
+		}
+	}
+	rc.pendingActions = pending
+
+	if len(due) > 0 {
+		rc.traceEntry = &data.RuleTrace{
+			Time:   now,
+			NodeID: rc.config.ID,
+			Active: rc.config.Active,
+		}
+		rc.traceKeep = false
+		defer rc.traceCommit()
+	}
+
+	for _, p := range due {
+		switch p.kind {
+		case pendingStart:
+			a := rc.action(p.id)
+			if a == nil {
+				break
+			}
+
+			err := rc.runActionStep(a, p.rest, p.triggerNodeID, p.triggerPoints)
+			if err != nil {
+				log.Println("Error running rule action:", err)
+			}
+		case pendingPulseEnd:
+			rc.endPulse(p)
+		case pendingRamp:
+			rc.nextRampValue(p)
+		case pendingConfirm:
+			a := rc.action(p.id)
+			if a == nil {
+				break
+			}
+
+			// the actions after this one do not run
+			rc.actionResult(actionResult{a.ID,
+				fmt.Errorf("timeout waiting for %v point", a.ConfirmPointType)})
+		}
+	}
+
+	rc.armActionTimer()
+}
+
+// cancelActions cancels the pending steps of actions. Pulses end early so that
+// outputs are not left on.
+func (rc *RuleClient) cancelActions(actions []Action) {
+	if len(rc.pendingActions) == 0 {
+		return
+	}
+
+	ids := make(map[string]bool)
+	for _, a := range actions {
+		ids[a.ID] = true
+	}
+
+	var pulses []pendingAction
+
+	pending := rc.pendingActions[:0]
+	for _, p := range rc.pendingActions {
+		if !ids[p.id] {
+			pending = append(pending, p)
+		} else if p.kind == pendingPulseEnd {
+			pulses = append(pulses, p)
+		}
+	}
+	rc.pendingActions = pending
+
+	for _, p := range pulses {
+		rc.endPulse(p)
+	}
+
+	rc.armActionTimer()
+}
+
+func (rc *RuleClient) addPendingAction(p pendingAction) {
+	rc.pendingActions = append(rc.pendingActions, p)
+	rc.armActionTimer()
+}
+
+// armActionTimer sets the action timer to fire when the first pending step is
+// due
+func (rc *RuleClient) armActionTimer() {
+	rc.actionTimer.Stop()
+
+	if len(rc.pendingActions) == 0 {
+		return
+	}
+
+	at := rc.pendingActions[0].at
+	for _, p := range rc.pendingActions[1:] {
+		if p.at.Before(at) {
+			at = p.at
+		}
+	}
+
+	rc.actionTimer.Reset(time.Until(at))
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// ruleTraceSize is the number of evaluations kept in the rule trace
+const ruleTraceSize = 100
+
+// GetRuleTrace returns the last evaluations of a rule, oldest first. The rule
+// must be running.
+func GetRuleTrace(nc *nats.Conn, ruleID string) ([]data.RuleTrace, error) {
+	msg, err := nc.Request("rule.trace."+ruleID, nil, time.Second*20)
+	if err != nil {
+		return nil, err
+	}
+
+	var results data.RuleTraceResults
+
+	err = json.Unmarshal(msg.Data, &results)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding rule trace: %v", err)
+	}
+
+	if results.ErrorMessage != "" {
+		return nil, errors.New(results.ErrorMessage)
+	}
+
+	return results.Trace, nil
+}
+
+// WatchRuleTrace calls callback for each evaluation of a rule as it happens.
+// The rule debug point must be set for evaluations to be published.
+// Unsubscribe from the returned subscription to stop watching.
+func WatchRuleTrace(nc *nats.Conn, ruleID string,
+	callback func(data.RuleTrace)) (*nats.Subscription, error) {
+	return nc.Subscribe("rule.debug."+ruleID, func(msg *nats.Msg) {
+		var trace data.RuleTrace
+		err := json.Unmarshal(msg.Data, &trace)
+		if err != nil {
+			log.Println("Error decoding rule trace:", err)
+			return
+		}
+
+		callback(trace)
+	})
+}
+
+func (rc *RuleClient) handleTrace(msg *nats.Msg) {
+	rc.traceLock.Lock()
+	results := data.RuleTraceResults{
+		Trace: append([]data.RuleTrace{}, rc.trace...),
+	}
+	rc.traceLock.Unlock()
+
+	res, err := json.Marshal(results)
+	if err != nil {
+		res = []byte(`{"error":"error encoding response"}`)
+	}
+
+	err = msg.Respond(res)
+	if err != nil {
+		log.Println("Error responding to rule trace request:", err)
+	}
+}
+
+// traceAction adds an action that ran to the evaluation in progress
+func (rc *RuleClient) traceAction(a Action, p *data.Point) {
+	if rc.traceEntry == nil {
+		return
+	}
+
+	rc.traceEntry.Actions = append(rc.traceEntry.Actions, data.RuleTraceAction{
+		ID:          a.ID,
+		Description: a.Description,
+		Action:      a.Action,
+		NodeID:      a.NodeID,
+		Point:       p,
+		Error:       a.Error,
+	})
+	rc.traceKeep = true
+}
+
+// traceCommit adds the evaluation in progress to the trace, and publishes it
+// if the rule debug point is set
+func (rc *RuleClient) traceCommit() {
+	trace := rc.traceEntry
+	rc.traceEntry = nil
+
+	if trace == nil || !rc.traceKeep || rc.dryRun != nil {
+		return
+	}
+
+	rc.traceLock.Lock()
+	rc.trace = append(rc.trace, *trace)
+	if len(rc.trace) > ruleTraceSize {
+		rc.trace = rc.trace[len(rc.trace)-ruleTraceSize:]
+	}
+	rc.traceLock.Unlock()
+
+	if rc.config.Debug <= 0 {
+		return
+	}
+
+	d, err := json.Marshal(trace)
+	if err != nil {
+		log.Println("Error encoding rule trace:", err)
+		return
+	}
+
+	err = rc.nc.Publish("rule.debug."+rc.config.ID, d)
+	if err != nil {
+		log.Println("Error publishing rule trace:", err)
+	}
+}
+
+// exprValuesString formats expression variables for the trace
+func exprValuesString(values map[string]exprValue) string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ret := make([]string, len(names))
+	for i, name := range names {
+		v := values[name]
+		if v.isText || v.text != "" {
+			ret[i] = fmt.Sprintf("%v=%q", name, v.text)
+		} else {
+			ret[i] = name + "=" + strconv.FormatFloat(v.num, 'f', -1, 64)
+		}
+	}
+
+	return strings.Join(ret, " ")
+}
@@ -1,31 +1,43 @@
 package client
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-audio/wav"
-	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
 	"github.com/simpleiot/simpleiot/data"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 )
 
 // Rule represent a rule node config
 type Rule struct {
-	ID              string      `node:"id"`
-	Parent          string      `node:"parent"`
-	Description     string      `point:"description"`
-	Disabled        bool        `point:"disabled"`
-	Active          bool        `point:"active"`
-	Error           string      `point:"error"`
-	Conditions      []Condition `child:"condition"`
-	Actions         []Action    `child:"action"`
-	ActionsInactive []Action    `child:"actionInactive"`
+	ID          string `node:"id"`
+	Parent      string `node:"parent"`
+	Description string `point:"description"`
+	Disabled    bool   `point:"disabled"`
+	Active      bool   `point:"active"`
+	Error       string `point:"error"`
+	// if Debug is set, each evaluation of the rule is published on the
+	// rule.debug.<id> subject
+	Debug int `point:"debug"`
+	// location used for sunrise and sunset schedules. If not set, the
+	// location of the first parent node with a location is used.
+	Latitude        float64          `point:"latitude"`
+	Longitude       float64          `point:"longitude"`
+	Conditions      []Condition      `child:"condition"`
+	ConditionGroups []ConditionGroup `child:"conditionGroup"`
+	Actions         []Action         `child:"action"`
+	ActionsInactive []Action         `child:"actionInactive"`
 }
 
 func (r Rule) String() string {
@@ -34,6 +46,9 @@ func (r Rule) String() string {
 	for _, c := range r.Conditions {
 		ret += fmt.Sprintf("%v", c)
 	}
+	for _, g := range r.ConditionGroups {
+		ret += g.string("  ")
+	}
 	for _, a := range r.Actions {
 		ret += fmt.Sprintf("  ACTION: %v", a)
 	}
@@ -48,13 +63,17 @@ func (r Rule) String() string {
 // Condition defines parameters to look for in a point or a schedule.
 type Condition struct {
 	// general parameters
-	ID            string  `node:"id"`
-	Parent        string  `node:"parent"`
-	Description   string  `point:"description"`
-	ConditionType string  `point:"conditionType"`
-	MinActive     float64 `point:"minActive"`
-	Active        bool    `point:"active"`
-	Error         string  `point:"error"`
+	ID            string `node:"id"`
+	Parent        string `node:"parent"`
+	Description   string `point:"description"`
+	ConditionType string `point:"conditionType"`
+	// MinActive is the time (minutes) a condition must be met before it
+	// is active, and ClearDelay is the time it must not be met before it is
+	// cleared
+	MinActive  float64 `point:"minActive"`
+	ClearDelay float64 `point:"clearDelay"`
+	Active     bool    `point:"active"`
+	Error      string  `point:"error"`
 
 	// used with point value rules
 	NodeID     string  `point:"nodeID"`
@@ -65,12 +84,42 @@ type Condition struct {
 	Operator   string  `point:"operator"`
 	Value      float64 `point:"value"`
 	ValueText  string  `point:"valueText"`
-
-	// used with shedule rules
+	// an active > or < number condition is cleared when the value crosses
+	// ValueOff if Hysteresis is set, otherwise when it is Deadband past
+	// Value. Deadband is the tolerance for = and !=.
+	Hysteresis bool    `point:"hysteresis"`
+	ValueOff   float64 `point:"valueOff"`
+	Deadband   float64 `point:"deadband"`
+	// if set, number conditions use the average of the points received in
+	// each window (minutes) instead of each point
+	AverageWindow float64 `point:"averageWindow"`
+	// Signal selects a value calculated over the last Window minutes for
+	// number conditions: rate (per minute), min, max, average, or stdDev
+	Signal string  `point:"signal"`
+	Window float64 `point:"window"`
+
+	// used with stale rules (and NodeID, PointType, PointKey). StaleTime is
+	// in minutes.
+	StaleTime float64 `point:"staleTime"`
+
+	// used with shedule rules. Start and End are HH:MM, or sunrise/sunset
+	// with an optional offset (sunset+30m). Times and dates are in Timezone
+	// (IANA name, for example America/New_York) if set, otherwise UTC. If
+	// Cron is set, the condition is active for Duration minutes (default 1)
+	// after each time matching the cron expression.
 	Start    string   `point:"start"`
 	End      string   `point:"end"`
 	Weekdays []bool   `point:"weekday"`
 	Dates    []string `point:"date"`
+	Timezone string   `point:"timezone"`
+	Cron     string   `point:"cron"`
+	Duration float64  `point:"duration"`
+
+	// used with expression rules. Variables maps variable names used in the
+	// expression to points: nodeID[.pointType[.pointKey]]. The point type
+	// defaults to value.
+	Expression string            `point:"expression"`
+	Variables  map[string]string `point:"variable"`
 }
 
 func (c Condition) String() string {
@@ -97,16 +146,49 @@ func (c Condition) String() string {
 		if c.NodeID != "" {
 			ret += fmt.Sprintf("  NODEID:%v", c.NodeID)
 		}
+		if c.Hysteresis {
+			ret += fmt.Sprintf("  OFF:%v", c.ValueOff)
+		}
+		if c.Deadband > 0 {
+			ret += fmt.Sprintf("  DB:%v", c.Deadband)
+		}
+		if c.AverageWindow > 0 {
+			ret += fmt.Sprintf("  AVG:%v", c.AverageWindow)
+		}
+		if c.Signal != "" {
+			ret += fmt.Sprintf("  SIG:%v/%v", c.Signal, c.Window)
+		}
 		if c.MinActive > 0 {
 			ret += fmt.Sprintf("  MINACT:%v", c.MinActive)
 		}
+		if c.ClearDelay > 0 {
+			ret += fmt.Sprintf("  CLRDLY:%v", c.ClearDelay)
+		}
 		ret += fmt.Sprintf("  A:%v", c.Active)
 		ret += "\n"
 	case data.PointValueSchedule:
 		ret = fmt.Sprintf("  COND: %v  CTYPE:%v",
 			c.Description, c.ConditionType)
-		ret += fmt.Sprintf("  W:%v", c.Weekdays)
-		ret += fmt.Sprintf("  D:%v", c.Dates)
+		if c.Cron != "" {
+			ret += fmt.Sprintf("  CRON:%v  DUR:%v", c.Cron, c.Duration)
+		} else {
+			ret += fmt.Sprintf("  S:%v  E:%v", c.Start, c.End)
+			ret += fmt.Sprintf("  W:%v", c.Weekdays)
+			ret += fmt.Sprintf("  D:%v", c.Dates)
+		}
+		if c.Timezone != "" {
+			ret += fmt.Sprintf("  TZ:%v", c.Timezone)
+		}
+		ret += "\n"
+	case data.PointValueStale:
+		ret = fmt.Sprintf("  COND: %v  CTYPE:%v  NODEID:%v  PT:%v  STALE:%v",
+			c.Description, c.ConditionType, c.NodeID, c.PointType, c.StaleTime)
+		ret += fmt.Sprintf("  A:%v", c.Active)
+		ret += "\n"
+	case data.PointValueExpression:
+		ret = fmt.Sprintf("  COND: %v  CTYPE:%v  EXPR:%v  VARS:%v",
+			c.Description, c.ConditionType, c.Expression, c.Variables)
+		ret += fmt.Sprintf("  A:%v", c.Active)
 		ret += "\n"
 
 	default:
@@ -115,6 +197,51 @@ func (c Condition) String() string {
 	return ret
 }
 
+// ConditionGroup combines conditions and other groups with an operator: and,
+// or, or not. A not group is active if none of its children are active. The
+// conditions and groups of a rule are combined with and.
+type ConditionGroup struct {
+	ID          string           `node:"id"`
+	Parent      string           `node:"parent"`
+	Description string           `point:"description"`
+	Operator    string           `point:"operator"`
+	Active      bool             `point:"active"`
+	Error       string           `point:"error"`
+	Conditions  []Condition      `child:"condition"`
+	Groups      []ConditionGroup `child:"conditionGroup"`
+}
+
+func (g ConditionGroup) String() string {
+	return g.string("")
+}
+
+func (g ConditionGroup) string(indent string) string {
+	ret := fmt.Sprintf("%vGROUP: %v  OP:%v  A:%v\n", indent, g.Description,
+		g.Operator, g.Active)
+	for _, c := range g.Conditions {
+		ret += indent + fmt.Sprintf("%v", c)
+	}
+	for _, cg := range g.Groups {
+		ret += cg.string(indent + "  ")
+	}
+	return ret
+}
+
+// offThreshold returns the value at which an active > or < condition is
+// cleared, and false if the condition does not use hysteresis or a deadband.
+func (c *Condition) offThreshold() (float64, bool) {
+	switch {
+	case c.Hysteresis:
+		return c.ValueOff, true
+	case c.Deadband <= 0:
+		return 0, false
+	case c.Operator == data.PointValueLessThan:
+		return c.Value + c.Deadband, true
+	default:
+		return c.Value - c.Deadband, true
+	}
+}
+
 // Action defines actions that can be taken if a rule is active.
 type Action struct {
 	ID          string `node:"id"`
@@ -122,7 +249,7 @@ type Action struct {
 	Description string `point:"description"`
 	Active      bool   `point:"active"`
 	Error       string `point:"error"`
-	// Action: notify, setValue, playAudio
+	// Action: notify, setValue, playAudio, webhook, publish, command
 	Action    string `point:"action"`
 	NodeID    string `point:"nodeID"`
 	PointType string `point:"pointType"`
@@ -134,6 +261,35 @@ type Action struct {
 	PointChannel  int    `point:"pointChannel"`
 	PointDevice   string `point:"pointDevice"`
 	PointFilePath string `point:"pointFilePath"`
+	// the following are used for webhook, publish, and command actions.
+	// Template is the webhook body or published message, and Template and
+	// Args are Go templates. Timeout is in seconds.
+	URL      string            `point:"url"`
+	Headers  map[string]string `point:"header"`
+	Subject  string            `point:"subject"`
+	Command  string            `point:"command"`
+	Args     []string          `point:"arg"`
+	Template string            `point:"template"`
+	Retries  int               `point:"retries"`
+	Timeout  float64           `point:"timeout"`
+	// the following are used for timed and sequenced actions. Delay,
+	// Pulse, Ramp, and RampStep are in seconds. Actions run in order of
+	// Index. If ConfirmPointType is set, the following actions wait for
+	// the action node to send a ConfirmPointType point with ConfirmValue,
+	// and the sequence stops if Timeout expires first.
+	Index            int     `point:"index"`
+	Delay            float64 `point:"delay"`
+	Pulse            float64 `point:"pulse"`
+	PulseValue       float64 `point:"pulseValue"`
+	Ramp             float64 `point:"ramp"`
+	RampStep         float64 `point:"rampStep"`
+	ConfirmPointType string  `point:"confirmPointType"`
+	ConfirmValue     float64 `point:"confirmValue"`
+	// the following are used for notify actions and are in minutes. A
+	// notification is not sent again while the last one is not
+	// acknowledged, or within Repeat of the last one.
+	Repeat   float64 `point:"repeat"`
+	Escalate float64 `point:"escalate"`
 }
 
 func (a Action) String() string {
@@ -155,6 +311,14 @@ func (a Action) String() string {
 	if a.NodeID != "" {
 		ret += fmt.Sprintf("  NODEID:%v", a.NodeID)
 	}
+	switch a.Action {
+	case data.PointValueWebhook:
+		ret += fmt.Sprintf("  URL:%v", a.URL)
+	case data.PointValuePublish:
+		ret += fmt.Sprintf("  SUBJ:%v", a.Subject)
+	case data.PointValueCommand:
+		ret += fmt.Sprintf("  CMD:%v %v", a.Command, a.Args)
+	}
 	ret += fmt.Sprintf("  A:%v", a.Active)
 	ret += "\n"
 	return ret
@@ -167,7 +331,7 @@ type ActionInactive struct {
 	Parent      string `node:"parent"`
 	Description string `point:"description"`
 	Active      bool   `point:"active"`
-	// Action: notify, setValue, playAudio
+	// Action: notify, setValue, playAudio, webhook, publish, command
 	Action    string `point:"action"`
 	NodeID    string `point:"nodeID"`
 	PointType string `point:"pointType"`
@@ -179,31 +343,152 @@ type ActionInactive struct {
 	PointChannel  int    `point:"pointChannel"`
 	PointDevice   string `point:"pointDevice"`
 	PointFilePath string `point:"pointFilePath"`
+	// the following are used for webhook, publish, and command actions.
+	// Template is the webhook body or published message, and Template and
+	// Args are Go templates. Timeout is in seconds.
+	URL      string            `point:"url"`
+	Headers  map[string]string `point:"header"`
+	Subject  string            `point:"subject"`
+	Command  string            `point:"command"`
+	Args     []string          `point:"arg"`
+	Template string            `point:"template"`
+	Retries  int               `point:"retries"`
+	Timeout  float64           `point:"timeout"`
+	// the following are used for timed and sequenced actions. Delay,
+	// Pulse, Ramp, and RampStep are in seconds. Actions run in order of
+	// Index. If ConfirmPointType is set, the following actions wait for
+	// the action node to send a ConfirmPointType point with ConfirmValue,
+	// and the sequence stops if Timeout expires first.
+	Index            int     `point:"index"`
+	Delay            float64 `point:"delay"`
+	Pulse            float64 `point:"pulse"`
+	PulseValue       float64 `point:"pulseValue"`
+	Ramp             float64 `point:"ramp"`
+	RampStep         float64 `point:"rampStep"`
+	ConfirmPointType string  `point:"confirmPointType"`
+	ConfirmValue     float64 `point:"confirmValue"`
+	// the following are used for notify actions and are in minutes. A
+	// notification is not sent again while the last one is not
+	// acknowledged, or within Repeat of the last one.
+	Repeat   float64 `point:"repeat"`
+	Escalate float64 `point:"escalate"`
 }
 
 // RuleClient is a SIOT client used to run rules
 type RuleClient struct {
 	nc            *nats.Conn
 	config        Rule
+	options       Options
 	stop          chan struct{}
 	newPoints     chan NewPoints
 	newEdgePoints chan NewPoints
 	newRulePoints chan NewPoints
 	upSub         *nats.Subscription
+	// subscriptions to nodes referenced by expression and stale
+	// conditions and action confirm points, indexed by node ID
+	nodeSubs map[string]*nats.Subscription
+	// compiled expressions, indexed by condition ID
+	exprs map[string]*ruleExpression
+	// condition state used for timing and averaging, indexed by condition ID
+	condStates map[string]*conditionState
+	// delayTimer fires at delayAt to activate or clear conditions waiting
+	// for MinActive or ClearDelay, and to check stale conditions
+	delayTimer *time.Timer
+	delayAt    time.Time
+	// location of a parent node used for sunrise and sunset
+	parentLocation []float64
+	// dryRun is set when history is replayed through the rule by a
+	// backtest. Points are recorded instead of sent, and actions are not run.
+	dryRun *ruleDryRun
+	// trace holds the last evaluations of the rule, oldest first.
+	// traceEntry is the evaluation in progress, and it is added to the
+	// trace if traceKeep is set.
+	trace      []data.RuleTrace
+	traceLock  sync.Mutex
+	traceEntry *data.RuleTrace
+	traceKeep  bool
+	traceSub   *nats.Subscription
+	// results of actions that run in the background
+	actionResults chan actionResult
+	// action steps that run later. actionTimer fires when the first one
+	// is due.
+	pendingActions []pendingAction
+	actionTimer    *time.Timer
+}
+
+// conditionState tracks whether a condition is met before MinActive and
+// ClearDelay are applied
+type conditionState struct {
+	met   bool
+	since time.Time
+	// last value seen by the condition, used in action templates
+	value float64
+	text  string
+
+	avg       *data.TimeWindowAverager
+	avgWindow float64
+	avgValue  float64
+	avgReady  bool
+
+	stats       *data.TimeWindowStats
+	statsWindow float64
+
+	// last update of the point watched by a stale condition
+	staleLoaded bool
+	staleLast   time.Time
+	staleText   string
 }
 
-// NewRuleClient constructor ...
-func NewRuleClient(nc *nats.Conn, config Rule) Client {
+// ruleExpression is a compiled expression condition and the last values of
+// its variables
+type ruleExpression struct {
+	src    string
+	vars   map[string]string
+	expr   *expression
+	err    error
+	values map[string]exprValue
+}
+
+// DefaultRulePublishPrefix is the subject prefix rule publish actions can
+// publish to if no prefix is configured
+const DefaultRulePublishPrefix = "rule.publish."
+
+// NewRuleClient constructor. Options restrict the commands and subjects rule
+// actions can use.
+func NewRuleClient(nc *nats.Conn, config Rule, o Options) Client {
+	if o.RulePublishPrefix == "" {
+		o.RulePublishPrefix = DefaultRulePublishPrefix
+	}
+
 	return &RuleClient{
 		nc:            nc,
 		config:        config,
+		options:       o,
 		stop:          make(chan struct{}),
 		newPoints:     make(chan NewPoints),
 		newEdgePoints: make(chan NewPoints),
 		newRulePoints: make(chan NewPoints),
+		nodeSubs:      make(map[string]*nats.Subscription),
+		exprs:         make(map[string]*ruleExpression),
+		condStates:    make(map[string]*conditionState),
+		delayTimer:    newStoppedTimer(),
+		actionResults: make(chan actionResult),
+		actionTimer:   newStoppedTimer(),
 	}
 }
 
+// ruleScheduleTick is how often schedule conditions are checked
+// TODO schedule ticker is a brute force way to do this
+// we could optimize at some point by creating a timer to expire
+// on the next schedule change
+const ruleScheduleTick = time.Second * 10
+
+func newStoppedTimer() *time.Timer {
+	t := time.NewTimer(time.Hour)
+	t.Stop()
+	return t
+}
+
 // Run runs the main logic for this client and blocks until stopped
 func (rc *RuleClient) Run() error {
 	// watch all points that flow through parent node
@@ -226,68 +511,31 @@ func (rc *RuleClient) Run() error {
 			return
 		}
 
-		rc.newRulePoints <- NewPoints{chunks[2], "", points}
+		select {
+		case rc.newRulePoints <- NewPoints{chunks[2], "", points}:
+		case <-rc.stop:
+		}
 	})
 
 	if err != nil {
 		return fmt.Errorf("Rule error subscribing to upsub: %v", err)
 	}
 
-	// TODO schedule ticker is a brute force way to do this
-	// we could optimize at some point by creating a timer to expire
-	// on the next schedule change
-	scheduleTickTime := time.Second * 10
-	scheduleTicker := time.NewTicker(scheduleTickTime)
-	if !rc.hasSchedule() {
-		scheduleTicker.Stop()
+	rc.traceSub, err = rc.nc.Subscribe("rule.trace."+rc.config.ID, rc.handleTrace)
+	if err != nil {
+		return fmt.Errorf("Rule error subscribing to trace: %v", err)
 	}
 
-	run := func(id string, pts data.Points) {
-		var active, changed bool
-		var err error
-
-		if len(pts) > 0 {
-			active, changed, err = rc.ruleProcessPoints(id, pts)
-			if err != nil {
-				log.Println("Error processing rule point:", err)
-			}
-
-			if !changed {
-				return
-			}
-		} else {
-			// send a schedule trigger through just in case someone changed a
-			// schedule condition
-			active, _, err = rc.ruleProcessPoints(rc.config.ID, data.Points{{
-				Time: time.Now(),
-				Type: data.PointTypeTrigger,
-			}})
-			if err != nil {
-				log.Println("Error processing rule point:", err)
-			}
-		}
-
-		if active {
-			err := rc.ruleRunActions(rc.config.Actions, id)
-			if err != nil {
-				log.Println("Error running rule actions:", err)
-			}
+	rc.updateNodeSubs()
 
-			err = rc.ruleInactiveActions(rc.config.ActionsInactive)
-			if err != nil {
-				log.Println("Error running rule inactive actions:", err)
-			}
-		} else {
-			err := rc.ruleRunActions(rc.config.ActionsInactive, id)
-			if err != nil {
-				log.Println("Error running rule actions:", err)
-			}
+	scheduleTicker := time.NewTicker(ruleScheduleTick)
+	if !rc.hasConditionType(data.PointValueSchedule) {
+		scheduleTicker.Stop()
+	}
 
-			err = rc.ruleInactiveActions(rc.config.Actions)
-			if err != nil {
-				log.Println("Error running rule inactive actions:", err)
-			}
-		}
+	// stale conditions must be checked even if no points arrive
+	if rc.hasConditionType(data.PointValueStale) {
+		rc.trigger()
 	}
 
 done:
@@ -296,38 +544,157 @@ done:
 		case <-rc.stop:
 			break done
 		case pts := <-rc.newRulePoints:
-			run(pts.ID, pts.Points)
+			rc.run(pts.ID, pts.Points)
 
 		case <-scheduleTicker.C:
-			run(rc.config.ID, data.Points{{
-				Time: time.Now(),
-				Type: data.PointTypeTrigger,
-			}})
+			rc.trigger()
+
+		case <-rc.delayTimer.C:
+			rc.delayAt = time.Time{}
+			rc.trigger()
+
+		case r := <-rc.actionResults:
+			rc.actionResult(r)
+
+		case <-rc.actionTimer.C:
+			rc.runPendingActions()
 
 		case pts := <-rc.newPoints:
+			rc.parentLocation = nil
 			err := data.MergePoints(pts.ID, pts.Points, &rc.config)
 			if err != nil {
 				log.Println("error merging rule points:", err)
 			}
-			if rc.hasSchedule() {
-				scheduleTicker = time.NewTicker(scheduleTickTime)
+
+			// turning debug on or off does not change how the rule
+			// runs, so don't run the actions again
+			if pts.ID == rc.config.ID && onlyDebugPoints(pts.Points) {
+				break
+			}
+
+			if rc.hasConditionType(data.PointValueSchedule) {
+				scheduleTicker = time.NewTicker(ruleScheduleTick)
 			} else {
 				scheduleTicker.Stop()
 			}
 
-			run("", nil)
+			rc.updateNodeSubs()
+			rc.run("", nil)
 		case pts := <-rc.newEdgePoints:
+			rc.parentLocation = nil
 			err := data.MergeEdgePoints(pts.ID, pts.Parent, pts.Points, &rc.config)
 			if err != nil {
 				log.Println("error merging rule edge points:", err)
 			}
-			run("", nil)
+			rc.updateNodeSubs()
+			rc.run("", nil)
+		}
+	}
+
+	for id, sub := range rc.nodeSubs {
+		err := sub.Unsubscribe()
+		if err != nil {
+			log.Println("Rule error unsubscribing from node:", err)
 		}
+		delete(rc.nodeSubs, id)
+	}
+
+	// end pulses that are in progress
+	rc.cancelActions(rc.config.Actions)
+	rc.cancelActions(rc.config.ActionsInactive)
+
+	err = rc.traceSub.Unsubscribe()
+	if err != nil {
+		log.Println("Rule error unsubscribing from trace:", err)
 	}
 
 	return rc.upSub.Unsubscribe()
 }
 
+// run processes points through the rule and runs the actions if the rule
+// active state changed. If there are no points, a trigger is processed and the
+// actions are run regardless.
+func (rc *RuleClient) run(id string, pts data.Points) {
+	var active, changed bool
+	var err error
+
+	defer rc.traceCommit()
+
+	if len(pts) > 0 {
+		active, changed, err = rc.ruleProcessPoints(id, pts)
+		if err != nil {
+			log.Println("Error processing rule point:", err)
+		}
+
+		if !changed {
+			// actions waiting for a confirming point may continue
+			rc.confirmActions(id, pts)
+			return
+		}
+	} else {
+		// send a schedule trigger through just in case someone changed a
+		// schedule condition
+		active, _, err = rc.ruleProcessPoints(rc.config.ID, data.Points{{
+			Time: rc.now(),
+			Type: data.PointTypeTrigger,
+		}})
+		if err != nil {
+			log.Println("Error processing rule point:", err)
+		}
+
+		// the actions run again, so trace them
+		rc.traceKeep = true
+	}
+
+	if active {
+		err := rc.ruleRunActions(rc.config.Actions, id, pts)
+		if err != nil {
+			log.Println("Error running rule actions:", err)
+		}
+
+		err = rc.ruleInactiveActions(rc.config.ActionsInactive)
+		if err != nil {
+			log.Println("Error running rule inactive actions:", err)
+		}
+	} else {
+		err := rc.ruleRunActions(rc.config.ActionsInactive, id, pts)
+		if err != nil {
+			log.Println("Error running rule actions:", err)
+		}
+
+		err = rc.ruleInactiveActions(rc.config.Actions)
+		if err != nil {
+			log.Println("Error running rule inactive actions:", err)
+		}
+	}
+}
+
+// onlyDebugPoints returns true if all points are debug points
+func onlyDebugPoints(pts data.Points) bool {
+	for _, p := range pts {
+		if p.Type != data.PointTypeDebug {
+			return false
+		}
+	}
+	return len(pts) > 0
+}
+
+// trigger runs the rule for schedule, delay, and stale checks
+func (rc *RuleClient) trigger() {
+	rc.run(rc.config.ID, data.Points{{
+		Time: rc.now(),
+		Type: data.PointTypeTrigger,
+	}})
+}
+
+// now returns the current time, or the replay time during a backtest
+func (rc *RuleClient) now() time.Time {
+	if rc.dryRun != nil {
+		return rc.dryRun.now
+	}
+	return time.Now()
+}
+
 // Stop sends a signal to the Run function to exit
 func (rc *RuleClient) Stop(_ error) {
 	close(rc.stop)
@@ -347,6 +714,11 @@ func (rc *RuleClient) EdgePoints(nodeID, parentID string, points []data.Point) {
 
 // sendPoint sets origin to the rule node
 func (rc *RuleClient) sendPoint(id string, point data.Point) error {
+	if rc.dryRun != nil {
+		rc.dryRun.point(id, point)
+		return nil
+	}
+
 	if id != rc.config.ID {
 		// we must set origin as we are sending a point to something
 		// other than the client root node
@@ -358,22 +730,219 @@ func (rc *RuleClient) sendPoint(id string, point data.Point) error {
 	return SendNodePoint(rc.nc, id, point, false)
 }
 
-func (rc *RuleClient) hasSchedule() bool {
-	for _, c := range rc.config.Conditions {
-		if c.ConditionType == data.PointValueSchedule {
+// conditions returns all conditions of the rule, including conditions in
+// groups. The returned pointers are only valid until the config is merged.
+func (rc *RuleClient) conditions() []*Condition {
+	var ret []*Condition
+
+	var walk func(conds []Condition, groups []ConditionGroup)
+	walk = func(conds []Condition, groups []ConditionGroup) {
+		for i := range conds {
+			ret = append(ret, &conds[i])
+		}
+		for _, g := range groups {
+			walk(g.Conditions, g.Groups)
+		}
+	}
+
+	walk(rc.config.Conditions, rc.config.ConditionGroups)
+
+	return ret
+}
+
+func (rc *RuleClient) hasConditionType(typ string) bool {
+	for _, c := range rc.conditions() {
+		if c.ConditionType == typ {
 			return true
 		}
 	}
 	return false
 }
 
+// updateNodeSubs subscribes to points of all nodes referenced by expression
+// and stale conditions, and of nodes that confirm action steps. Nodes below the rule parent are also seen through the
+// up subscription, which does no harm.
+func (rc *RuleClient) updateNodeSubs() {
+	ids := make(map[string]bool)
+
+	for _, c := range rc.conditions() {
+		switch c.ConditionType {
+		case data.PointValueExpression:
+			for _, v := range c.Variables {
+				nodeID, _, _ := parseExprVariable(v)
+				if nodeID != "" {
+					ids[nodeID] = true
+				}
+			}
+		case data.PointValueStale:
+			if c.NodeID != "" {
+				ids[c.NodeID] = true
+			}
+		}
+	}
+
+	for _, actions := range [][]Action{rc.config.Actions, rc.config.ActionsInactive} {
+		for _, a := range actions {
+			if a.ConfirmPointType != "" && a.NodeID != "" {
+				ids[a.NodeID] = true
+			}
+		}
+	}
+
+	for id, sub := range rc.nodeSubs {
+		if !ids[id] {
+			err := sub.Unsubscribe()
+			if err != nil {
+				log.Println("Rule error unsubscribing from node:", err)
+			}
+			delete(rc.nodeSubs, id)
+		}
+	}
+
+	for id := range ids {
+		if rc.nodeSubs[id] != nil {
+			continue
+		}
+
+		nodeID := id
+		sub, err := rc.nc.Subscribe(SubjectNodePoints(nodeID), func(msg *nats.Msg) {
+			points, err := data.PbDecodePoints(msg.Data)
+			if err != nil {
+				log.Println("Error decoding points in rule node sub:", err)
+				return
+			}
+
+			select {
+			case rc.newRulePoints <- NewPoints{nodeID, "", points}:
+			case <-rc.stop:
+			}
+		})
+		if err != nil {
+			log.Println("Rule error subscribing to node:", err)
+			continue
+		}
+
+		rc.nodeSubs[nodeID] = sub
+	}
+}
+
+// parseExprVariable parses an expression variable point:
+// nodeID[.pointType[.pointKey]]
+func parseExprVariable(v string) (nodeID, pointType, pointKey string) {
+	chunks := strings.SplitN(v, ".", 3)
+	nodeID = chunks[0]
+	pointType = data.PointTypeValue
+	pointKey = "0"
+	if len(chunks) > 1 && chunks[1] != "" {
+		pointType = chunks[1]
+	}
+	if len(chunks) > 2 && chunks[2] != "" {
+		pointKey = chunks[2]
+	}
+	return
+}
+
+// exprPointMatch returns true if a point is the point referenced by an
+// expression variable. An empty point key is the same as "0".
+func exprPointMatch(p data.Point, pointType, pointKey string) bool {
+	key := p.Key
+	if key == "" {
+		key = "0"
+	}
+	return p.Type == pointType && key == pointKey
+}
+
+// expression returns the compiled expression for a condition, compiling it if
+// the expression or variables changed
+func (rc *RuleClient) expression(c *Condition) *ruleExpression {
+	re := rc.exprs[c.ID]
+	if re != nil && re.src == c.Expression && maps.Equal(re.vars, c.Variables) {
+		return re
+	}
+
+	re = &ruleExpression{
+		src:    c.Expression,
+		vars:   maps.Clone(c.Variables),
+		values: make(map[string]exprValue),
+	}
+
+	names := make(map[string]bool)
+	for name := range c.Variables {
+		names[name] = true
+	}
+
+	re.expr, re.err = compileExpression(c.Expression, names)
+	if re.err == nil && strings.TrimSpace(c.Expression) == "" {
+		re.err = errors.New("expression is empty")
+	}
+
+	rc.exprs[c.ID] = re
+	return re
+}
+
+// exprEvaluate updates the variables of an expression from a point and
+// evaluates the expression. Variables that have not been seen yet are read
+// from the store. ok is false if the point is not used by the expression.
+func (rc *RuleClient) exprEvaluate(re *ruleExpression, nodeID string, p data.Point) (active, ok bool, err error) {
+	for name, v := range re.vars {
+		id, typ, key := parseExprVariable(v)
+		if id == nodeID && exprPointMatch(p, typ, key) {
+			re.values[name] = exprValue{num: p.Value, text: p.Text}
+			ok = true
+		}
+	}
+
+	if !ok && p.Type != data.PointTypeTrigger {
+		return false, false, nil
+	}
+
+	for _, name := range re.expr.vars {
+		if _, found := re.values[name]; found {
+			continue
+		}
+
+		// the current value in the store is not the value at the time
+		// of a backtest, so wait until all variables are replayed
+		if rc.dryRun != nil {
+			return false, true, nil
+		}
+
+		id, typ, key := parseExprVariable(re.vars[name])
+		nodes, err := GetNodes(rc.nc, "all", id, "", false)
+		if err != nil {
+			return false, true, fmt.Errorf("Error getting node for %v: %w", name, err)
+		}
+
+		if len(nodes) < 1 {
+			return false, true, fmt.Errorf("node for %v not found", name)
+		}
+
+		// points that have never been written are zero
+		var value exprValue
+		for _, np := range nodes[0].Points {
+			if exprPointMatch(np, typ, key) {
+				value = exprValue{num: np.Value, text: np.Text}
+			}
+		}
+
+		re.values[name] = value
+	}
+
+	v, err := re.expr.eval(re.values)
+	if err != nil {
+		return false, true, err
+	}
+
+	return v.bool(), true, nil
+}
+
 func (rc *RuleClient) processError(errS string) {
 	if errS != "" {
 		// always set rule error to the last error we encounter
 		if errS != rc.config.Error {
 			p := data.Point{
 				Type: data.PointTypeError,
-				Time: time.Now(),
+				Time: rc.now(),
 				Text: errS,
 			}
 
@@ -388,13 +957,28 @@ func (rc *RuleClient) processError(errS string) {
 		// check if any other errors still exist
 		found := ""
 
-		for _, c := range rc.config.Conditions {
+		for _, c := range rc.conditions() {
 			if c.Error != "" {
 				found = c.Error
 				break
 			}
 		}
 
+		var groupError func(groups []ConditionGroup)
+		groupError = func(groups []ConditionGroup) {
+			for _, g := range groups {
+				if g.Error != "" {
+					found = g.Error
+					return
+				}
+				groupError(g.Groups)
+			}
+		}
+
+		if found == "" {
+			groupError(rc.config.ConditionGroups)
+		}
+
 		for _, a := range rc.config.Actions {
 			if a.Error != "" {
 				found = a.Error
@@ -412,7 +996,7 @@ func (rc *RuleClient) processError(errS string) {
 		if found != rc.config.Error {
 			p := data.Point{
 				Type: data.PointTypeError,
-				Time: time.Now(),
+				Time: rc.now(),
 				Text: found,
 			}
 
@@ -431,18 +1015,45 @@ func (rc *RuleClient) processError(errS string) {
 // Currently, this function only processes the first point that matches -- this should
 // handle all current uses.
 func (rc *RuleClient) ruleProcessPoints(nodeID string, points data.Points) (bool, bool, error) {
+	conditions := rc.conditions()
+
+	trace := &data.RuleTrace{Time: rc.now(), NodeID: nodeID, Points: points}
+	rc.traceEntry = trace
+	rc.traceKeep = false
+
 	for _, p := range points {
-		for i, c := range rc.config.Conditions {
+		for _, c := range conditions {
 			var active bool
 			var errorActive bool
+			var traceValue float64
+			var traceText string
+
+			st := rc.conditionState(c)
+			prevMet, prevActive := st.met, c.Active
+
+			// points used by a condition are traced, while schedule,
+			// delay, and stale triggers are only traced if something
+			// changes
+			traceKeep := func(changed bool) {
+				if changed || p.Type != data.PointTypeTrigger {
+					rc.traceKeep = true
+				}
+			}
 
 			processError := func(err error) {
 				errorActive = true
 				errS := err.Error()
+				trace.Conditions = append(trace.Conditions, data.RuleTraceCondition{
+					ID:          c.ID,
+					Description: c.Description,
+					Active:      c.Active,
+					Error:       errS,
+				})
+				traceKeep(c.Error != errS)
 				if c.Error != errS {
 					p := data.Point{
 						Type: data.PointTypeError,
-						Time: time.Now(),
+						Time: rc.now(),
 						Text: errS,
 					}
 
@@ -451,7 +1062,7 @@ func (rc *RuleClient) ruleProcessPoints(nodeID string, points data.Points) (bool
 					if err != nil {
 						log.Println("Rule error sending point:", err)
 					} else {
-						rc.config.Conditions[i].Error = errS
+						c.Error = errS
 					}
 				}
 				rc.processError(errS)
@@ -474,23 +1085,58 @@ func (rc *RuleClient) ruleProcessPoints(nodeID string, points data.Points) (bool
 				// conditions match, so check value
 				switch c.ValueType {
 				case data.PointValueNumber:
+					value := p.Value
+
+					switch {
+					case c.Signal != "":
+						var ok bool
+						var err error
+						value, ok, err = conditionSignal(c, st, p)
+						if err != nil {
+							processError(err)
+							continue
+						}
+						if !ok {
+							continue
+						}
+					case c.AverageWindow > 0:
+						var ok bool
+						value, ok = rc.conditionAverage(c, st, p)
+						if !ok {
+							continue
+						}
+					}
+
+					traceValue = value
+					off, band := c.offThreshold()
+
 					switch c.Operator {
 					case data.PointValueGreaterThan:
-						active = p.Value > c.Value
+						if band && st.met {
+							active = value >= off
+						} else {
+							active = value > c.Value
+						}
 					case data.PointValueLessThan:
-						active = p.Value < c.Value
+						if band && st.met {
+							active = value <= off
+						} else {
+							active = value < c.Value
+						}
 					case data.PointValueEqual:
-						active = p.Value == c.Value
+						active = math.Abs(value-c.Value) <= c.Deadband
 					case data.PointValueNotEqual:
-						active = p.Value != c.Value
+						active = math.Abs(value-c.Value) > c.Deadband
 					}
 				case data.PointValueText:
+					traceText = p.Text
 					switch c.Operator {
 					case data.PointValueEqual:
 					case data.PointValueNotEqual:
 					case data.PointValueContains:
 					}
 				case data.PointValueOnOff:
+					traceValue = p.Value
 					condValue := c.Value != 0
 					pointValue := p.Value != 0
 					active = condValue == pointValue
@@ -509,35 +1155,98 @@ func (rc *RuleClient) ruleProcessPoints(nodeID string, points data.Points) (bool
 					}
 				}
 				sched := newSchedule(c.Start, c.End, weekdays, c.Dates)
+				sched.cron = c.Cron
+				sched.cronDuration = minutes(c.Duration)
 
 				var err error
+
+				if c.Timezone != "" {
+					sched.location, err = time.LoadLocation(c.Timezone)
+					if err != nil {
+						processError(fmt.Errorf("Error loading timezone: %w", err))
+						continue
+					}
+				}
+
+				if c.Cron == "" && sched.usesSun() {
+					sched.latitude, sched.longitude, err = rc.location()
+					if err != nil {
+						processError(err)
+						continue
+					}
+				}
+
 				active, err = sched.activeForTime(p.Time)
 				if err != nil {
 					processError(fmt.Errorf("Error parsing schedule: %w", err))
 					continue
 				}
-			}
 
-			if active != c.Active {
-				// update condition
-				p := data.Point{
-					Type:  data.PointTypeActive,
-					Time:  time.Now(),
-					Value: data.BoolToFloat(active),
+				if sched.location != nil {
+					traceText = p.Time.In(sched.location).Format(time.RFC3339)
+				} else {
+					traceText = p.Time.UTC().Format(time.RFC3339)
+				}
+			case data.PointValueStale:
+				if (nodeID != c.NodeID || !stalePointMatch(c, p)) &&
+					p.Type != data.PointTypeTrigger {
+					continue
 				}
 
-				err := rc.sendPoint(c.ID, p)
+				var err error
+				active, err = rc.staleActive(c, nodeID, p)
 				if err != nil {
-					log.Println("Rule error sending point:", err)
+					processError(fmt.Errorf("Stale condition error: %w", err))
+					continue
+				}
+
+				traceText = "last update " + st.staleLast.Format(time.RFC3339)
+			case data.PointValueExpression:
+				re := rc.expression(c)
+				if re.err != nil {
+					processError(fmt.Errorf("Error compiling expression: %w", re.err))
+					continue
+				}
+
+				var ok bool
+				var err error
+				active, ok, err = rc.exprEvaluate(re, nodeID, p)
+				if !ok {
+					continue
+				}
+				if err != nil {
+					processError(fmt.Errorf("Error evaluating expression: %w", err))
+					continue
 				}
 
-				rc.config.Conditions[i].Active = active
+				traceText = exprValuesString(re.values)
+			}
+
+			if active != st.met {
+				st.met = active
+				st.since = rc.now()
+			}
+
+			rc.setConditionActive(c, rc.conditionDelay(c, st))
+
+			traceKeep(st.met != prevMet || c.Active != prevActive)
+
+			if !errorActive {
+				st.value, st.text = traceValue, traceText
+				trace.Conditions = append(trace.Conditions, data.RuleTraceCondition{
+					ID:          c.ID,
+					Description: c.Description,
+					Value:       traceValue,
+					Text:        traceText,
+					Met:         st.met,
+					Active:      c.Active,
+				})
 			}
 
 			if !errorActive && c.Error != "" {
 				p := data.Point{
 					Type: data.PointTypeError,
-					Time: time.Now(),
+					Time: rc.now(),
 					Text: "",
 				}
 
@@ -545,28 +1254,41 @@ func (rc *RuleClient) ruleProcessPoints(nodeID string, points data.Points) (bool
 				if err != nil {
 					log.Println("Rule error sending point:", err)
 				} else {
-					rc.config.Conditions[i].Error = ""
+					c.Error = ""
 				}
 				rc.processError("")
 			}
 		}
 	}
 
-	allActive := true
-
-	for _, c := range rc.config.Conditions {
-		if !c.Active {
-			allActive = false
-			break
+	// activate or clear conditions whose delay has expired
+	for _, c := range conditions {
+		st := rc.condStates[c.ID]
+		if st != nil {
+			prevActive := c.Active
+			rc.setConditionActive(c, rc.conditionDelay(c, st))
+			if c.Active != prevActive {
+				rc.traceKeep = true
+				trace.Conditions = append(trace.Conditions, data.RuleTraceCondition{
+					ID:          c.ID,
+					Description: c.Description,
+					Text:        "delay expired",
+					Met:         st.met,
+					Active:      c.Active,
+				})
+			}
 		}
 	}
 
+	allActive := rc.groupActive(data.PointValueAnd, rc.config.Conditions,
+		rc.config.ConditionGroups)
+
 	changed := false
 
 	if allActive != rc.config.Active {
 		p := data.Point{
 			Type:  data.PointTypeActive,
-			Time:  time.Now(),
+			Time:  rc.now(),
 			Value: data.BoolToFloat(allActive),
 		}
 
@@ -579,156 +1301,566 @@ func (rc *RuleClient) ruleProcessPoints(nodeID string, points data.Points) (bool
 		rc.config.Active = allActive
 	}
 
+	trace.Active = allActive
+	trace.Changed = changed
+	if changed {
+		rc.traceKeep = true
+	}
+
 	return allActive, changed, nil
 }
 
-// ruleRunActions runs rule actions
-func (rc *RuleClient) ruleRunActions(actions []Action, triggerNodeID string) error {
-	for i, a := range actions {
-		errorActive := false
+// conditionState returns the state of a condition
+func (rc *RuleClient) conditionState(c *Condition) *conditionState {
+	st := rc.condStates[c.ID]
+	if st == nil {
+		st = &conditionState{met: c.Active, since: rc.now()}
+		rc.condStates[c.ID] = st
+	}
+	return st
+}
 
-		processError := func(err error) {
-			errorActive = true
-			errS := err.Error()
-			if a.Error != errS {
-				p := data.Point{
-					Type: data.PointTypeError,
-					Time: time.Now(),
-					Text: errS,
-				}
+// conditionAverage feeds a point into the condition averager, and returns the
+// average if the averaging window has expired.
+func (rc *RuleClient) conditionAverage(c *Condition, st *conditionState, p data.Point) (float64, bool) {
+	if st.avg == nil || st.avgWindow != c.AverageWindow {
+		st.avgWindow = c.AverageWindow
+		st.avg = data.NewTimeWindowAverager(minutes(c.AverageWindow),
+			func(avg data.Point) {
+				st.avgValue = avg.Value
+				st.avgReady = true
+			}, p.Type)
+	}
 
-				log.Printf("Rule action error %v:%v:%v\n", rc.config.Description, a.Description, err)
-				err := rc.sendPoint(a.ID, p)
-				if err != nil {
-					log.Println("Rule error sending point:", err)
-				} else {
-					actions[i].Error = errS
-				}
-			}
-			rc.processError(errS)
+	st.avgReady = false
+	st.avg.NewPoint(p)
+
+	return st.avgValue, st.avgReady
+}
+
+// conditionSignal adds a point to the condition time window, and returns the
+// signal calculated over the window. false is returned if the signal can't be
+// calculated yet.
+func conditionSignal(c *Condition, st *conditionState, p data.Point) (float64, bool, error) {
+	if c.Window <= 0 {
+		return 0, false, errors.New("signal window must be set")
+	}
+
+	if st.stats == nil || st.statsWindow != c.Window {
+		st.statsWindow = c.Window
+		st.stats = data.NewTimeWindowStats(minutes(c.Window))
+	}
+
+	st.stats.NewPoint(p)
+
+	switch c.Signal {
+	case data.PointValueRate:
+		rate, ok := st.stats.Rate()
+		return rate, ok, nil
+	case data.PointValueMin:
+		return st.stats.Min(), true, nil
+	case data.PointValueMax:
+		return st.stats.Max(), true, nil
+	case data.PointValueAverage:
+		return st.stats.Average(), true, nil
+	case data.PointValueStdDev:
+		return st.stats.StdDev(), true, nil
+	default:
+		return 0, false, fmt.Errorf("unknown signal: %v", c.Signal)
+	}
+}
+
+// conditionDelay applies MinActive and ClearDelay and returns the condition
+// active state. The delay timer is armed if the condition is waiting for a
+// delay to expire.
+func (rc *RuleClient) conditionDelay(c *Condition, st *conditionState) bool {
+	if st.met == c.Active {
+		return c.Active
+	}
+
+	delay := c.ClearDelay
+	if st.met {
+		delay = c.MinActive
+	}
+
+	at := st.since.Add(minutes(delay))
+	if !rc.now().Before(at) {
+		return st.met
+	}
+
+	rc.armDelayTimer(at)
+
+	return c.Active
+}
+
+// location returns the latitude and longitude of the rule, or of the first
+// parent node that has a location
+func (rc *RuleClient) location() (float64, float64, error) {
+	if rc.config.Latitude != 0 || rc.config.Longitude != 0 {
+		return rc.config.Latitude, rc.config.Longitude, nil
+	}
+
+	if rc.parentLocation != nil {
+		return rc.parentLocation[0], rc.parentLocation[1], nil
+	}
+
+	id := rc.config.Parent
+
+	for id != "" && id != "none" {
+		nodes, err := GetNodes(rc.nc, "all", id, "", false)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Error getting parent location: %w", err)
 		}
 
-		switch a.Action {
-		case data.PointValueSetValue:
-			if a.NodeID == "" {
-				processError(fmt.Errorf("Error, node action nodeID must be set"))
-				break
-			}
+		if len(nodes) < 1 {
+			break
+		}
 
-			if a.PointType == "" {
-				processError(fmt.Errorf("Error, node action point type must be set"))
-				break
+		lat, latOk := nodes[0].Points.Value(data.PointTypeLatitude, "")
+		long, longOk := nodes[0].Points.Value(data.PointTypeLongitude, "")
+		if latOk || longOk {
+			rc.parentLocation = []float64{lat, long}
+			return lat, long, nil
+		}
+
+		id = nodes[0].Parent
+	}
+
+	return 0, 0, errors.New("latitude/longitude not set on rule or parent nodes")
+}
+
+// armDelayTimer makes sure the delay timer fires at or before at
+func (rc *RuleClient) armDelayTimer(at time.Time) {
+	if rc.delayAt.IsZero() || at.Before(rc.delayAt) {
+		rc.delayAt = at
+		if rc.dryRun == nil {
+			rc.delayTimer.Reset(time.Until(at))
+		}
+	}
+}
+
+// stalePointMatch returns true if a point is watched by a stale condition. If
+// the condition point type is not set, all points of the node are watched.
+func stalePointMatch(c *Condition, p data.Point) bool {
+	if c.PointType == "" {
+		return true
+	}
+
+	if c.PointKey != "" && c.PointKey != p.Key {
+		return false
+	}
+
+	return c.PointType == p.Type
+}
+
+// staleUpdate records the time of a watched point
+func staleUpdate(st *conditionState, p data.Point) {
+	t := p.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	if t.After(st.staleLast) {
+		st.staleLast = t
+		st.staleText = p.Text
+	}
+}
+
+// staleActive returns true if a stale condition is active. If the condition is
+// not stale yet, the delay timer is armed to check it again when it would
+// become stale.
+func (rc *RuleClient) staleActive(c *Condition, nodeID string, p data.Point) (bool, error) {
+	if c.NodeID == "" {
+		return false, errors.New("node ID must be set")
+	}
+
+	if c.StaleTime <= 0 {
+		return false, errors.New("stale time must be set")
+	}
+
+	st := rc.conditionState(c)
+
+	// a backtest assumes the point was updated when the backtest starts
+	if !st.staleLoaded && rc.dryRun != nil {
+		st.staleLast = rc.dryRun.start
+		st.staleLoaded = true
+	}
+
+	if !st.staleLoaded {
+		nodes, err := GetNodes(rc.nc, "all", c.NodeID, "", false)
+		if err != nil {
+			return false, fmt.Errorf("Error getting node: %w", err)
+		}
+
+		if len(nodes) < 1 {
+			return false, errors.New("node not found")
+		}
+
+		for _, np := range nodes[0].Points {
+			if stalePointMatch(c, np) {
+				staleUpdate(st, np)
 			}
+		}
+
+		st.staleLoaded = true
+	}
+
+	if nodeID == c.NodeID && stalePointMatch(c, p) {
+		staleUpdate(st, p)
+	}
+
+	if c.PointType == data.PointTypeSysState {
+		switch st.staleText {
+		case data.PointValueSysStateOffline, data.PointValueSysStatePowerOff:
+			return true, nil
+		}
+	}
+
+	at := st.staleLast.Add(minutes(c.StaleTime))
+	if rc.now().Before(at) {
+		rc.armDelayTimer(at)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// setConditionActive updates the condition active point
+func (rc *RuleClient) setConditionActive(c *Condition, active bool) {
+	if active == c.Active {
+		return
+	}
+
+	p := data.Point{
+		Type:  data.PointTypeActive,
+		Time:  rc.now(),
+		Value: data.BoolToFloat(active),
+	}
+
+	err := rc.sendPoint(c.ID, p)
+	if err != nil {
+		log.Println("Rule error sending point:", err)
+	}
+
+	c.Active = active
+}
+
+func minutes(m float64) time.Duration {
+	return time.Duration(m * float64(time.Minute))
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// groupActive combines the active state of conditions and condition groups
+// with an operator, and updates the active and error points of the groups.
+func (rc *RuleClient) groupActive(op string, conds []Condition, groups []ConditionGroup) bool {
+	var actives []bool
+
+	for _, c := range conds {
+		actives = append(actives, c.Active)
+	}
+
+	for i := range groups {
+		g := &groups[i]
+
+		errS := ""
+		active := rc.groupActive(g.Operator, g.Conditions, g.Groups)
+
+		switch g.Operator {
+		case "", data.PointValueAnd, data.PointValueOr, data.PointValueNot:
+		default:
+			errS = fmt.Sprintf("unknown condition group operator: %v", g.Operator)
+			active = false
+		}
 
+		if errS != g.Error {
 			p := data.Point{
-				Time:   time.Now(),
-				Type:   a.PointType,
-				Value:  a.Value,
-				Text:   a.ValueText,
-				Origin: a.ID,
+				Type: data.PointTypeError,
+				Time: rc.now(),
+				Text: errS,
 			}
-			err := rc.sendPoint(a.NodeID, p)
+
+			err := rc.sendPoint(g.ID, p)
 			if err != nil {
-				log.Println("Error sending rule action point:", err)
+				log.Println("Rule error sending point:", err)
+			} else {
+				g.Error = errS
 			}
-		case data.PointValueNotify:
-			// get node that fired the rule
-			nodes, err := GetNodes(rc.nc, "none", triggerNodeID, "", false)
-			if err != nil {
-				processError(err)
-				break
+			rc.processError(errS)
+		}
+
+		if active != g.Active {
+			p := data.Point{
+				Type:  data.PointTypeActive,
+				Time:  rc.now(),
+				Value: data.BoolToFloat(active),
 			}
 
-			if len(nodes) < 1 {
-				processError(fmt.Errorf("trigger node not found"))
-				break
+			err := rc.sendPoint(g.ID, p)
+			if err != nil {
+				log.Println("Rule error sending point:", err)
 			}
 
-			triggerNode := nodes[0]
+			g.Active = active
+		}
 
-			triggerNodeDesc := triggerNode.Desc()
+		actives = append(actives, active)
+	}
 
-			n := data.Notification{
-				ID:         uuid.New().String(),
-				SourceNode: a.NodeID,
-				Message:    rc.config.Description + " fired at " + triggerNodeDesc,
+	switch op {
+	case data.PointValueOr:
+		for _, a := range actives {
+			if a {
+				return true
+			}
+		}
+		return false
+	case data.PointValueNot:
+		for _, a := range actives {
+			if a {
+				return false
 			}
+		}
+		return true
+	default:
+		for _, a := range actives {
+			if !a {
+				return false
+			}
+		}
+		return true
+	}
+}
 
-			// TODO this notify code needs to be reworked
-			d, err := n.ToPb()
+// ruleRunActions runs rule actions in order of Index. triggerPoints are the
+// points from triggerNodeID that changed the rule state. Pending steps from an
+// earlier run of the actions are cancelled.
+func (rc *RuleClient) ruleRunActions(actions []Action, triggerNodeID string, triggerPoints data.Points) error {
+	if rc.dryRun != nil {
+		for i, a := range actions {
+			rc.dryRun.action(a)
+			actions[i].Active = true
+		}
+		return nil
+	}
 
-			if err != nil {
-				return err
-			}
+	rc.cancelActions(actions)
 
-			err = rc.nc.Publish("node."+rc.config.ID+".not", d)
+	return rc.runActionSteps(actionOrder(actions), triggerNodeID, triggerPoints)
+}
 
-			if err != nil {
-				return err
+// runAction runs an action now
+func (rc *RuleClient) runAction(a *Action, triggerNodeID string, triggerPoints data.Points) error {
+	errorActive := false
+	// the result of actions that run in the background is sent to
+	// the Run loop
+	background := false
+	var actionPoint *data.Point
+
+	processError := func(err error) {
+		errorActive = true
+		errS := err.Error()
+		if a.Error != errS {
+			p := data.Point{
+				Type: data.PointTypeError,
+				Time: rc.now(),
+				Text: errS,
 			}
-		case data.PointValuePlayAudio:
-			f, err := os.Open(a.PointFilePath)
+
+			log.Printf("Rule action error %v:%v:%v\n", rc.config.Description, a.Description, err)
+			err := rc.sendPoint(a.ID, p)
 			if err != nil {
-				log.Fatal(err)
+				log.Println("Rule error sending point:", err)
+			} else {
+				a.Error = errS
 			}
-			defer f.Close()
+		}
+		rc.processError(errS)
+	}
 
-			d := wav.NewDecoder(f)
-			d.ReadInfo()
+	switch a.Action {
+	case data.PointValueSetValue:
+		if a.NodeID == "" {
+			processError(fmt.Errorf("Error, node action nodeID must be set"))
+			break
+		}
 
-			format := d.Format()
+		if a.PointType == "" {
+			processError(fmt.Errorf("Error, node action point type must be set"))
+			break
+		}
 
-			if format.SampleRate < 8000 {
-				log.Println("Rule action: invalid wave file sample rate:", format.SampleRate)
-				continue
+		if a.Ramp > 0 {
+			err := rc.startRamp(a)
+			if err != nil {
+				processError(err)
 			}
-
-			channelNum := strconv.Itoa(a.PointChannel)
-			sampleRate := strconv.Itoa(format.SampleRate)
-
-			go func() {
-				stderr, err := exec.Command("speaker-test", "-D"+a.PointDevice, "-twav", "-w"+a.PointFilePath, "-c5", "-s"+channelNum, "-r"+sampleRate).CombinedOutput()
-				if err != nil {
-					log.Println("Play audio error:", err)
-					log.Printf("Audio stderr: %s\n", stderr)
-				}
-			}()
-		default:
-			processError(fmt.Errorf("Uknown rule action: %v", a.Action))
+			break
 		}
 
 		p := data.Point{
-			Type:  data.PointTypeActive,
-			Value: 1,
+			Time:   rc.now(),
+			Type:   a.PointType,
+			Value:  a.Value,
+			Text:   a.ValueText,
+			Origin: a.ID,
 		}
-		err := rc.sendPoint(a.ID, p)
+		actionPoint = &p
+		err := rc.sendPoint(a.NodeID, p)
 		if err != nil {
 			log.Println("Error sending rule action point:", err)
 		}
 
-		actions[i].Active = true
+		if a.Pulse > 0 {
+			rc.startPulse(a)
+		}
+	case data.PointValueNotify:
+		err := rc.notify(a, triggerNodeID, triggerPoints)
+		if err != nil {
+			processError(err)
+		}
+	case data.PointValuePlayAudio:
+		f, err := os.Open(a.PointFilePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
 
-		if !errorActive && a.Error != "" {
-			p := data.Point{
-				Type: data.PointTypeError,
-				Time: time.Now(),
-				Text: "",
+		d := wav.NewDecoder(f)
+		d.ReadInfo()
+
+		format := d.Format()
+
+		if format.SampleRate < 8000 {
+			log.Println("Rule action: invalid wave file sample rate:", format.SampleRate)
+			return nil
+		}
+
+		channelNum := strconv.Itoa(a.PointChannel)
+		sampleRate := strconv.Itoa(format.SampleRate)
+
+		// the config may be merged while audio plays
+		device, filePath := a.PointDevice, a.PointFilePath
+
+		go func() {
+			stderr, err := exec.Command("speaker-test", "-D"+device, "-twav", "-w"+filePath, "-c5", "-s"+channelNum, "-r"+sampleRate).CombinedOutput()
+			if err != nil {
+				log.Println("Play audio error:", err)
+				log.Printf("Audio stderr: %s\n", stderr)
 			}
+		}()
+	case data.PointValueWebhook:
+		if a.URL == "" {
+			processError(fmt.Errorf("Error, webhook action url must be set"))
+			break
+		}
 
-			err := rc.sendPoint(a.ID, p)
+		body, err := renderActionTemplate(a.Template,
+			rc.actionTemplateData(triggerNodeID, triggerPoints))
+		if err != nil {
+			processError(fmt.Errorf("Error rendering webhook template: %w", err))
+			break
+		}
+
+		rc.runWebhook(*a, body)
+		background = true
+	case data.PointValuePublish:
+		if a.Subject == "" {
+			processError(fmt.Errorf("Error, publish action subject must be set"))
+			break
+		}
+
+		if !strings.HasPrefix(a.Subject, rc.options.RulePublishPrefix) {
+			processError(fmt.Errorf("Error, publish action subject must start with %v",
+				rc.options.RulePublishPrefix))
+			break
+		}
+
+		msg, err := renderActionTemplate(a.Template,
+			rc.actionTemplateData(triggerNodeID, triggerPoints))
+		if err != nil {
+			processError(fmt.Errorf("Error rendering publish template: %w", err))
+			break
+		}
+
+		err = rc.nc.Publish(a.Subject, []byte(msg))
+		if err != nil {
+			processError(fmt.Errorf("Error publishing: %w", err))
+		}
+	case data.PointValueCommand:
+		if a.Command == "" {
+			processError(fmt.Errorf("Error, command action command must be set"))
+			break
+		}
+
+		if !slices.Contains(rc.options.RuleCommands, a.Command) {
+			processError(fmt.Errorf("Error, command is not allowed: %v", a.Command))
+			break
+		}
+
+		td := rc.actionTemplateData(triggerNodeID, triggerPoints)
+
+		var args []string
+		var err error
+		for _, arg := range a.Args {
+			var v string
+			v, err = renderActionTemplate(arg, td)
 			if err != nil {
-				log.Println("Rule error sending point:", err)
-			} else {
-				actions[i].Error = ""
+				break
 			}
-			rc.processError("")
+			args = append(args, v)
+		}
+
+		if err != nil {
+			processError(fmt.Errorf("Error rendering command argument: %w", err))
+			break
+		}
+
+		rc.runCommand(*a, args)
+		background = true
+	default:
+		processError(fmt.Errorf("Uknown rule action: %v", a.Action))
+	}
+
+	p := data.Point{
+		Type:  data.PointTypeActive,
+		Value: 1,
+	}
+	err := rc.sendPoint(a.ID, p)
+	if err != nil {
+		log.Println("Error sending rule action point:", err)
+	}
+
+	a.Active = true
+
+	if !errorActive && !background && a.Error != "" {
+		p := data.Point{
+			Type: data.PointTypeError,
+			Time: rc.now(),
+			Text: "",
 		}
 
+		err := rc.sendPoint(a.ID, p)
+		if err != nil {
+			log.Println("Rule error sending point:", err)
+		} else {
+			a.Error = ""
+		}
+		rc.processError("")
 	}
+
+	rc.traceAction(*a, actionPoint)
+
 	return nil
 }
 
+// ruleInactiveActions clears the active state of actions and cancels their
+// pending steps
 func (rc *RuleClient) ruleInactiveActions(actions []Action) error {
+	rc.cancelActions(actions)
+
 	for i, a := range actions {
 		p := data.Point{
 			Type:  data.PointTypeActive,
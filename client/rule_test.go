@@ -1,9 +1,16 @@
 package client_test
 
 import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/nats-io/nats.go"
 	"github.com/simpleiot/simpleiot/client"
 	"github.com/simpleiot/simpleiot/data"
 	"github.com/simpleiot/simpleiot/server"
@@ -161,3 +168,1362 @@ func TestRules(t *testing.T) {
 		<-time.After(time.Millisecond * 10)
 	}
 }
+
+// TestRuleExpression tests an expression condition that uses points from
+// nodes inside and outside of the rule parent.
+func TestRuleExpression(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	// the rule and supply/pump variables are in a group, the return variable
+	// is outside of the rule parent
+	err = client.SendNode(nc, data.NodeEdge{ID: "ID-group", Type: data.NodeTypeGroup,
+		Parent: root.ID}, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	vars := []client.Variable{
+		{ID: "ID-supply", Parent: "ID-group", Description: "supply", Value: 70},
+		{ID: "ID-return", Parent: root.ID, Description: "return", Value: 68},
+		{ID: "ID-pump", Parent: "ID-group", Description: "pump", Value: 1},
+		{ID: "ID-varout", Parent: root.ID, Description: "var out"},
+	}
+
+	for _, v := range vars {
+		err = client.SendNodeType(nc, v, "test")
+		if err != nil {
+			t.Fatal("Error sending node: ", err)
+		}
+	}
+
+	r := client.Rule{
+		ID:          "ID-rule",
+		Parent:      "ID-group",
+		Description: "test rule",
+	}
+
+	err = client.SendNodeType(nc, r, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	c := client.Condition{
+		ID:            "ID-condition",
+		Parent:        r.ID,
+		Description:   "temp delta",
+		ConditionType: data.PointValueExpression,
+		Expression:    "supplyTemp - returnTemp > 5 && pumpOn",
+		Variables: map[string]string{
+			"supplyTemp": "ID-supply",
+			"returnTemp": "ID-return.value",
+			"pumpOn":     "ID-pump",
+		},
+	}
+
+	err = client.SendNodeType(nc, c, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	a := client.Action{
+		ID:          "ID-action-active",
+		Parent:      r.ID,
+		Description: "action active",
+		Action:      data.PointValueSetValue,
+		PointType:   data.PointTypeValue,
+		NodeID:      "ID-varout",
+		Value:       1,
+	}
+
+	err = client.SendNodeType(nc, a, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	voutGet, voutStop, err := client.NodeWatcher[client.Variable](nc, "ID-varout", root.ID)
+	if err != nil {
+		t.Fatal("Error setting up watcher")
+	}
+	defer voutStop()
+
+	condGet, condStop, err := client.NodeWatcher[client.Condition](nc, c.ID, c.Parent)
+	if err != nil {
+		t.Fatal("Error setting up watcher")
+	}
+	defer condStop()
+
+	waitFor := func(desc string, f func() bool) {
+		start := time.Now()
+		for !f() {
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("Timeout waiting for ", desc)
+			}
+			<-time.After(time.Millisecond * 10)
+		}
+	}
+
+	// wait for rule to get set up
+	waitFor("rule to start", func() bool {
+		nodes, err := client.GetNodes(nc, r.Parent, r.ID, "", false)
+		if err != nil || len(nodes) < 1 {
+			t.Fatal("Error getting rule: ", err)
+		}
+		state, _ := nodes[0].Points.Text(data.PointTypeClientState, "")
+		return state == data.PointValueClientStateRunning
+	})
+
+	if voutGet().Value != 0 {
+		t.Fatal("rule should not be active")
+	}
+
+	// lower the return temp, which is outside the rule parent
+	err = client.SendNodePoint(nc, "ID-return", data.Point{Type: data.PointTypeValue,
+		Value: 60, Origin: "test"}, true)
+	if err != nil {
+		t.Fatal("Error sending point: ", err)
+	}
+
+	waitFor("vout to be set", func() bool { return voutGet().Value == 1 })
+
+	// a compile error is reported on the condition
+	err = client.SendNodePoint(nc, c.ID, data.Point{Type: data.PointTypeExpression,
+		Text: "supplyTemp - > 5", Origin: "test"}, true)
+	if err != nil {
+		t.Fatal("Error sending point: ", err)
+	}
+
+	waitFor("condition error", func() bool { return condGet().Error != "" })
+
+	// and cleared when fixed
+	err = client.SendNodePoint(nc, c.ID, data.Point{Type: data.PointTypeExpression,
+		Text: "supplyTemp - returnTemp > 5", Origin: "test"}, true)
+	if err != nil {
+		t.Fatal("Error sending point: ", err)
+	}
+
+	waitFor("condition error to clear", func() bool { return condGet().Error == "" })
+}
+
+// TestRuleConditionGroups tests the rule
+// (tank high OR pump fault) AND NOT maintenance.
+func TestRuleConditionGroups(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	vars := []client.Variable{
+		{ID: "ID-tank", Parent: root.ID, Description: "tank high"},
+		{ID: "ID-fault", Parent: root.ID, Description: "pump fault"},
+		{ID: "ID-maint", Parent: root.ID, Description: "maintenance"},
+		{ID: "ID-varout", Parent: root.ID, Description: "var out"},
+	}
+
+	for _, v := range vars {
+		err = client.SendNodeType(nc, v, "test")
+		if err != nil {
+			t.Fatal("Error sending node: ", err)
+		}
+	}
+
+	r := client.Rule{
+		ID:          "ID-rule",
+		Parent:      root.ID,
+		Description: "test rule",
+	}
+
+	err = client.SendNodeType(nc, r, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	groups := []client.ConditionGroup{
+		{ID: "ID-or", Parent: r.ID, Operator: data.PointValueOr},
+		{ID: "ID-not", Parent: r.ID, Operator: data.PointValueNot},
+	}
+
+	for _, g := range groups {
+		err = client.SendNodeType(nc, g, "test")
+		if err != nil {
+			t.Fatal("Error sending node: ", err)
+		}
+	}
+
+	conds := []client.Condition{
+		{ID: "ID-cond-tank", Parent: "ID-or", NodeID: "ID-tank"},
+		{ID: "ID-cond-fault", Parent: "ID-or", NodeID: "ID-fault"},
+		{ID: "ID-cond-maint", Parent: "ID-not", NodeID: "ID-maint"},
+	}
+
+	for _, c := range conds {
+		c.ConditionType = data.PointValuePointValue
+		c.PointType = data.PointTypeValue
+		c.ValueType = data.PointValueOnOff
+		c.Operator = data.PointValueEqual
+		c.Value = 1
+
+		err = client.SendNodeType(nc, c, "test")
+		if err != nil {
+			t.Fatal("Error sending node: ", err)
+		}
+	}
+
+	a := client.Action{
+		ID:          "ID-action-active",
+		Parent:      r.ID,
+		Description: "action active",
+		Action:      data.PointValueSetValue,
+		PointType:   data.PointTypeValue,
+		NodeID:      "ID-varout",
+		Value:       1,
+	}
+
+	err = client.SendNodeType(nc, a, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	a2 := client.ActionInactive{
+		ID:          "ID-action-inactive",
+		Parent:      r.ID,
+		Description: "action inactive",
+		Action:      data.PointValueSetValue,
+		PointType:   data.PointTypeValue,
+		NodeID:      "ID-varout",
+		Value:       0,
+	}
+
+	err = client.SendNodeType(nc, a2, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	voutGet, voutStop, err := client.NodeWatcher[client.Variable](nc, "ID-varout", root.ID)
+	if err != nil {
+		t.Fatal("Error setting up watcher")
+	}
+	defer voutStop()
+
+	// wait for rule to get set up
+	time.Sleep(250 * time.Millisecond)
+
+	set := func(id string, value float64) {
+		err := client.SendNodePoint(nc, id, data.Point{Type: data.PointTypeValue,
+			Value: value, Origin: "test"}, true)
+		if err != nil {
+			t.Fatal("Error sending point: ", err)
+		}
+	}
+
+	waitFor := func(value float64) {
+		start := time.Now()
+		for voutGet().Value != value {
+			if time.Since(start) > time.Second {
+				t.Fatal("Timeout waiting for vout: ", value)
+			}
+			<-time.After(time.Millisecond * 10)
+		}
+	}
+
+	set("ID-fault", 1)
+	waitFor(1)
+
+	set("ID-maint", 1)
+	waitFor(0)
+
+	set("ID-fault", 0)
+	set("ID-tank", 1)
+	set("ID-maint", 0)
+	waitFor(1)
+
+	set("ID-tank", 0)
+	waitFor(0)
+}
+
+// TestRuleHysteresis tests a number condition with separate on/off thresholds,
+// min active time, and clear delay.
+func TestRuleHysteresis(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	vin := client.Variable{ID: "ID-temp", Parent: root.ID, Description: "temp"}
+
+	err = client.SendNodeType(nc, vin, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	r := client.Rule{
+		ID:          "ID-rule",
+		Parent:      root.ID,
+		Description: "test rule",
+	}
+
+	err = client.SendNodeType(nc, r, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	// 200ms
+	delay := 0.2 / 60
+
+	c := client.Condition{
+		ID:            "ID-condition",
+		Parent:        r.ID,
+		Description:   "temp high",
+		ConditionType: data.PointValuePointValue,
+		NodeID:        vin.ID,
+		PointType:     data.PointTypeValue,
+		ValueType:     data.PointValueNumber,
+		Operator:      data.PointValueGreaterThan,
+		Value:         20,
+		Hysteresis:    true,
+		ValueOff:      18,
+		MinActive:     delay,
+		ClearDelay:    delay,
+	}
+
+	err = client.SendNodeType(nc, c, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	condGet, condStop, err := client.NodeWatcher[client.Condition](nc, c.ID, c.Parent)
+	if err != nil {
+		t.Fatal("Error setting up watcher")
+	}
+	defer condStop()
+
+	// wait for rule to get set up
+	time.Sleep(250 * time.Millisecond)
+
+	set := func(value float64) {
+		err := client.SendNodePoint(nc, vin.ID, data.Point{Type: data.PointTypeValue,
+			Value: value, Origin: "test"}, true)
+		if err != nil {
+			t.Fatal("Error sending point: ", err)
+		}
+	}
+
+	// check the condition does not change before the delay, and changes
+	// after the delay
+	check := func(active bool) {
+		start := time.Now()
+		time.Sleep(100 * time.Millisecond)
+		if condGet().Active == active {
+			t.Fatal("condition changed before delay: ", active)
+		}
+		for condGet().Active != active {
+			if time.Since(start) > time.Second {
+				t.Fatal("Timeout waiting for condition: ", active)
+			}
+			<-time.After(time.Millisecond * 10)
+		}
+	}
+
+	set(21)
+	check(true)
+
+	// stays active between the thresholds
+	set(19)
+	time.Sleep(400 * time.Millisecond)
+	if !condGet().Active {
+		t.Fatal("condition cleared above off threshold")
+	}
+
+	set(17)
+	check(false)
+
+	// does not activate between the thresholds
+	set(19)
+	time.Sleep(400 * time.Millisecond)
+	if condGet().Active {
+		t.Fatal("condition set below on threshold")
+	}
+
+	// a short pulse does not activate the condition
+	set(21)
+	time.Sleep(50 * time.Millisecond)
+	set(17)
+	time.Sleep(400 * time.Millisecond)
+	if condGet().Active {
+		t.Fatal("condition set by short pulse")
+	}
+}
+
+// TestRuleStale tests a condition that goes active when a node stops sending
+// points, or reports it is offline.
+func TestRuleStale(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	vin := client.Variable{ID: "ID-probe", Parent: root.ID, Description: "probe"}
+
+	err = client.SendNodeType(nc, vin, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	r := client.Rule{
+		ID:          "ID-rule",
+		Parent:      root.ID,
+		Description: "test rule",
+	}
+
+	err = client.SendNodeType(nc, r, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	conds := []client.Condition{
+		{
+			ID:            "ID-cond-value",
+			Parent:        r.ID,
+			Description:   "value stale",
+			ConditionType: data.PointValueStale,
+			NodeID:        vin.ID,
+			PointType:     data.PointTypeValue,
+			// 300ms
+			StaleTime: 0.3 / 60,
+		},
+		{
+			ID:            "ID-cond-state",
+			Parent:        r.ID,
+			Description:   "probe offline",
+			ConditionType: data.PointValueStale,
+			NodeID:        vin.ID,
+			PointType:     data.PointTypeSysState,
+			StaleTime:     1,
+		},
+	}
+
+	for _, c := range conds {
+		err = client.SendNodeType(nc, c, "test")
+		if err != nil {
+			t.Fatal("Error sending node: ", err)
+		}
+	}
+
+	valueGet, valueStop, err := client.NodeWatcher[client.Condition](nc, conds[0].ID, r.ID)
+	if err != nil {
+		t.Fatal("Error setting up watcher")
+	}
+	defer valueStop()
+
+	stateGet, stateStop, err := client.NodeWatcher[client.Condition](nc, conds[1].ID, r.ID)
+	if err != nil {
+		t.Fatal("Error setting up watcher")
+	}
+	defer stateStop()
+
+	send := func(p data.Point) {
+		p.Time = time.Now()
+		p.Origin = "test"
+		err := client.SendNodePoint(nc, vin.ID, p, true)
+		if err != nil {
+			t.Fatal("Error sending point: ", err)
+		}
+	}
+
+	waitFor := func(desc string, f func() bool) {
+		start := time.Now()
+		for !f() {
+			if time.Since(start) > time.Second {
+				t.Fatal("Timeout waiting for ", desc)
+			}
+			<-time.After(time.Millisecond * 10)
+		}
+	}
+
+	// the probe has never sent a value, so it is stale
+	waitFor("initial stale", func() bool { return valueGet().Active })
+
+	// keep sending values faster than the stale time
+	start := time.Now()
+	send(data.Point{Type: data.PointTypeValue, Value: 1})
+	waitFor("value fresh", func() bool { return !valueGet().Active })
+
+	for time.Since(start) < 600*time.Millisecond {
+		send(data.Point{Type: data.PointTypeValue, Value: 1})
+		time.Sleep(100 * time.Millisecond)
+		if valueGet().Active {
+			t.Fatal("condition active while receiving values")
+		}
+	}
+
+	// stop sending and the condition goes active
+	waitFor("value stale", func() bool { return valueGet().Active })
+
+	// sysState
+	send(data.Point{Type: data.PointTypeSysState, Text: data.PointValueSysStateOnline})
+	waitFor("state online", func() bool { return !stateGet().Active })
+
+	send(data.Point{Type: data.PointTypeSysState, Text: data.PointValueSysStateOffline})
+	waitFor("state offline", func() bool { return stateGet().Active })
+}
+
+// TestRuleRateOfChange tests a condition on the rate of change of a point
+func TestRuleRateOfChange(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	vin := client.Variable{ID: "ID-level", Parent: root.ID, Description: "tank level"}
+
+	err = client.SendNodeType(nc, vin, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	r := client.Rule{
+		ID:          "ID-rule",
+		Parent:      root.ID,
+		Description: "test rule",
+	}
+
+	err = client.SendNodeType(nc, r, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	c := client.Condition{
+		ID:            "ID-condition",
+		Parent:        r.ID,
+		Description:   "level rising fast",
+		ConditionType: data.PointValuePointValue,
+		NodeID:        vin.ID,
+		PointType:     data.PointTypeValue,
+		ValueType:     data.PointValueNumber,
+		Operator:      data.PointValueGreaterThan,
+		Value:         5,
+		Signal:        data.PointValueRate,
+		Window:        5,
+	}
+
+	err = client.SendNodeType(nc, c, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	condGet, condStop, err := client.NodeWatcher[client.Condition](nc, c.ID, c.Parent)
+	if err != nil {
+		t.Fatal("Error setting up watcher")
+	}
+	defer condStop()
+
+	// wait for rule to get set up
+	time.Sleep(250 * time.Millisecond)
+
+	now := time.Now()
+
+	send := func(minutesAgo int, value float64) {
+		err := client.SendNodePoint(nc, vin.ID, data.Point{Type: data.PointTypeValue,
+			Time:  now.Add(-time.Duration(minutesAgo) * time.Minute),
+			Value: value, Origin: "test"}, true)
+		if err != nil {
+			t.Fatal("Error sending point: ", err)
+		}
+	}
+
+	send(4, 50)
+	send(3, 50)
+	send(2, 50)
+
+	time.Sleep(100 * time.Millisecond)
+	if condGet().Active {
+		t.Fatal("condition active for a steady level")
+	}
+
+	// rate of the last 5 points is 7/minute
+	send(1, 60)
+	send(0, 80)
+
+	start := time.Now()
+	for !condGet().Active {
+		if time.Since(start) > time.Second {
+			t.Fatal("Timeout waiting for condition")
+		}
+		<-time.After(time.Millisecond * 10)
+	}
+}
+
+// TestRuleBacktest replays history from a fake history node through a rule
+// and checks the rule events and that no actions were run
+func TestRuleBacktest(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	vin := client.Variable{ID: "ID-temp", Parent: root.ID, Description: "temp"}
+	vout := client.Variable{ID: "ID-fan", Parent: root.ID, Description: "fan"}
+
+	for _, v := range []client.Variable{vin, vout} {
+		err = client.SendNodeType(nc, v, "test")
+		if err != nil {
+			t.Fatal("Error sending node: ", err)
+		}
+	}
+
+	r := client.Rule{
+		ID:          "ID-rule",
+		Parent:      root.ID,
+		Description: "test rule",
+	}
+
+	err = client.SendNodeType(nc, r, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	c := client.Condition{
+		ID:            "ID-condition",
+		Parent:        r.ID,
+		Description:   "temp high",
+		ConditionType: data.PointValuePointValue,
+		NodeID:        vin.ID,
+		PointType:     data.PointTypeValue,
+		ValueType:     data.PointValueNumber,
+		Operator:      data.PointValueGreaterThan,
+		Value:         50,
+		MinActive:     1,
+	}
+
+	err = client.SendNodeType(nc, c, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	a := client.Action{
+		ID:          "ID-action",
+		Parent:      r.ID,
+		Description: "fan on",
+		Action:      data.PointValueSetValue,
+		NodeID:      vout.ID,
+		PointType:   data.PointTypeValue,
+		ValueType:   data.PointValueOnOff,
+		Value:       1,
+	}
+
+	err = client.SendNodeType(nc, a, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	minute := func(m float64) time.Time {
+		return start.Add(time.Duration(m * float64(time.Minute)))
+	}
+
+	// the temperature is high for 2 minutes, and then for 20s, which is
+	// shorter than the min active time
+	history := []data.HistoryPoint{
+		{Time: minute(1), Type: data.PointTypeValue, Value: 20},
+		{Time: minute(2), Type: data.PointTypeValue, Value: 60},
+		{Time: minute(2.5), Type: data.PointTypeValue, Value: 70},
+		{Time: minute(4), Type: data.PointTypeValue, Value: 30},
+		{Time: minute(5), Type: data.PointTypeValue, Value: 80},
+		{Time: minute(5 + 1.0/3), Type: data.PointTypeValue, Value: 10},
+	}
+
+	sub, err := nc.Subscribe("history.ID-history", func(msg *nats.Msg) {
+		var query data.HistoryQuery
+		var results data.HistoryResults
+
+		err := json.Unmarshal(msg.Data, &query)
+		if err != nil {
+			results.ErrorMessage = err.Error()
+		} else if query.TagFilters["node.id"] == vin.ID {
+			for _, hp := range history {
+				hp.NodeTags = map[string]string{"node.id": vin.ID}
+				results.Points = append(results.Points, hp)
+			}
+		}
+
+		res, _ := json.Marshal(results)
+		_ = msg.Respond(res)
+	})
+	if err != nil {
+		t.Fatal("Error subscribing to history: ", err)
+	}
+	defer sub.Unsubscribe()
+
+	results, err := client.RuleBacktest(nc, data.RuleBacktestQuery{
+		RuleID:  r.ID,
+		Start:   start,
+		Stop:    minute(10),
+		History: "ID-history",
+	})
+	if err != nil {
+		t.Fatal("Error running backtest: ", err)
+	}
+
+	if results.Points != len(history) {
+		t.Error("wrong number of points replayed: ", results.Points)
+	}
+
+	type event struct {
+		time   time.Time
+		id     string
+		active bool
+	}
+
+	exp := []event{
+		{minute(3), c.ID, true},
+		{minute(3), r.ID, true},
+		{minute(3), a.ID, true},
+		{minute(4), c.ID, false},
+		{minute(4), r.ID, false},
+	}
+
+	var events []event
+	for _, e := range results.Events {
+		events = append(events, event{e.Time, e.NodeID, e.Active})
+	}
+
+	if len(events) != len(exp) {
+		t.Fatalf("wrong events, exp: %v, got: %v", exp, events)
+	}
+
+	for i := range exp {
+		if !events[i].time.Equal(exp[i].time) || events[i].id != exp[i].id ||
+			events[i].active != exp[i].active {
+			t.Fatalf("wrong event %v, exp: %v, got: %v", i, exp[i], events[i])
+		}
+	}
+
+	action := results.Events[2]
+	if action.TargetNodeID != vout.ID || action.Point == nil ||
+		action.Point.Value != 1 {
+		t.Error("wrong action event: ", action)
+	}
+
+	// nothing should have been written by the backtest
+	nodes, err := client.GetNodes(nc, "all", vout.ID, "", false)
+	if err != nil {
+		t.Fatal("Error getting node: ", err)
+	}
+
+	if value, _ := nodes[0].Points.Value(data.PointTypeValue, ""); value != 0 {
+		t.Error("backtest action was run")
+	}
+
+	nodes, err = client.GetNodes(nc, "all", c.ID, "", false)
+	if err != nil {
+		t.Fatal("Error getting node: ", err)
+	}
+
+	if active, _ := nodes[0].Points.Value(data.PointTypeActive, ""); active != 0 {
+		t.Error("backtest set condition active")
+	}
+}
+
+func TestRuleTrace(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	vin := client.Variable{ID: "ID-temp", Parent: root.ID, Description: "temp"}
+	vout := client.Variable{ID: "ID-fan", Parent: root.ID, Description: "fan"}
+
+	for _, v := range []client.Variable{vin, vout} {
+		err = client.SendNodeType(nc, v, "test")
+		if err != nil {
+			t.Fatal("Error sending node: ", err)
+		}
+	}
+
+	r := client.Rule{
+		ID:          "ID-rule",
+		Parent:      root.ID,
+		Description: "test rule",
+		Debug:       1,
+	}
+
+	err = client.SendNodeType(nc, r, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	c := client.Condition{
+		ID:            "ID-condition",
+		Parent:        r.ID,
+		Description:   "temp high",
+		ConditionType: data.PointValuePointValue,
+		NodeID:        vin.ID,
+		PointType:     data.PointTypeValue,
+		ValueType:     data.PointValueNumber,
+		Operator:      data.PointValueGreaterThan,
+		Value:         50,
+	}
+
+	err = client.SendNodeType(nc, c, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	a := client.Action{
+		ID:          "ID-action",
+		Parent:      r.ID,
+		Description: "fan on",
+		Action:      data.PointValueSetValue,
+		NodeID:      vout.ID,
+		PointType:   data.PointTypeValue,
+		ValueType:   data.PointValueOnOff,
+		Value:       1,
+	}
+
+	err = client.SendNodeType(nc, a, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	// wait for rule to get set up
+	time.Sleep(250 * time.Millisecond)
+
+	traces := make(chan data.RuleTrace, 10)
+
+	sub, err := client.WatchRuleTrace(nc, r.ID, func(trace data.RuleTrace) {
+		traces <- trace
+	})
+	if err != nil {
+		t.Fatal("Error watching trace: ", err)
+	}
+	defer sub.Unsubscribe()
+
+	err = client.SendNodePoint(nc, vin.ID, data.Point{Type: data.PointTypeValue,
+		Value: 60, Origin: "test"}, true)
+	if err != nil {
+		t.Fatal("Error sending point: ", err)
+	}
+
+	var trace data.RuleTrace
+
+	select {
+	case trace = <-traces:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for trace")
+	}
+
+	if trace.NodeID != vin.ID || len(trace.Points) != 1 ||
+		trace.Points[0].Value != 60 {
+		t.Fatal("wrong trace trigger: ", trace)
+	}
+
+	if len(trace.Conditions) != 1 || trace.Conditions[0].Value != 60 ||
+		!trace.Conditions[0].Met || !trace.Conditions[0].Active {
+		t.Fatal("wrong trace conditions: ", trace)
+	}
+
+	if !trace.Active || !trace.Changed {
+		t.Fatal("wrong trace rule state: ", trace)
+	}
+
+	if len(trace.Actions) != 1 || trace.Actions[0].NodeID != vout.ID ||
+		trace.Actions[0].Point == nil || trace.Actions[0].Point.Value != 1 {
+		t.Fatal("wrong trace actions: ", trace)
+	}
+
+	// the trace can also be requested
+	traceReq, err := client.GetRuleTrace(nc, r.ID)
+	if err != nil {
+		t.Fatal("Error getting trace: ", err)
+	}
+
+	if len(traceReq) < 1 || !traceReq[len(traceReq)-1].Time.Equal(trace.Time) {
+		t.Fatal("trace request did not return the last evaluation: ", traceReq)
+	}
+}
+
+func TestRuleWebhookPublishCommand(t *testing.T) {
+	server.TestServerOptions.Clients.RuleCommands = []string{"touch"}
+	defer func() {
+		server.TestServerOptions.Clients.RuleCommands = nil
+	}()
+
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	type request struct {
+		path   string
+		header string
+		body   string
+	}
+
+	requests := make(chan request, 10)
+	retryCount := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case "/retry":
+			retryCount++
+			if retryCount < 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		requests <- request{r.URL.Path, r.Header.Get("X-Test"), string(body)}
+	}))
+	defer ts.Close()
+
+	msgs := make(chan string, 10)
+	sub, err := nc.Subscribe("rule.publish.test", func(msg *nats.Msg) {
+		msgs <- string(msg.Data)
+	})
+	if err != nil {
+		t.Fatal("Error subscribing: ", err)
+	}
+	defer sub.Unsubscribe()
+
+	dir := t.TempDir()
+
+	vin := client.Variable{ID: "ID-temp", Parent: root.ID, Description: "temp"}
+
+	err = client.SendNodeType(nc, vin, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	r := client.Rule{
+		ID:          "ID-rule",
+		Parent:      root.ID,
+		Description: "temp rule",
+	}
+
+	err = client.SendNodeType(nc, r, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	c := client.Condition{
+		ID:            "ID-condition",
+		Parent:        r.ID,
+		Description:   "temp high",
+		ConditionType: data.PointValuePointValue,
+		NodeID:        vin.ID,
+		PointType:     data.PointTypeValue,
+		ValueType:     data.PointValueNumber,
+		Operator:      data.PointValueGreaterThan,
+		Value:         50,
+	}
+
+	err = client.SendNodeType(nc, c, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	actions := []client.Action{
+		{
+			ID:       "ID-webhook",
+			Parent:   r.ID,
+			Action:   data.PointValueWebhook,
+			URL:      ts.URL + "/hook",
+			Headers:  map[string]string{"X-Test": "test header"},
+			Template: `{"rule":{{json .Description}},"value":{{.Point.Value}}}`,
+		},
+		{
+			ID:      "ID-webhook-fail",
+			Parent:  r.ID,
+			Action:  data.PointValueWebhook,
+			URL:     ts.URL + "/fail",
+			Timeout: 2,
+		},
+		{
+			ID:      "ID-webhook-retry",
+			Parent:  r.ID,
+			Action:  data.PointValueWebhook,
+			URL:     ts.URL + "/retry",
+			Retries: 1,
+		},
+		{
+			ID:       "ID-publish",
+			Parent:   r.ID,
+			Action:   data.PointValuePublish,
+			Subject:  "rule.publish.test",
+			Template: `{{.Description}} {{(index .Conditions "temp high").Value}}`,
+		},
+		{
+			ID:      "ID-command",
+			Parent:  r.ID,
+			Action:  data.PointValueCommand,
+			Command: "touch",
+			Args:    []string{dir + "/temp-{{.Point.Value}}"},
+		},
+		// subjects outside the publish prefix and commands that are not
+		// allowed are rejected
+		{
+			ID:      "ID-publish-denied",
+			Parent:  r.ID,
+			Action:  data.PointValuePublish,
+			Subject: "p." + vin.ID,
+		},
+		{
+			ID:      "ID-command-denied",
+			Parent:  r.ID,
+			Action:  data.PointValueCommand,
+			Command: "mkdir",
+			Args:    []string{dir + "/denied"},
+		},
+	}
+
+	for _, a := range actions {
+		err = client.SendNodeType(nc, a, "test")
+		if err != nil {
+			t.Fatal("Error sending node: ", err)
+		}
+	}
+
+	// wait for rule to get set up
+	time.Sleep(250 * time.Millisecond)
+
+	err = client.SendNodePoint(nc, vin.ID, data.Point{Type: data.PointTypeValue,
+		Value: 60, Origin: "test"}, true)
+	if err != nil {
+		t.Fatal("Error sending point: ", err)
+	}
+
+	select {
+	case msg := <-msgs:
+		if msg != "temp rule 60" {
+			t.Error("wrong published message: ", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for published message")
+	}
+
+	// the retry request arrives after a backoff
+	got := make(map[string]request)
+	for len(got) < 2 {
+		select {
+		case req := <-requests:
+			got[req.path] = req
+		case <-time.After(3 * time.Second):
+			t.Fatal("Timeout waiting for webhooks, got: ", got)
+		}
+	}
+
+	hook := got["/hook"]
+	if hook.header != "test header" ||
+		hook.body != `{"rule":"temp rule","value":60}` {
+		t.Error("wrong webhook request: ", hook)
+	}
+
+	if retryCount != 2 {
+		t.Error("webhook was not retried: ", retryCount)
+	}
+
+	if _, err := os.Stat(dir + "/temp-60"); err != nil {
+		t.Error("command did not run: ", err)
+	}
+
+	actionError := func(id string) string {
+		nodes, err := client.GetNodes(nc, r.ID, id, "", false)
+		if err != nil || len(nodes) < 1 {
+			t.Fatal("Error getting action: ", err)
+		}
+		errS, _ := nodes[0].Points.Text(data.PointTypeError, "")
+		return errS
+	}
+
+	start := time.Now()
+	for actionError("ID-webhook-fail") == "" {
+		if time.Since(start) > time.Second {
+			t.Fatal("webhook error was not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, id := range []string{"ID-publish-denied", "ID-command-denied"} {
+		if actionError(id) == "" {
+			t.Errorf("action %v was not rejected", id)
+		}
+	}
+
+	if _, err := os.Stat(dir + "/denied"); err == nil {
+		t.Error("command that is not allowed was run")
+	}
+
+	for _, id := range []string{"ID-webhook", "ID-webhook-retry", "ID-publish", "ID-command"} {
+		if errS := actionError(id); errS != "" {
+			t.Errorf("action %v error: %v", id, errS)
+		}
+	}
+}
+
+func TestRuleTimedActions(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	vin := client.Variable{ID: "ID-temp", Parent: root.ID, Description: "temp"}
+	outputs := []client.Variable{
+		{ID: "ID-pulse", Parent: root.ID, Description: "relay"},
+		{ID: "ID-delay", Parent: root.ID, Description: "fan"},
+		{ID: "ID-ramp", Parent: root.ID, Description: "setpoint"},
+		{ID: "ID-valve", Parent: root.ID, Description: "valve"},
+		{ID: "ID-pump", Parent: root.ID, Description: "pump"},
+	}
+
+	for _, v := range append(outputs, vin) {
+		err = client.SendNodeType(nc, v, "test")
+		if err != nil {
+			t.Fatal("Error sending node: ", err)
+		}
+	}
+
+	// record the points the actions send
+	var lock sync.Mutex
+	sent := make(map[string][]float64)
+
+	for _, v := range outputs {
+		id := v.ID
+		sub, err := nc.Subscribe(client.SubjectNodePoints(id), func(msg *nats.Msg) {
+			points, err := data.PbDecodePoints(msg.Data)
+			if err != nil {
+				t.Error("Error decoding points: ", err)
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			for _, p := range points {
+				if p.Origin == "ID-rule" {
+					sent[id] = append(sent[id], p.Value)
+				}
+			}
+		})
+		if err != nil {
+			t.Fatal("Error subscribing: ", err)
+		}
+		defer sub.Unsubscribe()
+	}
+
+	sentGet := func(id string) []float64 {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]float64{}, sent[id]...)
+	}
+
+	last := func(id string) float64 {
+		values := sentGet(id)
+		if len(values) < 1 {
+			return 0
+		}
+		return values[len(values)-1]
+	}
+
+	r := client.Rule{
+		ID:          "ID-rule",
+		Parent:      root.ID,
+		Description: "temp rule",
+	}
+
+	err = client.SendNodeType(nc, r, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	c := client.Condition{
+		ID:            "ID-condition",
+		Parent:        r.ID,
+		Description:   "temp high",
+		ConditionType: data.PointValuePointValue,
+		NodeID:        vin.ID,
+		PointType:     data.PointTypeValue,
+		ValueType:     data.PointValueNumber,
+		Operator:      data.PointValueGreaterThan,
+		Value:         50,
+	}
+
+	err = client.SendNodeType(nc, c, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	actions := []client.Action{
+		{
+			ID:        "ID-action-pump",
+			Parent:    r.ID,
+			Action:    data.PointValueSetValue,
+			NodeID:    "ID-pump",
+			PointType: data.PointTypeValue,
+			Value:     1,
+			Index:     2,
+		},
+		{
+			ID:               "ID-action-valve",
+			Parent:           r.ID,
+			Action:           data.PointValueSetValue,
+			NodeID:           "ID-valve",
+			PointType:        data.PointTypeValueSet,
+			Value:            1,
+			Index:            1,
+			ConfirmPointType: data.PointTypeValue,
+			ConfirmValue:     1,
+			Timeout:          0.5,
+		},
+		{
+			ID:        "ID-action-pulse",
+			Parent:    r.ID,
+			Action:    data.PointValueSetValue,
+			NodeID:    "ID-pulse",
+			PointType: data.PointTypeValue,
+			Value:     1,
+			Pulse:     0.3,
+		},
+		{
+			ID:        "ID-action-delay",
+			Parent:    r.ID,
+			Action:    data.PointValueSetValue,
+			NodeID:    "ID-delay",
+			PointType: data.PointTypeValue,
+			Value:     1,
+			Delay:     0.5,
+		},
+		{
+			ID:        "ID-action-ramp",
+			Parent:    r.ID,
+			Action:    data.PointValueSetValue,
+			NodeID:    "ID-ramp",
+			PointType: data.PointTypeValue,
+			Value:     10,
+			Ramp:      0.5,
+			RampStep:  0.1,
+		},
+	}
+
+	for _, a := range actions {
+		err = client.SendNodeType(nc, a, "test")
+		if err != nil {
+			t.Fatal("Error sending node: ", err)
+		}
+	}
+
+	// wait for rule to get set up
+	time.Sleep(250 * time.Millisecond)
+
+	waitFor := func(desc string, f func() bool) {
+		start := time.Now()
+		for !f() {
+			if time.Since(start) > 2*time.Second {
+				t.Fatal("Timeout waiting for ", desc)
+			}
+			<-time.After(time.Millisecond * 10)
+		}
+	}
+
+	sendPoint := func(id string, value float64) {
+		err := client.SendNodePoint(nc, id, data.Point{Type: data.PointTypeValue,
+			Value: value, Origin: "test"}, true)
+		if err != nil {
+			t.Fatal("Error sending point: ", err)
+		}
+	}
+
+	sendPoint(vin.ID, 60)
+
+	// the pump waits for the valve to confirm it is open
+	waitFor("valve to be set", func() bool { return last("ID-valve") == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if len(sentGet("ID-pump")) > 0 {
+		t.Fatal("pump started before valve confirmed")
+	}
+
+	sendPoint("ID-valve", 1)
+	waitFor("pump to start", func() bool { return last("ID-pump") == 1 })
+
+	waitFor("pulse to end", func() bool { return len(sentGet("ID-pulse")) == 2 })
+	if pulse := sentGet("ID-pulse"); pulse[0] != 1 || pulse[1] != 0 {
+		t.Error("wrong pulse: ", pulse)
+	}
+
+	waitFor("ramp to finish", func() bool { return last("ID-ramp") == 10 })
+	ramp := sentGet("ID-ramp")
+	if len(ramp) < 3 || ramp[0] <= 0 || ramp[0] >= 10 {
+		t.Error("setpoint did not ramp: ", ramp)
+	}
+
+	waitFor("delayed action", func() bool { return last("ID-delay") == 1 })
+
+	// actions that are pending when the rule goes inactive do not run
+	sendPoint(vin.ID, 40)
+	time.Sleep(50 * time.Millisecond)
+
+	lock.Lock()
+	sent = make(map[string][]float64)
+	lock.Unlock()
+
+	sendPoint(vin.ID, 60)
+	time.Sleep(100 * time.Millisecond)
+	sendPoint(vin.ID, 40)
+
+	// the pulse ends early
+	waitFor("pulse to end early", func() bool { return len(sentGet("ID-pulse")) == 2 })
+
+	time.Sleep(700 * time.Millisecond)
+
+	if len(sentGet("ID-delay")) > 0 {
+		t.Error("delayed action ran after the rule went inactive")
+	}
+
+	if len(sentGet("ID-pump")) > 0 {
+		t.Error("pump started without confirmation")
+	}
+
+	// the sequence stops if the valve does not confirm
+	sendPoint(vin.ID, 60)
+
+	valveGet, valveStop, err := client.NodeWatcher[client.Action](nc, "ID-action-valve", r.ID)
+	if err != nil {
+		t.Fatal("Error setting up watcher")
+	}
+	defer valveStop()
+
+	waitFor("valve timeout", func() bool { return valveGet().Error != "" })
+
+	if len(sentGet("ID-pump")) > 0 {
+		t.Error("pump started after valve timeout")
+	}
+}
@@ -5,15 +5,34 @@ import (
 	"log"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
+
+	// embed the time zone database, as devices may not have it installed
+	_ "time/tzdata"
 )
 
+// schedule is active between a start and end time of day on the selected
+// weekdays or dates, or after times matching a cron expression. Times and dates
+// are in the schedule location (UTC if not set), so a schedule follows daylight
+// saving time changes in its location. Start and end are HH:MM, or sunrise or
+// sunset with an optional offset (sunset+30m, sunrise-1h).
 type schedule struct {
 	startTime string
 	endTime   string
 	// A Weekday specifies a day of the week (Sunday = 0, ...).
 	weekdays []time.Weekday
 	dates    []string
+
+	location *time.Location
+	// used for sunrise and sunset times
+	latitude  float64
+	longitude float64
+
+	// if cron is set, the schedule is active for cronDuration (1m if not set)
+	// after each time that matches the cron expression
+	cron         string
+	cronDuration time.Duration
 }
 
 func newSchedule(start, end string, weekdays []time.Weekday, dates []string) *schedule {
@@ -26,72 +45,142 @@ func newSchedule(start, end string, weekdays []time.Weekday, dates []string) *sc
 }
 
 func (s *schedule) activeForTime(t time.Time) (bool, error) {
-	tUTC := t.UTC()
+	loc := s.location
+	if loc == nil {
+		loc = time.UTC
+	}
 
-	// parse out hour/minute
-	matches := reHourMin.FindStringSubmatch(s.startTime)
-	if len(matches) < 3 {
-		return false, fmt.Errorf("TimeRange: invalid start: %v ", s.startTime)
+	tLoc := t.In(loc)
+
+	if s.cron != "" {
+		c, err := parseCron(s.cron)
+		if err != nil {
+			return false, err
+		}
+
+		duration := s.cronDuration
+		if duration <= 0 {
+			duration = time.Minute
+		}
+
+		return c.activeForTime(tLoc, duration), nil
 	}
 
-	startHour, err := strconv.Atoi(matches[1])
-	if err != nil {
-		return false, fmt.Errorf("TimeRange: error parsing start hour: %v", matches[1])
+	y, m, d := tLoc.Date()
+
+	// a time range that starts the previous day may end today
+	var timeRanges timeRanges
+
+	for _, day := range []int{-1, 0} {
+		// noon is used so the date is not affected by DST changes
+		date := time.Date(y, m, d+day, 12, 0, 0, 0, loc)
+
+		tr, ok, err := s.rangeForDay(date)
+		if err != nil {
+			return false, err
+		}
+
+		if ok {
+			timeRanges = append(timeRanges, tr)
+		}
 	}
 
-	startMin, err := strconv.Atoi(matches[2])
+	timeRanges.filterWeekdays(s.weekdays)
+	err := timeRanges.filterDates(s.dates)
 	if err != nil {
-		return false, fmt.Errorf("TimeRange: error parsing start hour: %v", matches[1])
+		return false, err
 	}
 
-	matches = reHourMin.FindStringSubmatch(s.endTime)
-	if len(matches) < 3 {
-		return false, fmt.Errorf("TimeRange: invalid end: %v ", s.endTime)
+	if timeRanges.in(t) {
+		return true, nil
 	}
 
-	endHour, err := strconv.Atoi(matches[1])
+	return false, nil
+}
 
+// rangeForDay returns the time range that starts on date. If the end time is
+// not after the start time, the range ends the next day. false is returned if
+// the range does not exist on that day (no sunrise or sunset).
+func (s *schedule) rangeForDay(date time.Time) (timeRange, bool, error) {
+	start, ok, err := s.timeOfDay(s.startTime, date)
 	if err != nil {
-		return false, fmt.Errorf("TimeRange: error parsing end hour: %v", matches[1])
+		return timeRange{}, false, fmt.Errorf("TimeRange: invalid start: %w", err)
 	}
 
-	endMin, err := strconv.Atoi(matches[2])
+	if !ok {
+		return timeRange{}, false, nil
+	}
 
+	end, ok, err := s.timeOfDay(s.endTime, date)
+	if err == nil && ok && !end.After(start) {
+		end, ok, err = s.timeOfDay(s.endTime, date.AddDate(0, 0, 1))
+	}
 	if err != nil {
-		return false, fmt.Errorf("TimeRange: error parsing end hour: %v", matches[1])
+		return timeRange{}, false, fmt.Errorf("TimeRange: invalid end: %w", err)
 	}
 
-	y := tUTC.Year()
-	m := tUTC.Month()
-	d := tUTC.Day()
+	return timeRange{start, end}, ok, nil
+}
 
-	start := time.Date(y, m, d, startHour, startMin, 0, 0, time.UTC)
-	end := time.Date(y, m, d, endHour, endMin, 0, 0, time.UTC)
+// timeOfDay returns the time for a HH:MM or sunrise/sunset time on date.
+// false is returned if there is no sunrise or sunset on date.
+func (s *schedule) timeOfDay(tod string, date time.Time) (time.Time, bool, error) {
+	y, m, d := date.Date()
+	tod = strings.TrimSpace(tod)
 
-	timeRanges := timeRanges{
-		{start, end},
-	}
+	for _, event := range []string{"sunrise", "sunset"} {
+		if !strings.HasPrefix(strings.ToLower(tod), event) {
+			continue
+		}
 
-	// adjust time ranges if end time is before start
-	if !end.After(start) {
-		timeRanges[0].end = timeRanges[0].end.AddDate(0, 0, 1)
+		var offset time.Duration
+		if o := tod[len(event):]; o != "" {
+			var err error
+			offset, err = time.ParseDuration(o)
+			if err != nil || (o[0] != '+' && o[0] != '-') {
+				return time.Time{}, false, fmt.Errorf("invalid offset: %v", tod)
+			}
+		}
 
-		timeRanges = append(timeRanges,
-			timeRange{start.AddDate(0, 0, -1), end},
-		)
+		rise, set, ok := sunTimes(date, s.latitude, s.longitude)
+		if !ok {
+			return time.Time{}, false, nil
+		}
+
+		if event == "sunrise" {
+			return rise.Add(offset), true, nil
+		}
+		return set.Add(offset), true, nil
 	}
 
-	timeRanges.filterWeekdays(s.weekdays)
-	err = timeRanges.filterDates(s.dates)
+	// parse out hour/minute
+	matches := reHourMin.FindStringSubmatch(tod)
+	if len(matches) < 3 {
+		return time.Time{}, false, fmt.Errorf("%v", tod)
+	}
+
+	hour, err := strconv.Atoi(matches[1])
 	if err != nil {
-		return false, err
+		return time.Time{}, false, fmt.Errorf("error parsing hour: %v", matches[1])
 	}
 
-	if timeRanges.in(t) {
-		return true, nil
+	min, err := strconv.Atoi(matches[2])
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("error parsing minute: %v", matches[2])
 	}
 
-	return false, nil
+	return time.Date(y, m, d, hour, min, 0, 0, date.Location()), true, nil
+}
+
+// usesSun returns true if the schedule start or end is sunrise or sunset
+func (s *schedule) usesSun() bool {
+	for _, tod := range []string{s.startTime, s.endTime} {
+		tod = strings.ToLower(strings.TrimSpace(tod))
+		if strings.HasPrefix(tod, "sunrise") || strings.HasPrefix(tod, "sunset") {
+			return true
+		}
+	}
+	return false
 }
 
 var reHourMin = regexp.MustCompile(`(\d{1,2}):(\d\d)`)
@@ -162,15 +251,15 @@ func (trs *timeRanges) filterDates(dates []string) error {
 				return fmt.Errorf("Invalid day: %v", d)
 			}
 
-			if year != tr.start.UTC().Year() {
+			if year != tr.start.Year() {
 				continue
 			}
 
-			if month != int(tr.start.UTC().Month()) {
+			if month != int(tr.start.Month()) {
 				continue
 			}
 
-			if day != tr.start.UTC().Day() {
+			if day != tr.start.Day() {
 				continue
 			}
 
@@ -106,3 +106,104 @@ func TestScheduleWrapDates(t *testing.T) {
 
 	tests.run(t, sched)
 }
+
+func TestScheduleTimezone(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal("Error loading location: ", err)
+	}
+
+	sched := newSchedule("8:00", "9:00", []time.Weekday{time.Friday, time.Monday}, nil)
+	sched.location = loc
+
+	// DST starts 2023-03-12, so the schedule moves an hour in UTC.
+	// 2023-03-10 is a Friday, 2023-03-13 is a Monday.
+	tests := testTable{
+		{time.Date(2023, time.March, 10, 13, 30, 0, 0, time.UTC), true},
+		{time.Date(2023, time.March, 10, 12, 30, 0, 0, time.UTC), false},
+		{time.Date(2023, time.March, 13, 12, 30, 0, 0, time.UTC), true},
+		{time.Date(2023, time.March, 13, 13, 30, 0, 0, time.UTC), false},
+		// Sunday
+		{time.Date(2023, time.March, 12, 12, 30, 0, 0, time.UTC), false},
+	}
+
+	tests.run(t, sched)
+
+	// weekdays and dates are in the schedule location. 2023-03-11 1:00 UTC is
+	// Friday evening in New York.
+	sched = newSchedule("20:00", "21:00", nil, []string{"2023-03-10"})
+	sched.location = loc
+
+	tests = testTable{
+		{time.Date(2023, time.March, 11, 1, 30, 0, 0, time.UTC), true},
+		{time.Date(2023, time.March, 10, 1, 30, 0, 0, time.UTC), false},
+	}
+
+	tests.run(t, sched)
+}
+
+func TestScheduleSun(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal("Error loading location: ", err)
+	}
+
+	// sunset in New York on 2021-06-21 is 20:31 EDT
+	sched := newSchedule("sunset+30m", "23:00", nil, nil)
+	sched.location = loc
+	sched.latitude = 40.7128
+	sched.longitude = -74.0060
+
+	tests := testTable{
+		{time.Date(2021, time.June, 21, 20, 50, 0, 0, loc), false},
+		{time.Date(2021, time.June, 21, 21, 10, 0, 0, loc), true},
+		{time.Date(2021, time.June, 21, 23, 10, 0, 0, loc), false},
+	}
+
+	tests.run(t, sched)
+
+	// sunrise on 2021-06-21 is 5:25 EDT
+	sched = newSchedule("sunset", "sunrise-1h", nil, nil)
+	sched.location = loc
+	sched.latitude = 40.7128
+	sched.longitude = -74.0060
+
+	tests = testTable{
+		{time.Date(2021, time.June, 21, 23, 0, 0, 0, loc), true},
+		{time.Date(2021, time.June, 22, 4, 15, 0, 0, loc), true},
+		{time.Date(2021, time.June, 22, 4, 35, 0, 0, loc), false},
+		{time.Date(2021, time.June, 22, 12, 0, 0, 0, loc), false},
+	}
+
+	tests.run(t, sched)
+
+	sched = newSchedule("sunset+30", "23:00", nil, nil)
+	_, err = sched.activeForTime(time.Now())
+	if err == nil {
+		t.Error("expected error for invalid offset")
+	}
+}
+
+func TestScheduleCron(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal("Error loading location: ", err)
+	}
+
+	// 2:00 on the first 7 days of the month
+	sched := newSchedule("", "", nil, nil)
+	sched.cron = "0 2 1-7 * *"
+	sched.cronDuration = 30 * time.Minute
+	sched.location = loc
+
+	tests := testTable{
+		{time.Date(2023, time.November, 1, 2, 0, 0, 0, loc), true},
+		{time.Date(2023, time.November, 1, 2, 29, 0, 0, loc), true},
+		{time.Date(2023, time.November, 1, 2, 30, 0, 0, loc), false},
+		{time.Date(2023, time.November, 8, 2, 10, 0, 0, loc), false},
+		{time.Date(2023, time.November, 1, 7, 10, 0, 0, time.UTC), false},
+		{time.Date(2023, time.November, 2, 6, 10, 0, 0, time.UTC), true},
+	}
+
+	tests.run(t, sched)
+}
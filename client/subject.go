@@ -1,6 +1,10 @@
 package client
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/simpleiot/simpleiot/data"
+)
 
 // create subject strings for various types of messages
 
@@ -68,3 +72,9 @@ func (sd Destination) Subject(originID string, parentID string) string {
 	}
 	return SubjectNodePoints(destID)
 }
+
+// SubjectNodeEvent constructs a NATS subject for node events. Use "*" for
+// any field to subscribe to multiple events.
+func SubjectNodeEvent(eventType data.NodeEventType, nodeType, nodeID string) string {
+	return fmt.Sprintf("nodeEvent.%v.%v.%v", eventType, nodeType, nodeID)
+}
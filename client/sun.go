@@ -0,0 +1,64 @@
+package client
+
+import (
+	"math"
+	"time"
+)
+
+// sunTimes returns sunrise and sunset for the day of date (in the date's
+// location) at a latitude and longitude (degrees, east and north positive).
+// The calculation follows the NOAA sunrise equation and is accurate to about a
+// minute. ok is false if the sun does not rise or set on that day (polar day
+// or night).
+func sunTimes(date time.Time, lat, long float64) (rise, set time.Time, ok bool) {
+	const (
+		julianUnixEpoch = 2440587.5
+		julian2000      = 2451545.0
+	)
+
+	rad := math.Pi / 180
+
+	// julian day at noon UTC of the local date
+	y, m, d := date.Date()
+	noon := time.Date(y, m, d, 12, 0, 0, 0, time.UTC)
+	jd := float64(noon.Unix())/86400 + julianUnixEpoch
+
+	n := math.Round(jd - julian2000 + 0.0008)
+
+	// mean solar time
+	jStar := n - long/360
+
+	// solar mean anomaly
+	ma := math.Mod(357.5291+0.98560028*jStar, 360)
+
+	// equation of the center
+	c := 1.9148*math.Sin(ma*rad) + 0.0200*math.Sin(2*ma*rad) +
+		0.0003*math.Sin(3*ma*rad)
+
+	// ecliptic longitude
+	lambda := math.Mod(ma+c+180+102.9372, 360)
+
+	// solar transit
+	jTransit := julian2000 + jStar + 0.0053*math.Sin(ma*rad) -
+		0.0069*math.Sin(2*lambda*rad)
+
+	// declination of the sun
+	sinDec := math.Sin(lambda*rad) * math.Sin(23.4397*rad)
+	cosDec := math.Cos(math.Asin(sinDec))
+
+	// hour angle
+	cosW := (math.Sin(-0.833*rad) - math.Sin(lat*rad)*sinDec) /
+		(math.Cos(lat*rad) * cosDec)
+	if cosW < -1 || cosW > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+
+	w := math.Acos(cosW) / rad
+
+	toTime := func(j float64) time.Time {
+		sec := (j - julianUnixEpoch) * 86400
+		return time.Unix(0, int64(sec*1e9)).In(date.Location()).Truncate(time.Second)
+	}
+
+	return toTime(jTransit - w/360), toTime(jTransit + w/360), true
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSunTimes(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal("Error loading location: ", err)
+	}
+
+	date := time.Date(2021, time.June, 21, 12, 0, 0, 0, loc)
+
+	rise, set, ok := sunTimes(date, 40.7128, -74.0060)
+	if !ok {
+		t.Fatal("no sunrise/sunset")
+	}
+
+	expRise := time.Date(2021, time.June, 21, 5, 25, 0, 0, loc)
+	expSet := time.Date(2021, time.June, 21, 20, 31, 0, 0, loc)
+
+	if d := rise.Sub(expRise); d < -2*time.Minute || d > 2*time.Minute {
+		t.Error("wrong sunrise: ", rise)
+	}
+
+	if d := set.Sub(expSet); d < -2*time.Minute || d > 2*time.Minute {
+		t.Error("wrong sunset: ", set)
+	}
+
+	// Tokyo on 2021-12-21, sunrise 6:47, sunset 16:32
+	loc, err = time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal("Error loading location: ", err)
+	}
+
+	date = time.Date(2021, time.December, 21, 12, 0, 0, 0, loc)
+
+	rise, set, ok = sunTimes(date, 35.6762, 139.6503)
+	if !ok {
+		t.Fatal("no sunrise/sunset")
+	}
+
+	expRise = time.Date(2021, time.December, 21, 6, 47, 0, 0, loc)
+	expSet = time.Date(2021, time.December, 21, 16, 32, 0, 0, loc)
+
+	if d := rise.Sub(expRise); d < -2*time.Minute || d > 2*time.Minute {
+		t.Error("wrong sunrise: ", rise)
+	}
+
+	if d := set.Sub(expSet); d < -2*time.Minute || d > 2*time.Minute {
+		t.Error("wrong sunset: ", set)
+	}
+
+	// midnight sun in Tromsø
+	_, _, ok = sunTimes(time.Date(2021, time.June, 21, 12, 0, 0, 0, time.UTC), 69.65, 18.96)
+	if ok {
+		t.Error("expected no sunset in Tromsø in June")
+	}
+}
@@ -106,6 +106,13 @@ func (up *SyncClient) Run() error {
 			return
 		}
 
+		// passwords are only stored locally as hashes and are never
+		// synced
+		points = data.Points(points).RemoveType(data.PointTypePass)
+		if len(points) <= 0 {
+			return
+		}
+
 		chLocalNodePoints <- NewPoints{ID: nodeID, Points: points}
 
 	})
@@ -394,6 +401,11 @@ func (up *SyncClient) subscribeRemoteNodePoints(id string) error {
 				return
 			}
 
+			points = data.Points(points).RemoveType(data.PointTypePass)
+			if len(points) <= 0 {
+				return
+			}
+
 			err = SendNodePoints(up.ncLocal, nodeID, points, false)
 			if err != nil {
 				log.Println("Error sending node points to remote system:", err)
@@ -713,7 +725,8 @@ func (up *SyncClient) syncNode(parent, id string) error {
 			}
 		}
 
-		if !found {
+		// deleted points may have been purged on the other side
+		if !found && p.Tombstone == 0 {
 			err := SendNodePoint(up.ncRemote, nodeUp.ID, p, true)
 			if err != nil {
 				log.Println("Error sending point:", err)
@@ -723,7 +736,7 @@ func (up *SyncClient) syncNode(parent, id string) error {
 
 	// check for any points that do not exist locally
 	for i, pUp := range nodeUp.Points {
-		if _, ok := upstreamProcessed[i]; !ok {
+		if _, ok := upstreamProcessed[i]; !ok && pUp.Tombstone == 0 {
 			err := SendNodePoint(up.nc, nodeLocal.ID, pUp, true)
 			if err != nil {
 				log.Println("Error syncing point from upstream:", err)
@@ -759,7 +772,7 @@ func (up *SyncClient) syncNode(parent, id string) error {
 				}
 			}
 
-			if !found {
+			if !found && p.Tombstone == 0 {
 				err := SendEdgePoint(up.ncRemote, nodeUp.ID, nodeUp.Parent, p, true)
 				if err != nil {
 					log.Println("Error sending point:", err)
@@ -769,7 +782,7 @@ func (up *SyncClient) syncNode(parent, id string) error {
 
 		// check for any points that do not exist locally
 		for i, pUp := range nodeUp.EdgePoints {
-			if _, ok := upstreamProcessed[i]; !ok {
+			if _, ok := upstreamProcessed[i]; !ok && pUp.Tombstone == 0 {
 				err := SendEdgePoint(up.nc, nodeLocal.ID, nodeLocal.Parent, pUp, true)
 				if err != nil {
 					log.Println("Error syncing edge point from upstream:", err)
@@ -10,6 +10,7 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"os/user"
 	"path"
 	"runtime"
@@ -18,8 +19,10 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/nats-io/nats.go"
 	"github.com/oklog/run"
 	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
 	"github.com/simpleiot/simpleiot/install"
 	"github.com/simpleiot/simpleiot/server"
 )
@@ -47,6 +50,10 @@ func main() {
 		fmt.Println("  - install (install SIOT and register service)")
 		fmt.Println("  - import (import nodes from YAML file)")
 		fmt.Println("  - export (export nodes to YAML file)")
+		fmt.Println("  - backup (backup store to file, requires server to be running)")
+		fmt.Println("  - restore (restore store from backup, requires server to be running)")
+		fmt.Println("  - rule test (replay history through a rule, requires server to be running)")
+		fmt.Println("  - rule trace (show recent evaluations of a rule, requires server to be running)")
 	}
 
 	_ = flags.Parse(os.Args[1:])
@@ -81,8 +88,14 @@ func main() {
 		runImport(args[1:])
 	case "export":
 		runExport(args[1:])
+	case "backup":
+		runBackup(args[1:])
+	case "restore":
+		runRestore(args[1:])
+	case "rule":
+		runRule(args[1:])
 	default:
-		log.Fatal("Unknown command; options: serve, log, store")
+		log.Fatal("Unknown command; options: serve, log, store, install, import, export, backup, restore, rule")
 	}
 }
 
@@ -117,7 +130,7 @@ func runServer(args []string, version string, id string) error {
 
 	// Load the default SIOT clients -- you can replace this with a customized
 	// list
-	clients, err := client.DefaultClients(nc)
+	clients, err := client.DefaultClients(nc, options.Clients)
 	if err != nil {
 		return err
 	}
@@ -184,6 +197,8 @@ func runStore(args []string) {
 	flagAuthToken := flags.String("token", "", "Auth token")
 	flagCheck := flags.Bool("check", false, "Check store")
 	flagFix := flags.Bool("fix", false, "Fix store")
+	flagGC := flags.Bool("gc", false, "Purge deleted nodes and points and compact store")
+	flagRetention := flags.Duration("retention", 0, "Tombstone retention for -gc, defaults to the store setting")
 
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("error: ", err)
@@ -250,6 +265,14 @@ func runStore(args []string) {
 			log.Println("DB maint success :-)")
 		}
 
+	case *flagGC:
+		results, err := client.AdminStoreGC(nc, *flagRetention)
+		if err != nil {
+			log.Println("DB gc failed:", err)
+		} else {
+			log.Println("DB gc success, purged", results)
+		}
+
 	default:
 		fmt.Println("Error, no operation given.")
 		flags.Usage()
@@ -535,3 +558,276 @@ func runExport(args []string) {
 	}
 
 }
+
+func runBackup(args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+
+	flagOut := flags.String("out", "", "backup file. Default is STDOUT")
+	flagNatsServer := flags.String("natsServer", defaultNatsServer, "NATS Server")
+	flagAuthToken := flags.String("token", "", "Auth token")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("error: ", err)
+	}
+
+	nc := adminConnect(*flagNatsServer, *flagAuthToken)
+
+	out := os.Stdout
+	if *flagOut != "" {
+		f, err := os.Create(*flagOut)
+		if err != nil {
+			log.Fatal("Error creating backup file: ", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	err := client.AdminStoreBackup(nc, out)
+	if err != nil {
+		log.Fatal("Error backing up store: ", err)
+	}
+
+	log.Println("Backup success!")
+}
+
+func runRestore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+
+	flagIn := flags.String("in", "", "backup file. Default is STDIN")
+	flagNatsServer := flags.String("natsServer", defaultNatsServer, "NATS Server")
+	flagAuthToken := flags.String("token", "", "Auth token")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("error: ", err)
+	}
+
+	nc := adminConnect(*flagNatsServer, *flagAuthToken)
+
+	in := os.Stdin
+	if *flagIn != "" {
+		f, err := os.Open(*flagIn)
+		if err != nil {
+			log.Fatal("Error opening backup file: ", err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	err := client.AdminStoreRestore(nc, in)
+	if err != nil {
+		log.Fatal("Error restoring store: ", err)
+	}
+
+	log.Println("Restore success! Restart SIOT so clients load the restored nodes.")
+}
+
+func runRule(args []string) {
+	if len(args) < 1 {
+		log.Fatal("Rule command missing; options: test, trace")
+	}
+
+	switch args[0] {
+	case "test":
+		runRuleTest(args[1:])
+	case "trace":
+		runRuleTrace(args[1:])
+	default:
+		log.Fatal("Unknown rule command; options: test, trace")
+	}
+}
+
+func runRuleTest(args []string) {
+	flags := flag.NewFlagSet("rule test", flag.ExitOnError)
+
+	flagID := flags.String("id", "", "rule node ID")
+	flagStart := flags.String("start", "", "start of the test (RFC3339). Default is 24h before stop")
+	flagStop := flags.String("stop", "", "end of the test (RFC3339). Default is now")
+	flagHistory := flags.String("history", "", "ID of the node that answers history queries (Influx DB node). Default is the SIOT store")
+	flagNatsServer := flags.String("natsServer", defaultNatsServer, "NATS Server")
+	flagAuthToken := flags.String("token", "", "Auth token")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("error: ", err)
+	}
+
+	if *flagID == "" {
+		log.Fatal("rule ID must be given with -id")
+	}
+
+	stop := time.Now()
+	if *flagStop != "" {
+		var err error
+		stop, err = time.Parse(time.RFC3339, *flagStop)
+		if err != nil {
+			log.Fatal("Error parsing stop: ", err)
+		}
+	}
+
+	start := stop.Add(-24 * time.Hour)
+	if *flagStart != "" {
+		var err error
+		start, err = time.Parse(time.RFC3339, *flagStart)
+		if err != nil {
+			log.Fatal("Error parsing start: ", err)
+		}
+	}
+
+	nc := adminConnect(*flagNatsServer, *flagAuthToken)
+
+	results, err := client.RuleBacktest(nc, data.RuleBacktestQuery{
+		RuleID:  *flagID,
+		Start:   start,
+		Stop:    stop,
+		History: *flagHistory,
+	})
+	if err != nil {
+		log.Fatal("Error testing rule: ", err)
+	}
+
+	fired := 0
+	ruleActive := false
+
+	for _, e := range results.Events {
+		state := "inactive"
+		if e.Active {
+			state = "active"
+		}
+
+		switch {
+		case e.Action != "":
+			state = "run " + e.Action
+			if e.TargetNodeID != "" {
+				state += " " + e.TargetNodeID
+			}
+			if e.Point != nil {
+				state += fmt.Sprintf(" %v=%v", e.Point.Type, e.Point.Value)
+				if e.Point.Text != "" {
+					state += fmt.Sprintf(" (%v)", e.Point.Text)
+				}
+			}
+		case e.Error != "":
+			state += ", error: " + e.Error
+		}
+
+		if e.NodeType == data.NodeTypeRule {
+			if e.Active && !ruleActive {
+				fired++
+			}
+			ruleActive = e.Active
+		}
+
+		fmt.Printf("%v  %-14v  %-20v  %v\n", e.Time.Format(time.RFC3339),
+			e.NodeType, e.Description, state)
+	}
+
+	fmt.Printf("Replayed %v points, rule was activated %v times\n",
+		results.Points, fired)
+}
+
+func runRuleTrace(args []string) {
+	flags := flag.NewFlagSet("rule trace", flag.ExitOnError)
+
+	flagID := flags.String("id", "", "rule node ID")
+	flagFollow := flags.Bool("follow", false, "print new evaluations as they happen (sets the rule debug point)")
+	flagNatsServer := flags.String("natsServer", defaultNatsServer, "NATS Server")
+	flagAuthToken := flags.String("token", "", "Auth token")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("error: ", err)
+	}
+
+	if *flagID == "" {
+		log.Fatal("rule ID must be given with -id")
+	}
+
+	nc := adminConnect(*flagNatsServer, *flagAuthToken)
+
+	trace, err := client.GetRuleTrace(nc, *flagID)
+	if err != nil {
+		log.Fatal("Error getting rule trace: ", err)
+	}
+
+	for _, t := range trace {
+		fmt.Print(t)
+	}
+
+	if !*flagFollow {
+		return
+	}
+
+	sub, err := client.WatchRuleTrace(nc, *flagID, func(t data.RuleTrace) {
+		fmt.Print(t)
+	})
+	if err != nil {
+		log.Fatal("Error watching rule trace: ", err)
+	}
+
+	err = client.SendNodePoint(nc, *flagID, data.Point{
+		Type:   data.PointTypeDebug,
+		Value:  1,
+		Origin: "rule trace",
+	}, true)
+	if err != nil {
+		log.Fatal("Error enabling rule debug: ", err)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	_ = sub.Unsubscribe()
+
+	err = client.SendNodePoint(nc, *flagID, data.Point{
+		Type:   data.PointTypeDebug,
+		Value:  0,
+		Origin: "rule trace",
+	}, true)
+	if err != nil {
+		log.Println("Error disabling rule debug: ", err)
+	}
+}
+
+// adminConnect connects to the NATS server for admin commands. Environment
+// variables are used if the options are not given.
+func adminConnect(natsServer, authToken string) *nats.Conn {
+	// only consider env if command line option is something different
+	// that default
+	if natsServer == defaultNatsServer {
+		natsServerE := os.Getenv("SIOT_NATS_SERVER")
+		if natsServerE != "" {
+			natsServer = natsServerE
+		}
+	}
+
+	if authToken == "" {
+		authTokenE := os.Getenv("SIOT_AUTH_TOKEN")
+		if authTokenE != "" {
+			authToken = authTokenE
+		}
+	}
+
+	opts := client.EdgeOptions{
+		URI:       natsServer,
+		AuthToken: authToken,
+		NoEcho:    true,
+		Disconnected: func() {
+			log.Println("NATS Disconnected")
+		},
+		Reconnected: func() {
+			log.Println("NATS Reconnected")
+		},
+		Closed: func() {
+			log.Println("NATS Closed")
+		},
+		Connected: func() {
+			log.Println("NATS Connected")
+		},
+	}
+
+	nc, err := client.EdgeConnect(opts)
+	if err != nil {
+		log.Fatal("Error connecting to NATS server: ", err)
+	}
+
+	return nc
+}
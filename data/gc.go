@@ -0,0 +1,26 @@
+package data
+
+import "fmt"
+
+// GCResults reports the rows purged by store tombstone garbage collection
+type GCResults struct {
+	ErrorMessage string `json:"error,omitempty"`
+	// Nodes that no longer had any edges
+	Nodes int64 `json:"nodes"`
+	// Edges that were deleted or belonged to purged nodes
+	Edges      int64 `json:"edges"`
+	NodePoints int64 `json:"nodePoints"`
+	EdgePoints int64 `json:"edgePoints"`
+	Revisions  int64 `json:"revisions"`
+}
+
+// Total returns the total number of purged rows. Nodes are not stored in
+// their own rows, so they are not included.
+func (r GCResults) Total() int64 {
+	return r.Edges + r.NodePoints + r.EdgePoints + r.Revisions
+}
+
+func (r GCResults) String() string {
+	return fmt.Sprintf("nodes: %v, edges: %v, node points: %v, edge points: %v, revisions: %v",
+		r.Nodes, r.Edges, r.NodePoints, r.EdgePoints, r.Revisions)
+}
@@ -7,6 +7,15 @@ type MsgService struct {
 	SID       string
 	AuthToken string
 	From      string
+	// the following are used for SMTP. TLS is starttls (default), tls, or
+	// none. Template and HTMLTemplate are Go templates for the email body.
+	Server       string
+	Port         int
+	Username     string
+	Password     string
+	TLS          string
+	Template     string
+	HTMLTemplate string
 }
 
 // NodeToMsgService converts a node to message service
@@ -23,6 +32,20 @@ func NodeToMsgService(node Node) (MsgService, error) {
 			ret.AuthToken = p.Text
 		case PointTypeFrom:
 			ret.From = p.Text
+		case PointTypeServer:
+			ret.Server = p.Text
+		case PointTypePort:
+			ret.Port = int(p.Value)
+		case PointTypeUsername:
+			ret.Username = p.Text
+		case PointTypePassword:
+			ret.Password = p.Text
+		case PointTypeTLS:
+			ret.TLS = p.Text
+		case PointTypeTemplate:
+			ret.Template = p.Text
+		case PointTypeHTMLTemplate:
+			ret.HTMLTemplate = p.Text
 		}
 	}
 
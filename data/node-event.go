@@ -0,0 +1,39 @@
+package data
+
+import "time"
+
+// NodeEventType describes a change to the node tree
+type NodeEventType string
+
+// Node event types
+const (
+	// NodeEventCreated is sent when a node is added to a parent, or an
+	// edge is undeleted
+	NodeEventCreated NodeEventType = "created"
+	// NodeEventDeleted is sent when a node is deleted from a parent
+	NodeEventDeleted NodeEventType = "deleted"
+	// NodeEventMoved is sent when a node is removed from OldParent after it
+	// was added to Parent by a move. NodeEventCreated is sent for the new
+	// parent before the move event.
+	NodeEventMoved NodeEventType = "moved"
+	// NodeEventEdgeChanged is sent when edge points (role, node type, etc)
+	// change on an existing edge
+	NodeEventEdgeChanged NodeEventType = "edgeChanged"
+	// NodeEventRescan is sent when the store changed the node tree without
+	// sending events for each node (restore, garbage collection). ID and
+	// NodeType are not set. Watchers should rescan the node tree.
+	NodeEventRescan NodeEventType = "rescan"
+)
+
+// NodeEvent is published by the store when the node tree changes
+type NodeEvent struct {
+	Type     NodeEventType `json:"type"`
+	Time     time.Time     `json:"time"`
+	ID       string        `json:"id"`
+	Parent   string        `json:"parent"`
+	NodeType string        `json:"nodeType"`
+	// OldParent is set for move events
+	OldParent string `json:"oldParent,omitempty"`
+	// Points are the edge points that caused the event
+	Points Points `json:"points,omitempty"`
+}
@@ -57,8 +57,10 @@ type Point struct {
 
 // CRC returns a CRC for the point
 func (p Point) CRC() uint32 {
-	// Node type points are not returned so don't include that in hash
-	if p.Type == PointTypeNodeType {
+	// Node type points are not returned so don't include that in hash.
+	// Password hashes are salted per instance and are never returned or
+	// synced, so they are not included either.
+	if p.Type == PointTypeNodeType || p.Type == PointTypePass {
 		return 0
 	}
 	// we are using this in a XOR checksum, so simply hashing time is probably
@@ -207,6 +209,31 @@ func (ps Points) Find(typ, key string) (Point, bool) {
 	return Point{}, false
 }
 
+// RemoveType returns points without any points of the given type. If there
+// are no points of that type, the original points are returned.
+func (ps Points) RemoveType(typ string) Points {
+	var found bool
+	for _, p := range ps {
+		if p.Type == typ {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return ps
+	}
+
+	ret := make(Points, 0, len(ps))
+	for _, p := range ps {
+		if p.Type != typ {
+			ret = append(ret, p)
+		}
+	}
+
+	return ret
+}
+
 // Value fetches a value from an array of points given ID, Type, and Index.
 // If ID or Type are set to "", they are ignored.
 func (ps *Points) Value(typ, key string) (float64, bool) {
@@ -0,0 +1,299 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Operators that can be used in a PointQuery
+const (
+	QueryOpEqual        = "="
+	QueryOpNotEqual     = "!="
+	QueryOpLess         = "<"
+	QueryOpLessEqual    = "<="
+	QueryOpGreater      = ">"
+	QueryOpGreaterEqual = ">="
+)
+
+// queryOps is ordered so that two character operators are matched first
+var queryOps = []string{QueryOpNotEqual, QueryOpLessEqual, QueryOpGreaterEqual,
+	QueryOpEqual, QueryOpLess, QueryOpGreater}
+
+// NodeQuery is used to find nodes by node type and point values. All
+// conditions must match for a node to be returned.
+type NodeQuery struct {
+	// Root limits the query to this node and its descendants. If blank,
+	// all nodes are searched.
+	Root string `json:"root,omitempty"`
+	// Type is the node type to match. If blank, all types match.
+	Type string `json:"type,omitempty"`
+	// IncludeDeleted returns deleted nodes. Descendants of deleted nodes
+	// are only searched if this is set.
+	IncludeDeleted bool `json:"includeDeleted,omitempty"`
+	// Points are conditions on node points
+	Points []PointQuery `json:"points,omitempty"`
+}
+
+// PointQuery matches a node if any point of Type and Key that is not
+// deleted matches the comparison. A node without a matching point does not
+// match.
+type PointQuery struct {
+	Type string `json:"type"`
+	// Key of the point. If blank, points with any key are compared.
+	Key string `json:"key,omitempty"`
+	// Op is one of the QueryOp* operators
+	Op    string  `json:"op"`
+	Value float64 `json:"value,omitempty"`
+	Text  string  `json:"text,omitempty"`
+	// CompareText compares the point Text with Text instead of the point
+	// Value with Value
+	CompareText bool `json:"compareText,omitempty"`
+}
+
+// NodeQueryResults is returned from a node query
+type NodeQueryResults struct {
+	ErrorMessage string     `json:"error,omitempty"`
+	Nodes        []NodeEdge `json:"nodes"`
+}
+
+// Validate checks that the query can be run
+func (q NodeQuery) Validate() error {
+	for _, f := range q.Points {
+		if f.Type == "" {
+			return errors.New("point query type must be set")
+		}
+
+		if f.Type == PointTypePass {
+			return errors.New("password points can not be queried")
+		}
+
+		if !validQueryOp(f.Op) {
+			return fmt.Errorf("invalid point query operator: %v", f.Op)
+		}
+	}
+
+	return nil
+}
+
+// MatchPoints returns true if points match all the point conditions of the query
+func (q NodeQuery) MatchPoints(points Points) bool {
+	for _, f := range q.Points {
+		if !f.MatchPoints(points) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// MatchPoints returns true if any point that is not deleted matches the query
+func (f PointQuery) MatchPoints(points Points) bool {
+	for _, p := range points {
+		if f.Match(p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Match returns true if a point matches the query. Deleted points never
+// match.
+func (f PointQuery) Match(p Point) bool {
+	if p.Tombstone%2 == 1 || p.Type != f.Type {
+		return false
+	}
+
+	if f.Key != "" && p.Key != f.Key {
+		return false
+	}
+
+	var c int
+	if f.CompareText {
+		c = strings.Compare(p.Text, f.Text)
+	} else {
+		switch {
+		case p.Value < f.Value:
+			c = -1
+		case p.Value > f.Value:
+			c = 1
+		}
+	}
+
+	switch f.Op {
+	case QueryOpEqual:
+		return c == 0
+	case QueryOpNotEqual:
+		return c != 0
+	case QueryOpLess:
+		return c < 0
+	case QueryOpLessEqual:
+		return c <= 0
+	case QueryOpGreater:
+		return c > 0
+	case QueryOpGreaterEqual:
+		return c >= 0
+	}
+
+	return false
+}
+
+func validQueryOp(op string) bool {
+	for _, o := range queryOps {
+		if op == o {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNodeQuery parses the text form of a node query. The query is a list
+// of space separated terms that all must match:
+//
+//	type=<node type>          match the node type
+//	root=<node id>            only search this node and its descendants
+//	deleted=true              include deleted nodes
+//	<point type>[.<key>]<op><value>
+//
+// Point terms compare a point with one of =, !=, <, <=, >, >=. Numbers and
+// true/false are compared with the point value, and anything else is compared
+// with the point text. Text that contains spaces or looks like a number can be
+// double quoted. Examples:
+//
+//	type=modbusIo error!=""
+//	type=device sysState=offline
+//	root=123 type=variable value.0>=10.5
+func ParseNodeQuery(query string) (NodeQuery, error) {
+	var ret NodeQuery
+
+	terms, err := splitQuery(query)
+	if err != nil {
+		return ret, err
+	}
+
+	for _, term := range terms {
+		name, op, value, err := splitTerm(term)
+		if err != nil {
+			return ret, err
+		}
+
+		switch name {
+		case "type", "root", "deleted":
+			if op != QueryOpEqual {
+				return ret, fmt.Errorf("only = can be used with %v", name)
+			}
+
+			text, err := unquote(value)
+			if err != nil {
+				return ret, err
+			}
+
+			switch name {
+			case "type":
+				ret.Type = text
+			case "root":
+				ret.Root = text
+			case "deleted":
+				ret.IncludeDeleted, err = strconv.ParseBool(text)
+				if err != nil {
+					return ret, fmt.Errorf("invalid deleted value: %v", text)
+				}
+			}
+
+			continue
+		}
+
+		f := PointQuery{Op: op}
+		f.Type, f.Key, _ = strings.Cut(name, ".")
+
+		switch {
+		case strings.HasPrefix(value, `"`):
+			f.CompareText = true
+			f.Text, err = unquote(value)
+			if err != nil {
+				return ret, err
+			}
+		case value == "true":
+			f.Value = 1
+		case value == "false":
+			f.Value = 0
+		default:
+			f.Value, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				f.CompareText = true
+				f.Text = value
+			}
+		}
+
+		ret.Points = append(ret.Points, f)
+	}
+
+	return ret, ret.Validate()
+}
+
+// splitQuery splits a query into terms on spaces that are not quoted
+func splitQuery(query string) ([]string, error) {
+	var ret []string
+	var term strings.Builder
+	var quoted, escaped bool
+
+	for _, r := range query {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if term.Len() > 0 {
+				ret = append(ret, term.String())
+				term.Reset()
+			}
+			continue
+		}
+
+		term.WriteRune(r)
+	}
+
+	if quoted {
+		return nil, errors.New("unterminated quote in query")
+	}
+
+	if term.Len() > 0 {
+		ret = append(ret, term.String())
+	}
+
+	return ret, nil
+}
+
+// splitTerm splits a query term into name, operator, and value
+func splitTerm(term string) (string, string, string, error) {
+	i := strings.IndexAny(term, "=!<>")
+	if i <= 0 {
+		return "", "", "", fmt.Errorf("invalid query term: %v", term)
+	}
+
+	for _, op := range queryOps {
+		if strings.HasPrefix(term[i:], op) {
+			return term[:i], op, term[i+len(op):], nil
+		}
+	}
+
+	return "", "", "", fmt.Errorf("invalid operator in query term: %v", term)
+}
+
+func unquote(value string) (string, error) {
+	if !strings.HasPrefix(value, `"`) {
+		return value, nil
+	}
+
+	ret, err := strconv.Unquote(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid quoted text: %v", value)
+	}
+
+	return ret, nil
+}
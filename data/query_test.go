@@ -0,0 +1,82 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNodeQuery(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected NodeQuery
+	}{
+		{"", NodeQuery{}},
+		{"type=modbusIo", NodeQuery{Type: "modbusIo"}},
+		{"root=123 deleted=true", NodeQuery{Root: "123", IncludeDeleted: true}},
+		{`type=modbusIo error!=""`, NodeQuery{Type: "modbusIo", Points: []PointQuery{
+			{Type: "error", Op: QueryOpNotEqual, CompareText: true}}}},
+		{"sysState=offline", NodeQuery{Points: []PointQuery{
+			{Type: "sysState", Op: QueryOpEqual, Text: "offline", CompareText: true}}}},
+		{"value.2>=10.5  disabled=false", NodeQuery{Points: []PointQuery{
+			{Type: "value", Key: "2", Op: QueryOpGreaterEqual, Value: 10.5},
+			{Type: "disabled", Op: QueryOpEqual, Value: 0}}}},
+		{`description="pump 1" value<-1`, NodeQuery{Points: []PointQuery{
+			{Type: "description", Op: QueryOpEqual, Text: "pump 1", CompareText: true},
+			{Type: "value", Op: QueryOpLess, Value: -1}}}},
+		{`description="a \"quoted\" name"`, NodeQuery{Points: []PointQuery{
+			{Type: "description", Op: QueryOpEqual, Text: `a "quoted" name`, CompareText: true}}}},
+	}
+
+	for _, test := range tests {
+		q, err := ParseNodeQuery(test.query)
+		if err != nil {
+			t.Errorf("query %v, error: %v", test.query, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(q, test.expected) {
+			t.Errorf("query %v, expected %+v, got %+v", test.query, test.expected, q)
+		}
+	}
+
+	bad := []string{"type", "=modbusIo", "type>modbusIo", "deleted=maybe", `error="`,
+		"value!10", "pass=secret"}
+
+	for _, b := range bad {
+		_, err := ParseNodeQuery(b)
+		if err == nil {
+			t.Errorf("query %v should have failed", b)
+		}
+	}
+}
+
+func TestPointQueryMatch(t *testing.T) {
+	points := Points{
+		{Type: PointTypeValue, Key: "0", Value: 5},
+		{Type: PointTypeValue, Key: "1", Value: 10, Tombstone: 1},
+		{Type: PointTypeError, Key: "0", Text: "timeout"},
+		// deleted and then added again
+		{Type: PointTypeErrorCount, Key: "0", Value: 20, Tombstone: 2},
+	}
+
+	tests := []struct {
+		query    PointQuery
+		expected bool
+	}{
+		{PointQuery{Type: PointTypeValue, Op: QueryOpEqual, Value: 5}, true},
+		{PointQuery{Type: PointTypeValue, Op: QueryOpGreater, Value: 5}, false},
+		{PointQuery{Type: PointTypeValue, Key: "1", Op: QueryOpEqual, Value: 10}, false},
+		{PointQuery{Type: PointTypeErrorCount, Op: QueryOpEqual, Value: 20}, true},
+		{PointQuery{Type: PointTypeValue, Op: QueryOpLessEqual, Value: 5}, true},
+		{PointQuery{Type: PointTypeError, Op: QueryOpNotEqual, CompareText: true}, true},
+		{PointQuery{Type: PointTypeError, Op: QueryOpEqual, Text: "timeout",
+			CompareText: true}, true},
+		{PointQuery{Type: PointTypeDescription, Op: QueryOpNotEqual, CompareText: true}, false},
+	}
+
+	for _, test := range tests {
+		if test.query.MatchPoints(points) != test.expected {
+			t.Errorf("query %+v, expected %v", test.query, test.expected)
+		}
+	}
+}
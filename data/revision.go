@@ -0,0 +1,27 @@
+package data
+
+import "time"
+
+// Revision is a recorded change to the points of a node. Revisions are only
+// recorded for points that have Origin set (changes made by users, rules,
+// other nodes, etc). Points a client generates for its own node, such as
+// measurements, are not recorded.
+type Revision struct {
+	ID     int64     `json:"id"`
+	NodeID string    `json:"nodeId"`
+	Time   time.Time `json:"time"`
+	Origin string    `json:"origin,omitempty"`
+	// User is set if Origin is a user node
+	User   string `json:"user,omitempty"`
+	Points Points `json:"points"`
+	// Previous contains the point values before this revision and is
+	// indexed the same as Points. If a point did not exist before this
+	// revision, the previous point has a zero Time.
+	Previous Points `json:"previous"`
+}
+
+// RevisionResults is returned by a revisions request
+type RevisionResults struct {
+	ErrorMessage string     `json:"error,omitempty"`
+	Revisions    []Revision `json:"revisions,omitempty"`
+}
@@ -0,0 +1,38 @@
+package data
+
+import "time"
+
+// RuleBacktestQuery is sent to the rule.backtest subject to replay the
+// history of the points used by a rule through the rule conditions
+type RuleBacktestQuery struct {
+	RuleID string    `json:"ruleID"`
+	Start  time.Time `json:"start"`
+	Stop   time.Time `json:"stop"`
+	// History is the ID of the node that answers history queries, for
+	// example an Influx DB node. If not set, the history stored in the SIOT
+	// store is used.
+	History string `json:"history,omitempty"`
+}
+
+// RuleBacktestEvent is a change of the active or error state of a rule,
+// condition, or condition group, or an action that would have run
+type RuleBacktestEvent struct {
+	Time        time.Time `json:"time"`
+	NodeID      string    `json:"nodeID"`
+	NodeType    string    `json:"nodeType"`
+	Description string    `json:"description,omitempty"`
+	Active      bool      `json:"active"`
+	Error       string    `json:"error,omitempty"`
+	// the following are set for actions
+	Action       string `json:"action,omitempty"`
+	TargetNodeID string `json:"targetNodeID,omitempty"`
+	Point        *Point `json:"point,omitempty"`
+}
+
+// RuleBacktestResults is the result of a rule backtest. Events are sorted by
+// time.
+type RuleBacktestResults struct {
+	ErrorMessage string              `json:"error,omitempty"`
+	Points       int                 `json:"points"`
+	Events       []RuleBacktestEvent `json:"events,omitempty"`
+}
@@ -0,0 +1,96 @@
+package data
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RuleTrace is one evaluation of a rule: the points that triggered it, the
+// value each condition saw, the resulting rule state, and the actions that
+// ran.
+type RuleTrace struct {
+	Time time.Time `json:"time"`
+	// NodeID is the node the points were received from. Schedule, delay,
+	// and stale checks are trigger points from the rule itself.
+	NodeID     string               `json:"nodeID"`
+	Points     Points               `json:"points"`
+	Conditions []RuleTraceCondition `json:"conditions,omitempty"`
+	Active     bool                 `json:"active"`
+	Changed    bool                 `json:"changed"`
+	Actions    []RuleTraceAction    `json:"actions,omitempty"`
+}
+
+// RuleTraceCondition is the state of a condition after it evaluated a point
+type RuleTraceCondition struct {
+	ID          string `json:"id"`
+	Description string `json:"description,omitempty"`
+	// Value is the number the condition compared, and Text the text value
+	// or the schedule time, last stale update, or expression variables.
+	Value float64 `json:"value"`
+	Text  string  `json:"text,omitempty"`
+	// Met is true if the condition is met. Active can differ from Met until
+	// the min active or clear delay expires.
+	Met    bool   `json:"met"`
+	Active bool   `json:"active"`
+	Error  string `json:"error,omitempty"`
+}
+
+// RuleTraceAction is an action that ran
+type RuleTraceAction struct {
+	ID          string `json:"id"`
+	Description string `json:"description,omitempty"`
+	Action      string `json:"action"`
+	NodeID      string `json:"nodeID,omitempty"`
+	Point       *Point `json:"point,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// RuleTraceResults is the response to a rule trace request. The trace is
+// oldest first.
+type RuleTraceResults struct {
+	ErrorMessage string      `json:"error,omitempty"`
+	Trace        []RuleTrace `json:"trace,omitempty"`
+}
+
+func (rt RuleTrace) String() string {
+	var points []string
+	for _, p := range rt.Points {
+		points = append(points, strings.TrimSpace(p.String()))
+	}
+
+	ret := fmt.Sprintf("%v  NODE:%v  %v\n", rt.Time.Format(time.RFC3339Nano),
+		rt.NodeID, strings.Join(points, ", "))
+
+	for _, c := range rt.Conditions {
+		value := c.Text
+		if value == "" {
+			value = strconv.FormatFloat(c.Value, 'f', -1, 64)
+		}
+		ret += fmt.Sprintf("  COND: %v  V:%v  MET:%v  A:%v", c.Description,
+			value, c.Met, c.Active)
+		if c.Error != "" {
+			ret += fmt.Sprintf("  ERR:%v", c.Error)
+		}
+		ret += "\n"
+	}
+
+	ret += fmt.Sprintf("  RULE: A:%v  CHANGED:%v\n", rt.Active, rt.Changed)
+
+	for _, a := range rt.Actions {
+		ret += fmt.Sprintf("  ACTION: %v  ACT:%v", a.Description, a.Action)
+		if a.NodeID != "" {
+			ret += fmt.Sprintf("  NODEID:%v", a.NodeID)
+		}
+		if a.Point != nil {
+			ret += fmt.Sprintf("  %v", strings.TrimSpace(a.Point.String()))
+		}
+		if a.Error != "" {
+			ret += fmt.Sprintf("  ERR:%v", a.Error)
+		}
+		ret += "\n"
+	}
+
+	return ret
+}
@@ -74,10 +74,14 @@ const (
 	PointTypeEmail     = "email"
 	PointTypePass      = "pass"
 
-	// user edge points
+	// user edge points. The role controls access to the subtree of the
+	// group the user belongs to. Admin and user roles can read and write,
+	// and the read role can only read. Users without a role can read and
+	// write.
 	PointTypeRole       = "role"
 	PointValueRoleAdmin = "admin"
 	PointValueRoleUser  = "user"
+	PointValueRoleRead  = "read"
 
 	// User Authentication
 	NodeTypeJWT    = "jwt"
@@ -135,18 +139,30 @@ const (
 
 	NodeTypeCondition = "condition"
 
+	NodeTypeConditionGroup = "conditionGroup"
+	PointValueAnd          = "and"
+	PointValueOr           = "or"
+	PointValueNot          = "not"
+
 	PointTypeConditionType = "conditionType"
 	PointValuePointValue   = "pointValue"
 	PointValueSchedule     = "schedule"
+	PointValueExpression   = "expression"
+	PointValueStale        = "stale"
 
 	PointTypeNodeID = "nodeID"
 
 	PointTypeTrigger = "trigger"
 
-	PointTypeStart   = "start"
-	PointTypeEnd     = "end"
-	PointTypeWeekday = "weekday"
-	PointTypeDate    = "date"
+	PointTypeStart     = "start"
+	PointTypeEnd       = "end"
+	PointTypeWeekday   = "weekday"
+	PointTypeDate      = "date"
+	PointTypeTimezone  = "timezone"
+	PointTypeCron      = "cron"
+	PointTypeDuration  = "duration"
+	PointTypeLatitude  = "latitude"
+	PointTypeLongitude = "longitude"
 
 	PointTypePointID    = "pointID"
 	PointTypePointKey   = "pointKey"
@@ -168,7 +184,23 @@ const (
 
 	PointTypeValueText = "valueText"
 
-	PointTypeMinActive = "minActive"
+	PointTypeExpression = "expression"
+	PointTypeVariable   = "variable"
+
+	PointTypeMinActive     = "minActive"
+	PointTypeClearDelay    = "clearDelay"
+	PointTypeHysteresis    = "hysteresis"
+	PointTypeValueOff      = "valueOff"
+	PointTypeDeadband      = "deadband"
+	PointTypeAverageWindow = "averageWindow"
+	PointTypeStaleTime     = "staleTime"
+	PointTypeWindow        = "window"
+	PointTypeSignal        = "signal"
+	PointValueRate         = "rate"
+	PointValueMin          = "min"
+	PointValueMax          = "max"
+	PointValueAverage      = "average"
+	PointValueStdDev       = "stdDev"
 
 	NodeTypeAction         = "action"
 	NodeTypeActionInactive = "actionInactive"
@@ -178,6 +210,25 @@ const (
 	PointValueNotify    = "notify"
 	PointValueSetValue  = "setValue"
 	PointValuePlayAudio = "playAudio"
+	PointValueWebhook   = "webhook"
+	PointValuePublish   = "publish"
+	PointValueCommand   = "command"
+
+	PointTypeURL      = "url"
+	PointTypeHeader   = "header"
+	PointTypeTemplate = "template"
+	PointTypeRetries  = "retries"
+	PointTypeTimeout  = "timeout"
+	PointTypeSubject  = "subject"
+	PointTypeCommand  = "command"
+
+	PointTypeDelay            = "delay"
+	PointTypePulse            = "pulse"
+	PointTypePulseValue       = "pulseValue"
+	PointTypeRamp             = "ramp"
+	PointTypeRampStep         = "rampStep"
+	PointTypeConfirmPointType = "confirmPointType"
+	PointTypeConfirmValue     = "confirmValue"
 
 	// Transient points that are used for notifications, etc.
 	// These points are not stored in the state of any node,
@@ -185,6 +236,18 @@ const (
 	PointMsgAll  = "msgAll"
 	PointMsgUser = "msgUser"
 
+	NodeTypeNotification = "notification"
+
+	PointTypeMessage      = "message"
+	PointTypeSourceNode   = "sourceNode"
+	PointTypeSourceAction = "sourceAction"
+	PointTypeCreated      = "created"
+	PointTypeEscalate     = "escalate"
+	PointTypeLevel        = "level"
+	PointTypeNotified     = "notified"
+	PointTypeAck          = "ack"
+	PointTypeRepeat       = "repeat"
+
 	NodeTypeMsgService = "msgService"
 
 	PointTypeService = "service"
@@ -196,11 +259,20 @@ const (
 	PointTypeAuthToken = "authToken"
 	PointTypeFrom      = "from"
 
+	PointTypeUsername     = "username"
+	PointTypePassword     = "password"
+	PointTypeTLS          = "tls"
+	PointTypeHTMLTemplate = "htmlTemplate"
+
 	NodeTypeVariable      = "variable"
 	PointTypeVariableType = "variableType"
 
 	NodeTypeSync = "sync"
 
+	NodeTypePlugin = "plugin"
+	PointTypePath  = "path"
+	PointTypeArg   = "arg"
+
 	PointTypeMetricNatsCycleNodePoint          = "metricNatsCycleNodePoint"
 	PointTypeMetricNatsCycleNodeEdgePoint      = "metricNatsCycleNodeEdgePoint"
 	PointTypeMetricNatsCycleNode               = "metricNatsCycleNode"
@@ -209,6 +281,18 @@ const (
 	PointTypeMetricNatsPendingNodeEdgePoint    = "metricNatsPendingNodeEdgePoint"
 	PointTypeMetricNatsThroughputNodePoint     = "metricNatsThroughputNodePoint"
 	PointTypeMetricNatsThroughputNodeEdgePoint = "metricNatsThroughputNodeEdgePoint"
+	PointTypeMetricStoreCacheHitPercent        = "metricStoreCacheHitPercent"
+	PointTypeMetricStoreCacheNodes             = "metricStoreCacheNodes"
+
+	// client status points written by client.Manager on managed nodes
+	PointTypeClientState    = "clientState"
+	PointTypeClientStart    = "clientStart"
+	PointTypeClientRestarts = "clientRestarts"
+	PointTypeClientError    = "clientError"
+
+	PointValueClientStateRunning = "running"
+	PointValueClientStateError   = "error"
+	PointValueClientStateStopped = "stopped"
 
 	// serial MCU clients
 	NodeTypeSerialDev         = "serialDev"
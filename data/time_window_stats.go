@@ -0,0 +1,138 @@
+package data
+
+import (
+	"math"
+	"time"
+)
+
+// TimeWindowStats keeps the points received in a sliding time window, and
+// calculates statistics of the point values in the window. Unlike
+// TimeWindowAverager, the window moves with each point.
+type TimeWindowStats struct {
+	windowLen time.Duration
+	points    []Point
+}
+
+// NewTimeWindowStats initializes and returns a TimeWindowStats
+func NewTimeWindowStats(windowLen time.Duration) *TimeWindowStats {
+	return &TimeWindowStats{windowLen: windowLen}
+}
+
+// NewPoint adds a point to the window, and drops points older than the window
+// length from the newest point. Points without a time are set to the current
+// time.
+func (tws *TimeWindowStats) NewPoint(p Point) {
+	if p.Time.IsZero() {
+		p.Time = time.Now()
+	}
+
+	// keep points sorted by time
+	i := len(tws.points)
+	for i > 0 && tws.points[i-1].Time.After(p.Time) {
+		i--
+	}
+	tws.points = append(tws.points, Point{})
+	copy(tws.points[i+1:], tws.points[i:])
+	tws.points[i] = p
+
+	start := tws.points[len(tws.points)-1].Time.Add(-tws.windowLen)
+	drop := 0
+	for drop < len(tws.points) && tws.points[drop].Time.Before(start) {
+		drop++
+	}
+	tws.points = tws.points[drop:]
+}
+
+// Count returns the number of points in the window
+func (tws *TimeWindowStats) Count() int {
+	return len(tws.points)
+}
+
+// Min returns the minimum value in the window
+func (tws *TimeWindowStats) Min() float64 {
+	if len(tws.points) == 0 {
+		return 0
+	}
+
+	ret := tws.points[0].Value
+	for _, p := range tws.points[1:] {
+		ret = math.Min(ret, p.Value)
+	}
+	return ret
+}
+
+// Max returns the maximum value in the window
+func (tws *TimeWindowStats) Max() float64 {
+	if len(tws.points) == 0 {
+		return 0
+	}
+
+	ret := tws.points[0].Value
+	for _, p := range tws.points[1:] {
+		ret = math.Max(ret, p.Value)
+	}
+	return ret
+}
+
+// Average returns the average value in the window
+func (tws *TimeWindowStats) Average() float64 {
+	if len(tws.points) == 0 {
+		return 0
+	}
+
+	var total float64
+	for _, p := range tws.points {
+		total += p.Value
+	}
+	return total / float64(len(tws.points))
+}
+
+// StdDev returns the (population) standard deviation of the values in the
+// window
+func (tws *TimeWindowStats) StdDev() float64 {
+	if len(tws.points) == 0 {
+		return 0
+	}
+
+	avg := tws.Average()
+
+	var total float64
+	for _, p := range tws.points {
+		total += (p.Value - avg) * (p.Value - avg)
+	}
+	return math.Sqrt(total / float64(len(tws.points)))
+}
+
+// Rate returns the rate of change per minute in the window, calculated with a
+// least squares fit of the values. false is returned if there are not at
+// least two points at different times.
+func (tws *TimeWindowStats) Rate() (float64, bool) {
+	if len(tws.points) < 2 {
+		return 0, false
+	}
+
+	start := tws.points[0].Time
+	n := float64(len(tws.points))
+
+	var sumT, sumV float64
+	for _, p := range tws.points {
+		sumT += p.Time.Sub(start).Minutes()
+		sumV += p.Value
+	}
+
+	avgT := sumT / n
+	avgV := sumV / n
+
+	var num, den float64
+	for _, p := range tws.points {
+		dt := p.Time.Sub(start).Minutes() - avgT
+		num += dt * (p.Value - avgV)
+		den += dt * dt
+	}
+
+	if den == 0 {
+		return 0, false
+	}
+
+	return num / den, true
+}
@@ -0,0 +1,62 @@
+package data
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTimeWindowStats(t *testing.T) {
+	start := time.Now()
+
+	tws := NewTimeWindowStats(5 * time.Minute)
+
+	if _, ok := tws.Rate(); ok {
+		t.Error("rate with no points should not be valid")
+	}
+
+	// value rises 2 per minute
+	for i := 0; i < 10; i++ {
+		tws.NewPoint(Point{Time: start.Add(time.Duration(i) * time.Minute),
+			Value: float64(i * 2)})
+	}
+
+	// points at 4..9 minutes are in the window
+	if tws.Count() != 6 {
+		t.Fatal("wrong count: ", tws.Count())
+	}
+
+	if tws.Min() != 8 {
+		t.Error("wrong min: ", tws.Min())
+	}
+
+	if tws.Max() != 18 {
+		t.Error("wrong max: ", tws.Max())
+	}
+
+	if tws.Average() != 13 {
+		t.Error("wrong average: ", tws.Average())
+	}
+
+	// values 8, 10, ... 18
+	if math.Abs(tws.StdDev()-math.Sqrt(35.0/3)) > 1e-9 {
+		t.Error("wrong std dev: ", tws.StdDev())
+	}
+
+	rate, ok := tws.Rate()
+	if !ok || math.Abs(rate-2) > 1e-9 {
+		t.Error("wrong rate: ", rate, ok)
+	}
+
+	// an old point does not move the window back
+	tws.NewPoint(Point{Time: start, Value: 100})
+	if tws.Count() != 6 || tws.Max() != 18 {
+		t.Error("old point was not dropped")
+	}
+
+	// out of order point in the window
+	tws.NewPoint(Point{Time: start.Add(8*time.Minute + 30*time.Second), Value: 17})
+	if tws.Count() != 7 {
+		t.Error("out of order point was not added")
+	}
+}
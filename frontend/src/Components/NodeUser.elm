@@ -54,7 +54,7 @@ view o =
                     , textInput Point.typeLastName "Last Name" ""
                     , textInputLowerCase Point.typeEmail "Email" ""
                     , textInput Point.typePhone "Phone" ""
-                    , textInput Point.typePass "Pass" ""
+                    , textInput Point.typePass "Pass" "unchanged"
                     , NodeInputs.nodeKeyValueInput opts Point.typeTag "Tags" "Add Tag"
                     ]
 
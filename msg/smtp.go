@@ -0,0 +1,250 @@
+package msg
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTP TLS modes
+const (
+	// SMTPStartTLS upgrades the connection with STARTTLS. This is the
+	// default and is usually used on port 587.
+	SMTPStartTLS = "starttls"
+	// SMTPTLS connects with TLS, usually on port 465
+	SMTPTLS = "tls"
+	// SMTPNone does not encrypt the connection. Passwords are only sent to
+	// localhost without TLS.
+	SMTPNone = "none"
+)
+
+// smtpTimeout is the timeout for sending an email
+const smtpTimeout = 30 * time.Second
+
+// SMTP can be used to send email through an SMTP server
+type SMTP struct {
+	server   string
+	port     int
+	username string
+	password string
+	from     string
+	tlsMode  string
+	// used by tests to trust the server certificate
+	tlsConfig *tls.Config
+}
+
+// NewSMTP creates a new SMTP messenger. If port is 0, the default port of the
+// TLS mode is used. If username is set, the server must support AUTH PLAIN.
+func NewSMTP(server string, port int, username, password, from, tlsMode string) *SMTP {
+	if tlsMode == "" {
+		tlsMode = SMTPStartTLS
+	}
+
+	if port == 0 {
+		switch tlsMode {
+		case SMTPTLS:
+			port = 465
+		case SMTPNone:
+			port = 25
+		default:
+			port = 587
+		}
+	}
+
+	return &SMTP{
+		server:   server,
+		port:     port,
+		username: username,
+		password: password,
+		from:     from,
+		tlsMode:  tlsMode,
+	}
+}
+
+// SendEmail sends an email. If html is set, the email has a plain text and
+// an HTML part.
+func (m *SMTP) SendEmail(to, subject, text, html string) error {
+	if m.server == "" {
+		return errors.New("SMTP server not set")
+	}
+
+	if m.from == "" {
+		return errors.New("SMTP from address not set")
+	}
+
+	body, err := m.message(to, subject, text, html)
+	if err != nil {
+		return err
+	}
+
+	c, err := m.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if m.tlsMode == SMTPStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("SMTP server does not support STARTTLS")
+		}
+
+		err = c.StartTLS(m.tlsClientConfig())
+		if err != nil {
+			return fmt.Errorf("STARTTLS error: %w", err)
+		}
+	}
+
+	if m.username != "" {
+		err = c.Auth(smtp.PlainAuth("", m.username, m.password, m.server))
+		if err != nil {
+			return fmt.Errorf("SMTP auth error: %w", err)
+		}
+	}
+
+	err = c.Mail(m.from)
+	if err != nil {
+		return err
+	}
+
+	err = c.Rcpt(to)
+	if err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(body)
+	if err != nil {
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+func (m *SMTP) tlsClientConfig() *tls.Config {
+	if m.tlsConfig != nil {
+		ret := m.tlsConfig.Clone()
+		ret.ServerName = m.server
+		return ret
+	}
+	return &tls.Config{ServerName: m.server}
+}
+
+func (m *SMTP) dial() (*smtp.Client, error) {
+	addr := net.JoinHostPort(m.server, strconv.Itoa(m.port))
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+
+	var conn net.Conn
+	var err error
+
+	if m.tlsMode == SMTPTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, m.tlsClientConfig())
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.SetDeadline(time.Now().Add(smtpTimeout))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c, err := smtp.NewClient(conn, m.server)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// message formats the email headers and body
+func (m *SMTP) message(to, subject, text, html string) ([]byte, error) {
+	if strings.ContainsAny(to+m.from, "\r\n") {
+		return nil, errors.New("invalid email address")
+	}
+
+	buf := new(bytes.Buffer)
+
+	fmt.Fprintf(buf, "From: %v\r\n", m.from)
+	fmt.Fprintf(buf, "To: %v\r\n", to)
+	fmt.Fprintf(buf, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(buf, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	if html == "" {
+		buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+		err := writeQuotedPrintable(buf, text)
+		if err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(buf)
+
+	fmt.Fprintf(buf, "Content-Type: multipart/alternative; boundary=%v\r\n\r\n",
+		mw.Boundary())
+
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain", text},
+		{"text/html", html},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		err = writeQuotedPrintable(w, part.body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := mw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qw := quotedprintable.NewWriter(w)
+
+	_, err := qw.Write([]byte(s))
+	if err != nil {
+		return err
+	}
+
+	return qw.Close()
+}
@@ -0,0 +1,313 @@
+package msg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpStandIn is a minimal SMTP server used to test the SMTP client
+type smtpStandIn struct {
+	ln        net.Listener
+	tlsConfig *tls.Config
+	// offer STARTTLS
+	startTLS bool
+	mails    chan smtpMail
+}
+
+type smtpMail struct {
+	tls  bool
+	auth string
+	from string
+	to   string
+	data []byte
+}
+
+func newSMTPStandIn(t *testing.T, implicitTLS, startTLS bool) (*smtpStandIn, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Error generating key: ", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "smtp test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("Error creating certificate: ", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("Error parsing certificate: ", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	s := &smtpStandIn{
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+		}}},
+		startTLS: startTLS,
+		mails:    make(chan smtpMail, 1),
+	}
+
+	s.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error listening: ", err)
+	}
+
+	if implicitTLS {
+		s.ln = tls.NewListener(s.ln, s.tlsConfig)
+	}
+
+	t.Cleanup(func() { s.ln.Close() })
+
+	go func() {
+		for {
+			conn, err := s.ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, implicitTLS)
+		}
+	}()
+
+	return s, pool
+}
+
+func (s *smtpStandIn) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpStandIn) serve(conn net.Conn, isTLS bool) {
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+	_ = tp.PrintfLine("220 localhost ESMTP")
+
+	m := smtpMail{tls: isTLS}
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		cmd, arg, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(cmd) {
+		case "EHLO":
+			ext := []string{"localhost", "AUTH PLAIN"}
+			if s.startTLS && !m.tls {
+				ext = append(ext, "STARTTLS")
+			}
+			for i, e := range ext {
+				sep := "-"
+				if i == len(ext)-1 {
+					sep = " "
+				}
+				_ = tp.PrintfLine("250%v%v", sep, e)
+			}
+		case "STARTTLS":
+			_ = tp.PrintfLine("220 ready")
+			tc := tls.Server(conn, s.tlsConfig)
+			if tc.Handshake() != nil {
+				return
+			}
+			conn = tc
+			tp = textproto.NewConn(tc)
+			m.tls = true
+		case "AUTH":
+			_, resp, _ := strings.Cut(arg, " ")
+			d, _ := base64.StdEncoding.DecodeString(resp)
+			m.auth = string(d)
+			_ = tp.PrintfLine("235 ok")
+		case "MAIL":
+			m.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			_ = tp.PrintfLine("250 ok")
+		case "RCPT":
+			m.to = strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			_ = tp.PrintfLine("250 ok")
+		case "DATA":
+			_ = tp.PrintfLine("354 go ahead")
+			m.data, err = tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			_ = tp.PrintfLine("250 ok")
+			s.mails <- m
+		case "QUIT":
+			_ = tp.PrintfLine("221 bye")
+			return
+		default:
+			_ = tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func (s *smtpStandIn) mail(t *testing.T) smtpMail {
+	select {
+	case m := <-s.mails:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for mail")
+	}
+	return smtpMail{}
+}
+
+// readPart returns the decoded body of a quoted printable part
+func readPart(t *testing.T, r io.Reader) string {
+	d, err := io.ReadAll(quotedprintable.NewReader(r))
+	if err != nil {
+		t.Fatal("Error reading part: ", err)
+	}
+	return string(d)
+}
+
+func TestSMTPStartTLS(t *testing.T) {
+	s, pool := newSMTPStandIn(t, false, true)
+
+	m := NewSMTP("127.0.0.1", s.port(), "siot", "secret", "siot@example.com", "")
+	m.tlsConfig = &tls.Config{RootCAs: pool}
+
+	err := m.SendEmail("joe@example.com", "Tank level high ✓", "level is 95%",
+		"<p>level is <b>95%</b></p>")
+	if err != nil {
+		t.Fatal("Error sending email: ", err)
+	}
+
+	got := s.mail(t)
+
+	if !got.tls {
+		t.Error("connection was not upgraded to TLS")
+	}
+
+	if got.auth != "\x00siot\x00secret" {
+		t.Errorf("wrong auth: %q", got.auth)
+	}
+
+	if got.from != "siot@example.com" || got.to != "joe@example.com" {
+		t.Error("wrong envelope: ", got.from, got.to)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(got.data)))
+	if err != nil {
+		t.Fatal("Error parsing email: ", err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Tank level high ✓" {
+		t.Errorf("wrong subject: %q, %v", subject, err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatal("wrong content type: ", mediaType, err)
+	}
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+
+	expected := []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", "level is 95%"},
+		{"text/html; charset=utf-8", "<p>level is <b>95%</b></p>"},
+	}
+
+	for _, e := range expected {
+		p, err := mr.NextRawPart()
+		if err != nil {
+			t.Fatal("Error reading part: ", err)
+		}
+
+		if ct := p.Header.Get("Content-Type"); ct != e.contentType {
+			t.Error("wrong part content type: ", ct)
+		}
+
+		if body := readPart(t, p); body != e.body {
+			t.Errorf("wrong %v body: %q", e.contentType, body)
+		}
+	}
+}
+
+func TestSMTPImplicitTLS(t *testing.T) {
+	s, pool := newSMTPStandIn(t, true, false)
+
+	m := NewSMTP("127.0.0.1", s.port(), "", "", "siot@example.com", SMTPTLS)
+	m.tlsConfig = &tls.Config{RootCAs: pool}
+
+	err := m.SendEmail("joe@example.com", "test", "plain text only", "")
+	if err != nil {
+		t.Fatal("Error sending email: ", err)
+	}
+
+	got := s.mail(t)
+
+	if got.auth != "" {
+		t.Error("auth should not be used without a username")
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(got.data)))
+	if err != nil {
+		t.Fatal("Error parsing email: ", err)
+	}
+
+	if ct := msg.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Error("wrong content type: ", ct)
+	}
+
+	// the end of the data adds a line break
+	if body := readPart(t, msg.Body); body != "plain text only\n" {
+		t.Errorf("wrong body: %q", body)
+	}
+}
+
+func TestSMTPErrors(t *testing.T) {
+	s, pool := newSMTPStandIn(t, false, false)
+
+	// credentials are not sent if the server does not support STARTTLS
+	m := NewSMTP("127.0.0.1", s.port(), "siot", "secret", "siot@example.com", SMTPStartTLS)
+	m.tlsConfig = &tls.Config{RootCAs: pool}
+
+	err := m.SendEmail("joe@example.com", "test", "body", "")
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Error("expected STARTTLS error, got: ", err)
+	}
+
+	err = m.SendEmail("joe@example.com\r\nBcc: eve@example.com", "test", "body", "")
+	if err == nil {
+		t.Error("expected error for address with a line break")
+	}
+
+	m = NewSMTP("", 0, "", "", "siot@example.com", "")
+	if err := m.SendEmail("joe@example.com", "test", "body", ""); err == nil {
+		t.Error("expected error if server is not set")
+	}
+
+	if m.port != 587 {
+		t.Error("wrong default port: ", m.port)
+	}
+}
@@ -0,0 +1,179 @@
+// Package plugin is used to write Simple IoT clients that run in their own
+// process. A plugin node (type plugin) tells the SIOT server which executable
+// in the plugin directory to start. The server passes the NATS server, a
+// plugin auth token, and the plugin node to the process in environment
+// variables, and forwards point updates for the plugin node and its children.
+//
+// A plugin is a normal client.Client:
+//
+//	type myPlugin struct {
+//		ID          string `node:"id"`
+//		Parent      string `node:"parent"`
+//		Description string `point:"description"`
+//		Port        string `point:"port"`
+//	}
+//
+//	func main() {
+//		err := plugin.Run(newMyPluginClient)
+//		if err != nil {
+//			log.Fatal(err)
+//		}
+//	}
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// ErrNotPlugin is returned by Run if the process was not started by a SIOT
+// server
+var ErrNotPlugin = errors.New("plugin environment not set, must be started by SIOT")
+
+// Node returns the plugin node passed in by the SIOT server
+func Node() (data.NodeEdge, error) {
+	var ne data.NodeEdge
+
+	nodeJSON := os.Getenv(client.PluginEnvNode)
+	if nodeJSON == "" {
+		return ne, ErrNotPlugin
+	}
+
+	err := json.Unmarshal([]byte(nodeJSON), &ne)
+	if err != nil {
+		return ne, fmt.Errorf("Error decoding plugin node: %v", err)
+	}
+
+	return ne, nil
+}
+
+// Connect connects to the NATS server that started the plugin
+func Connect() (*nats.Conn, error) {
+	server := os.Getenv(client.PluginEnvNatsServer)
+	if server == "" {
+		return nil, ErrNotPlugin
+	}
+
+	return nats.Connect(server,
+		nats.Token(os.Getenv(client.PluginEnvAuthToken)),
+		nats.Timeout(10*time.Second),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	)
+}
+
+// Run connects to the SIOT server, decodes the plugin node and its children
+// into the config, and runs the client returned by construct. Points for the
+// plugin node and its children are passed to the client Points and EdgePoints
+// methods. Run returns when the client Run returns, or the process receives
+// SIGINT or SIGTERM (the SIOT server sends SIGINT to stop a plugin).
+func Run[T any](construct func(*nats.Conn, T) client.Client) error {
+	ne, err := Node()
+	if err != nil {
+		return err
+	}
+
+	nc, err := Connect()
+	if err != nil {
+		return fmt.Errorf("Error connecting to NATS: %v", err)
+	}
+	defer nc.Close()
+
+	nec, err := nodeChildren(nc, ne)
+	if err != nil {
+		return err
+	}
+
+	var config T
+
+	err = data.Decode(nec, &config)
+	if err != nil {
+		return fmt.Errorf("Error decoding plugin node: %v", err)
+	}
+
+	c := construct(nc, config)
+
+	prefix := client.SubjectPluginPoints(ne.ID, "")
+	sub, err := nc.Subscribe(prefix+">", func(msg *nats.Msg) {
+		points, err := data.PbDecodePoints(msg.Data)
+		if err != nil {
+			log.Println("Plugin error decoding points:", err)
+			return
+		}
+
+		chunks := strings.Split(strings.TrimPrefix(msg.Subject, prefix), ".")
+		switch len(chunks) {
+		case 1:
+			c.Points(chunks[0], points)
+		case 2:
+			c.EdgePoints(chunks[0], chunks[1], points)
+		default:
+			log.Println("Plugin subject malformed:", msg.Subject)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("Error subscribing to plugin points: %v", err)
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	chStopped := make(chan error, 1)
+	go func() {
+		chStopped <- c.Run()
+	}()
+
+	select {
+	case err := <-chStopped:
+		return err
+	case <-sigs:
+		c.Stop(nil)
+	}
+
+	select {
+	case err := <-chStopped:
+		return err
+	case <-time.After(5 * time.Second):
+		return errors.New("timeout stopping plugin client")
+	}
+}
+
+// nodeChildren loads the current plugin node and its children from the
+// store. The node passed in by the server only includes the plugin points.
+func nodeChildren(nc *nats.Conn, ne data.NodeEdge) (data.NodeEdgeChildren, error) {
+	nodes, err := client.GetNodes(nc, ne.Parent, ne.ID, "", false)
+	if err != nil {
+		return data.NodeEdgeChildren{}, fmt.Errorf("Error getting plugin node: %v", err)
+	}
+
+	if len(nodes) > 0 {
+		ne = nodes[0]
+	}
+
+	children, err := client.GetNodes(nc, ne.ID, "all", "", false)
+	if err != nil {
+		return data.NodeEdgeChildren{}, fmt.Errorf("Error getting plugin children: %v", err)
+	}
+
+	nec := data.NodeEdgeChildren{NodeEdge: ne}
+	for _, c := range children {
+		nec.Children = append(nec.Children, data.NodeEdgeChildren{NodeEdge: c})
+	}
+
+	return nec, nil
+}
@@ -2,12 +2,17 @@ package server
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"path"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/simpleiot/simpleiot/assets/files"
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/store"
 	"github.com/simpleiot/simpleiot/system"
 )
 
@@ -28,12 +33,26 @@ func Args(args []string, flags *flag.FlagSet) (Options, error) {
 	flagNatsServer := flags.String("natsServer", defaultNatsServer, "NATS Server")
 	flagNatsDisableServer := flags.Bool("natsDisableServer", false, "disable NATS server (if you want to run NATS separately)")
 	flagStore := flags.String("store", "siot.sqlite", "store file, default siot.sqlite")
+	flagStoreType := flags.String("storeType", "sqlite", "store backend: sqlite, postgres (experimental), or memory")
+	flagStoreURI := flags.String("storeURI", "", "store connection string (postgres)")
 	flagResetStore := flags.Bool("resetStore", false, "permanently wipe data in store at start-up")
 	flagAuthToken := flags.String("token", "", "auth token")
 	flagSyslog := flags.Bool("syslog", false, "log to syslog instead of stdout")
 	flagDev := flags.Bool("dev", false, "run server in development mode")
 	flagCustomUIDir := flags.String("customUIDir", "", "pass custom UI directory")
 	flagUIAssetsDebug := flags.Bool("UIAssetsDebug", false, "Dump asset files for debugging")
+	flagHistory := flags.Bool("history", false, "store point history in the SIOT store")
+	flagHistoryRetention := flags.Duration("historyRetention", 0, "how long to keep raw point history, 0 keeps it forever")
+	flagHistoryRetentionNode := flags.String("historyRetentionNode", "", "history retention by node type, ex: modbusIo=48h,device=720h")
+	flagHistoryRetentionPoint := flags.String("historyRetentionPoint", "", "history retention by point type, ex: temp=2160h,voltage=24h")
+	flagHistoryDownsampleAfter := flags.Duration("historyDownsampleAfter", 0, "age at which point history is downsampled, 0 disables downsampling")
+	flagHistoryDownsampleWindow := flags.Duration("historyDownsampleWindow", 15*time.Minute, "window used when downsampling point history")
+	flagHistoryAggRetention := flags.Duration("historyAggRetention", 0, "how long to keep downsampled point history, 0 keeps it forever")
+	flagTombstoneRetention := flags.Duration("tombstoneRetention", 0, "how long to keep deleted nodes and points before they are purged, 0 keeps them forever")
+	flagRevisionRetention := flags.Duration("revisionRetention", 0, "how long to keep node revisions, 0 keeps them forever")
+	flagPluginDir := flags.String("pluginDir", "", "directory plugin executables are started from, plugins are disabled if not set")
+	flagRuleCommands := flags.String("ruleCommands", "", "comma separated executables rule command actions can run, command actions are disabled if not set")
+	flagRulePublishPrefix := flags.String("rulePublishPrefix", client.DefaultRulePublishPrefix, "subject prefix rule publish actions can publish to")
 
 	if err := flags.Parse(args); err != nil {
 		return Options{}, err
@@ -59,6 +78,21 @@ func Args(args []string, flags *flag.FlagSet) (Options, error) {
 
 	storeFilePath := path.Join(dataDir, *flagStore)
 
+	storeURI := os.Getenv("SIOT_STORE_URI")
+	if *flagStoreURI != "" {
+		storeURI = *flagStoreURI
+	}
+
+	historyRetentionNode, err := store.ParseRetention(*flagHistoryRetentionNode)
+	if err != nil {
+		return Options{}, fmt.Errorf("Error parsing historyRetentionNode: %w", err)
+	}
+
+	historyRetentionPoint, err := store.ParseRetention(*flagHistoryRetentionPoint)
+	if err != nil {
+		return Options{}, fmt.Errorf("Error parsing historyRetentionPoint: %w", err)
+	}
+
 	// =============================================
 	// NATS stuff
 	// =============================================
@@ -146,13 +180,43 @@ func Args(args []string, flags *flag.FlagSet) (Options, error) {
 		osVersionField = "VERSION"
 	}
 
+	pluginDir := os.Getenv("SIOT_PLUGIN_DIR")
+	if *flagPluginDir != "" {
+		pluginDir = *flagPluginDir
+	}
+
+	ruleCommandsS := os.Getenv("SIOT_RULE_COMMANDS")
+	if *flagRuleCommands != "" {
+		ruleCommandsS = *flagRuleCommands
+	}
+
+	var ruleCommands []string
+	for _, c := range strings.Split(ruleCommandsS, ",") {
+		c = strings.TrimSpace(c)
+		if c != "" {
+			ruleCommands = append(ruleCommands, c)
+		}
+	}
+
+	// only consider env if command line option is something different
+	// that default
+	rulePublishPrefix := *flagRulePublishPrefix
+	if rulePublishPrefix == client.DefaultRulePublishPrefix {
+		rulePublishPrefixE := os.Getenv("SIOT_RULE_PUBLISH_PREFIX")
+		if rulePublishPrefixE != "" {
+			rulePublishPrefix = rulePublishPrefixE
+		}
+	}
+
 	// set up particle connection if configured
 	// todo -- move this to a node
 	particleAPIKey := os.Getenv("SIOT_PARTICLE_API_KEY")
 
 	// TODO, convert this to builder pattern
 	o := Options{
+		StoreType:         *flagStoreType,
 		StoreFile:         storeFilePath,
+		StoreURI:          storeURI,
 		ResetStore:        *flagResetStore,
 		HTTPPort:          port,
 		DebugHTTP:         *flagDebugHTTP,
@@ -171,6 +235,22 @@ func Args(args []string, flags *flag.FlagSet) (Options, error) {
 		Dev:               *flagDev,
 		CustomUIDir:       *flagCustomUIDir,
 		UIAssetsDebug:     *flagUIAssetsDebug,
+		History: store.HistoryConfig{
+			Enable:             *flagHistory,
+			Retention:          *flagHistoryRetention,
+			RetentionNodeType:  historyRetentionNode,
+			RetentionPointType: historyRetentionPoint,
+			DownsampleAfter:    *flagHistoryDownsampleAfter,
+			DownsampleWindow:   *flagHistoryDownsampleWindow,
+			AggregateRetention: *flagHistoryAggRetention,
+		},
+		TombstoneRetention: *flagTombstoneRetention,
+		RevisionRetention:  *flagRevisionRetention,
+		Clients: client.Options{
+			PluginDir:         pluginDir,
+			RuleCommands:      ruleCommands,
+			RulePublishPrefix: rulePublishPrefix,
+		},
 	}
 
 	return o, nil
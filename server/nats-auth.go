@@ -0,0 +1,231 @@
+package server
+
+import (
+	"crypto/subtle"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/api"
+	"github.com/simpleiot/simpleiot/client"
+)
+
+// natsAuthRefreshDelay is how long to wait after the node tree changes
+// before checking if user permissions changed. Changes usually come in
+// bursts.
+var natsAuthRefreshDelay = 250 * time.Millisecond
+
+// natsPluginUserPrefix is the prefix of the NATS username of plugins
+const natsPluginUserPrefix = "plugin:"
+
+// natsAuth authenticates NATS clients. Clients that connect with the auth
+// token have full access. Clients that connect with a user JWT (returned by
+// auth.user) as the token are limited to the nodes the user has access to.
+// Plugins connect with a plugin token (see client.PluginToken) and are
+// limited to the plugin node and its children.
+// User permissions are generated when the client connects. When the node tree
+// changes, users whose access changed are disconnected so that they reconnect
+// with new permissions.
+type natsAuth struct {
+	token      string
+	nc         *nats.Conn
+	lock       sync.RWMutex
+	authorizer api.Authorizer
+	access     *client.AccessCache
+	server     *server.Server
+	// users maps the NATS usernames of connected users and plugins to the
+	// access their permissions were generated from
+	users        map[string]client.Access
+	refreshTimer *time.Timer
+	refreshLock  sync.Mutex
+}
+
+// setAuthorizer sets the authorizer used to validate user JWTs. Users are
+// rejected until this is set.
+func (na *natsAuth) setAuthorizer(a api.Authorizer) {
+	na.lock.Lock()
+	defer na.lock.Unlock()
+	na.authorizer = a
+}
+
+// setServer sets the NATS server used to disconnect users whose access
+// changed
+func (na *natsAuth) setServer(s *server.Server) {
+	na.lock.Lock()
+	defer na.lock.Unlock()
+	na.server = s
+}
+
+// Check implements the NATS server Authentication interface
+func (na *natsAuth) Check(c server.ClientAuthentication) bool {
+	token := c.GetOpts().Token
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(na.token)) == 1 {
+		c.RegisterUser(&server.User{Username: "siot"})
+		return true
+	}
+
+	var username string
+
+	if pluginID, ok := client.PluginTokenID(na.token, token); ok {
+		username = natsPluginUserPrefix + pluginID
+	} else {
+		na.lock.RLock()
+		authorizer := na.authorizer
+		na.lock.RUnlock()
+
+		if authorizer == nil {
+			return false
+		}
+
+		valid, userID := authorizer.ValidToken(token)
+		if !valid || userID == "" {
+			return false
+		}
+
+		username = userID
+	}
+
+	access, err := na.getAccess(username)
+	if err != nil {
+		log.Println("NATS auth: error getting user access:", err)
+		return false
+	}
+
+	na.lock.Lock()
+	if na.users == nil {
+		na.users = make(map[string]client.Access)
+	}
+	na.users[username] = access
+	na.lock.Unlock()
+
+	perms := natsUserPermissions(access)
+	if pluginID, ok := strings.CutPrefix(username, natsPluginUserPrefix); ok {
+		// points are forwarded to plugins on plugin.<id>.>
+		perms.Subscribe.Allow = append(perms.Subscribe.Allow, "plugin."+pluginID+".>")
+	}
+
+	c.RegisterUser(&server.User{
+		Username:    username,
+		Permissions: perms,
+	})
+
+	return true
+}
+
+// getAccess returns the access of a NATS user. Plugins can access the
+// plugin node and its children.
+func (na *natsAuth) getAccess(username string) (client.Access, error) {
+	if pluginID, ok := strings.CutPrefix(username, natsPluginUserPrefix); ok {
+		return na.access.GetNode(pluginID)
+	}
+
+	return na.access.Get(username)
+}
+
+// accessChanged is called when the node tree changes. Users are refreshed
+// after the changes settle.
+func (na *natsAuth) accessChanged() {
+	na.lock.Lock()
+	defer na.lock.Unlock()
+
+	if na.refreshTimer == nil {
+		na.refreshTimer = time.AfterFunc(natsAuthRefreshDelay, na.refresh)
+	} else {
+		na.refreshTimer.Reset(natsAuthRefreshDelay)
+	}
+}
+
+// refresh disconnects the users whose access changed. NATS clients
+// reconnect and are authenticated again with new permissions.
+func (na *natsAuth) refresh() {
+	na.refreshLock.Lock()
+	defer na.refreshLock.Unlock()
+
+	na.lock.RLock()
+	s := na.server
+	users := make(map[string]client.Access, len(na.users))
+	for userID, access := range na.users {
+		users[userID] = access
+	}
+	na.lock.RUnlock()
+
+	if s == nil {
+		return
+	}
+
+	for userID, old := range users {
+		access, err := na.getAccess(userID)
+		if err != nil {
+			log.Println("NATS auth: error getting user access:", err)
+			continue
+		}
+
+		if reflect.DeepEqual(old, access) {
+			continue
+		}
+
+		conns, err := s.Connz(&server.ConnzOptions{Username: true, User: userID})
+		if err != nil {
+			log.Println("NATS auth: error getting user connections:", err)
+			continue
+		}
+
+		for _, c := range conns.Conns {
+			err := s.DisconnectClientByID(c.Cid)
+			if err != nil {
+				log.Println("NATS auth: error disconnecting user:", err)
+			}
+		}
+
+		na.lock.Lock()
+		// the user may have connected again in the meantime
+		if reflect.DeepEqual(na.users[userID], old) {
+			if len(conns.Conns) > 0 {
+				na.users[userID] = access
+			} else {
+				delete(na.users, userID)
+			}
+		}
+		na.lock.Unlock()
+	}
+}
+
+// natsUserPermissions generates the NATS permissions for a user. Users can
+// request nodes and history, and subscribe to points for nodes they can read,
+// and send points to nodes they can write. Edge points can only be sent for
+// existing edges where both the node and the parent can be written, so users
+// can't move nodes they don't own into their tree. Nodes are created and
+// moved with the HTTP API.
+func natsUserPermissions(access client.Access) *server.Permissions {
+	pub := []string{"auth.user"}
+	sub := []string{"_INBOX.>"}
+
+	ids := make([]string, 0, len(access.Nodes))
+	for id := range access.Nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		pub = append(pub, "nodes.*."+id, "nodes."+id+".>", "revisions."+id, "history."+id)
+		sub = append(sub, "p."+id, "p."+id+".*", "phr."+id, "up."+id+".>")
+
+		if access.CanWrite(id) {
+			pub = append(pub, "p."+id, "node."+id+".>")
+			for _, parent := range access.Parents[id] {
+				pub = append(pub, "p."+id+"."+parent)
+			}
+		}
+	}
+
+	return &server.Permissions{
+		Publish:   &server.SubjectPermission{Allow: pub},
+		Subscribe: &server.SubjectPermission{Allow: sub},
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func TestNatsUserPermissions(t *testing.T) {
+	opts := Options{
+		StoreFile:    "test-auth.sqlite",
+		NatsPort:     8920,
+		HTTPPort:     "8921",
+		NatsHTTPPort: 8922,
+		NatsServer:   "nats://localhost:8920",
+		AuthToken:    "secret",
+		ID:           "inst-auth",
+	}
+
+	cleanup := func() {
+		_ = exec.Command("sh", "-c", "rm "+opts.StoreFile+"*").Run()
+	}
+
+	cleanup()
+	defer cleanup()
+
+	s, nc, err := NewServer(opts)
+	if err != nil {
+		t.Fatal("Error creating server: ", err)
+	}
+
+	stopped := make(chan struct{})
+
+	go func() {
+		_ = s.Run()
+		close(stopped)
+	}()
+
+	defer func() {
+		s.Stop(nil)
+		<-stopped
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	err = s.WaitStart(ctx)
+	cancel()
+	if err != nil {
+		t.Fatal("Error waiting for server: ", err)
+	}
+
+	roots, err := client.GetNodes(nc, "root", "all", "", false)
+	if err != nil || len(roots) < 1 {
+		t.Fatal("Error getting root node: ", err)
+	}
+
+	// create a group with a read only user
+	group := data.NodeEdge{ID: "group1", Parent: roots[0].ID, Type: data.NodeTypeGroup}
+	err = client.SendNode(nc, group, "test")
+	if err != nil {
+		t.Fatal("Error sending group: ", err)
+	}
+
+	// hashing the password can take longer than the ack timeout with the
+	// race detector, so it is sent without an ack
+	user := data.User{ID: "user1", Email: "user@test.com"}
+	err = client.SendNode(nc, data.NodeEdge{ID: user.ID, Parent: group.ID,
+		Type: data.NodeTypeUser, Points: user.ToPoints()}, "test")
+	if err != nil {
+		t.Fatal("Error sending user: ", err)
+	}
+
+	user.Pass = "pass"
+	err = client.SendNodePoint(nc, user.ID, data.Point{Type: data.PointTypePass,
+		Text: user.Pass}, false)
+	if err != nil {
+		t.Fatal("Error sending password: ", err)
+	}
+
+	err = client.SendEdgePoint(nc, user.ID, group.ID, data.Point{Type: data.PointTypeRole,
+		Text: data.PointValueRoleRead}, true)
+	if err != nil {
+		t.Fatal("Error sending role: ", err)
+	}
+
+	access, err := client.GetUserAccess(nc, user.ID)
+	if err != nil {
+		t.Fatal("Error getting access: ", err)
+	}
+
+	if !access.CanRead(group.ID) || access.CanWrite(group.ID) || access.CanRead(roots[0].ID) {
+		t.Fatalf("user access is not correct: %+v", access)
+	}
+
+	var token string
+	start := time.Now()
+	for token == "" && time.Since(start) < 10*time.Second {
+		nodes, err := client.UserCheck(nc, user.Email, user.Pass)
+		if err != nil {
+			t.Fatal("Error checking user: ", err)
+		}
+
+		for _, n := range nodes {
+			if n.Type == data.NodeTypeJWT {
+				token, _ = n.Points.Text(data.PointTypeToken, "")
+			}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if token == "" {
+		t.Fatal("did not get user JWT")
+	}
+
+	_, err = nats.Connect(opts.NatsServer, nats.Token("bad"))
+	if err == nil {
+		t.Fatal("connection with bad token should fail")
+	}
+
+	ncUser, err := nats.Connect(opts.NatsServer, nats.Token(token),
+		nats.ReconnectWait(100*time.Millisecond))
+	if err != nil {
+		t.Fatal("Error connecting as user: ", err)
+	}
+	defer ncUser.Close()
+
+	groups, err := client.GetNodes(ncUser, "all", group.ID, "", false)
+	if err != nil || len(groups) < 1 {
+		t.Fatal("user could not read group: ", err)
+	}
+
+	_, err = ncUser.Request("nodes.root.all", nil, 500*time.Millisecond)
+	if err == nil {
+		t.Fatal("user should not be able to read root node")
+	}
+
+	err = client.SendNodePoint(ncUser, group.ID, data.Point{Type: data.PointTypeDescription,
+		Text: "hacked"}, true)
+	if err == nil {
+		t.Fatal("read only user should not be able to write points")
+	}
+
+	// the user reconnects with new permissions when the role changes
+	err = client.SendEdgePoint(nc, user.ID, group.ID, data.Point{Type: data.PointTypeRole,
+		Text: data.PointValueRoleAdmin}, true)
+	if err != nil {
+		t.Fatal("Error sending role: ", err)
+	}
+
+	start = time.Now()
+	for {
+		err = client.SendNodePoint(ncUser, group.ID, data.Point{Type: data.PointTypeDescription,
+			Text: "group 1"}, true)
+		if err == nil {
+			break
+		}
+
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("user permissions were not refreshed: ", err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// users can't add nodes they can't write to their tree
+	foreign := data.NodeEdge{ID: "foreign", Parent: roots[0].ID, Type: data.NodeTypeDevice}
+	err = client.SendNode(nc, foreign, "test")
+	if err != nil {
+		t.Fatal("Error sending node: ", err)
+	}
+
+	err = client.SendEdgePoint(ncUser, foreign.ID, group.ID, data.Point{Type: data.PointTypeTombstone,
+		Value: 0}, true)
+	if err == nil {
+		t.Fatal("user should not be able to add a node they can't write to their tree")
+	}
+
+	// edge points of writable nodes can be sent
+	err = client.SendEdgePoint(ncUser, user.ID, group.ID, data.Point{Type: data.PointTypeDescription,
+		Text: "edge"}, true)
+	if err != nil {
+		t.Fatal("Error sending edge point: ", err)
+	}
+
+	// plugins can only access the plugin node and its children
+	plugin := data.NodeEdge{ID: "plugin1", Parent: roots[0].ID, Type: data.NodeTypePlugin}
+	pluginChild := data.NodeEdge{ID: "pluginChild", Parent: plugin.ID, Type: data.NodeTypeDevice}
+	for _, ne := range []data.NodeEdge{plugin, pluginChild} {
+		err = client.SendNode(nc, ne, "test")
+		if err != nil {
+			t.Fatal("Error sending node: ", err)
+		}
+	}
+
+	_, err = nats.Connect(opts.NatsServer, nats.Token(client.PluginToken("bad", plugin.ID)))
+	if err == nil {
+		t.Fatal("connection with bad plugin token should fail")
+	}
+
+	ncPlugin, err := nats.Connect(opts.NatsServer,
+		nats.Token(client.PluginToken(opts.AuthToken, plugin.ID)))
+	if err != nil {
+		t.Fatal("Error connecting as plugin: ", err)
+	}
+	defer ncPlugin.Close()
+
+	err = client.SendNodePoint(ncPlugin, pluginChild.ID, data.Point{Type: data.PointTypeDescription,
+		Text: "child"}, true)
+	if err != nil {
+		t.Fatal("plugin could not write its child: ", err)
+	}
+
+	err = client.SendNodePoint(ncPlugin, group.ID, data.Point{Type: data.PointTypeDescription,
+		Text: "hacked"}, true)
+	if err == nil {
+		t.Fatal("plugin should not be able to write nodes outside the plugin")
+	}
+}
@@ -16,6 +16,8 @@ type natsServerOptions struct {
 	TLSCert    string
 	TLSKey     string
 	TLSTimeout float64
+	// CustomAuth replaces token authentication if set
+	CustomAuth server.Authentication
 }
 
 // newNatsServer creates a new nats server instance
@@ -27,6 +29,10 @@ func newNatsServer(o natsServerOptions) (*server.Server, error) {
 		NoSigs:        true,
 	}
 
+	if o.CustomAuth != nil {
+		opts.CustomClientAuthentication = o.CustomAuth
+	}
+
 	if o.TLSCert != "" && o.TLSKey != "" {
 		log.Println("Setting up NATS TLS ...")
 		opts.TLS = true
@@ -28,7 +28,10 @@ var ErrServerStopped = errors.New("Server stopped")
 
 // Options used for starting Simple IoT
 type Options struct {
+	// StoreType is the store backend: sqlite (default), postgres, or memory
+	StoreType         string
 	StoreFile         string
+	StoreURI          string
 	ResetStore        bool
 	DataDir           string
 	HTTPPort          string
@@ -51,6 +54,16 @@ type Options struct {
 	CustomUIDir       string
 	CustomUIFS        fs.FS
 	UIAssetsDebug     bool
+	// History configures the point history kept in the store
+	History store.HistoryConfig
+	// TombstoneRetention is how long deleted nodes and points are kept in
+	// the store. If zero, they are kept forever.
+	TombstoneRetention time.Duration
+	// RevisionRetention is how long node revisions are kept in the store.
+	// If zero, they are kept forever.
+	RevisionRetention time.Duration
+	// Clients configures the default clients
+	Clients client.Options
 	// optional ID (must be unique) for this instance, otherwise, a UUID will be used
 	ID string
 }
@@ -158,12 +171,40 @@ func (s *Server) Run() error {
 		TLSTimeout: o.NatsTLSTimeout,
 	}
 
+	// when auth is enabled, users can connect with a JWT and only
+	// access the nodes they have been granted
+	var natsAuthenticator *natsAuth
+	var accessChanged func()
+	if o.AuthToken != "" {
+		natsAuthenticator = &natsAuth{token: o.AuthToken, nc: s.nc}
+		natsOptions.CustomAuth = natsAuthenticator
+		accessChanged = natsAuthenticator.accessChanged
+	}
+
+	// user access is shared by the NATS authenticator and the HTTP API
+	access, err := client.NewAccessCache(s.nc, accessChanged)
+	if err != nil {
+		return fmt.Errorf("Error creating access cache: %v", err)
+	}
+
+	defer func() {
+		access.Stop()
+	}()
+
+	if natsAuthenticator != nil {
+		natsAuthenticator.access = access
+	}
+
 	if !o.NatsDisableServer {
 		s.natsServer, err = newNatsServer(natsOptions)
 		if err != nil {
 			return fmt.Errorf("Error setting up nats server: %v", err)
 		}
 
+		if natsAuthenticator != nil {
+			natsAuthenticator.setServer(s.natsServer)
+		}
+
 		g.Add(func() error {
 			s.natsServer.Start()
 			s.natsServer.WaitForShutdown()
@@ -183,11 +224,16 @@ func (s *Server) Run() error {
 	// ====================================
 
 	storeParams := store.Params{
-		File:      o.StoreFile,
-		AuthToken: o.AuthToken,
-		Server:    o.NatsServer,
-		Nc:        s.nc,
-		ID:        s.options.ID,
+		Backend:            o.StoreType,
+		File:               o.StoreFile,
+		URI:                o.StoreURI,
+		AuthToken:          o.AuthToken,
+		Server:             o.NatsServer,
+		Nc:                 s.nc,
+		ID:                 s.options.ID,
+		History:            o.History,
+		TombstoneRetention: o.TombstoneRetention,
+		RevisionRetention:  o.RevisionRetention,
 	}
 
 	siotStore, err := store.NewStore(storeParams)
@@ -202,6 +248,10 @@ func (s *Server) Run() error {
 		log.Fatal("Error creating store: ", err)
 	}
 
+	if natsAuthenticator != nil {
+		natsAuthenticator.setAuthorizer(siotStore.GetAuthorizer())
+	}
+
 	siotWaitCtx, siotWaitCancel := context.WithTimeout(context.Background(), time.Second*10)
 
 	g.Add(func() error {
@@ -378,6 +428,7 @@ func (s *Server) Run() error {
 		JwtAuth:    siotStore.GetAuthorizer(),
 		AuthToken:  o.AuthToken,
 		Nc:         s.nc,
+		Access:     access,
 	})
 
 	g.Add(func() error {
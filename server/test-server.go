@@ -55,7 +55,7 @@ func TestServer(args ...string) (*nats.Conn, data.NodeEdge, func(), error) {
 		return nil, data.NodeEdge{}, nil, fmt.Errorf("Error starting siot server: %v", err)
 	}
 
-	clients, _ := client.DefaultClients(nc)
+	clients, _ := client.DefaultClients(nc, opts.Clients)
 	s.AddClient(clients)
 
 	stopped := make(chan struct{})
@@ -0,0 +1,487 @@
+package store
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// Backend types that can be used to persist the store
+const (
+	BackendSqlite   = "sqlite"
+	BackendPostgres = "postgres"
+	BackendMemory   = "memory"
+)
+
+// Backend is implemented by the databases that persist SIOT nodes, edges,
+// and points. The Store only accesses data through this interface.
+type Backend interface {
+	// nodePoints writes node points and updates upstream hashes
+	nodePoints(id string, points data.Points) error
+	// nodePointsBatch writes points for multiple nodes in one transaction.
+	// Upstream hashes are updated once per edge for the whole batch.
+	nodePointsBatch(updates []nodeUpdate) error
+	// edgePoints writes edge points, creating the edge if needed, and
+	// updates upstream hashes
+	edgePoints(nodeID, parentID string, points data.Points) error
+	// getNodes returns nodes. If parent is set to "all", then all
+	// instances of the node are returned. If parent is set and id is
+	// "all", then all child nodes are returned. Parent can be set to
+	// "root" and id to "all" to fetch the root node(s).
+	getNodes(parent, id, typ string, includeDel bool) ([]data.NodeEdge, error)
+	// queryNodes returns the nodes that match a query
+	queryNodes(q data.NodeQuery) ([]data.NodeEdge, error)
+	// up returns upstream ids for a node
+	up(id string, includeDeleted bool) ([]string, error)
+	// userCheck returns user nodes that match email and password. Returns
+	// nil, nil if user is not found.
+	userCheck(email, password string) (data.Nodes, error)
+	// verifyNodeHashes recursively verifies, and optionally fixes all the
+	// hash values for all nodes
+	verifyNodeHashes(fix bool) error
+	rootNodeID() string
+	jwtKey() []byte
+	// reset permanently wipes all data
+	reset() error
+	setHistory(cfg HistoryConfig)
+	// historyQuery queries point history. If root is set, only the history
+	// of the root node and its descendants is returned.
+	historyQuery(qry data.HistoryQuery, root string, results *data.HistoryResults)
+	historyMaint(now time.Time) error
+	// backup writes a consistent snapshot of the store to file
+	backup(file string) error
+	// restore replaces all data in the store with a snapshot created by
+	// backup after validating it
+	restore(file string) error
+	// revisions returns the recorded revisions of a node, newest first
+	revisions(nodeID string) ([]data.Revision, error)
+	// gc purges deleted edges, nodes that no longer have edges, and
+	// deleted points whose tombstone is older than before. Upstream hashes
+	// are updated to match. Revisions older than revisionsBefore are also
+	// purged. Nothing is purged for a zero time.
+	gc(before, revisionsBefore time.Time) (data.GCResults, error)
+	// compact reclaims space after data is purged
+	compact() error
+	Close() error
+}
+
+// NewBackend opens a store backend. For SQLite, uri is the database file, and
+// for PostgreSQL, uri is the connection string. The memory backend does not
+// use uri.
+func NewBackend(typ, uri, rootID string) (Backend, error) {
+	switch typ {
+	case BackendSqlite, "":
+		return NewSqliteDb(uri, rootID)
+	case BackendPostgres:
+		return NewPostgresDb(uri, rootID)
+	case BackendMemory:
+		return NewMemoryDb(rootID)
+	default:
+		return nil, fmt.Errorf("unknown store backend: %v", typ)
+	}
+}
+
+// nodeUpdate is a set of points written to a node
+type nodeUpdate struct {
+	id     string
+	points data.Points
+}
+
+// mergeNodeUpdates combines updates for the same node so that each node is
+// written once in a batch. Updates are kept in the order nodes first appear.
+// Points are not collapsed here, as history records every point.
+func mergeNodeUpdates(updates []nodeUpdate) []nodeUpdate {
+	var ret []nodeUpdate
+	index := make(map[string]int)
+
+	for _, u := range updates {
+		if i, ok := index[u.id]; ok {
+			ret[i].points = append(ret[i].points, u.points...)
+			continue
+		}
+
+		index[u.id] = len(ret)
+		ret = append(ret, nodeUpdate{id: u.id, points: append(data.Points{}, u.points...)})
+	}
+
+	return ret
+}
+
+// updateEdgeHashes applies hash updates for a set of nodes to all of their
+// upstream edges. Edges of each ancestor are read once and every changed edge
+// is written once, no matter how many nodes below it changed. selectQuery
+// must select id, up, and hash of the edges with a down node, and
+// updateQuery must set the hash of an edge by ID.
+func updateEdgeHashes(tx *sql.Tx, selectQuery, updateQuery string, updates map[string]uint32) error {
+	type upEdge struct {
+		id string
+		up string
+	}
+
+	// edges indexed by down node
+	edgesDown := make(map[string][]upEdge)
+	// original and updated hashes indexed by edge ID
+	orig := make(map[string]uint32)
+	hashes := make(map[string]uint32)
+
+	var walk func(id string, hashUpdate uint32) error
+
+	walk = func(id string, hashUpdate uint32) error {
+		edges, ok := edgesDown[id]
+		if !ok {
+			rows, err := tx.Query(selectQuery, id)
+			if err != nil {
+				return fmt.Errorf("Error getting edges: %v", err)
+			}
+
+			for rows.Next() {
+				var e upEdge
+				var hash int64
+				err := rows.Scan(&e.id, &e.up, &hash)
+				if err != nil {
+					rows.Close()
+					return fmt.Errorf("Error scanning edges: %v", err)
+				}
+				orig[e.id] = uint32(hash)
+				hashes[e.id] = uint32(hash)
+				edges = append(edges, e)
+			}
+
+			if err := rows.Close(); err != nil {
+				return err
+			}
+
+			edgesDown[id] = edges
+		}
+
+		for _, e := range edges {
+			hashes[e.id] ^= hashUpdate
+
+			if e.up != "none" {
+				err := walk(e.up, hashUpdate)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	for id, hashUpdate := range updates {
+		if hashUpdate == 0 {
+			continue
+		}
+
+		err := walk(id, hashUpdate)
+		if err != nil {
+			return err
+		}
+	}
+
+	for id, hash := range hashes {
+		if hash == orig[id] {
+			continue
+		}
+
+		_, err := tx.Exec(updateQuery, int64(hash), id)
+		if err != nil {
+			return fmt.Errorf("Error updating edge hash: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// mergePoints determines which incoming points need to be written to a backend
+// given the points currently stored. For each point returned, the index of the
+// matching stored point is returned, or -1 if the point is new. The returned
+// hash update is XOR'd into upstream edge hashes.
+func mergePoints(desc string, dbPoints, points data.Points) (data.Points, []int, uint32) {
+	var writePoints data.Points
+	var writeIndexes []int
+
+	var hashUpdate uint32
+
+NextPin:
+	for _, pIn := range points {
+		if pIn.Time.IsZero() {
+			pIn.Time = time.Now()
+		}
+
+		if pIn.Key == "" {
+			pIn.Key = "0"
+		}
+
+		for j, pDb := range dbPoints {
+			if pIn.Type == pDb.Type && pIn.Key == pDb.Key {
+				// found a match
+				if pDb.Time.Before(pIn.Time) || pDb.Time.Equal(pIn.Time) {
+					writePoints = append(writePoints, pIn)
+					writeIndexes = append(writeIndexes, j)
+					// back out old CRC and add in new one
+					hashUpdate ^= pDb.CRC()
+					hashUpdate ^= pIn.CRC()
+				} else {
+					log.Printf("Ignoring %v point due to timestamps: %v", desc, pIn)
+				}
+				continue NextPin
+			}
+		}
+
+		// point was not found so write it
+		writePoints = append(writePoints, pIn)
+		hashUpdate ^= pIn.CRC()
+		writeIndexes = append(writeIndexes, -1)
+	}
+
+	return writePoints, writeIndexes, hashUpdate
+}
+
+// revisionSkipTypes are status points that clients write while they run.
+// They are not configuration, so they are not recorded in revisions.
+var revisionSkipTypes = map[string]bool{
+	data.PointTypeValue:          true,
+	data.PointTypeActive:         true,
+	data.PointTypeError:          true,
+	data.PointTypeClientState:    true,
+	data.PointTypeClientStart:    true,
+	data.PointTypeClientRestarts: true,
+	data.PointTypeClientError:    true,
+}
+
+// revisionSkipOrigin returns true if points sent by a node of this type are
+// rule outputs, which are not recorded in revisions.
+func revisionSkipOrigin(nodeType string) bool {
+	switch nodeType {
+	case data.NodeTypeRule, data.NodeTypeAction, data.NodeTypeActionInactive:
+		return true
+	}
+	return false
+}
+
+// revisionPoints returns the points that are recorded in a revision along
+// with their previous values. Only points with Origin set that change a stored
+// point are recorded. Status points and password hashes are not recorded.
+func revisionPoints(dbPoints, writePoints data.Points, writeIndexes []int) (data.Points, data.Points) {
+	var points, previous data.Points
+
+	for i, p := range writePoints {
+		if p.Origin == "" || revisionSkipTypes[p.Type] {
+			continue
+		}
+
+		prev := data.Point{Type: p.Type, Key: p.Key}
+		if writeIndexes[i] >= 0 {
+			prev = dbPoints[writeIndexes[i]]
+			if prev.Value == p.Value && prev.Text == p.Text &&
+				bytes.Equal(prev.Data, p.Data) && prev.Tombstone == p.Tombstone {
+				// nothing changed
+				continue
+			}
+		}
+
+		if p.Type == data.PointTypePass {
+			p.Text = ""
+			prev.Text = ""
+		}
+
+		points = append(points, p)
+		previous = append(previous, prev)
+	}
+
+	return points, previous
+}
+
+// pointIDs returns the IDs of points being written. Existing IDs are reused,
+// and new IDs are generated for new points.
+func pointIDs(dbPointIDs []string, indexes []int) []string {
+	ret := make([]string, len(indexes))
+	for i, j := range indexes {
+		if j < 0 {
+			ret[i] = uuid.New().String()
+		} else {
+			ret[i] = dbPointIDs[j]
+		}
+	}
+	return ret
+}
+
+// splitNodeType removes node type points, which are not stored, and returns
+// the node type
+func splitNodeType(points data.Points) (string, data.Points) {
+	var nodeType string
+	ret := make(data.Points, 0, len(points))
+	for _, p := range points {
+		if p.Type == data.PointTypeNodeType {
+			nodeType = p.Text
+			continue
+		}
+		ret = append(ret, p)
+	}
+	return nodeType, ret
+}
+
+// initRoot creates the root node and default admin user in a backend
+func initRoot(b Backend, rootID string) (string, error) {
+	log.Println("STORE: Initialize root node and admin user")
+	rootNode := data.NodeEdge{
+		ID:   rootID,
+		Type: data.NodeTypeDevice,
+	}
+
+	if rootNode.ID == "" {
+		rootNode.ID = uuid.New().String()
+	}
+
+	err := b.nodePoints(rootNode.ID, rootNode.Points)
+	if err != nil {
+		return "", fmt.Errorf("Error setting root node points: %v", err)
+	}
+
+	err = b.edgePoints(rootNode.ID, "root", data.Points{
+		{Type: data.PointTypeTombstone, Value: 0},
+		{Type: data.PointTypeNodeType, Text: rootNode.Type},
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error sending root node edges: %w", err)
+	}
+
+	// create admin user off root node
+	admin := data.User{
+		ID:        uuid.New().String(),
+		FirstName: "admin",
+		LastName:  "user",
+		Email:     "admin@admin.com",
+		Pass:      "admin",
+	}
+
+	points := admin.ToPoints()
+
+	err = hashPasswordPoints(points)
+	if err != nil {
+		return "", fmt.Errorf("Error hashing default user password: %v", err)
+	}
+
+	err = b.nodePoints(admin.ID, points)
+	if err != nil {
+		return "", fmt.Errorf("Error setting default user: %v", err)
+	}
+
+	err = b.edgePoints(admin.ID, rootNode.ID, data.Points{
+		{Type: data.PointTypeTombstone, Value: 0},
+		{Type: data.PointTypeNodeType, Text: data.NodeTypeUser},
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return rootNode.ID, nil
+}
+
+func newJwtKey() ([]byte, error) {
+	key := make([]byte, 20)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading making JWT key: %v", err)
+	}
+	return key, nil
+}
+
+// verifyHashes walks to the bottom of the tree and then works its way back
+// up, calculating hashes. fix is called for each node where the stored hash
+// does not match the calculated hash. If fix is nil, an error is returned
+// if any hashes do not match.
+func verifyHashes(b Backend, fix func(node data.NodeEdge, hash uint32) error) error {
+	// get root node to kick things off
+	rootNodes, err := b.getNodes("root", "all", "", true)
+	if err != nil {
+		return err
+	}
+
+	if len(rootNodes) < 1 {
+		return fmt.Errorf("no root nodes")
+	}
+
+	var failed int
+
+	var verify func(node data.NodeEdge) error
+
+	verify = func(node data.NodeEdge) error {
+		children, err := b.getNodes(node.ID, "all", "", true)
+		if err != nil {
+			return err
+		}
+
+		// it's important to go through children first as this can
+		// impact the current hash
+		for _, c := range children {
+			err := verify(c)
+			if err != nil {
+				return err
+			}
+		}
+
+		hash := node.CalcHash(children)
+
+		if hash != node.Hash {
+			log.Printf("Hash failed for %v, stored: %v, calc: %v",
+				node.ID, node.Hash, hash)
+			if fix != nil {
+				log.Println("fixing ...")
+				return fix(node, hash)
+			}
+			failed++
+		}
+
+		return nil
+	}
+
+	err = verify(rootNodes[0])
+	if err != nil {
+		return fmt.Errorf("Verify failed: %v", err)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Verify failed: %v node hashes do not match", failed)
+	}
+
+	return nil
+}
+
+// checkUserPathRoot returns true if there is a non-deleted path from node id
+// to the root of the tree
+func checkUserPathRoot(b Backend, id string) (bool, error) {
+	ups, err := b.up(id, false)
+	if err != nil {
+		return false, err
+	}
+
+	for _, up := range ups {
+		if up == "root" {
+			return true, nil
+		}
+
+		// continue walking upstream
+		ok, err := checkUserPathRoot(b, up)
+		if err != nil {
+			return false, err
+		}
+
+		if ok {
+			// found a path, return
+			return ok, nil
+		}
+
+		// look at the next edge
+	}
+
+	return false, nil
+}
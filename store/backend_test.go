@@ -0,0 +1,743 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// testBackends runs a test against each store backend. PostgreSQL is only
+// tested if the SIOT_TEST_POSTGRES environment variable is set to a
+// connection string.
+func testBackends(t *testing.T, test func(t *testing.T, db Backend)) {
+	t.Run(BackendSqlite, func(t *testing.T) {
+		db := newTestDb(t)
+		defer db.Close()
+		test(t, db)
+	})
+
+	t.Run(BackendMemory, func(t *testing.T) {
+		db, err := NewMemoryDb("")
+		if err != nil {
+			t.Fatal("Error opening db: ", err)
+		}
+		defer db.Close()
+		test(t, db)
+	})
+
+	t.Run(BackendPostgres, func(t *testing.T) {
+		uri := os.Getenv("SIOT_TEST_POSTGRES")
+		if uri == "" {
+			t.Skip("SIOT_TEST_POSTGRES not set")
+		}
+
+		db, err := NewPostgresDb(uri, "")
+		if err != nil {
+			t.Fatal("Error opening db: ", err)
+		}
+		defer db.Close()
+
+		err = db.reset()
+		if err != nil {
+			t.Fatal("Error resetting db: ", err)
+		}
+
+		test(t, db)
+	})
+}
+
+func TestBackendNodes(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Backend) {
+		rootID := db.rootNodeID()
+
+		if rootID == "" {
+			t.Fatal("Root ID is blank: ", rootID)
+		}
+
+		rns, err := db.getNodes("all", rootID, "", false)
+		if err != nil {
+			t.Fatal("Error getting root node: ", err)
+		}
+
+		rn := rns[0]
+
+		if rn.ID == "" {
+			t.Fatal("Root node ID is blank")
+		}
+
+		// modify a point and see if it changes
+		err = db.nodePoints(rootID, data.Points{{Type: data.PointTypeDescription, Text: "root"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rns, err = db.getNodes("all", rootID, "", false)
+		if err != nil {
+			t.Fatal("Error getting root node: ", err)
+		}
+
+		rn = rns[0]
+
+		if rn.Desc() != "root" {
+			t.Fatal("Description should have been root, got: ", rn.Desc())
+		}
+
+		// send an old point and verify it does not change
+		err = db.nodePoints(rootID, data.Points{{Time: time.Now().Add(-time.Hour),
+			Type: data.PointTypeDescription, Text: "root with old time"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rns, err = db.getNodes("all", rootID, "", false)
+		if err != nil {
+			t.Fatal("Error getting root node: ", err)
+		}
+		rn = rns[0]
+
+		if rn.Desc() != "root" {
+			t.Fatal("Description should have stayed root, got: ", rn.Desc())
+		}
+
+		// verify default admin user got set
+		children, err := db.getNodes(rootID, "all", "", false)
+		if err != nil {
+			t.Fatal("children error: ", err)
+		}
+
+		if len(children) < 1 {
+			t.Fatal("did not return any children")
+		}
+
+		if children[0].Parent != rootID {
+			t.Fatal("Parent not correct: ", children[0].Parent)
+		}
+
+		// test getNodes API
+		adminID := children[0].ID
+
+		adminNodes, err := db.getNodes(rootID, adminID, "", false)
+		if err != nil {
+			t.Fatal("Error getting admin nodes", err)
+		}
+
+		if len(adminNodes) < 1 {
+			t.Fatal("did not return admin nodes")
+		}
+
+		if adminNodes[0].Type != data.NodeTypeUser {
+			t.Fatal("getNodes did not return right node type for user")
+		}
+
+		adminNodes, err = db.getNodes("all", adminID, "", false)
+		if err != nil {
+			t.Fatal("Error getting admin nodes", err)
+		}
+
+		if len(adminNodes) < 1 {
+			t.Fatal("did not return admin nodes")
+		}
+
+		rootNodes, err := db.getNodes("root", "all", "", false)
+		if err != nil {
+			t.Fatal("Error getting root nodes", err)
+		}
+
+		if len(rootNodes) < 1 {
+			t.Fatal("did not return root nodes")
+		}
+
+		if rootNodes[0].ID != rootID {
+			t.Fatal("root node ID is not correct")
+		}
+
+		// test edge points
+		err = db.edgePoints(adminID, rootID, data.Points{{Type: data.PointTypeRole, Text: data.PointValueRoleAdmin}})
+		if err != nil {
+			t.Fatal("Error sending edge points: ", err)
+		}
+
+		adminNodes, err = db.getNodes(rootID, adminID, "", false)
+		if err != nil {
+			t.Fatal("Error getting admin nodes", err)
+		}
+
+		p, ok := adminNodes[0].EdgePoints.Find(data.PointTypeRole, "")
+		if !ok {
+			t.Fatal("point not found")
+		}
+		if p.Text != data.PointValueRoleAdmin {
+			t.Fatal("point does not have right value")
+		}
+
+		// try two children
+		groupNodeID := uuid.New().String()
+
+		err = db.edgePoints(groupNodeID, rootID, data.Points{
+			{Type: data.PointTypeTombstone, Value: 0},
+			{Type: data.PointTypeNodeType, Text: data.NodeTypeGroup},
+		})
+		if err != nil {
+			t.Fatal("Error creating group edge", err)
+		}
+
+		// verify default admin user got set
+		children, err = db.getNodes(rootID, "all", "", false)
+		if err != nil {
+			t.Fatal("children error: ", err)
+		}
+
+		if len(children) < 2 {
+			t.Fatal("did not return 2 children")
+		}
+
+		// verify getNodes with "all" works
+		start := time.Now()
+		adminNodes, err = db.getNodes("all", adminID, "", false)
+		fmt.Println("getNodes time: ", time.Since(start))
+		if err != nil {
+			t.Fatal("Error getting admin nodes with all specified: ", err)
+		}
+
+		if adminNodes[0].Parent != rootID {
+			t.Fatal("Parent ID is not correct")
+		}
+
+		if len(adminNodes) < 1 {
+			t.Fatal("did not return admin nodes")
+		}
+	})
+}
+
+func TestBackendKeyZero(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Backend) {
+		// what to do when we have points with key set to "0" and ""
+		// technically these should map to the same point so that
+		// we can easily upgrade from scalars to arrays with no
+		// data changes
+
+		rootID := db.rootNodeID()
+
+		err := db.nodePoints(rootID, data.Points{{Type: data.PointTypeValue, Value: 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		nodes, err := db.getNodes("all", rootID, "", false)
+		if err != nil {
+			t.Fatal("Error getting root node: ", err)
+		}
+
+		n := nodes[0]
+
+		err = db.nodePoints(rootID, data.Points{{Type: data.PointTypeValue, Key: "0", Value: 2}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		nodes, err = db.getNodes("all", rootID, "", false)
+		if err != nil {
+			t.Fatal("Error getting root node: ", err)
+		}
+
+		n = nodes[0]
+
+		if len(n.Points) != 1 {
+			t.Fatal("Error, point did not get merged")
+		}
+	})
+}
+
+func TestBackendUserCheck(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Backend) {
+		nodes, err := db.userCheck("admin@admin.com", "admin")
+		if err != nil {
+			t.Fatal("userCheck returned error: ", err)
+		}
+
+		if len(nodes) < 1 {
+			t.Fatal("userCheck did not return nodes")
+		}
+
+		pass, _ := nodes[0].Points.Text(data.PointTypePass, "")
+		if pass == "admin" || !isPasswordHash(pass) {
+			t.Fatal("password is not stored as a hash: ", pass)
+		}
+
+		nodes, err = db.userCheck("admin@admin.com", "wrong")
+		if err != nil {
+			t.Fatal("userCheck returned error: ", err)
+		}
+
+		if len(nodes) > 0 {
+			t.Fatal("userCheck returned nodes for wrong password")
+		}
+	})
+}
+
+func TestBackendUp(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Backend) {
+		rootID := db.rootNodeID()
+
+		children, err := db.getNodes(rootID, "all", "", false)
+
+		if err != nil {
+			t.Fatal("Error getting children")
+		}
+
+		if len(children) < 1 {
+			t.Fatal("no children")
+		}
+
+		childID := children[0].ID
+
+		ups, err := db.up(childID, false)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(ups) < 1 {
+			t.Fatal("No ups for admin user")
+		}
+
+		if ups[0] != rootID {
+			t.Fatal("ups, wrong ID: ", ups[0])
+		}
+
+		// try to get ups of root node
+		ups, err = db.up(rootID, false)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(ups) < 1 {
+			t.Fatal("No ups for root user")
+		}
+
+		if ups[0] != "root" {
+			t.Fatal("ups, wrong ID for root: ", ups[0])
+		}
+	})
+}
+
+func TestBackendBatchPoints(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Backend) {
+		rootID := db.rootNodeID()
+
+		now := time.Now()
+
+		pts := data.Points{
+			{Time: now, Type: data.PointTypeValue},
+			{Time: now.Add(-time.Second), Type: data.PointTypeValue},
+			{Time: now.Add(-time.Second * 2), Type: data.PointTypeValue},
+		}
+
+		err := db.nodePoints(rootID, pts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		nodes, err := db.getNodes("all", rootID, "", false)
+		if err != nil {
+			t.Fatal("Error getting root node: ", err)
+		}
+
+		n := nodes[0]
+
+		if len(n.Points) != 1 {
+			t.Fatal("Error, point did not get merged")
+		}
+
+		if !n.Points[0].Time.Equal(now) {
+			t.Fatal("Point collapsing did not pick latest")
+		}
+	})
+}
+
+func TestBackendRevisions(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Backend) {
+		rootID := db.rootNodeID()
+
+		// points without origin are not recorded
+		err := db.nodePoints(rootID, data.Points{{Type: data.PointTypeValue, Value: 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.nodePoints(rootID, data.Points{{Type: data.PointTypeDescription,
+			Text: "one", Origin: "user1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.nodePoints(rootID, data.Points{{Type: data.PointTypeDescription,
+			Text: "two", Origin: "user2"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// no change, so no revision
+		err = db.nodePoints(rootID, data.Points{{Type: data.PointTypeDescription,
+			Text: "two", Origin: "user2"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// status points are not recorded
+		err = db.nodePoints(rootID, data.Points{{Type: data.PointTypeActive,
+			Value: 1, Origin: "user2"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// rule outputs are not recorded
+		err = db.edgePoints("action1", rootID, data.Points{{Type: data.PointTypeNodeType,
+			Text: data.NodeTypeAction}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.nodePoints(rootID, data.Points{{Type: data.PointTypeDescription,
+			Text: "three", Origin: "action1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		revs, err := db.revisions(rootID)
+		if err != nil {
+			t.Fatal("revisions error: ", err)
+		}
+
+		if len(revs) != 2 {
+			t.Fatal("expected 2 revisions, got: ", len(revs))
+		}
+
+		if revs[0].Origin != "user2" || revs[0].Points[0].Text != "two" ||
+			revs[0].Previous[0].Text != "one" {
+			t.Fatalf("latest revision is not correct: %+v", revs[0])
+		}
+
+		if revs[1].Origin != "user1" || !revs[1].Previous[0].Time.IsZero() {
+			t.Fatalf("first revision is not correct: %+v", revs[1])
+		}
+
+		if revs[0].ID <= revs[1].ID {
+			t.Fatal("revisions are not ordered newest first")
+		}
+
+		// revisions are purged after their retention
+		results, err := db.gc(time.Time{}, time.Now().Add(-time.Hour))
+		if err != nil || results.Revisions != 0 {
+			t.Fatalf("gc purged new revisions: %+v, %v", results, err)
+		}
+
+		results, err = db.gc(time.Time{}, time.Now().Add(time.Hour))
+		if err != nil || results.Revisions != 2 {
+			t.Fatalf("gc did not purge old revisions: %+v, %v", results, err)
+		}
+
+		revs, err = db.revisions(rootID)
+		if err != nil || len(revs) != 0 {
+			t.Fatal("revisions were not purged: ", len(revs), err)
+		}
+	})
+}
+
+func TestBackendQueryNodes(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Backend) {
+		rootID := db.rootNodeID()
+
+		nodes := []struct {
+			id, parent, typ string
+			points          data.Points
+		}{
+			{"g1", rootID, data.NodeTypeGroup, nil},
+			{"d1", "g1", data.NodeTypeVariable, data.Points{{Type: data.PointTypeSysState,
+				Text: data.PointValueSysStateOffline}, {Type: data.PointTypeDescription,
+				Text: "gone", Tombstone: 1}}},
+			// the description was deleted and then added again
+			{"d2", rootID, data.NodeTypeVariable, data.Points{{Type: data.PointTypeSysState,
+				Text: data.PointValueSysStateOnline}, {Type: data.PointTypeDescription,
+				Text: "readded", Tombstone: 2}}},
+			{"d3", "g1", data.NodeTypeVariable, data.Points{{Type: data.PointTypeSysState,
+				Text: data.PointValueSysStateOffline}}},
+			{"m1", "g1", data.NodeTypeModbusIO, data.Points{{Type: data.PointTypeErrorCount,
+				Value: 5}, {Type: data.PointTypeError, Text: "timeout"}}},
+			{"m2", rootID, data.NodeTypeModbusIO, data.Points{{Type: data.PointTypeErrorCount,
+				Value: 1}, {Type: data.PointTypeError, Text: ""}}},
+		}
+
+		for _, n := range nodes {
+			err := db.edgePoints(n.id, n.parent, data.Points{{Type: data.PointTypeNodeType,
+				Text: n.typ}})
+			if err != nil {
+				t.Fatal("Error creating node: ", err)
+			}
+
+			if len(n.points) > 0 {
+				err = db.nodePoints(n.id, n.points)
+				if err != nil {
+					t.Fatal("Error writing points: ", err)
+				}
+			}
+		}
+
+		// delete d3
+		err := db.edgePoints("d3", "g1", data.Points{{Type: data.PointTypeTombstone, Value: 1}})
+		if err != nil {
+			t.Fatal("Error deleting node: ", err)
+		}
+
+		ids := func(q string) string {
+			query, err := data.ParseNodeQuery(q)
+			if err != nil {
+				t.Fatalf("Error parsing query %v: %v", q, err)
+			}
+
+			nodes, err := db.queryNodes(query)
+			if err != nil {
+				t.Fatalf("Error running query %v: %v", q, err)
+			}
+
+			var ret []string
+			for _, n := range nodes {
+				ret = append(ret, n.ID)
+			}
+			sort.Strings(ret)
+			return strings.Join(ret, ",")
+		}
+
+		tests := []struct {
+			query    string
+			expected string
+		}{
+			{"type=variable", "d1,d2"},
+			{"type=variable deleted=true", "d1,d2,d3"},
+			{"type=variable sysState=offline", "d1"},
+			{"root=g1 type=variable", "d1"},
+			{"root=g1", "g1,d1,m1"},
+			{`type=modbusIo error!=""`, "m1"},
+			{"errorCount>=1", "m1,m2"},
+			{"errorCount>1", "m1"},
+			{"errorCount.0<5 type=modbusIo", "m2"},
+			{"errorCount.1>0", ""},
+			{"type=user description=nobody", ""},
+			{"description=gone", ""},
+			{"description=readded", "d2"},
+		}
+
+		for _, test := range tests {
+			got := ids(test.query)
+
+			expected := strings.Split(test.expected, ",")
+			sort.Strings(expected)
+
+			if got != strings.Join(expected, ",") {
+				t.Errorf("query %v, expected %v, got %v", test.query, test.expected, got)
+			}
+		}
+
+		_, err = db.queryNodes(data.NodeQuery{Points: []data.PointQuery{{Type: data.PointTypePass,
+			Op: data.QueryOpEqual, Text: "x", CompareText: true}}})
+		if err == nil {
+			t.Fatal("querying passwords should fail")
+		}
+	})
+}
+
+func TestBackendGC(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Backend) {
+		rootID := db.rootNodeID()
+		now := time.Now()
+		old := now.Add(-2 * time.Hour)
+
+		edges := []struct{ id, parent string }{
+			{"g1", rootID},
+			{"c1", "g1"},
+			{"c2", "c1"},
+			{"d1", rootID},
+			{"m1", rootID},
+			{"m1", "g1"},
+		}
+
+		for _, e := range edges {
+			err := db.edgePoints(e.id, e.parent, data.Points{{Type: data.PointTypeNodeType,
+				Text: data.NodeTypeGroup}})
+			if err != nil {
+				t.Fatal("Error creating node: ", err)
+			}
+		}
+
+		for _, id := range []string{"g1", "c1", "c2", "d1"} {
+			err := db.nodePoints(id, data.Points{{Type: data.PointTypeDescription, Text: id}})
+			if err != nil {
+				t.Fatal("Error writing points: ", err)
+			}
+		}
+
+		// delete g1 long ago, and d1 recently
+		err := db.edgePoints("g1", rootID, data.Points{{Type: data.PointTypeTombstone,
+			Value: 1, Time: old}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.edgePoints("d1", rootID, data.Points{{Type: data.PointTypeTombstone,
+			Value: 1, Time: now}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// deleted points
+		err = db.nodePoints(rootID, data.Points{
+			{Type: data.PointTypeValue, Key: "1", Value: 1, Time: old, Tombstone: 1},
+			{Type: data.PointTypeValue, Key: "2", Value: 2, Time: now, Tombstone: 1},
+			// deleted and then added again
+			{Type: data.PointTypeValue, Key: "3", Value: 3, Time: old, Tombstone: 2},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.edgePoints("d1", rootID, data.Points{{Type: data.PointTypeRole,
+			Text: data.PointValueRoleAdmin, Time: old, Tombstone: 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.verifyNodeHashes(false)
+		if err != nil {
+			t.Fatal("hashes not valid before gc: ", err)
+		}
+
+		results, err := db.gc(now.Add(-time.Hour), time.Time{})
+		if err != nil {
+			t.Fatal("gc error: ", err)
+		}
+
+		// g1, c1, and c2 edges, and the m1 edge under g1
+		if results.Nodes != 3 || results.Edges != 4 || results.EdgePoints < 2 ||
+			results.NodePoints != 4 {
+			t.Fatalf("gc results not correct: %+v", results)
+		}
+
+		err = db.verifyNodeHashes(false)
+		if err != nil {
+			t.Fatal("hashes not valid after gc: ", err)
+		}
+
+		for _, id := range []string{"g1", "c1", "c2"} {
+			nodes, err := db.getNodes("all", id, "", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(nodes) > 0 {
+				t.Fatal("node was not purged: ", id)
+			}
+		}
+
+		m1, err := db.getNodes("all", "m1", "", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(m1) != 1 || m1[0].Parent != rootID {
+			t.Fatalf("mirrored node not correct: %+v", m1)
+		}
+
+		d1, err := db.getNodes(rootID, "d1", "", true)
+		if err != nil || len(d1) != 1 {
+			t.Fatal("recently deleted node should not be purged: ", err)
+		}
+
+		if _, ok := d1[0].EdgePoints.Find(data.PointTypeRole, ""); ok {
+			t.Fatal("deleted edge point was not purged")
+		}
+
+		root, err := db.getNodes("all", rootID, "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := root[0].Points.Find(data.PointTypeValue, "1"); ok {
+			t.Fatal("deleted node point was not purged")
+		}
+
+		if _, ok := root[0].Points.Find(data.PointTypeValue, "2"); !ok {
+			t.Fatal("recently deleted node point should not be purged")
+		}
+
+		if _, ok := root[0].Points.Find(data.PointTypeValue, "3"); !ok {
+			t.Fatal("node point that was added again should not be purged")
+		}
+
+		// nothing left to purge
+		results, err = db.gc(now.Add(-time.Hour), time.Time{})
+		if err != nil {
+			t.Fatal("gc error: ", err)
+		}
+
+		if results.Total() != 0 {
+			t.Fatalf("second gc should not purge anything: %+v", results)
+		}
+	})
+}
+
+func TestBackendNodePointsBatch(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Backend) {
+		rootID := db.rootNodeID()
+
+		for _, id := range []string{"n1", "n2"} {
+			err := db.edgePoints(id, rootID, data.Points{{Type: data.PointTypeNodeType,
+				Text: data.NodeTypeVariable}})
+			if err != nil {
+				t.Fatal("Error creating node: ", err)
+			}
+		}
+
+		now := time.Now()
+
+		err := db.nodePointsBatch([]nodeUpdate{
+			{"n1", data.Points{{Type: data.PointTypeValue, Value: 1, Time: now}}},
+			{"n2", data.Points{{Type: data.PointTypeValue, Value: 10, Time: now}}},
+			{"n1", data.Points{{Type: data.PointTypeValue, Value: 2,
+				Time: now.Add(time.Millisecond)}}},
+			// older points in a batch do not overwrite newer ones
+			{"n1", data.Points{{Type: data.PointTypeValue, Value: 0,
+				Time: now.Add(-time.Millisecond)}}},
+			{"n2", data.Points{{Type: data.PointTypeDescription, Text: "two", Time: now}}},
+		})
+		if err != nil {
+			t.Fatal("Error writing batch: ", err)
+		}
+
+		check := func(id string, value float64) {
+			nodes, err := db.getNodes(rootID, id, "", false)
+			if err != nil || len(nodes) != 1 {
+				t.Fatal("Error getting node: ", err)
+			}
+
+			v, _ := nodes[0].Points.Value(data.PointTypeValue, "")
+			if v != value {
+				t.Errorf("node %v value: expected %v, got %v", id, value, v)
+			}
+		}
+
+		check("n1", 2)
+		check("n2", 10)
+
+		err = db.verifyNodeHashes(false)
+		if err != nil {
+			t.Fatal("hashes not valid after batch: ", err)
+		}
+	})
+}
@@ -0,0 +1,257 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// tables that are copied when a backup is restored. The meta table is handled
+// separately.
+var restoreTables = []string{"edges", "node_points", "edge_points",
+	"history_points", "history_aggregates", "revisions", "revision_points"}
+
+// backup writes a consistent snapshot of the database to file. The database
+// can be written to while the backup is running.
+func (sdb *DbSqlite) backup(file string) error {
+	_, err := sdb.db.Exec(`VACUUM INTO ?`, file)
+	if err != nil {
+		return fmt.Errorf("Error creating snapshot: %v", err)
+	}
+
+	return nil
+}
+
+// restore replaces all data in the database with data from a snapshot created
+// by backup. The snapshot is validated before anything is changed, and the
+// data is copied in a single transaction, so a failed restore leaves the
+// current data in place.
+func (sdb *DbSqlite) restore(file string) error {
+	snapRootID, err := validateSnapshot(file)
+	if err != nil {
+		return err
+	}
+
+	sdb.writeLock.Lock()
+	defer sdb.writeLock.Unlock()
+
+	// ATTACH only applies to one connection, so make sure everything runs
+	// on the same one
+	ctx := context.Background()
+	conn, err := sdb.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `ATTACH DATABASE ? AS snap`, file)
+	if err != nil {
+		return fmt.Errorf("Error attaching snapshot: %v", err)
+	}
+
+	defer func() {
+		_, err := conn.ExecContext(ctx, `DETACH DATABASE snap`)
+		if err != nil {
+			log.Println("Error detaching snapshot:", err)
+		}
+	}()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	rollback := func() {
+		err := tx.Rollback()
+		if err != nil {
+			log.Println("Rollback error:", err)
+		}
+	}
+
+	for _, t := range restoreTables {
+		_, err = tx.Exec(`DELETE FROM main.` + t)
+		if err != nil {
+			rollback()
+			return fmt.Errorf("Error clearing %v: %v", t, err)
+		}
+
+		// columns added by migrations may be in a different order in the
+		// snapshot, so they are listed explicitly
+		columns, err := restoreColumns(tx, t)
+		if err != nil {
+			rollback()
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO main.` + t + `(` + columns + `) SELECT ` +
+			columns + ` FROM snap.` + t)
+		if err != nil {
+			rollback()
+			return fmt.Errorf("Error restoring %v: %v", t, err)
+		}
+	}
+
+	// the JWT key is not restored so existing logins stay valid
+	_, err = tx.Exec(`UPDATE main.meta SET root_id = ?`, snapRootID)
+	if err != nil {
+		rollback()
+		return fmt.Errorf("Error restoring meta: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Error committing restore: %v", err)
+	}
+
+	if snapRootID != sdb.meta.RootID {
+		log.Println("STORE: restored snapshot has a different root node, restart recommended")
+	}
+
+	sdb.meta.RootID = snapRootID
+
+	return nil
+}
+
+// tableColumns returns the column names of a table in the order they were
+// created
+func tableColumns(tx *sql.Tx, schema, table string) ([]string, error) {
+	rows, err := tx.Query(`SELECT name FROM pragma_table_info(?, ?) ORDER BY cid`,
+		table, schema)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ret []string
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, name)
+	}
+
+	return ret, rows.Err()
+}
+
+// restoreColumns returns the list of columns that are copied from the
+// snapshot for a table. All columns of the store table must be in the
+// snapshot.
+func restoreColumns(tx *sql.Tx, table string) (string, error) {
+	columns, err := tableColumns(tx, "main", table)
+	if err != nil {
+		return "", fmt.Errorf("Error reading %v columns: %v", table, err)
+	}
+
+	snapColumns, err := tableColumns(tx, "snap", table)
+	if err != nil {
+		return "", fmt.Errorf("Error reading snapshot %v columns: %v", table, err)
+	}
+
+	for _, c := range columns {
+		if !slices.Contains(snapColumns, c) {
+			return "", fmt.Errorf("snapshot %v table is missing column %v", table, c)
+		}
+	}
+
+	return strings.Join(columns, ", "), nil
+}
+
+// validateSnapshot checks a snapshot file before it is restored and returns
+// the root node ID of the snapshot. Older snapshots are migrated to the
+// current schema in place.
+func validateSnapshot(file string) (string, error) {
+	// check the file before opening it as a store, as opening the store
+	// would create a new root node in an empty database
+	db, err := sql.Open("sqlite", file)
+	if err != nil {
+		return "", err
+	}
+
+	var integrity string
+	err = db.QueryRow(`PRAGMA integrity_check`).Scan(&integrity)
+	if err != nil {
+		db.Close()
+		return "", fmt.Errorf("Error checking snapshot integrity: %v", err)
+	}
+
+	if integrity != "ok" {
+		db.Close()
+		return "", fmt.Errorf("snapshot integrity check failed: %v", integrity)
+	}
+
+	var version sql.NullInt64
+	var rootID sql.NullString
+	err = db.QueryRow(`SELECT version, root_id FROM meta`).Scan(&version, &rootID)
+	db.Close()
+	if err != nil {
+		return "", fmt.Errorf("Error reading snapshot meta: %v", err)
+	}
+
+	if rootID.String == "" {
+		return "", errors.New("snapshot does not have a root node")
+	}
+
+	// snapshots from newer versions of SIOT may have columns we don't know
+	// about
+	if version.Int64 > sqliteVersion {
+		return "", fmt.Errorf("snapshot schema version %v is newer than %v",
+			version.Int64, sqliteVersion)
+	}
+
+	snap, err := NewSqliteDb(file, "")
+	if err != nil {
+		return "", fmt.Errorf("Error opening snapshot: %v", err)
+	}
+	defer snap.Close()
+
+	if snap.meta.Version != sqliteVersion {
+		return "", fmt.Errorf("snapshot schema version %v was not migrated to %v",
+			snap.meta.Version, sqliteVersion)
+	}
+
+	err = snap.verifyNodeHashes(false)
+	if err != nil {
+		return "", fmt.Errorf("snapshot hash verification failed: %v", err)
+	}
+
+	// make sure WAL is merged so the snapshot can be attached
+	_, err = snap.db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`)
+	if err != nil {
+		return "", err
+	}
+
+	return snap.meta.RootID, nil
+}
+
+// snapshotFile returns a path in a new temporary directory that can be used
+// for a snapshot. The returned function removes the directory.
+func snapshotFile() (string, func(), error) {
+	dir, err := os.MkdirTemp("", "siot-snapshot")
+	if err != nil {
+		return "", nil, err
+	}
+
+	return filepath.Join(dir, "snapshot.sqlite"), func() {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			log.Println("Error removing snapshot:", err)
+		}
+	}, nil
+}
+
+// errReader is used to send an error to the receiver of a snapshot
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(_ []byte) (int, error) {
+	return 0, r.err
+}
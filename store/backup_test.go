@@ -0,0 +1,178 @@
+package store
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func TestDbSqliteBackupRestore(t *testing.T) {
+	db := newTestDb(t)
+	defer db.Close()
+
+	rootID := db.rootNodeID()
+
+	err := db.nodePoints(rootID, data.Points{{Type: data.PointTypeDescription, Text: "before"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, cleanup, err := snapshotFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	err = db.backup(file)
+	if err != nil {
+		t.Fatal("backup failed: ", err)
+	}
+
+	err = db.nodePoints(rootID, data.Points{{Type: data.PointTypeDescription, Text: "after"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt a hash in the snapshot, restore should fail
+	snap, err := sql.Open("sqlite", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hash uint32
+	err = snap.QueryRow(`SELECT hash FROM edges WHERE down = ?`, rootID).Scan(&hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = snap.Exec(`UPDATE edges SET hash = 1234 WHERE down = ?`, rootID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.restore(file)
+	if err == nil {
+		t.Fatal("restore of snapshot with bad hash should fail")
+	}
+
+	nodes, err := db.getNodes("all", rootID, "", false)
+	if err != nil || len(nodes) < 1 {
+		t.Fatal("error getting root node: ", err)
+	}
+
+	if desc, _ := nodes[0].Points.Text(data.PointTypeDescription, ""); desc != "after" {
+		t.Fatal("failed restore modified data: ", desc)
+	}
+
+	// fix the snapshot and restore
+	_, err = snap.Exec(`UPDATE edges SET hash = ? WHERE down = ?`, hash, rootID)
+	snap.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.restore(file)
+	if err != nil {
+		t.Fatal("restore failed: ", err)
+	}
+
+	nodes, err = db.getNodes("all", rootID, "", false)
+	if err != nil || len(nodes) < 1 {
+		t.Fatal("error getting root node: ", err)
+	}
+
+	if desc, _ := nodes[0].Points.Text(data.PointTypeDescription, ""); desc != "before" {
+		t.Fatal("restore did not restore data: ", desc)
+	}
+}
+
+func TestDbSqliteRestoreSchema(t *testing.T) {
+	db := newTestDb(t)
+	defer db.Close()
+
+	rootID := db.rootNodeID()
+
+	err := db.nodePoints(rootID, data.Points{{Type: data.PointTypeDescription, Text: "before"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, cleanup, err := snapshotFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	err = db.backup(file)
+	if err != nil {
+		t.Fatal("backup failed: ", err)
+	}
+
+	err = db.nodePoints(rootID, data.Points{{Type: data.PointTypeDescription, Text: "after"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := sql.Open("sqlite", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// snapshots from newer versions can't be restored
+	_, err = snap.Exec(`UPDATE meta SET version = 99`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.restore(file)
+	if err == nil {
+		t.Fatal("restore of snapshot with newer schema should fail")
+	}
+
+	// columns added by migrations are at the end of older tables
+	_, err = snap.Exec(`UPDATE meta SET version = ?`, sqliteVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []string{
+		`DROP TABLE history_points`,
+		`CREATE TABLE history_points (node_id TEXT, type TEXT, key TEXT,
+			time INT, value REAL, text TEXT, node_type TEXT)`,
+		`INSERT INTO history_points VALUES ('node', 'temp', '0', 1, 20, '', 'device')`,
+	} {
+		_, err = snap.Exec(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snap.Close()
+
+	err = db.restore(file)
+	if err != nil {
+		t.Fatal("restore failed: ", err)
+	}
+
+	nodes, err := db.getNodes("all", rootID, "", false)
+	if err != nil || len(nodes) < 1 {
+		t.Fatal("error getting root node: ", err)
+	}
+
+	if desc, _ := nodes[0].Points.Text(data.PointTypeDescription, ""); desc != "before" {
+		t.Fatal("restore did not restore data: ", desc)
+	}
+
+	var nodeType string
+	var value float64
+	err = db.db.QueryRow(`SELECT node_type, value FROM history_points
+		WHERE node_id = 'node'`).Scan(&nodeType, &value)
+	if err != nil {
+		t.Fatal("error reading restored history: ", err)
+	}
+
+	if nodeType != "device" || value != 20 {
+		t.Fatal("history restored into the wrong columns: ", nodeType, value)
+	}
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"log"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// maximum number of node point messages written in one transaction
+var pointBatchMax = 500
+
+// pointWrite is a node point message waiting to be written
+type pointWrite struct {
+	nodeID string
+	points data.Points
+	reply  string
+	start  time.Time
+}
+
+// runPointWriter writes node points received by handleNodePoints. Messages
+// that arrive while a batch is being written are collected into the next
+// batch, so at low rates each message is written right away, and at high
+// rates many messages share one transaction. done is closed after any
+// pending messages are written when the store is stopped.
+func (st *Store) runPointWriter(done chan struct{}) {
+	defer close(done)
+
+	for {
+		var batch []pointWrite
+
+		select {
+		case w := <-st.chPointWrites:
+			batch = append(batch, w)
+		case <-st.chStop:
+			// write whatever is left before the store is closed
+			for {
+				select {
+				case w := <-st.chPointWrites:
+					st.writePoints([]pointWrite{w})
+				default:
+					return
+				}
+			}
+		}
+
+	collect:
+		for len(batch) < pointBatchMax {
+			select {
+			case w := <-st.chPointWrites:
+				batch = append(batch, w)
+			default:
+				break collect
+			}
+		}
+
+		st.writePoints(batch)
+	}
+}
+
+// writePoints writes a batch of node point messages in one transaction, then
+// sends the points upstream and acks each message in the order they were
+// received. If the batch fails, each message is written on its own so an
+// error is only returned for the messages that fail.
+func (st *Store) writePoints(batch []pointWrite) {
+	updates := make([]nodeUpdate, len(batch))
+	for i, w := range batch {
+		updates[i] = nodeUpdate{id: w.nodeID, points: w.points}
+	}
+
+	err := st.db.nodePointsBatch(updates)
+	if err != nil && len(batch) > 1 {
+		log.Printf("Error writing batch of %v point messages, retrying one at a time: %v",
+			len(batch), err)
+		for _, w := range batch {
+			st.writePoints([]pointWrite{w})
+		}
+		return
+	}
+
+	for _, w := range batch {
+		if err != nil {
+			// TODO track error stats
+			log.Printf("Error writing nodeID (%v) to Db: %v", w.nodeID, err)
+			st.reply(w.reply, err)
+			continue
+		}
+
+		// process point in upstream nodes. Password hashes never leave
+		// the store.
+		upErr := st.processPointsUpstream(w.nodeID, w.nodeID, removePasswordPoints(w.points))
+		if upErr != nil {
+			// TODO track error stats
+			log.Println("Error processing point in upstream nodes:", upErr)
+		}
+
+		st.reply(w.reply, nil)
+
+		t := time.Since(w.start).Milliseconds()
+		mErr := st.metricCycleNodePoint.AddSample(float64(t))
+		if mErr != nil {
+			log.Println("Error adding metric sample:", mErr)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// benchNodes creates count nodes below a group node and returns their IDs
+func benchNodes(b *testing.B, db Backend, count int) []string {
+	err := db.edgePoints("bench", db.rootNodeID(), data.Points{{Type: data.PointTypeNodeType,
+		Text: data.NodeTypeGroup}})
+	if err != nil {
+		b.Fatal("Error creating group: ", err)
+	}
+
+	ids := make([]string, count)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("io%v", i)
+		err := db.edgePoints(ids[i], "bench", data.Points{{Type: data.PointTypeNodeType,
+			Text: data.NodeTypeModbusIO}})
+		if err != nil {
+			b.Fatal("Error creating node: ", err)
+		}
+	}
+
+	return ids
+}
+
+// BenchmarkSqliteNodePoints measures the rate node points can be written when
+// each message is its own transaction and when messages are batched.
+func BenchmarkSqliteNodePoints(b *testing.B) {
+	for _, batchSize := range []int{1, 10, 100, 500} {
+		b.Run(fmt.Sprintf("batch-%v", batchSize), func(b *testing.B) {
+			db := newTestDb(b)
+			defer db.Close()
+
+			ids := benchNodes(b, db, 200)
+			start := time.Now()
+
+			b.ResetTimer()
+
+			var batch []nodeUpdate
+
+			for i := 0; i < b.N; i++ {
+				batch = append(batch, nodeUpdate{id: ids[i%len(ids)], points: data.Points{
+					{Type: data.PointTypeValue, Value: float64(i), Time: start.Add(time.Duration(i))}}})
+
+				if len(batch) >= batchSize || i == b.N-1 {
+					err := db.nodePointsBatch(batch)
+					if err != nil {
+						b.Fatal("Error writing points: ", err)
+					}
+					batch = batch[:0]
+				}
+			}
+
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "points/s")
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package store
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// nodeCache is a write-through cache of nodes, edges, and points in front of a
+// Backend. Node requests are answered from memory, and the cache entries for a
+// node and all its ancestors (whose hashes change) are dropped when points or
+// edges are written through the cache. All writes to the backend must go
+// through the cache.
+type nodeCache struct {
+	Backend
+
+	lock sync.Mutex
+	// gen is incremented on every invalidation, so entries read from the
+	// backend while a write is in progress are not cached
+	gen uint64
+	// all edges (including deleted) of a node, indexed by node ID
+	nodes map[string][]data.NodeEdge
+	// all child edges (including deleted) of a node, indexed by parent ID
+	children map[string][]data.NodeEdge
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func newNodeCache(db Backend) *nodeCache {
+	return &nodeCache{
+		Backend:  db,
+		nodes:    make(map[string][]data.NodeEdge),
+		children: make(map[string][]data.NodeEdge),
+	}
+}
+
+// getNodes returns nodes from the cache, loading them from the backend if
+// needed. See Backend.getNodes for the parameters.
+func (c *nodeCache) getNodes(parent, id, typ string, includeDel bool) ([]data.NodeEdge, error) {
+	if parent == "" || parent == "none" || (parent == "all" && (id == "all" || id == "")) {
+		// let the backend return the error
+		return c.Backend.getNodes(parent, id, typ, includeDel)
+	}
+
+	if id == "" {
+		id = "all"
+	}
+
+	var edges []data.NodeEdge
+	var err error
+
+	switch {
+	case parent == "root":
+		edges, err = c.nodeEdges(c.rootNodeID())
+		parent = "all"
+	case id == "all":
+		edges, err = c.childEdges(parent)
+		parent = "all"
+	default:
+		edges, err = c.nodeEdges(id)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []data.NodeEdge
+
+	for _, ne := range edges {
+		if parent != "all" && ne.Parent != parent {
+			continue
+		}
+
+		if typ != "" && ne.Type != typ {
+			continue
+		}
+
+		if !includeDel {
+			tombstone, _ := ne.IsTombstone()
+			if tombstone {
+				continue
+			}
+		}
+
+		ret = append(ret, copyNodeEdge(ne))
+	}
+
+	return ret, nil
+}
+
+// up returns upstream ids for a node
+func (c *nodeCache) up(id string, includeDeleted bool) ([]string, error) {
+	edges, err := c.nodeEdges(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var ups []string
+
+	for _, ne := range edges {
+		if !includeDeleted {
+			tombstone, _ := ne.IsTombstone()
+			if tombstone {
+				continue
+			}
+		}
+
+		ups = append(ups, ne.Parent)
+	}
+
+	return ups, nil
+}
+
+// nodeEdges returns all edges of a node
+func (c *nodeCache) nodeEdges(id string) ([]data.NodeEdge, error) {
+	return c.load(c.nodes, id, func() ([]data.NodeEdge, error) {
+		return c.Backend.getNodes("all", id, "", true)
+	})
+}
+
+// childEdges returns all child edges of a node
+func (c *nodeCache) childEdges(parent string) ([]data.NodeEdge, error) {
+	return c.load(c.children, parent, func() ([]data.NodeEdge, error) {
+		return c.Backend.getNodes(parent, "all", "", true)
+	})
+}
+
+// load returns a cache entry, or reads it from the backend and caches it if
+// nothing was written while it was being read. The returned slice must not be
+// modified.
+func (c *nodeCache) load(entries map[string][]data.NodeEdge, id string,
+	read func() ([]data.NodeEdge, error)) ([]data.NodeEdge, error) {
+	c.lock.Lock()
+	edges, ok := entries[id]
+	gen := c.gen
+	c.lock.Unlock()
+
+	if ok {
+		c.hits.Add(1)
+		return edges, nil
+	}
+
+	c.misses.Add(1)
+
+	edges, err := read()
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	if c.gen == gen {
+		entries[id] = edges
+	}
+	c.lock.Unlock()
+
+	return edges, nil
+}
+
+// invalidate drops the cache entries for nodes and all their ancestors
+func (c *nodeCache) invalidate(ids ...string) {
+	drop := make(map[string]bool)
+
+	var walk func(id string)
+	walk = func(id string) {
+		if drop[id] || id == "root" || id == "none" {
+			return
+		}
+		drop[id] = true
+
+		ups, err := c.parents(id)
+		if err != nil {
+			// we can't find all ancestors, so start over
+			drop = nil
+			return
+		}
+
+		for _, up := range ups {
+			if drop == nil {
+				return
+			}
+			walk(up)
+		}
+	}
+
+	for _, id := range ids {
+		walk(id)
+		if drop == nil {
+			break
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.gen++
+
+	if drop == nil {
+		c.nodes = make(map[string][]data.NodeEdge)
+		c.children = make(map[string][]data.NodeEdge)
+		return
+	}
+
+	for id := range drop {
+		delete(c.nodes, id)
+		delete(c.children, id)
+	}
+}
+
+// parents returns the parents of a node (including deleted edges) from the
+// cache if available, otherwise from the backend. Nothing is cached.
+func (c *nodeCache) parents(id string) ([]string, error) {
+	c.lock.Lock()
+	edges, ok := c.nodes[id]
+	c.lock.Unlock()
+
+	if !ok {
+		return c.Backend.up(id, true)
+	}
+
+	ups := make([]string, len(edges))
+	for i, ne := range edges {
+		ups[i] = ne.Parent
+	}
+
+	return ups, nil
+}
+
+// clear drops all cache entries
+func (c *nodeCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.gen++
+	c.nodes = make(map[string][]data.NodeEdge)
+	c.children = make(map[string][]data.NodeEdge)
+}
+
+// stats returns the number of cache hits and misses since the last call, and
+// the number of cached nodes.
+func (c *nodeCache) stats() (hits, misses uint64, nodes int) {
+	c.lock.Lock()
+	nodes = len(c.nodes)
+	c.lock.Unlock()
+
+	return c.hits.Swap(0), c.misses.Swap(0), nodes
+}
+
+func (c *nodeCache) nodePoints(id string, points data.Points) error {
+	err := c.Backend.nodePoints(id, points)
+	c.invalidate(id)
+	return err
+}
+
+func (c *nodeCache) nodePointsBatch(updates []nodeUpdate) error {
+	err := c.Backend.nodePointsBatch(updates)
+
+	ids := make([]string, len(updates))
+	for i, u := range updates {
+		ids[i] = u.id
+	}
+	c.invalidate(ids...)
+
+	return err
+}
+
+func (c *nodeCache) edgePoints(nodeID, parentID string, points data.Points) error {
+	// edges are never removed (only marked deleted), so the ancestors
+	// found after the write include all of the previous ancestors. The
+	// node's hash is updated in all of its edges.
+	err := c.Backend.edgePoints(nodeID, parentID, points)
+	c.invalidate(nodeID, parentID)
+	return err
+}
+
+func (c *nodeCache) verifyNodeHashes(fix bool) error {
+	err := c.Backend.verifyNodeHashes(fix)
+	if fix {
+		c.clear()
+	}
+	return err
+}
+
+func (c *nodeCache) reset() error {
+	err := c.Backend.reset()
+	c.clear()
+	return err
+}
+
+func (c *nodeCache) restore(file string) error {
+	err := c.Backend.restore(file)
+	c.clear()
+	return err
+}
+
+func (c *nodeCache) gc(before, revisionsBefore time.Time) (data.GCResults, error) {
+	results, err := c.Backend.gc(before, revisionsBefore)
+	c.clear()
+	return results, err
+}
+
+// copyNodeEdge copies the point slices of a cached node so callers can modify
+// the node
+func copyNodeEdge(ne data.NodeEdge) data.NodeEdge {
+	ne.Points = append(data.Points(nil), ne.Points...)
+	ne.EdgePoints = append(data.Points(nil), ne.EdgePoints...)
+	return ne
+}
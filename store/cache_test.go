@@ -0,0 +1,130 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// checkCache verifies the cache returns the same nodes as the backend
+func checkCache(t *testing.T, c *nodeCache, ids ...string) {
+	t.Helper()
+
+	rootID := c.rootNodeID()
+
+	type query struct{ parent, id string }
+	queries := []query{{"root", "all"}, {"all", rootID}, {rootID, "all"}}
+	for _, id := range ids {
+		queries = append(queries, query{"all", id}, query{id, "all"})
+		ups, err := c.Backend.up(id, true)
+		if err != nil {
+			t.Fatal("Error getting ups: ", err)
+		}
+		for _, up := range ups {
+			queries = append(queries, query{up, id})
+		}
+	}
+
+	for _, q := range queries {
+		for _, includeDel := range []bool{false, true} {
+			exp, err := c.Backend.getNodes(q.parent, q.id, "", includeDel)
+			if err != nil {
+				t.Fatal("Error getting nodes from backend: ", err)
+			}
+
+			// run twice so the second read comes from the cache
+			for i := 0; i < 2; i++ {
+				nodes, err := c.getNodes(q.parent, q.id, "", includeDel)
+				if err != nil {
+					t.Fatal("Error getting nodes from cache: ", err)
+				}
+
+				if len(nodes) != len(exp) || (len(exp) > 0 && !reflect.DeepEqual(nodes, exp)) {
+					t.Fatalf("getNodes(%v, %v, %v), expected %+v, got %+v",
+						q.parent, q.id, includeDel, exp, nodes)
+				}
+			}
+		}
+	}
+}
+
+func TestNodeCache(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Backend) {
+		c := newNodeCache(db)
+		rootID := c.rootNodeID()
+
+		for _, n := range []struct{ id, parent, typ string }{
+			{"g1", rootID, data.NodeTypeGroup},
+			{"g2", rootID, data.NodeTypeGroup},
+			{"v1", "g1", data.NodeTypeVariable},
+		} {
+			err := c.edgePoints(n.id, n.parent, data.Points{{Type: data.PointTypeNodeType,
+				Text: n.typ}})
+			if err != nil {
+				t.Fatal("Error creating node: ", err)
+			}
+		}
+
+		ids := []string{"g1", "g2", "v1"}
+
+		checkCache(t, c, ids...)
+
+		hits, misses, _ := c.stats()
+		if hits == 0 || misses == 0 {
+			t.Errorf("expected cache hits and misses, got %v, %v", hits, misses)
+		}
+
+		// points change the node and all upstream hashes
+		err := c.nodePoints("v1", data.Points{{Type: data.PointTypeValue, Value: 5,
+			Time: time.Now()}})
+		if err != nil {
+			t.Fatal("Error writing points: ", err)
+		}
+		checkCache(t, c, ids...)
+
+		err = c.nodePointsBatch([]nodeUpdate{
+			{"v1", data.Points{{Type: data.PointTypeValue, Value: 6, Time: time.Now()}}},
+			{"g2", data.Points{{Type: data.PointTypeDescription, Text: "two",
+				Time: time.Now()}}},
+		})
+		if err != nil {
+			t.Fatal("Error writing batch: ", err)
+		}
+		checkCache(t, c, ids...)
+
+		err = c.verifyNodeHashes(false)
+		if err != nil {
+			t.Fatal("hashes not valid: ", err)
+		}
+
+		// mirror, then delete the original edge
+		err = c.edgePoints("v1", "g2", data.Points{{Type: data.PointTypeNodeType,
+			Text: data.NodeTypeVariable}})
+		if err != nil {
+			t.Fatal("Error mirroring node: ", err)
+		}
+		checkCache(t, c, ids...)
+
+		err = c.edgePoints("v1", "g1", data.Points{{Type: data.PointTypeTombstone, Value: 1}})
+		if err != nil {
+			t.Fatal("Error deleting node: ", err)
+		}
+		checkCache(t, c, ids...)
+
+		ups, err := c.up("v1", false)
+		if err != nil || !reflect.DeepEqual(ups, []string{"g2"}) {
+			t.Fatalf("expected v1 up to be g2, got %v, %v", ups, err)
+		}
+
+		// nodes returned from the cache can be modified
+		nodes, err := c.getNodes("all", "v1", "", false)
+		if err != nil || len(nodes) != 1 {
+			t.Fatal("Error getting node: ", err)
+		}
+		nodes[0].Points[0].Value = 100
+		checkCache(t, c, ids...)
+
+	})
+}
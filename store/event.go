@@ -0,0 +1,90 @@
+package store
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/simpleiot/simpleiot/client"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// edgeLive returns true if an edge exists and is not deleted
+func edgeLive(edges []data.NodeEdge) bool {
+	if len(edges) < 1 {
+		return false
+	}
+
+	tombstone, _ := edges[0].IsTombstone()
+	return !tombstone
+}
+
+// publishNodeEvent compares an edge before and after edge points were written
+// and publishes a node event if the tree changed
+func (st *Store) publishNodeEvent(nodeID, parentID string, before []data.NodeEdge,
+	points data.Points) {
+	after, err := st.db.getNodes(parentID, nodeID, "", true)
+	if err != nil {
+		log.Println("Error getting node for event:", err)
+		return
+	}
+
+	if len(after) < 1 {
+		return
+	}
+
+	event := data.NodeEvent{
+		Time:     time.Now(),
+		ID:       nodeID,
+		Parent:   parentID,
+		NodeType: after[0].Type,
+		Points:   points,
+	}
+
+	wasLive, live := edgeLive(before), edgeLive(after)
+
+	switch {
+	case !wasLive && live:
+		event.Type = data.NodeEventCreated
+	case wasLive && !live:
+		event.Type = data.NodeEventDeleted
+		// client.MoveNode sets the tombstone text to the new parent
+		p, _ := after[0].EdgePoints.Find(data.PointTypeTombstone, "")
+		if p.Text != "" && p.Text != parentID {
+			event.Type = data.NodeEventMoved
+			event.Parent = p.Text
+			event.OldParent = parentID
+		}
+	case wasLive && live:
+		event.Type = data.NodeEventEdgeChanged
+	default:
+		// points written to a deleted edge
+		return
+	}
+
+	d, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Error encoding node event:", err)
+		return
+	}
+
+	err = st.nc.Publish(client.SubjectNodeEvent(event.Type, event.NodeType, nodeID), d)
+	if err != nil {
+		log.Println("Error publishing node event:", err)
+	}
+}
+
+// publishRescan tells watchers to rescan the node tree after the tree was
+// changed without node events
+func (st *Store) publishRescan() {
+	d, err := json.Marshal(data.NodeEvent{Type: data.NodeEventRescan, Time: time.Now()})
+	if err != nil {
+		log.Println("Error encoding node event:", err)
+		return
+	}
+
+	err = st.nc.Publish(client.SubjectNodeEvent(data.NodeEventRescan, "all", "all"), d)
+	if err != nil {
+		log.Println("Error publishing node event:", err)
+	}
+}
@@ -0,0 +1,521 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+var gcPeriod = time.Hour
+
+// sqlGC purges tombstones from the SQLite and PostgreSQL stores in a single
+// transaction. Queries are written with ? placeholders, which are converted
+// to numbered placeholders for PostgreSQL.
+type sqlGC struct {
+	tx              *sql.Tx
+	numbered        bool
+	updateHash      func(tx *sql.Tx, id string, hashUpdate uint32) error
+	before          int64
+	revisionsBefore int64
+	ret             data.GCResults
+}
+
+func (g *sqlGC) rebind(query string) string {
+	if !g.numbered {
+		return query
+	}
+
+	var sb strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		sb.WriteRune(r)
+	}
+
+	return sb.String()
+}
+
+func (g *sqlGC) exec(query string, args ...any) (int64, error) {
+	res, err := g.tx.Exec(g.rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// strings returns the first column of a query
+func (g *sqlGC) strings(query string, args ...any) ([]string, error) {
+	rows, err := g.tx.Query(g.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ret []string
+	for rows.Next() {
+		var s string
+		err := rows.Scan(&s)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, s)
+	}
+
+	return ret, rows.Err()
+}
+
+// pointHashes returns the XOR of the CRCs of points returned by query,
+// indexed by the node or edge ID in the first column
+func (g *sqlGC) pointHashes(query string, args ...any) (map[string]uint32, error) {
+	rows, err := g.tx.Query(g.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make(map[string]uint32)
+	for rows.Next() {
+		var id string
+		var p data.Point
+		var timeNS int64
+		var text sql.NullString
+		err := rows.Scan(&id, &p.Type, &p.Key, &timeNS, &p.Value, &text)
+		if err != nil {
+			return nil, err
+		}
+		p.Time = time.Unix(0, timeNS)
+		p.Text = text.String
+		ret[id] ^= p.CRC()
+	}
+
+	return ret, rows.Err()
+}
+
+func (g *sqlGC) deleteEdge(id string) error {
+	n, err := g.exec(`DELETE FROM edge_points WHERE edge_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	g.ret.EdgePoints += n
+
+	n, err = g.exec(`DELETE FROM edges WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	g.ret.Edges += n
+
+	return nil
+}
+
+// deleteNode removes the points and revisions of a node
+func (g *sqlGC) deleteNode(id string) error {
+	g.ret.Nodes++
+
+	n, err := g.exec(`DELETE FROM node_points WHERE node_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	g.ret.NodePoints += n
+
+	_, err = g.exec(`DELETE FROM revision_points WHERE revision IN
+		(SELECT id FROM revisions WHERE node_id = ?)`, id)
+	if err != nil {
+		return err
+	}
+
+	n, err = g.exec(`DELETE FROM revisions WHERE node_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	g.ret.Revisions += n
+
+	return nil
+}
+
+func (g *sqlGC) run() error {
+	// deleted edges
+	ids, err := g.strings(`SELECT e.id FROM edges e JOIN edge_points p ON p.edge_id = e.id
+		WHERE p.type = ? AND p.value = 1 AND p.time < ? AND e.up != 'root'`,
+		data.PointTypeTombstone, g.before)
+	if err != nil {
+		return fmt.Errorf("Error finding deleted edges: %v", err)
+	}
+
+	var removed []string
+
+	for _, id := range ids {
+		var up, down string
+		var hash int64
+		err := g.tx.QueryRow(g.rebind(`SELECT up, down, hash FROM edges WHERE id = ?`),
+			id).Scan(&up, &down, &hash)
+		if err == sql.ErrNoRows {
+			// already removed with a parent
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		// back the edge out of upstream hashes
+		err = g.updateHash(g.tx, up, uint32(hash))
+		if err != nil {
+			return fmt.Errorf("Error updating hash: %v", err)
+		}
+
+		err = g.deleteEdge(id)
+		if err != nil {
+			return fmt.Errorf("Error deleting edge: %v", err)
+		}
+
+		removed = append(removed, down)
+	}
+
+	// nodes without edges are removed along with their child edges. The
+	// hashes of child edges are not included in any remaining edge.
+	for len(removed) > 0 {
+		id := removed[len(removed)-1]
+		removed = removed[:len(removed)-1]
+
+		var count int
+		err := g.tx.QueryRow(g.rebind(`SELECT COUNT(*) FROM edges WHERE down = ?`),
+			id).Scan(&count)
+		if err != nil {
+			return err
+		}
+
+		if count > 0 {
+			continue
+		}
+
+		err = g.deleteNode(id)
+		if err != nil {
+			return fmt.Errorf("Error deleting node: %v", err)
+		}
+
+		children, err := g.strings(`SELECT id FROM edges WHERE up = ?`, id)
+		if err != nil {
+			return err
+		}
+
+		for _, c := range children {
+			var down string
+			err := g.tx.QueryRow(g.rebind(`SELECT down FROM edges WHERE id = ?`),
+				c).Scan(&down)
+			if err != nil {
+				return err
+			}
+
+			err = g.deleteEdge(c)
+			if err != nil {
+				return fmt.Errorf("Error deleting edge: %v", err)
+			}
+
+			removed = append(removed, down)
+		}
+	}
+
+	// points of nodes that never had an edge
+	orphans, err := g.strings(`SELECT node_id FROM node_points
+		WHERE node_id NOT IN (SELECT down FROM edges)
+		GROUP BY node_id HAVING MAX(time) < ?`, g.before)
+	if err != nil {
+		return fmt.Errorf("Error finding orphaned nodes: %v", err)
+	}
+
+	for _, id := range orphans {
+		err := g.deleteNode(id)
+		if err != nil {
+			return fmt.Errorf("Error deleting node: %v", err)
+		}
+	}
+
+	// deleted node points
+	nodeHashes, err := g.pointHashes(`SELECT node_id, type, key, time, value, text
+		FROM node_points WHERE tombstone % 2 = 1 AND time < ?`, g.before)
+	if err != nil {
+		return fmt.Errorf("Error finding deleted node points: %v", err)
+	}
+
+	for id, hash := range nodeHashes {
+		err := g.updateHash(g.tx, id, hash)
+		if err != nil {
+			return fmt.Errorf("Error updating hash: %v", err)
+		}
+	}
+
+	n, err := g.exec(`DELETE FROM node_points WHERE tombstone % 2 = 1 AND time < ?`, g.before)
+	if err != nil {
+		return fmt.Errorf("Error deleting node points: %v", err)
+	}
+	g.ret.NodePoints += n
+
+	// deleted edge points are only included in the hash of their edge
+	edgeHashes, err := g.pointHashes(`SELECT edge_id, type, key, time, value, text
+		FROM edge_points WHERE tombstone % 2 = 1 AND time < ?`, g.before)
+	if err != nil {
+		return fmt.Errorf("Error finding deleted edge points: %v", err)
+	}
+
+	for id, hash := range edgeHashes {
+		var up string
+		var edgeHash int64
+		err := g.tx.QueryRow(g.rebind(`SELECT up, hash FROM edges WHERE id = ?`),
+			id).Scan(&up, &edgeHash)
+		if err != nil {
+			return err
+		}
+
+		_, err = g.exec(`UPDATE edges SET hash = ? WHERE id = ?`,
+			int64(uint32(edgeHash)^hash), id)
+		if err != nil {
+			return err
+		}
+
+		err = g.updateHash(g.tx, up, hash)
+		if err != nil {
+			return fmt.Errorf("Error updating hash: %v", err)
+		}
+	}
+
+	n, err = g.exec(`DELETE FROM edge_points WHERE tombstone % 2 = 1 AND time < ?`, g.before)
+	if err != nil {
+		return fmt.Errorf("Error deleting edge points: %v", err)
+	}
+	g.ret.EdgePoints += n
+
+	_, err = g.exec(`DELETE FROM revision_points WHERE revision IN
+		(SELECT id FROM revisions WHERE time < ?)`, g.revisionsBefore)
+	if err != nil {
+		return fmt.Errorf("Error deleting revision points: %v", err)
+	}
+
+	n, err = g.exec(`DELETE FROM revisions WHERE time < ?`, g.revisionsBefore)
+	if err != nil {
+		return fmt.Errorf("Error deleting revisions: %v", err)
+	}
+	g.ret.Revisions += n
+
+	return nil
+}
+
+// gcTime returns the time used in gc queries. The zero time is converted to
+// the smallest time so nothing is purged for it.
+func gcTime(t time.Time) int64 {
+	if t.IsZero() {
+		return math.MinInt64
+	}
+	return t.UnixNano()
+}
+
+func (sdb *DbSqlite) gc(before, revisionsBefore time.Time) (data.GCResults, error) {
+	sdb.writeLock.Lock()
+	defer sdb.writeLock.Unlock()
+
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		return data.GCResults{}, err
+	}
+
+	g := &sqlGC{tx: tx, updateHash: sdb.updateHash, before: gcTime(before),
+		revisionsBefore: gcTime(revisionsBefore)}
+
+	err = g.run()
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			log.Println("Rollback error:", rbErr)
+		}
+		return data.GCResults{}, err
+	}
+
+	return g.ret, tx.Commit()
+}
+
+// compact reclaims the space of deleted rows
+func (sdb *DbSqlite) compact() error {
+	_, err := sdb.db.Exec(`VACUUM`)
+	return err
+}
+
+func (pdb *DbPostgres) gc(before, revisionsBefore time.Time) (data.GCResults, error) {
+	pdb.writeLock.Lock()
+	defer pdb.writeLock.Unlock()
+
+	tx, err := pdb.db.Begin()
+	if err != nil {
+		return data.GCResults{}, err
+	}
+
+	g := &sqlGC{tx: tx, numbered: true, updateHash: pdb.updateHash,
+		before: gcTime(before), revisionsBefore: gcTime(revisionsBefore)}
+
+	err = g.run()
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			log.Println("Rollback error:", rbErr)
+		}
+		return data.GCResults{}, err
+	}
+
+	return g.ret, tx.Commit()
+}
+
+func (pdb *DbPostgres) compact() error {
+	_, err := pdb.db.Exec(`VACUUM`)
+	return err
+}
+
+func (mdb *DbMemory) gc(before, revisionsBefore time.Time) (data.GCResults, error) {
+	var ret data.GCResults
+
+	mdb.lock.Lock()
+	defer mdb.lock.Unlock()
+
+	deleteEdge := func(e *data.Edge) {
+		ret.Edges++
+		ret.EdgePoints += int64(len(e.Points))
+		delete(mdb.edges, e.ID)
+		mdb.edgesUp[e.Up] = removeID(mdb.edgesUp[e.Up], e.ID)
+		mdb.edgesDown[e.Down] = removeID(mdb.edgesDown[e.Down], e.ID)
+	}
+
+	deleteNode := func(id string) {
+		ret.Nodes++
+		ret.NodePoints += int64(len(mdb.nodes[id]))
+		delete(mdb.nodes, id)
+
+		revisions := mdb.revisionLog[:0]
+		for _, r := range mdb.revisionLog {
+			if r.NodeID == id {
+				ret.Revisions++
+				continue
+			}
+			revisions = append(revisions, r)
+		}
+		mdb.revisionLog = revisions
+	}
+
+	var removed []string
+
+	for _, e := range mdb.edges {
+		if e.Up == "root" {
+			continue
+		}
+
+		p, _ := e.Points.Find(data.PointTypeTombstone, "")
+		if !p.Bool() || !p.Time.Before(before) {
+			continue
+		}
+
+		mdb.updateHash(e.Up, e.Hash)
+		deleteEdge(e)
+		removed = append(removed, e.Down)
+	}
+
+	for len(removed) > 0 {
+		id := removed[len(removed)-1]
+		removed = removed[:len(removed)-1]
+
+		if len(mdb.edgesDown[id]) > 0 {
+			continue
+		}
+
+		deleteNode(id)
+
+		for _, eID := range mdb.edgesUp[id] {
+			e := mdb.edges[eID]
+			deleteEdge(e)
+			removed = append(removed, e.Down)
+		}
+	}
+
+	for id, points := range mdb.nodes {
+		if len(mdb.edgesDown[id]) > 0 {
+			continue
+		}
+
+		var latest time.Time
+		for _, p := range points {
+			if p.Time.After(latest) {
+				latest = p.Time
+			}
+		}
+
+		if latest.Before(before) {
+			deleteNode(id)
+		}
+	}
+
+	for id, points := range mdb.nodes {
+		var hash uint32
+		keep := points[:0]
+		for _, p := range points {
+			if p.Tombstone%2 == 1 && p.Time.Before(before) {
+				hash ^= p.CRC()
+				ret.NodePoints++
+				continue
+			}
+			keep = append(keep, p)
+		}
+		mdb.nodes[id] = keep
+		mdb.updateHash(id, hash)
+	}
+
+	for _, e := range mdb.edges {
+		var hash uint32
+		keep := e.Points[:0]
+		for _, p := range e.Points {
+			if p.Tombstone%2 == 1 && p.Time.Before(before) {
+				hash ^= p.CRC()
+				ret.EdgePoints++
+				continue
+			}
+			keep = append(keep, p)
+		}
+		e.Points = keep
+
+		if hash != 0 {
+			e.Hash ^= hash
+			if e.Up != "root" {
+				mdb.updateHash(e.Up, hash)
+			}
+		}
+	}
+
+	if !revisionsBefore.IsZero() {
+		revisions := mdb.revisionLog[:0]
+		for _, r := range mdb.revisionLog {
+			if r.Time.Before(revisionsBefore) {
+				ret.Revisions++
+				continue
+			}
+			revisions = append(revisions, r)
+		}
+		mdb.revisionLog = revisions
+	}
+
+	return ret, nil
+}
+
+func (mdb *DbMemory) compact() error {
+	return nil
+}
+
+func removeID(ids []string, id string) []string {
+	for i, v := range ids {
+		if v == id {
+			return append(ids[:i], ids[i+1:]...)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,534 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// HistoryConfig is used to configure the point history that can optionally
+// be kept in the store. This allows small systems to graph and query
+// historical data without running an external time series database.
+type HistoryConfig struct {
+	// Enable recording of point history
+	Enable bool
+	// Retention is how long raw history points are kept. Zero keeps
+	// points forever.
+	Retention time.Duration
+	// RetentionNodeType overrides Retention for all points of a node type
+	RetentionNodeType map[string]time.Duration
+	// RetentionPointType overrides Retention for a point type. Point type
+	// retention takes precedence over node type retention.
+	RetentionPointType map[string]time.Duration
+	// DownsampleAfter is the age at which raw points are rolled up into
+	// aggregates that cover DownsampleWindow. Zero disables downsampling.
+	DownsampleAfter  time.Duration
+	DownsampleWindow time.Duration
+	// AggregateRetention is how long downsampled aggregates are kept.
+	// Zero keeps aggregates forever.
+	AggregateRetention time.Duration
+}
+
+// ParseRetention parses a comma separated list of type=duration pairs
+// (ex: temp=720h,voltage=24h) into a map of retention durations
+func ParseRetention(s string) (map[string]time.Duration, error) {
+	ret := make(map[string]time.Duration)
+
+	if strings.TrimSpace(s) == "" {
+		return ret, nil
+	}
+
+	for _, f := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid retention entry: %v", f)
+		}
+
+		d, err := time.ParseDuration(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention duration for %v: %w", kv[0], err)
+		}
+
+		ret[kv[0]] = d
+	}
+
+	return ret, nil
+}
+
+var historyMaintPeriod = time.Minute * 10
+
+func (sdb *DbSqlite) initHistory() error {
+	_, err := sdb.db.Exec(`CREATE TABLE IF NOT EXISTS history_points (
+				node_id TEXT,
+				node_type TEXT,
+				type TEXT,
+				key TEXT,
+				time INT,
+				value REAL,
+				text TEXT)`)
+	if err != nil {
+		return fmt.Errorf("Error creating history_points table: %v", err)
+	}
+
+	_, err = sdb.db.Exec(`CREATE TABLE IF NOT EXISTS history_aggregates (
+				node_id TEXT,
+				node_type TEXT,
+				type TEXT,
+				key TEXT,
+				time INT,
+				period INT,
+				count INT,
+				total REAL,
+				minimum REAL,
+				maximum REAL,
+				PRIMARY KEY (node_id, type, key, time, period))`)
+	if err != nil {
+		return fmt.Errorf("Error creating history_aggregates table: %v", err)
+	}
+
+	_, err = sdb.db.Exec(`CREATE INDEX IF NOT EXISTS historyNodeTime ON history_points(node_id, time)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = sdb.db.Exec(`CREATE INDEX IF NOT EXISTS historyTime ON history_points(time)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = sdb.db.Exec(`CREATE INDEX IF NOT EXISTS historyAggTime ON history_aggregates(time)`)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// historyWrite records points in the history tables. It is run in the same
+// transaction as the node point write.
+func (sdb *DbSqlite) historyWrite(tx *sql.Tx, nodeID string, points data.Points) error {
+	if !sdb.history.Enable || len(points) <= 0 {
+		return nil
+	}
+
+	var nodeType string
+	err := tx.QueryRow(`SELECT type FROM edges WHERE down = ? LIMIT 1`, nodeID).Scan(&nodeType)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO history_points(node_id, node_type, type, key,
+		time, value, text) VALUES(?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, p := range points {
+		if p.Type == data.PointTypePass {
+			// never keep a history of credentials
+			continue
+		}
+
+		t := p.Time
+		if t.IsZero() {
+			t = time.Now()
+		}
+
+		key := p.Key
+		if key == "" {
+			key = "0"
+		}
+
+		_, err := stmt.Exec(nodeID, nodeType, p.Type, key, t.UnixNano(), p.Value, p.Text)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// historyMaint downsamples old history points and removes points that are
+// older than the configured retention.
+func (sdb *DbSqlite) historyMaint(now time.Time) error {
+	if !sdb.history.Enable {
+		return nil
+	}
+
+	cfg := sdb.history
+
+	sdb.writeLock.Lock()
+	defer sdb.writeLock.Unlock()
+
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	rollback := func() {
+		rbErr := tx.Rollback()
+		if rbErr != nil {
+			log.Println("Rollback error:", rbErr)
+		}
+	}
+
+	if cfg.DownsampleAfter > 0 && cfg.DownsampleWindow > 0 {
+		window := cfg.DownsampleWindow.Nanoseconds()
+		// align cutoff to a window boundary so we only roll up full windows
+		cutoff := now.Add(-cfg.DownsampleAfter).UnixNano() / window * window
+
+		_, err := tx.Exec(`INSERT INTO history_aggregates(node_id, node_type, type, key,
+				time, period, count, total, minimum, maximum)
+			SELECT node_id, node_type, type, key, (time / ?1) * ?1, ?1,
+				COUNT(*), SUM(value), MIN(value), MAX(value)
+			FROM history_points WHERE time < ?2
+			GROUP BY node_id, type, key, (time / ?1)
+			ON CONFLICT(node_id, type, key, time, period) DO UPDATE SET
+				count = count + excluded.count,
+				total = total + excluded.total,
+				minimum = MIN(minimum, excluded.minimum),
+				maximum = MAX(maximum, excluded.maximum)`, window, cutoff)
+		if err != nil {
+			rollback()
+			return fmt.Errorf("Error downsampling history: %w", err)
+		}
+
+		_, err = tx.Exec(`DELETE FROM history_points WHERE time < ?`, cutoff)
+		if err != nil {
+			rollback()
+			return fmt.Errorf("Error removing downsampled history: %w", err)
+		}
+	}
+
+	pointTypes := make([]any, 0, len(cfg.RetentionPointType))
+	for typ, r := range cfg.RetentionPointType {
+		pointTypes = append(pointTypes, typ)
+		_, err := tx.Exec(`DELETE FROM history_points WHERE type = ? AND time < ?`,
+			typ, now.Add(-r).UnixNano())
+		if err != nil {
+			rollback()
+			return err
+		}
+	}
+
+	excludeTypes := ""
+	if len(pointTypes) > 0 {
+		excludeTypes = " AND type NOT IN (?" + strings.Repeat(",?", len(pointTypes)-1) + ")"
+	}
+
+	nodeTypes := make([]any, 0, len(cfg.RetentionNodeType))
+	for typ, r := range cfg.RetentionNodeType {
+		nodeTypes = append(nodeTypes, typ)
+		args := append([]any{typ, now.Add(-r).UnixNano()}, pointTypes...)
+		_, err := tx.Exec(`DELETE FROM history_points WHERE node_type = ? AND time < ?`+
+			excludeTypes, args...)
+		if err != nil {
+			rollback()
+			return err
+		}
+	}
+
+	if cfg.Retention > 0 {
+		q := `DELETE FROM history_points WHERE time < ?` + excludeTypes
+		args := append([]any{now.Add(-cfg.Retention).UnixNano()}, pointTypes...)
+		if len(nodeTypes) > 0 {
+			q += " AND node_type NOT IN (?" + strings.Repeat(",?", len(nodeTypes)-1) + ")"
+			args = append(args, nodeTypes...)
+		}
+
+		_, err := tx.Exec(q, args...)
+		if err != nil {
+			rollback()
+			return err
+		}
+	}
+
+	if cfg.AggregateRetention > 0 {
+		_, err := tx.Exec(`DELETE FROM history_aggregates WHERE time < ?`,
+			now.Add(-cfg.AggregateRetention).UnixNano())
+		if err != nil {
+			rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// historyFilter converts tag filters into a SQL clause that is appended to a
+// WHERE clause. Parameters are numbered starting at first so the clause can be
+// used more than once in a query. Supported tags are type, key, node.id,
+// node.type, node.description, and node.<pointType>.<key>, which matches the
+// text of a node point. If root is set, the clause also limits results to the
+// root node and its descendants, which are found with a recursive query so the
+// number of parameters does not depend on the size of the tree.
+func historyFilter(filters data.TagFilters, root string, first int) (string, []any, error) {
+	var clauses []string
+	var args []any
+
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("?%v", first+len(args)-1)
+	}
+
+	// sort keys so generated queries are deterministic
+	keys := make([]string, 0, len(filters))
+	for k := range filters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := filters[k]
+		switch {
+		case k == "type":
+			clauses = append(clauses, "type = "+arg(v))
+		case k == "key":
+			clauses = append(clauses, "key = "+arg(v))
+		case k == "node.id":
+			clauses = append(clauses, "node_id = "+arg(v))
+		case k == "node.type":
+			clauses = append(clauses, "node_type = "+arg(v))
+		case strings.HasPrefix(k, "node."):
+			typ, key, _ := strings.Cut(strings.TrimPrefix(k, "node."), ".")
+			if key == "" {
+				key = "0"
+			}
+			clauses = append(clauses, fmt.Sprintf(`node_id IN (SELECT node_id FROM node_points
+				WHERE type = %v AND key = %v AND text = %v AND tombstone %% 2 = 0)`,
+				arg(typ), arg(key), arg(v)))
+		default:
+			return "", nil, errors.New("invalid tag filter " + k)
+		}
+	}
+
+	if root != "" {
+		clauses = append(clauses, fmt.Sprintf(`node_id IN (WITH RECURSIVE sub(id) AS (
+				SELECT %v UNION SELECT e.down FROM edges e JOIN sub ON e.up = sub.id
+				WHERE NOT EXISTS (SELECT 1 FROM edge_points t
+					WHERE t.edge_id = e.id AND t.type = %v AND t.value = 1))
+				SELECT id FROM sub)`, arg(root), arg(data.PointTypeTombstone)))
+	}
+
+	if len(clauses) <= 0 {
+		return "", nil, nil
+	}
+
+	return " AND " + strings.Join(clauses, " AND "), args, nil
+}
+
+// historyQuery executes a history query against the history stored in the
+// store. Results are populated the same way the Influx DB client does so
+// consumers don't need to know where history is stored.
+func (sdb *DbSqlite) historyQuery(qry data.HistoryQuery, root string, results *data.HistoryResults) {
+	if !sdb.history.Enable {
+		results.ErrorMessage = "history is not enabled in the store"
+		return
+	}
+
+	if qry.AggregateWindow == nil {
+		sdb.historyQueryPoints(qry, root, results)
+	} else {
+		sdb.historyQueryAggregated(qry, root, results)
+	}
+}
+
+func (sdb *DbSqlite) historyQueryPoints(qry data.HistoryQuery, root string, results *data.HistoryResults) {
+	filter, filterArgs, err := historyFilter(qry.TagFilters, root, 3)
+	if err != nil {
+		results.ErrorMessage = "generating query: " + err.Error()
+		return
+	}
+
+	args := append([]any{qry.Start.UnixNano(), qry.Stop.UnixNano()}, filterArgs...)
+
+	// downsampled data is returned as points using the mean value
+	rows, err := sdb.db.Query(`SELECT node_id, node_type, type, key, time, value, text
+		FROM history_points WHERE time >= ?1 AND time < ?2`+filter+`
+		UNION ALL
+		SELECT node_id, node_type, type, key, time, total / count, ''
+		FROM history_aggregates WHERE time >= ?1 AND time < ?2`+filter+`
+		ORDER BY time`, args...)
+	if err != nil {
+		results.ErrorMessage = "executing query: " + err.Error()
+		return
+	}
+	defer rows.Close()
+
+	tags := make(map[string]map[string]string)
+
+	for rows.Next() {
+		var hp data.HistoryPoint
+		var nodeID, nodeType string
+		var t int64
+		err := rows.Scan(&nodeID, &nodeType, &hp.Type, &hp.Key, &t, &hp.Value, &hp.Text)
+		if err != nil {
+			results.ErrorMessage = "decoding results: " + err.Error()
+			return
+		}
+		hp.Time = time.Unix(0, t)
+		hp.NodeTags = historyNodeTags(tags, nodeID, nodeType)
+		results.Points = append(results.Points, hp)
+	}
+
+	if err := rows.Err(); err != nil {
+		results.ErrorMessage = "executing query: " + err.Error()
+		return
+	}
+
+	if err := rows.Close(); err != nil {
+		results.ErrorMessage = "executing query: " + err.Error()
+		return
+	}
+
+	if err := sdb.historyDescriptions(tags); err != nil {
+		results.ErrorMessage = "fetching node descriptions: " + err.Error()
+	}
+}
+
+func (sdb *DbSqlite) historyQueryAggregated(qry data.HistoryQuery, root string, results *data.HistoryResults) {
+	window := qry.AggregateWindow.Nanoseconds()
+	if window <= 0 {
+		results.ErrorMessage = "aggregate window must be positive"
+		return
+	}
+
+	// downsampled history can't be split into windows smaller than the
+	// downsample window, so don't return misleading results for it
+	cfg := sdb.history
+	if cfg.DownsampleAfter > 0 && cfg.DownsampleWindow > 0 &&
+		*qry.AggregateWindow < cfg.DownsampleWindow &&
+		qry.Start.Before(time.Now().Add(-cfg.DownsampleAfter)) {
+		results.ErrorMessage = fmt.Sprintf("aggregate window must be at least %v for history older than %v",
+			cfg.DownsampleWindow, cfg.DownsampleAfter)
+		return
+	}
+
+	filter, filterArgs, err := historyFilter(qry.TagFilters, root, 4)
+	if err != nil {
+		results.ErrorMessage = "generating query: " + err.Error()
+		return
+	}
+
+	stop := qry.Stop.UnixNano()
+	args := append([]any{window, qry.Start.UnixNano(), stop}, filterArgs...)
+
+	// windows are aligned to the epoch like the Influx window() function
+	rows, err := sdb.db.Query(`SELECT node_id, node_type, type, key, win,
+			SUM(cnt), SUM(total), MIN(mn), MAX(mx) FROM (
+		SELECT node_id, node_type, type, key, time / ?1 AS win,
+			COUNT(*) AS cnt, SUM(value) AS total, MIN(value) AS mn, MAX(value) AS mx
+		FROM history_points WHERE time >= ?2 AND time < ?3`+filter+`
+		GROUP BY node_id, type, key, win
+		UNION ALL
+		SELECT node_id, node_type, type, key, time / ?1 AS win,
+			SUM(count), SUM(total), MIN(minimum), MAX(maximum)
+		FROM history_aggregates WHERE time >= ?2 AND time < ?3`+filter+`
+		GROUP BY node_id, type, key, win)
+		GROUP BY node_id, type, key, win
+		ORDER BY win`, args...)
+	if err != nil {
+		results.ErrorMessage = "executing query: " + err.Error()
+		return
+	}
+	defer rows.Close()
+
+	tags := make(map[string]map[string]string)
+
+	for rows.Next() {
+		var hap data.HistoryAggregatedPoint
+		var nodeID, nodeType string
+		var win int64
+		var sum float64
+		err := rows.Scan(&nodeID, &nodeType, &hap.Type, &hap.Key, &win,
+			&hap.Count, &sum, &hap.Min, &hap.Max)
+		if err != nil {
+			results.ErrorMessage = "decoding results: " + err.Error()
+			return
+		}
+
+		// aggregated points are timestamped at the end of the window
+		stopNs := (win + 1) * window
+		if stopNs > stop {
+			stopNs = stop
+		}
+		hap.Time = time.Unix(0, stopNs)
+		if hap.Count > 0 {
+			hap.Mean = sum / float64(hap.Count)
+		}
+		hap.NodeTags = historyNodeTags(tags, nodeID, nodeType)
+		results.AggregatedPoints = append(results.AggregatedPoints, hap)
+	}
+
+	if err := rows.Err(); err != nil {
+		results.ErrorMessage = "executing query: " + err.Error()
+		return
+	}
+
+	if err := rows.Close(); err != nil {
+		results.ErrorMessage = "executing query: " + err.Error()
+		return
+	}
+
+	if err := sdb.historyDescriptions(tags); err != nil {
+		results.ErrorMessage = "fetching node descriptions: " + err.Error()
+	}
+}
+
+// historyNodeTags returns the node tags map for a node. The map is shared by
+// all results for the node so the description can be filled in later.
+func historyNodeTags(tags map[string]map[string]string, nodeID, nodeType string) map[string]string {
+	t, ok := tags[nodeID]
+	if !ok {
+		t = map[string]string{
+			"node.id":   nodeID,
+			"node.type": nodeType,
+		}
+		tags[nodeID] = t
+	}
+	return t
+}
+
+// historyDescriptionChunk limits the number of node IDs in each description
+// query so large results stay under the SQLite parameter limit.
+const historyDescriptionChunk = 500
+
+// historyDescriptions fills in the node.description tag for each node
+func (sdb *DbSqlite) historyDescriptions(tags map[string]map[string]string) error {
+	ids := make([]any, 0, len(tags))
+	for id := range tags {
+		ids = append(ids, id)
+	}
+
+	for len(ids) > 0 {
+		chunk := ids
+		if len(chunk) > historyDescriptionChunk {
+			chunk = chunk[:historyDescriptionChunk]
+		}
+		ids = ids[len(chunk):]
+
+		points, err := sdb.queryPoints(nil,
+			"SELECT * FROM node_points WHERE type = 'description' AND node_id IN(?"+
+				strings.Repeat(",?", len(chunk)-1)+")", chunk...)
+		if err != nil {
+			return err
+		}
+
+		for id, pts := range points {
+			for _, p := range pts {
+				if p.Tombstone%2 == 0 {
+					tags[id]["node.description"] = p.Text
+				}
+			}
+		}
+	}
+
+	return nil
+}
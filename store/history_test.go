@@ -0,0 +1,190 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+func TestHistory(t *testing.T) {
+	db := newTestDb(t)
+	defer db.Close()
+
+	db.history = HistoryConfig{
+		Enable:           true,
+		DownsampleAfter:  time.Hour,
+		DownsampleWindow: time.Minute,
+	}
+
+	rootID := db.rootNodeID()
+
+	start := time.Now().Truncate(time.Minute).Add(-2 * time.Hour)
+
+	// two points in each minute
+	var pts data.Points
+	for i := 0; i < 10; i++ {
+		pts = append(pts, data.Point{Type: data.PointTypeValue,
+			Time: start.Add(time.Duration(i) * 30 * time.Second), Value: float64(i)})
+	}
+
+	err := db.nodePoints(rootID, pts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := data.HistoryQuery{
+		Start:      start,
+		Stop:       start.Add(time.Hour),
+		TagFilters: data.TagFilters{"node.id": rootID, "type": data.PointTypeValue},
+	}
+
+	var results data.HistoryResults
+	db.historyQuery(query, "", &results)
+	if results.ErrorMessage != "" {
+		t.Fatal("query error: ", results.ErrorMessage)
+	}
+
+	if len(results.Points) != 10 {
+		t.Fatal("expected 10 points, got: ", len(results.Points))
+	}
+
+	if results.Points[0].NodeTags["node.type"] != data.NodeTypeDevice {
+		t.Fatal("node type tag not set: ", results.Points[0].NodeTags)
+	}
+
+	// queries limited to other nodes don't return the root node history
+	results = data.HistoryResults{}
+	db.historyQuery(query, "other", &results)
+	if results.ErrorMessage != "" || len(results.Points) != 0 {
+		t.Fatal("node filter not applied: ", results.ErrorMessage, len(results.Points))
+	}
+
+	// queries limited to a node return the history of its descendants
+	err = db.edgePoints("group", rootID, data.Points{
+		{Type: data.PointTypeNodeType, Text: data.NodeTypeGroup},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"device", "deleted"} {
+		err = db.edgePoints(id, "group", data.Points{
+			{Type: data.PointTypeNodeType, Text: data.NodeTypeDevice},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.nodePoints(id, data.Points{{Type: data.PointTypeValue,
+			Time: start, Value: 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = db.edgePoints("deleted", "group", data.Points{
+		{Type: data.PointTypeTombstone, Value: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subQuery := data.HistoryQuery{
+		Start:      start,
+		Stop:       start.Add(time.Hour),
+		TagFilters: data.TagFilters{"type": data.PointTypeValue},
+	}
+
+	results = data.HistoryResults{}
+	db.historyQuery(subQuery, "group", &results)
+	if results.ErrorMessage != "" {
+		t.Fatal("subtree query error: ", results.ErrorMessage)
+	}
+
+	if len(results.Points) != 1 || results.Points[0].NodeTags["node.id"] != "device" {
+		t.Fatal("subtree query returned wrong points: ", results.Points)
+	}
+
+	window := time.Minute
+	query.AggregateWindow = &window
+
+	checkAggregates := func() {
+		results = data.HistoryResults{}
+		db.historyQuery(query, "", &results)
+		if results.ErrorMessage != "" {
+			t.Fatal("aggregate query error: ", results.ErrorMessage)
+		}
+
+		if len(results.AggregatedPoints) != 5 {
+			t.Fatal("expected 5 aggregated points, got: ", len(results.AggregatedPoints))
+		}
+
+		ap := results.AggregatedPoints[1]
+		if ap.Count != 2 || ap.Min != 2 || ap.Max != 3 || ap.Mean != 2.5 {
+			t.Fatalf("aggregated point is not correct: %+v", ap)
+		}
+	}
+
+	checkAggregates()
+
+	// downsample and make sure we get the same results
+	err = db.historyMaint(time.Now())
+	if err != nil {
+		t.Fatal("history maint error: ", err)
+	}
+
+	var count int
+	err = db.db.QueryRow("SELECT COUNT(*) FROM history_points WHERE node_id = ? AND type = ?",
+		rootID, data.PointTypeValue).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 0 {
+		t.Fatal("raw points were not downsampled: ", count)
+	}
+
+	checkAggregates()
+
+	// windows smaller than the downsample window can't be returned for
+	// downsampled history
+	smallWindow := 30 * time.Second
+	query.AggregateWindow = &smallWindow
+	results = data.HistoryResults{}
+	db.historyQuery(query, "", &results)
+	if results.ErrorMessage == "" {
+		t.Fatal("expected error for window smaller than downsample window")
+	}
+	query.AggregateWindow = &window
+
+	// retention should remove everything
+	db.history.AggregateRetention = time.Hour
+	err = db.historyMaint(time.Now())
+	if err != nil {
+		t.Fatal("history maint error: ", err)
+	}
+
+	query.AggregateWindow = nil
+	results = data.HistoryResults{}
+	db.historyQuery(query, "", &results)
+	if len(results.Points) != 0 {
+		t.Fatal("retention did not remove points: ", len(results.Points))
+	}
+}
+
+func TestParseRetention(t *testing.T) {
+	r, err := ParseRetention("temp=24h, voltage=30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r["temp"] != 24*time.Hour || r["voltage"] != 30*time.Minute {
+		t.Fatal("retention parsed incorrectly: ", r)
+	}
+
+	_, err = ParseRetention("temp")
+	if err == nil {
+		t.Fatal("expected error for invalid retention")
+	}
+}
@@ -0,0 +1,456 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// DbMemory is an in-memory store backend. Data is lost when the process
+// exits, so this is mostly useful for tests and ephemeral instances.
+type DbMemory struct {
+	lock sync.RWMutex
+	meta Meta
+	// node points by node ID
+	nodes map[string]data.Points
+	// edges by edge ID
+	edges map[string]*data.Edge
+	// edge IDs indexed by up and down node IDs
+	edgesUp   map[string][]string
+	edgesDown map[string][]string
+	// revisions in the order they were recorded
+	revisionLog []data.Revision
+}
+
+// NewMemoryDb creates a new in-memory data store
+func NewMemoryDb(rootID string) (*DbMemory, error) {
+	ret := &DbMemory{}
+	ret.init()
+
+	var err error
+	ret.meta.JWTKey, err = newJwtKey()
+	if err != nil {
+		return nil, err
+	}
+
+	ret.meta.RootID, err = initRoot(ret, rootID)
+	if err != nil {
+		return nil, fmt.Errorf("Error initializing root node: %v", err)
+	}
+
+	return ret, nil
+}
+
+func (mdb *DbMemory) init() {
+	mdb.nodes = make(map[string]data.Points)
+	mdb.edges = make(map[string]*data.Edge)
+	mdb.edgesUp = make(map[string][]string)
+	mdb.edgesDown = make(map[string][]string)
+	mdb.revisionLog = nil
+}
+
+func (mdb *DbMemory) nodePoints(id string, points data.Points) error {
+	mdb.lock.Lock()
+	defer mdb.lock.Unlock()
+
+	mdb.nodePointsLocked(id, points)
+
+	return nil
+}
+
+func (mdb *DbMemory) nodePointsBatch(updates []nodeUpdate) error {
+	mdb.lock.Lock()
+	defer mdb.lock.Unlock()
+
+	for _, u := range mergeNodeUpdates(updates) {
+		mdb.nodePointsLocked(u.id, u.points)
+	}
+
+	return nil
+}
+
+// nodePointsLocked writes node points. Lock must be held when calling.
+func (mdb *DbMemory) nodePointsLocked(id string, points data.Points) {
+	points.Collapse()
+
+	dbPoints := mdb.nodes[id]
+
+	writePoints, writeIndexes, hashUpdate := mergePoints("node "+id, dbPoints, points)
+
+	revPoints, revPrevious := revisionPoints(dbPoints, writePoints, writeIndexes)
+	mdb.revisionWrite(id, revPoints, revPrevious)
+
+	for i, p := range writePoints {
+		if writeIndexes[i] < 0 {
+			dbPoints = append(dbPoints, p)
+		} else {
+			dbPoints[writeIndexes[i]] = p
+		}
+	}
+
+	mdb.nodes[id] = dbPoints
+
+	mdb.updateHash(id, hashUpdate)
+}
+
+func (mdb *DbMemory) edgePoints(nodeID, parentID string, points data.Points) error {
+	points.Collapse()
+
+	if nodeID == parentID {
+		return fmt.Errorf("Error: edgePoints nodeID=parentID=%v", nodeID)
+	}
+
+	if nodeID == mdb.meta.RootID {
+		for _, p := range points {
+			if p.Type == data.PointTypeTombstone && p.Value > 0 {
+				return fmt.Errorf("Error, can't delete root node")
+			}
+		}
+	}
+
+	if parentID == "" {
+		parentID = "root"
+	}
+
+	mdb.lock.Lock()
+	defer mdb.lock.Unlock()
+
+	edge := mdb.findEdge(parentID, nodeID)
+
+	// we don't store node type points
+	nodeType, points := splitNodeType(points)
+
+	var hashUpdate uint32
+
+	if edge == nil {
+		if nodeType == "" {
+			return fmt.Errorf("Node type must be sent with new edges")
+		}
+
+		edge = &data.Edge{
+			ID:   uuid.New().String(),
+			Up:   parentID,
+			Down: nodeID,
+			Type: nodeType,
+		}
+
+		// existing node points must be added to the hash
+		for _, p := range mdb.nodes[nodeID] {
+			hashUpdate ^= p.CRC()
+		}
+
+		mdb.edges[edge.ID] = edge
+		mdb.edgesUp[parentID] = append(mdb.edgesUp[parentID], edge.ID)
+		mdb.edgesDown[nodeID] = append(mdb.edgesDown[nodeID], edge.ID)
+
+		if parentID == "root" {
+			mdb.meta.RootID = nodeID
+		}
+	}
+
+	writePoints, writeIndexes, pointsHash := mergePoints("edge "+edge.ID, edge.Points, points)
+	hashUpdate ^= pointsHash
+
+	for i, p := range writePoints {
+		if writeIndexes[i] < 0 {
+			edge.Points = append(edge.Points, p)
+		} else {
+			edge.Points[writeIndexes[i]] = p
+		}
+	}
+
+	mdb.updateHash(nodeID, hashUpdate)
+
+	return nil
+}
+
+func (mdb *DbMemory) findEdge(up, down string) *data.Edge {
+	for _, id := range mdb.edgesDown[down] {
+		if e := mdb.edges[id]; e.Up == up {
+			return e
+		}
+	}
+	return nil
+}
+
+// updateHash applies a hash update to all upstream edges of a node. Lock
+// must be held when calling.
+func (mdb *DbMemory) updateHash(id string, hashUpdate uint32) {
+	if hashUpdate == 0 {
+		return
+	}
+
+	for _, eID := range mdb.edgesDown[id] {
+		e := mdb.edges[eID]
+		e.Hash ^= hashUpdate
+		if e.Up != "root" {
+			mdb.updateHash(e.Up, hashUpdate)
+		}
+	}
+}
+
+func (mdb *DbMemory) getNodes(parent, id, typ string, includeDel bool) ([]data.NodeEdge, error) {
+	var ret []data.NodeEdge
+
+	if parent == "" || parent == "none" {
+		return nil, errors.New("Parent must be set to valid ID, or all")
+	}
+
+	if id == "" {
+		id = "all"
+	}
+
+	mdb.lock.RLock()
+	defer mdb.lock.RUnlock()
+
+	var edgeIDs []string
+
+	switch {
+	case parent == "root":
+		edgeIDs = mdb.edgesDown[mdb.meta.RootID]
+	case parent == "all" && id == "all":
+		return nil, errors.New("invalid combination of parent and id")
+	case parent == "all":
+		edgeIDs = mdb.edgesDown[id]
+	case id == "all":
+		edgeIDs = mdb.edgesUp[parent]
+	default:
+		// both parent and id are specified
+		if e := mdb.findEdge(parent, id); e != nil {
+			edgeIDs = []string{e.ID}
+		}
+	}
+
+	for _, eID := range edgeIDs {
+		edge := mdb.edges[eID]
+		if typ != "" && edge.Type != typ {
+			continue
+		}
+
+		ne := data.NodeEdge{
+			ID:         edge.Down,
+			Parent:     edge.Up,
+			Hash:       edge.Hash,
+			Type:       edge.Type,
+			EdgePoints: clonePoints(edge.Points),
+			Points:     clonePoints(mdb.nodes[edge.Down]),
+		}
+
+		if !includeDel {
+			tombstone, _ := ne.IsTombstone()
+			if tombstone {
+				// skip deleted nodes
+				continue
+			}
+		}
+
+		ret = append(ret, ne)
+	}
+
+	return ret, nil
+}
+
+func clonePoints(points data.Points) data.Points {
+	if points == nil {
+		return nil
+	}
+	ret := make(data.Points, len(points))
+	copy(ret, points)
+	return ret
+}
+
+func (mdb *DbMemory) up(id string, includeDeleted bool) ([]string, error) {
+	mdb.lock.RLock()
+	defer mdb.lock.RUnlock()
+
+	var ups []string
+
+	for _, eID := range mdb.edgesDown[id] {
+		e := mdb.edges[eID]
+		if includeDeleted || !e.IsTombstone() {
+			ups = append(ups, e.Up)
+		}
+	}
+
+	return ups, nil
+}
+
+func (mdb *DbMemory) userCheck(email, password string) (data.Nodes, error) {
+	mdb.lock.RLock()
+	var ids []string
+	for _, e := range mdb.edges {
+		if e.Type == data.NodeTypeUser {
+			ids = append(ids, e.Down)
+		}
+	}
+	mdb.lock.RUnlock()
+
+	// make results deterministic
+	sort.Strings(ids)
+
+	var ret data.Nodes
+
+	for _, id := range ids {
+		ne, err := mdb.getNodes("all", id, "", false)
+		if err != nil || len(ne) < 1 {
+			continue
+		}
+
+		n := ne[0].ToNode()
+		u := n.ToUser()
+		if u.Email != email || !checkPassword(u.Pass, password) {
+			continue
+		}
+
+		// make sure user node is still alive and has path to root
+		ok, err := checkUserPathRoot(mdb, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			ret = append(ret, ne...)
+		}
+	}
+
+	return ret, nil
+}
+
+func (mdb *DbMemory) verifyNodeHashes(fix bool) error {
+	var fixHash func(data.NodeEdge, uint32) error
+
+	if fix {
+		fixHash = func(node data.NodeEdge, hash uint32) error {
+			mdb.lock.Lock()
+			defer mdb.lock.Unlock()
+			if e := mdb.findEdge(node.Parent, node.ID); e != nil {
+				e.Hash = hash
+			}
+			return nil
+		}
+	}
+
+	return verifyHashes(mdb, fixHash)
+}
+
+func (mdb *DbMemory) rootNodeID() string {
+	mdb.lock.RLock()
+	defer mdb.lock.RUnlock()
+	return mdb.meta.RootID
+}
+
+func (mdb *DbMemory) jwtKey() []byte {
+	return mdb.meta.JWTKey
+}
+
+func (mdb *DbMemory) reset() error {
+	mdb.lock.Lock()
+	rootID := mdb.meta.RootID
+	mdb.init()
+	mdb.lock.Unlock()
+
+	var err error
+	mdb.meta.RootID, err = initRoot(mdb, rootID)
+	return err
+}
+
+func (mdb *DbMemory) setHistory(_ HistoryConfig) {
+	// history is not supported in memory
+}
+
+func (mdb *DbMemory) historyQuery(_ data.HistoryQuery, _ string, results *data.HistoryResults) {
+	results.ErrorMessage = "history is not supported by the memory store"
+}
+
+func (mdb *DbMemory) historyMaint(_ time.Time) error {
+	return nil
+}
+
+// revisionWrite records a revision for each origin except rules. Lock must be
+// held when calling.
+func (mdb *DbMemory) revisionWrite(nodeID string, points, previous data.Points) {
+	now := time.Now()
+	revisions := make(map[string]int)
+
+	for i, p := range points {
+		idx, ok := revisions[p.Origin]
+		if !ok {
+			e := mdb.findEdgeDown(p.Origin)
+			if e != nil && revisionSkipOrigin(e.Type) {
+				revisions[p.Origin] = -1
+				continue
+			}
+
+			var id int64 = 1
+			if len(mdb.revisionLog) > 0 {
+				id = mdb.revisionLog[len(mdb.revisionLog)-1].ID + 1
+			}
+
+			rev := data.Revision{
+				ID:     id,
+				NodeID: nodeID,
+				Time:   now,
+				Origin: p.Origin,
+			}
+
+			if e != nil && e.Type == data.NodeTypeUser {
+				rev.User = p.Origin
+			}
+
+			mdb.revisionLog = append(mdb.revisionLog, rev)
+			idx = len(mdb.revisionLog) - 1
+			revisions[p.Origin] = idx
+		}
+
+		if idx < 0 {
+			continue
+		}
+
+		mdb.revisionLog[idx].Points = append(mdb.revisionLog[idx].Points, p)
+		mdb.revisionLog[idx].Previous = append(mdb.revisionLog[idx].Previous, previous[i])
+	}
+}
+
+// findEdgeDown returns the first edge for a node
+func (mdb *DbMemory) findEdgeDown(id string) *data.Edge {
+	if ids := mdb.edgesDown[id]; len(ids) > 0 {
+		return mdb.edges[ids[0]]
+	}
+	return nil
+}
+
+func (mdb *DbMemory) revisions(nodeID string) ([]data.Revision, error) {
+	mdb.lock.RLock()
+	defer mdb.lock.RUnlock()
+
+	var ret []data.Revision
+
+	for i := len(mdb.revisionLog) - 1; i >= 0; i-- {
+		rev := mdb.revisionLog[i]
+		if rev.NodeID == nodeID {
+			rev.Points = clonePoints(rev.Points)
+			rev.Previous = clonePoints(rev.Previous)
+			ret = append(ret, rev)
+		}
+	}
+
+	return ret, nil
+}
+
+func (mdb *DbMemory) backup(_ string) error {
+	return errors.New("backup is not supported by the memory store")
+}
+
+func (mdb *DbMemory) restore(_ string) error {
+	return errors.New("restore is not supported by the memory store")
+}
+
+// Close the db
+func (mdb *DbMemory) Close() error {
+	return nil
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"strings"
+
+	"github.com/simpleiot/simpleiot/data"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// isPasswordHash returns true if a password has already been hashed
+func isPasswordHash(pass string) bool {
+	return strings.HasPrefix(pass, "$2a$") || strings.HasPrefix(pass, "$2b$") ||
+		strings.HasPrefix(pass, "$2y$")
+}
+
+// hashPassword returns a salted bcrypt hash of a password. Passwords that are
+// already hashed are returned unchanged.
+func hashPassword(pass string) (string, error) {
+	if pass == "" || isPasswordHash(pass) {
+		return pass, nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// checkPassword compares a password with a stored password hash
+func checkPassword(hash, pass string) bool {
+	if hash == "" || !isPasswordHash(hash) {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+}
+
+// hashPasswordPoints hashes the text of any password points before they are
+// written to the store
+func hashPasswordPoints(points data.Points) error {
+	for i, p := range points {
+		if p.Type != data.PointTypePass {
+			continue
+		}
+
+		hash, err := hashPassword(p.Text)
+		if err != nil {
+			return err
+		}
+
+		points[i].Text = hash
+	}
+
+	return nil
+}
+
+// removePasswordPoints returns points without password points. Password
+// hashes must never leave the store.
+func removePasswordPoints(points data.Points) data.Points {
+	return points.RemoveType(data.PointTypePass)
+}
+
+// removePasswordNodes removes password points from nodes
+func removePasswordNodes(nodes []data.NodeEdge) {
+	for i := range nodes {
+		nodes[i].Points = removePasswordPoints(nodes[i].Points)
+	}
+}
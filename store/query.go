@@ -0,0 +1,189 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// sqlArgs collects query arguments and returns placeholders for them. SQLite
+// uses ? and PostgreSQL uses numbered placeholders.
+type sqlArgs struct {
+	args     []any
+	numbered bool
+}
+
+func (a *sqlArgs) add(v any) string {
+	a.args = append(a.args, v)
+	if a.numbered {
+		return fmt.Sprintf("$%v", len(a.args))
+	}
+	return "?"
+}
+
+// nodeQueryWhere builds a WHERE clause for the edges table that selects the
+// edges matching a node query. Point conditions are evaluated with EXISTS
+// subqueries so the node_points indexes can be used, and the subtree is
+// found with a recursive query.
+func nodeQueryWhere(q data.NodeQuery, numbered bool) (string, []any, error) {
+	if err := q.Validate(); err != nil {
+		return "", nil, err
+	}
+
+	a := &sqlArgs{numbered: numbered}
+
+	notDeleted := func(edge string) string {
+		return fmt.Sprintf(`NOT EXISTS (SELECT 1 FROM edge_points t
+			WHERE t.edge_id = %v.id AND t.type = %v AND t.value = 1)`,
+			edge, a.add(data.PointTypeTombstone))
+	}
+
+	sb := &strings.Builder{}
+
+	sb.WriteString("id IN (")
+
+	if q.Root != "" {
+		sb.WriteString("WITH RECURSIVE sub(id, down) AS (SELECT s.id, s.down FROM edges s WHERE s.down = ")
+		sb.WriteString(a.add(q.Root))
+		if !q.IncludeDeleted {
+			sb.WriteString(" AND " + notDeleted("s"))
+		}
+		sb.WriteString(" UNION SELECT c.id, c.down FROM edges c JOIN sub ON c.up = sub.down")
+		if !q.IncludeDeleted {
+			sb.WriteString(" WHERE " + notDeleted("c"))
+		}
+		sb.WriteString(") ")
+	}
+
+	sb.WriteString("SELECT e.id FROM edges e WHERE 1 = 1")
+
+	if q.Root != "" {
+		sb.WriteString(" AND e.id IN (SELECT id FROM sub)")
+	}
+
+	if q.Type != "" {
+		sb.WriteString(" AND e.type = " + a.add(q.Type))
+	}
+
+	if !q.IncludeDeleted {
+		sb.WriteString(" AND " + notDeleted("e"))
+	}
+
+	for _, f := range q.Points {
+		sb.WriteString(" AND EXISTS (SELECT 1 FROM node_points p WHERE p.node_id = e.down AND p.tombstone % 2 = 0 AND p.type = ")
+		sb.WriteString(a.add(f.Type))
+
+		if f.Key != "" {
+			sb.WriteString(" AND p.key = " + a.add(f.Key))
+		}
+
+		// the operator was checked by Validate
+		if f.CompareText {
+			sb.WriteString(" AND p.text " + f.Op + " " + a.add(f.Text))
+		} else {
+			sb.WriteString(" AND p.value " + f.Op + " " + a.add(f.Value))
+		}
+
+		sb.WriteString(")")
+	}
+
+	sb.WriteString(")")
+
+	return sb.String(), a.args, nil
+}
+
+func (sdb *DbSqlite) queryNodes(q data.NodeQuery) ([]data.NodeEdge, error) {
+	where, args, err := nodeQueryWhere(q, false)
+	if err != nil {
+		return nil, err
+	}
+
+	edges, err := sdb.edges(nil, "SELECT * FROM edges WHERE "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return sdb.edgeNodes(edges, true)
+}
+
+func (pdb *DbPostgres) queryNodes(q data.NodeQuery) ([]data.NodeEdge, error) {
+	where, args, err := nodeQueryWhere(q, true)
+	if err != nil {
+		return nil, err
+	}
+
+	edges, err := pdb.edges(pdb.db, where, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return pdb.edgeNodes(edges, true)
+}
+
+func (mdb *DbMemory) queryNodes(q data.NodeQuery) ([]data.NodeEdge, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	mdb.lock.RLock()
+	defer mdb.lock.RUnlock()
+
+	deleted := func(e *data.Edge) bool {
+		p, _ := e.Points.Find(data.PointTypeTombstone, "")
+		return p.Bool()
+	}
+
+	var edges []*data.Edge
+
+	if q.Root != "" {
+		// breadth first walk of the subtree. Edges are only visited once in
+		// case the tree has loops.
+		visited := make(map[string]bool)
+		next := mdb.edgesDown[q.Root]
+		for len(next) > 0 {
+			var children []string
+			for _, eID := range next {
+				e := mdb.edges[eID]
+				if visited[eID] || (!q.IncludeDeleted && deleted(e)) {
+					continue
+				}
+				visited[eID] = true
+				edges = append(edges, e)
+				children = append(children, mdb.edgesUp[e.Down]...)
+			}
+			next = children
+		}
+	} else {
+		for _, e := range mdb.edges {
+			if !q.IncludeDeleted && deleted(e) {
+				continue
+			}
+			edges = append(edges, e)
+		}
+	}
+
+	var ret []data.NodeEdge
+
+	for _, e := range edges {
+		if q.Type != "" && e.Type != q.Type {
+			continue
+		}
+
+		points := mdb.nodes[e.Down]
+		if !q.MatchPoints(points) {
+			continue
+		}
+
+		ret = append(ret, data.NodeEdge{
+			ID:         e.Down,
+			Parent:     e.Up,
+			Hash:       e.Hash,
+			Type:       e.Type,
+			EdgePoints: clonePoints(e.Points),
+			Points:     clonePoints(points),
+		})
+	}
+
+	return ret, nil
+}
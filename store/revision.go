@@ -0,0 +1,172 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/simpleiot/simpleiot/data"
+)
+
+// initRevisions creates the tables used to record node revisions
+func (sdb *DbSqlite) initRevisions() error {
+	_, err := sdb.db.Exec(`CREATE TABLE IF NOT EXISTS revisions (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				node_id TEXT,
+				time INT,
+				origin TEXT,
+				user_id TEXT)`)
+	if err != nil {
+		return fmt.Errorf("Error creating revisions table: %v", err)
+	}
+
+	_, err = sdb.db.Exec(`CREATE TABLE IF NOT EXISTS revision_points (
+				revision INT,
+				idx INT,
+				type TEXT,
+				key TEXT,
+				time INT,
+				value REAL,
+				text TEXT,
+				data BLOB,
+				tombstone INT,
+				origin TEXT,
+				prev_time INT,
+				prev_value REAL,
+				prev_text TEXT,
+				prev_data BLOB,
+				prev_tombstone INT,
+				prev_origin TEXT)`)
+	if err != nil {
+		return fmt.Errorf("Error creating revision_points table: %v", err)
+	}
+
+	_, err = sdb.db.Exec(`CREATE INDEX IF NOT EXISTS revisionsNode ON revisions(node_id)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = sdb.db.Exec(`CREATE INDEX IF NOT EXISTS revisionPointsRevision ON revision_points(revision)`)
+	return err
+}
+
+// revisionWrite records a revision for points that were written to a node.
+// Points are grouped into one revision per origin. Points from rules are not
+// recorded.
+func (sdb *DbSqlite) revisionWrite(tx *sql.Tx, nodeID string, points, previous data.Points) error {
+	if len(points) <= 0 {
+		return nil
+	}
+
+	now := time.Now().UnixNano()
+
+	revisionIDs := make(map[string]int64)
+
+	for i, p := range points {
+		revID, ok := revisionIDs[p.Origin]
+		if !ok {
+			var originType string
+			err := tx.QueryRow(`SELECT type FROM edges WHERE down = ? LIMIT 1`,
+				p.Origin).Scan(&originType)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+
+			revID = -1
+			if !revisionSkipOrigin(originType) {
+				var userID string
+				if originType == data.NodeTypeUser {
+					userID = p.Origin
+				}
+
+				res, err := tx.Exec(`INSERT INTO revisions(node_id, time, origin, user_id)
+					VALUES(?, ?, ?, ?)`, nodeID, now, p.Origin, userID)
+				if err != nil {
+					return err
+				}
+
+				revID, err = res.LastInsertId()
+				if err != nil {
+					return err
+				}
+			}
+
+			revisionIDs[p.Origin] = revID
+		}
+
+		if revID < 0 {
+			continue
+		}
+
+		prev := previous[i]
+		var prevTime int64
+		if !prev.Time.IsZero() {
+			prevTime = prev.Time.UnixNano()
+		}
+
+		_, err := tx.Exec(`INSERT INTO revision_points(revision, idx, type, key, time,
+			value, text, data, tombstone, origin, prev_time, prev_value, prev_text,
+			prev_data, prev_tombstone, prev_origin)
+			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			revID, i, p.Type, p.Key, p.Time.UnixNano(), p.Value, p.Text, p.Data,
+			p.Tombstone, p.Origin, prevTime, prev.Value, prev.Text, prev.Data,
+			prev.Tombstone, prev.Origin)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (sdb *DbSqlite) revisions(nodeID string) ([]data.Revision, error) {
+	rows, err := sdb.db.Query(`SELECT r.id, r.time, r.origin, r.user_id, p.type, p.key,
+		p.time, p.value, p.text, p.data, p.tombstone, p.origin, p.prev_time,
+		p.prev_value, p.prev_text, p.prev_data, p.prev_tombstone, p.prev_origin
+		FROM revisions r JOIN revision_points p ON p.revision = r.id
+		WHERE r.node_id = ? ORDER BY r.id DESC, p.idx`, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanRevisions(rows, nodeID)
+}
+
+// scanRevisions reads revisions from rows returned by a revisions query. Rows
+// must be ordered by revision.
+func scanRevisions(rows *sql.Rows, nodeID string) ([]data.Revision, error) {
+	var ret []data.Revision
+
+	for rows.Next() {
+		var rev data.Revision
+		var p, prev data.Point
+		var revTime, pTime, prevTime int64
+
+		err := rows.Scan(&rev.ID, &revTime, &rev.Origin, &rev.User, &p.Type, &p.Key,
+			&pTime, &p.Value, &p.Text, &p.Data, &p.Tombstone, &p.Origin, &prevTime,
+			&prev.Value, &prev.Text, &prev.Data, &prev.Tombstone, &prev.Origin)
+		if err != nil {
+			return nil, err
+		}
+
+		p.Time = time.Unix(0, pTime)
+		prev.Type = p.Type
+		prev.Key = p.Key
+		if prevTime != 0 {
+			prev.Time = time.Unix(0, prevTime)
+		}
+
+		if len(ret) <= 0 || ret[len(ret)-1].ID != rev.ID {
+			rev.NodeID = nodeID
+			rev.Time = time.Unix(0, revTime)
+			ret = append(ret, rev)
+		}
+
+		r := &ret[len(ret)-1]
+		r.Points = append(r.Points, p)
+		r.Previous = append(r.Previous, prev)
+	}
+
+	return ret, rows.Err()
+}
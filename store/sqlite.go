@@ -1,7 +1,6 @@
 package store
 
 import (
-	"crypto/rand"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -23,6 +22,7 @@ type DbSqlite struct {
 	db        *sql.DB
 	meta      Meta
 	writeLock sync.Mutex
+	history   HistoryConfig
 }
 
 // Meta contains metadata about the database
@@ -135,6 +135,31 @@ func NewSqliteDb(dbFile string, rootID string) (*DbSqlite, error) {
 		return nil, err
 	}
 
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS nodePointsNode ON node_points(node_id)`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS nodePointsType ON node_points(type, key)`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS edgePointsEdge ON edge_points(edge_id)`)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ret.initHistory()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ret.initRevisions()
+	if err != nil {
+		return nil, err
+	}
+
 	err = ret.initMeta()
 	if err != nil {
 		return nil, fmt.Errorf("Error initializing db meta: %v", err)
@@ -161,7 +186,7 @@ func NewSqliteDb(dbFile string, rootID string) (*DbSqlite, error) {
 	}
 
 	// make sure we find root ID
-	nodes, err := ret.getNodes(nil, "all", ret.meta.RootID, "", false)
+	nodes, err := ret.getNodes("all", ret.meta.RootID, "", false)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching root node: %v", err)
 	}
@@ -201,6 +226,9 @@ func (sdb *DbSqlite) initMeta() error {
 	return nil
 }
 
+// sqliteVersion is the schema version runMigrations migrates the store to
+const sqliteVersion = 5
+
 func (sdb *DbSqlite) runMigrations() error {
 	if sdb.meta.Version < 4 {
 		_, err := sdb.db.Exec(`UPDATE node_points SET key = '0' WHERE key = ''`)
@@ -220,192 +248,144 @@ func (sdb *DbSqlite) runMigrations() error {
 		sdb.meta.Version = 4
 	}
 
-	return nil
-}
-
-// reset the database by permanently wiping all data
-func (sdb *DbSqlite) reset() error {
-	var err error
-
-	// truncate several tables
-	tables := []string{"meta", "edges", "node_points", "edge_points"}
-	for _, v := range tables {
-		_, err = sdb.db.Exec(`DELETE FROM ` + v)
+	if sdb.meta.Version < 5 {
+		err := sdb.migratePasswords()
 		if err != nil {
-			return fmt.Errorf("Error truncating table: %v", err)
+			return fmt.Errorf("Error migrating passwords: %v", err)
 		}
-	}
 
-	// we need to initialize root node and user
-	// preserve root ID
-	sdb.meta.RootID, err = sdb.initRoot(sdb.meta.RootID)
-	if err != nil {
-		return fmt.Errorf("error initializing root node: %v", err)
-	}
-
-	// make sure we find root ID
-	nodes, err := sdb.getNodes(nil, "all", sdb.meta.RootID, "", false)
-	if err != nil {
-		return fmt.Errorf("error fetching root node: %v", err)
-	}
-
-	if len(nodes) < 1 {
-		return fmt.Errorf("root node not found")
+		_, err = sdb.db.Exec(`UPDATE meta SET version = 5`)
+		if err != nil {
+			return err
+		}
+		sdb.meta.Version = 5
 	}
 
 	return nil
 }
 
-// verifyNodeHashes recursively verifies all the hash values for all nodes
-// this walks to the bottom of the tree, and then works its way back up
-func (sdb *DbSqlite) verifyNodeHashes(fix bool) error {
-	// must run this in a transaction so we don't get any modifications
-	// while reading child nodes. This may be expensive for a large DB, so
-	// we may want to eventually break this down into transactions for each node
-	// and its children.
-	tx, err := sdb.db.Begin()
+// migratePasswords replaces plaintext passwords with hashes. Password points
+// are no longer included in node hashes, so hashes are recalculated as well.
+func (sdb *DbSqlite) migratePasswords() error {
+	rows, err := sdb.db.Query(`SELECT id, text FROM node_points WHERE type = ?`,
+		data.PointTypePass)
 	if err != nil {
 		return err
 	}
 
-	rollback := func() {
-		rbErr := tx.Rollback()
-		if rbErr != nil {
-			log.Println("Rollback error:", rbErr)
+	passwords := make(map[string]string)
+
+	for rows.Next() {
+		var id, pass string
+		err := rows.Scan(&id, &pass)
+		if err != nil {
+			rows.Close()
+			return err
 		}
+		passwords[id] = pass
 	}
 
-	// get root node to kick things off
-	rootNodes, err := sdb.getNodes(nil, "root", "all", "", true)
-
-	if err != nil {
-		rollback()
+	if err := rows.Close(); err != nil {
 		return err
 	}
 
-	if len(rootNodes) < 1 {
-		rollback()
-		return errors.New("no root nodes")
-	}
-
-	root := rootNodes[0]
-
-	var verify func(node data.NodeEdge) error
-
-	verify = func(node data.NodeEdge) error {
-		children, err := sdb.getNodes(nil, node.ID, "all", "", true)
+	for id, pass := range passwords {
+		hash, err := hashPassword(pass)
 		if err != nil {
 			return err
 		}
 
-		// it's important to go through children first as this can
-		// impact the current hash
-		for _, c := range children {
-			err := verify(c)
-			if err != nil {
-				return err
-			}
+		if hash == pass {
+			continue
 		}
 
-		hash := node.CalcHash(children)
-
-		if hash != node.Hash {
-			log.Printf("Hash failed for %v, stored: %v, calc: %v",
-				node.ID, node.Hash, hash)
-			if fix {
-				log.Println("fixing ...")
-				_, err := tx.Exec(`UPDATE edges SET hash = ? WHERE up = ? AND down = ?`,
-					hash, node.Parent, node.ID)
-				if err != nil {
-					return err
-				}
-			}
+		_, err = sdb.db.Exec(`UPDATE node_points SET text = ? WHERE id = ?`, hash, id)
+		if err != nil {
+			return err
 		}
-
-		return nil
 	}
 
-	err = verify(root)
-
-	if err != nil {
-		rollback()
-		return fmt.Errorf("Verify failed: %v", err)
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		return err
+	if sdb.meta.RootID == "" {
+		// new database, nothing to fix
+		return nil
 	}
 
-	return nil
+	return sdb.verifyNodeHashes(true)
 }
 
-func (sdb *DbSqlite) initRoot(rootID string) (string, error) {
-	log.Println("STORE: Initialize root node and admin user")
-	rootNode := data.NodeEdge{
-		ID:   rootID,
-		Type: data.NodeTypeDevice,
-	}
-
-	rootNode.ID = rootID
+// reset the database by permanently wiping all data
+func (sdb *DbSqlite) reset() error {
+	var err error
 
-	if rootNode.ID == "" {
-		rootNode.ID = uuid.New().String()
+	// truncate several tables
+	tables := []string{"meta", "edges", "node_points", "edge_points",
+		"history_points", "history_aggregates", "revisions", "revision_points"}
+	for _, v := range tables {
+		_, err = sdb.db.Exec(`DELETE FROM ` + v)
+		if err != nil {
+			return fmt.Errorf("Error truncating table: %v", err)
+		}
 	}
 
-	err := sdb.nodePoints(rootNode.ID, rootNode.Points)
+	// we need to initialize root node and user
+	// preserve root ID
+	sdb.meta.RootID, err = sdb.initRoot(sdb.meta.RootID)
 	if err != nil {
-		return "", fmt.Errorf("Error setting root node points: %v", err)
+		return fmt.Errorf("error initializing root node: %v", err)
 	}
 
-	err = sdb.edgePoints(rootNode.ID, "root", data.Points{
-		{Type: data.PointTypeTombstone, Value: 0},
-		{Type: data.PointTypeNodeType, Text: rootNode.Type},
-	})
+	// make sure we find root ID
+	nodes, err := sdb.getNodes("all", sdb.meta.RootID, "", false)
 	if err != nil {
-		return "", fmt.Errorf("Error sending root node edges: %w", err)
+		return fmt.Errorf("error fetching root node: %v", err)
 	}
 
-	// create admin user off root node
-	admin := data.User{
-		ID:        uuid.New().String(),
-		FirstName: "admin",
-		LastName:  "user",
-		Email:     "admin@admin.com",
-		Pass:      "admin",
+	if len(nodes) < 1 {
+		return fmt.Errorf("root node not found")
 	}
 
-	points := admin.ToPoints()
+	return nil
+}
 
-	err = sdb.nodePoints(admin.ID, points)
-	if err != nil {
-		return "", fmt.Errorf("Error setting default user: %v", err)
+// verifyNodeHashes recursively verifies all the hash values for all nodes
+// this walks to the bottom of the tree, and then works its way back up
+func (sdb *DbSqlite) verifyNodeHashes(fix bool) error {
+	var fixHash func(data.NodeEdge, uint32) error
+
+	if fix {
+		fixHash = func(node data.NodeEdge, hash uint32) error {
+			sdb.writeLock.Lock()
+			defer sdb.writeLock.Unlock()
+			_, err := sdb.db.Exec(`UPDATE edges SET hash = ? WHERE up = ? AND down = ?`,
+				hash, node.Parent, node.ID)
+			return err
+		}
 	}
 
-	err = sdb.edgePoints(admin.ID, rootNode.ID, data.Points{
-		{Type: data.PointTypeTombstone, Value: 0},
-		{Type: data.PointTypeNodeType, Text: data.NodeTypeUser},
-	})
+	return verifyHashes(sdb, fixHash)
+}
 
+func (sdb *DbSqlite) initRoot(rootID string) (string, error) {
+	id, err := initRoot(sdb, rootID)
 	if err != nil {
 		return "", err
 	}
 
 	sdb.writeLock.Lock()
 	defer sdb.writeLock.Unlock()
-	_, err = sdb.db.Exec("UPDATE meta SET root_id = ?", rootNode.ID)
+	_, err = sdb.db.Exec("UPDATE meta SET root_id = ?", id)
 	if err != nil {
 		return "", fmt.Errorf("Error setting meta rootID: %v", err)
 	}
 
-	return rootNode.ID, nil
+	return id, nil
 }
 
 func (sdb *DbSqlite) initJwtKey() error {
-	sdb.meta.JWTKey = make([]byte, 20)
-	_, err := rand.Read(sdb.meta.JWTKey)
+	var err error
+	sdb.meta.JWTKey, err = newJwtKey()
 	if err != nil {
-		return fmt.Errorf("Error reading making JWT key: %v", err)
+		return err
 	}
 
 	sdb.writeLock.Lock()
@@ -419,7 +399,11 @@ func (sdb *DbSqlite) initJwtKey() error {
 }
 
 func (sdb *DbSqlite) nodePoints(id string, points data.Points) error {
-	points.Collapse()
+	return sdb.nodePointsBatch([]nodeUpdate{{id: id, points: points}})
+}
+
+func (sdb *DbSqlite) nodePointsBatch(updates []nodeUpdate) error {
+	updates = mergeNodeUpdates(updates)
 
 	sdb.writeLock.Lock()
 	defer sdb.writeLock.Unlock()
@@ -435,75 +419,6 @@ func (sdb *DbSqlite) nodePoints(id string, points data.Points) error {
 		}
 	}
 
-	rowsPoints, err := tx.Query("SELECT * FROM node_points WHERE node_id=?", id)
-	if err != nil {
-		rollback()
-		return err
-	}
-	defer rowsPoints.Close()
-
-	var dbPoints data.Points
-	var dbPointIDs []string
-
-	for rowsPoints.Next() {
-		var p data.Point
-		var timeNS int64
-		var pID string
-		var nodeID string
-		var index float32
-		err := rowsPoints.Scan(&pID, &nodeID, &p.Type, &p.Key, &timeNS, &index, &p.Value, &p.Text,
-			&p.Data, &p.Tombstone, &p.Origin)
-		if err != nil {
-			rollback()
-			return err
-		}
-		p.Time = time.Unix(0, timeNS)
-		dbPoints = append(dbPoints, p)
-		dbPointIDs = append(dbPointIDs, pID)
-	}
-
-	if err := rowsPoints.Close(); err != nil {
-		rollback()
-		return fmt.Errorf("Error closing rowsPoints: %v", err)
-	}
-
-	var writePoints data.Points
-	var writePointIDs []string
-
-	var hashUpdate uint32
-
-NextPin:
-	for _, pIn := range points {
-		if pIn.Time.IsZero() {
-			pIn.Time = time.Now()
-		}
-
-		if pIn.Key == "" {
-			pIn.Key = "0"
-		}
-
-		for j, pDb := range dbPoints {
-			if pIn.Type == pDb.Type && pIn.Key == pDb.Key {
-				// found a match
-				if pDb.Time.Before(pIn.Time) || pDb.Time.Equal(pIn.Time) {
-					writePoints = append(writePoints, pIn)
-					writePointIDs = append(writePointIDs, dbPointIDs[j])
-					// back out old CRC and add in new one
-					hashUpdate ^= pDb.CRC()
-					hashUpdate ^= pIn.CRC()
-				} else {
-					log.Println("Ignoring node point due to timestamps:", id, pIn)
-				}
-				continue NextPin
-			}
-		}
-
-		// point was not found so write it
-		writePoints = append(writePoints, pIn)
-		hashUpdate ^= pIn.CRC()
-		writePointIDs = append(writePointIDs, uuid.New().String())
-	}
-
 	stmt, err := tx.Prepare(`INSERT INTO node_points(id, node_id, type, key, time,
                  idx, value, text, data, tombstone, origin)
 		 VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
@@ -531,11 +446,10 @@ NextPin:
 		}
 	}()
 
-	for i, p := range writePoints {
-		tNs := p.Time.UnixNano()
-		pID := writePointIDs[i]
-		_, err = stmt.Exec(pID, id, p.Type, p.Key, tNs, 0, p.Value, p.Text, p.Data, p.Tombstone,
-			p.Origin)
+	hashUpdates := make(map[string]uint32)
+
+	for _, u := range updates {
+		hashUpdates[u.id], err = sdb.nodePointsTx(tx, stmt, u.id, u.points)
 		if err != nil {
 			rollback()
 			return err
@@ -544,7 +458,7 @@ NextPin:
 
 	stmt.Close()
 
-	err = sdb.updateHash(tx, id, hashUpdate)
+	err = sdb.updateHashes(tx, hashUpdates)
 	if err != nil {
 		rollback()
 		return fmt.Errorf("Error updating upstream hash: %v", err)
@@ -558,6 +472,69 @@ NextPin:
 	return nil
 }
 
+// nodePointsTx writes the points of one node using the insert statement stmt
+// and returns the hash update for the node
+func (sdb *DbSqlite) nodePointsTx(tx *sql.Tx, stmt *sql.Stmt, id string, points data.Points) (uint32, error) {
+	// history records every point, not just the latest of each type/key
+	historyPoints := points
+	points.Collapse()
+
+	rowsPoints, err := tx.Query("SELECT * FROM node_points WHERE node_id=?", id)
+	if err != nil {
+		return 0, err
+	}
+	defer rowsPoints.Close()
+
+	var dbPoints data.Points
+	var dbPointIDs []string
+
+	for rowsPoints.Next() {
+		var p data.Point
+		var timeNS int64
+		var pID string
+		var nodeID string
+		var index float32
+		err := rowsPoints.Scan(&pID, &nodeID, &p.Type, &p.Key, &timeNS, &index, &p.Value, &p.Text,
+			&p.Data, &p.Tombstone, &p.Origin)
+		if err != nil {
+			return 0, err
+		}
+		p.Time = time.Unix(0, timeNS)
+		dbPoints = append(dbPoints, p)
+		dbPointIDs = append(dbPointIDs, pID)
+	}
+
+	if err := rowsPoints.Close(); err != nil {
+		return 0, fmt.Errorf("Error closing rowsPoints: %v", err)
+	}
+
+	writePoints, writeIndexes, hashUpdate := mergePoints("node "+id, dbPoints, points)
+	writePointIDs := pointIDs(dbPointIDs, writeIndexes)
+	revPoints, revPrevious := revisionPoints(dbPoints, writePoints, writeIndexes)
+
+	for i, p := range writePoints {
+		tNs := p.Time.UnixNano()
+		pID := writePointIDs[i]
+		_, err = stmt.Exec(pID, id, p.Type, p.Key, tNs, 0, p.Value, p.Text, p.Data, p.Tombstone,
+			p.Origin)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = sdb.historyWrite(tx, id, historyPoints)
+	if err != nil {
+		return 0, fmt.Errorf("Error writing history: %v", err)
+	}
+
+	err = sdb.revisionWrite(tx, id, revPoints, revPrevious)
+	if err != nil {
+		return 0, fmt.Errorf("Error writing revision: %v", err)
+	}
+
+	return hashUpdate, nil
+}
+
 func (sdb *DbSqlite) edgePoints(nodeID, parentID string, points data.Points) error {
 	points.Collapse()
 
@@ -642,50 +619,11 @@ func (sdb *DbSqlite) edgePoints(nodeID, parentID string, points data.Points) err
 		return fmt.Errorf("Error closing rowsPoints: %v", err)
 	}
 
-	var writePoints data.Points
-	var writePointIDs []string
-
-	var hashUpdate uint32
-
-	var nodeType string
-
-NextPin:
-	for _, pIn := range points {
-		// we don't store node type points
-		if pIn.Type == data.PointTypeNodeType {
-			nodeType = pIn.Text
-			continue NextPin
-		}
-
-		if pIn.Time.IsZero() {
-			pIn.Time = time.Now()
-		}
-
-		if pIn.Key == "" {
-			pIn.Key = "0"
-		}
-
-		for j, pDb := range dbPoints {
-			if pIn.Type == pDb.Type && pIn.Key == pDb.Key {
-				// found a match
-				if pDb.Time.Before(pIn.Time) || pDb.Time.Equal(pIn.Time) {
-					writePoints = append(writePoints, pIn)
-					writePointIDs = append(writePointIDs, dbPointIDs[j])
-					// back out old CRC and add in new one
-					hashUpdate ^= pDb.CRC()
-					hashUpdate ^= pIn.CRC()
-				} else {
-					log.Println("Ignoring edge point due to timestamps:", edge.ID, pIn)
-				}
-				continue NextPin
-			}
-		}
+	// we don't store node type points
+	nodeType, points := splitNodeType(points)
 
-		// point was not found so write it
-		writePoints = append(writePoints, pIn)
-		hashUpdate ^= pIn.CRC()
-		writePointIDs = append(writePointIDs, uuid.New().String())
-	}
+	writePoints, writeIndexes, hashUpdate := mergePoints("edge "+edge.ID, dbPoints, points)
+	writePointIDs := pointIDs(dbPointIDs, writeIndexes)
 
 	// loop through write points and write them
 	stmt, err := tx.Prepare(`INSERT INTO edge_points(id, edge_id, type, key, time,
@@ -813,54 +751,13 @@ NextPin:
 }
 
 func (sdb *DbSqlite) updateHash(tx *sql.Tx, id string, hashUpdate uint32) error {
-	// key in edgeCache is up-down
-	cache := make(map[string]uint32)
-	err := sdb.updateHashHelper(tx, id, hashUpdate, cache)
-	if err != nil {
-		return err
-	}
-
-	// write update hash values back to edges
-	stmt, err := tx.Prepare(`UPDATE edges SET hash = ? WHERE id = ?`)
-
-	if err != nil {
-		return err
-	}
-
-	for id, hash := range cache {
-		_, err = stmt.Exec(hash, id)
-		if err != nil {
-			stmt.Close()
-			return fmt.Errorf("Error updating edge hash: %v", err)
-		}
-	}
-
-	stmt.Close()
-
-	return nil
+	return sdb.updateHashes(tx, map[string]uint32{id: hashUpdate})
 }
 
-func (sdb *DbSqlite) updateHashHelper(tx *sql.Tx, id string, hashUpdate uint32, cache map[string]uint32) error {
-	edges, err := sdb.edges(tx, "SELECT * FROM edges WHERE down=?", id)
-	if err != nil {
-		return err
-	}
-
-	for _, e := range edges {
-		if _, ok := cache[e.ID]; !ok {
-			cache[e.ID] = e.Hash
-		}
-
-		cache[e.ID] ^= hashUpdate
-
-		if e.Up != "none" {
-			err := sdb.updateHashHelper(tx, e.Up, hashUpdate, cache)
-			if err != nil {
-				return err
-			}
-		}
-	}
-	return nil
+// updateHashes applies hash updates for multiple nodes to upstream edges
+func (sdb *DbSqlite) updateHashes(tx *sql.Tx, updates map[string]uint32) error {
+	return updateEdgeHashes(tx, `SELECT id, up, hash FROM edges WHERE down = ?`,
+		`UPDATE edges SET hash = ? WHERE id = ?`, updates)
 }
 
 func (sdb *DbSqlite) edges(tx *sql.Tx, query string, args ...any) ([]data.Edge, error) {
@@ -929,10 +826,19 @@ func (sdb *DbSqlite) rootNodeID() string {
 	return sdb.meta.RootID
 }
 
-// If parent is set to "all", then all instances of the node are returned.
-// If parent is set and id is "all", then all child nodes are returned.
-// Parent can be set to "root" and id to "all" to fetch the root node(s).
-func (sdb *DbSqlite) getNodes(tx *sql.Tx, parent, id, typ string, includeDel bool) ([]data.NodeEdge, error) {
+func (sdb *DbSqlite) jwtKey() []byte {
+	return sdb.meta.JWTKey
+}
+
+func (sdb *DbSqlite) setHistory(cfg HistoryConfig) {
+	sdb.history = cfg
+}
+
+// getNodes returns nodes. If parent is set to "all", then all instances of
+// the node are returned. If parent is set and id is "all", then all child
+// nodes are returned. Parent can be set to "root" and id to "all" to fetch
+// the root node(s).
+func (sdb *DbSqlite) getNodes(parent, id, typ string, includeDel bool) ([]data.NodeEdge, error) {
 	var ret []data.NodeEdge
 
 	if parent == "" || parent == "none" {
@@ -964,15 +870,18 @@ func (sdb *DbSqlite) getNodes(tx *sql.Tx, parent, id, typ string, includeDel boo
 		q += fmt.Sprintf("AND type = '%v'", typ)
 	}
 
-	edges, err := sdb.edges(tx, q)
+	edges, err := sdb.edges(nil, q)
 
 	if err != nil {
 		return ret, err
 	}
 
-	if len(edges) < 1 {
-		return ret, nil
-	}
+	return sdb.edgeNodes(edges, includeDel)
+}
+
+// edgeNodes returns NodeEdges with node and edge points for edges
+func (sdb *DbSqlite) edgeNodes(edges []data.Edge, includeDel bool) ([]data.NodeEdge, error) {
+	var ret []data.NodeEdge
 
 	// Populate `ret` with NodeEdges with edge points
 	for _, edge := range edges {
@@ -1004,7 +913,7 @@ func (sdb *DbSqlite) getNodes(tx *sql.Tx, parent, id, typ string, includeDel boo
 		nodeIDs[i] = ne.ID
 	}
 	nodePoints, err := sdb.queryPoints(
-		tx,
+		nil,
 		"SELECT * FROM node_points WHERE node_id IN(?"+
 			strings.Repeat(",?", len(nodeIDs)-1)+")",
 		nodeIDs...,
@@ -1087,7 +996,7 @@ func (sdb *DbSqlite) userCheck(email, password string) (data.Nodes, error) {
 	}
 
 	for _, id := range ids {
-		ne, err := sdb.getNodes(nil, "all", id, "", false)
+		ne, err := sdb.getNodes("all", id, "", false)
 		if err != nil {
 			log.Println("Error getting user node for id:", id)
 			continue
@@ -1098,7 +1007,7 @@ func (sdb *DbSqlite) userCheck(email, password string) (data.Nodes, error) {
 
 		n := ne[0].ToNode()
 		u := n.ToUser()
-		if u.Email == email && u.Pass == password {
+		if u.Email == email && checkPassword(u.Pass, password) {
 			users = append(users, ne...)
 		}
 	}
@@ -1106,45 +1015,8 @@ func (sdb *DbSqlite) userCheck(email, password string) (data.Nodes, error) {
 	// make sure all these user nodes are still alive and have path to root
 	var ret []data.NodeEdge
 
-	var checkUserPathRoot func(string) (bool, error)
-
-	checkUserPathRoot = func(id string) (bool, error) {
-		edges, err := sdb.edges(nil, "SELECT * FROM edges WHERE down=?", id)
-		if err != nil {
-			return false, err
-		}
-
-		for _, e := range edges {
-			// make sure edge is not tombstone
-			for _, p := range e.Points {
-				if p.Type == data.PointTypeTombstone && p.Value != 0 {
-					return false, nil
-				}
-			}
-
-			if e.Up == "root" {
-				return true, nil
-			}
-
-			// continue walking upstream
-			ok, err := checkUserPathRoot(e.Up)
-			if err != nil {
-				return false, err
-			}
-
-			if ok {
-				// found a path, return
-				return ok, nil
-			}
-
-			// look at the next edge
-		}
-
-		return false, nil
-	}
-
 	for _, u := range users {
-		ok, err := checkUserPathRoot(u.ID)
+		ok, err := checkUserPathRoot(sdb, u.ID)
 		if err != nil {
 			return nil, err
 		}
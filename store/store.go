@@ -2,9 +2,12 @@ package store
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"strings"
 	"time"
 
@@ -23,7 +26,8 @@ type Store struct {
 	params        Params
 	nc            *nats.Conn
 	subscriptions map[string]*nats.Subscription
-	db            *DbSqlite
+	db            Backend
+	cache         *nodeCache
 	authorizer    api.Authorizer
 
 	// cycle metrics track how long it takes to handle a point
@@ -36,6 +40,18 @@ type Store struct {
 	metricPendingNodePoint     *client.Metric
 	metricPendingNodeEdgePoint *client.Metric
 
+	// node cache hit rate (percent) and size
+	metricCacheHitPercent *client.Metric
+	metricCacheNodes      *client.Metric
+
+	// restore in progress
+	restoreFile    *os.File
+	restoreSeq     int32
+	restoreCleanup func()
+
+	// node points waiting to be written
+	chPointWrites chan pointWrite
+
 	chStop        chan struct{}
 	chStopMetrics chan struct{}
 	chWaitStart   chan struct{}
@@ -43,37 +59,63 @@ type Store struct {
 
 // Params are used to configure a store
 type Params struct {
-	File      string
+	// Backend is the type of database used (sqlite, postgres, or memory).
+	// SQLite is used if not set.
+	Backend string
+	// File is the SQLite database file
+	File string
+	// URI is the PostgreSQL connection string
+	URI       string
 	AuthToken string
 	Server    string
 	Nc        *nats.Conn
 	// ID for the instance -- it is only used when initializing the store.
 	// ID must be unique. If ID is not set, then a UUID is generated.
 	ID string
+	// History configures point history kept in the store
+	History HistoryConfig
+	// TombstoneRetention is how long deleted nodes and points are kept
+	// before they are purged. If zero, they are kept forever.
+	TombstoneRetention time.Duration
+	// RevisionRetention is how long node revisions are kept. If zero, they
+	// are kept forever.
+	RevisionRetention time.Duration
 }
 
 // NewStore creates a new NATS client for handling SIOT requests
 func NewStore(p Params) (*Store, error) {
-	db, err := NewSqliteDb(p.File, p.ID)
+	uri := p.File
+	if p.Backend == BackendPostgres {
+		uri = p.URI
+	}
+
+	db, err := NewBackend(p.Backend, uri, p.ID)
 	if err != nil {
 		return nil, fmt.Errorf("Error opening db: %v", err)
 	}
 
+	db.setHistory(p.History)
+
 	// we don't have node ID yet, but need to init here so we can start
 	// collecting data
 
-	authorizer, err := api.NewKey(db.meta.JWTKey)
+	authorizer, err := api.NewKey(db.jwtKey())
 	if err != nil {
 		return nil, fmt.Errorf("Error creating authorizer: %v", err)
 	}
 
+	// all store access goes through the cache so writes invalidate it
+	cache := newNodeCache(db)
+
 	log.Println("store connecting to nats server:", p.Server)
 	return &Store{
 		params:        p,
 		nc:            p.Nc,
-		db:            db,
+		db:            cache,
+		cache:         cache,
 		authorizer:    authorizer,
 		subscriptions: make(map[string]*nats.Subscription),
+		chPointWrites: make(chan pointWrite, pointBatchMax),
 		chStop:        make(chan struct{}),
 		chStopMetrics: make(chan struct{}),
 		chWaitStart:   make(chan struct{}),
@@ -111,16 +153,6 @@ func (st *Store) Run() error {
 		return fmt.Errorf("Subscribe node error: %w", err)
 	}
 
-	/*
-		if st.subscriptions["notifications"], err = nc.Subscribe("node.*.not", st.handleNotification); err != nil {
-			return fmt.Errorf("Subscribe notification error: %w", err)
-		}
-
-		if st.subscriptions["messages"], err = nc.Subscribe("node.*.msg", st.handleMessage); err != nil {
-			return fmt.Errorf("Subscribe message error: %w", err)
-		}
-	*/
-
 	if st.subscriptions["auth.user"], err = nc.Subscribe("auth.user", st.handleAuthUser); err != nil {
 		return fmt.Errorf("Subscribe auth error: %w", err)
 	}
@@ -137,12 +169,63 @@ func (st *Store) Run() error {
 		return fmt.Errorf("Subscribe dbMaint error: %w", err)
 	}
 
+	if st.subscriptions["admin.storeBackup"], err = nc.Subscribe("admin.storeBackup", st.handleStoreBackup); err != nil {
+		return fmt.Errorf("Subscribe storeBackup error: %w", err)
+	}
+
+	if st.subscriptions["admin.storeRestore"], err = nc.Subscribe("admin.storeRestore", st.handleStoreRestore); err != nil {
+		return fmt.Errorf("Subscribe storeRestore error: %w", err)
+	}
+
+	if st.subscriptions["nodes.query"], err = nc.Subscribe("nodes.query", st.handleNodesQuery); err != nil {
+		return fmt.Errorf("Subscribe nodes query error: %w", err)
+	}
+
+	if st.subscriptions["admin.storeGC"], err = nc.Subscribe("admin.storeGC", st.handleStoreGC); err != nil {
+		return fmt.Errorf("Subscribe storeGC error: %w", err)
+	}
+
+	if st.subscriptions["revisions"], err = nc.Subscribe("revisions.*", st.handleRevisions); err != nil {
+		return fmt.Errorf("Subscribe revisions error: %w", err)
+	}
+
+	historyMaintTicker := time.NewTicker(historyMaintPeriod)
+	defer historyMaintTicker.Stop()
+
+	if st.params.History.Enable {
+		if st.subscriptions["history"], err = nc.Subscribe("history.*", st.handleHistory); err != nil {
+			return fmt.Errorf("Subscribe history error: %w", err)
+		}
+	} else {
+		historyMaintTicker.Stop()
+	}
+
+	gcTicker := time.NewTicker(gcPeriod)
+	defer gcTicker.Stop()
+
+	if st.params.TombstoneRetention <= 0 && st.params.RevisionRetention <= 0 {
+		gcTicker.Stop()
+	}
+
+	pointWriterDone := make(chan struct{})
+	go st.runPointWriter(pointWriterDone)
+
 done:
 	for {
 		select {
 		case <-st.chWaitStart:
 			// don't need to do anything as simply reading this
 			// channel will unblock the caller
+		case <-historyMaintTicker.C:
+			err := st.db.historyMaint(time.Now())
+			if err != nil {
+				log.Println("Error running history maintenance:", err)
+			}
+		case <-gcTicker.C:
+			_, err := st.gc(st.params.TombstoneRetention)
+			if err != nil {
+				log.Println("Error purging tombstones:", err)
+			}
 		case <-st.chStop:
 			log.Println("Store stopped")
 			break done
@@ -157,6 +240,8 @@ done:
 		}
 	}
 
+	<-pointWriterDone
+
 	st.db.Close()
 
 	return nil
@@ -204,6 +289,10 @@ func (st *Store) StartMetrics(nodeID string) error {
 		data.PointTypeMetricNatsPendingNodePoint, reportMetricsPeriod)
 	st.metricPendingNodeEdgePoint = client.NewMetric(st.nc, nodeID,
 		data.PointTypeMetricNatsPendingNodeEdgePoint, reportMetricsPeriod)
+	st.metricCacheHitPercent = client.NewMetric(st.nc, nodeID,
+		data.PointTypeMetricStoreCacheHitPercent, reportMetricsPeriod)
+	st.metricCacheNodes = client.NewMetric(st.nc, nodeID,
+		data.PointTypeMetricStoreCacheNodes, reportMetricsPeriod)
 
 	t := time.NewTimer(time.Millisecond)
 
@@ -232,6 +321,20 @@ func (st *Store) StartMetrics(nodeID string) error {
 			if err != nil {
 				log.Println("Error handling metric:", err)
 			}
+
+			hits, misses, cacheNodes := st.cache.stats()
+			if hits+misses > 0 {
+				err = st.metricCacheHitPercent.AddSample(
+					float64(hits) * 100 / float64(hits+misses))
+				if err != nil {
+					log.Println("Error handling metric:", err)
+				}
+			}
+
+			err = st.metricCacheNodes.AddSample(float64(cacheNodes))
+			if err != nil {
+				log.Println("Error handling metric:", err)
+			}
 			t.Reset(time.Second * 10)
 		}
 	}
@@ -242,15 +345,10 @@ func (st *Store) StopMetrics(_ error) {
 	close(st.chStopMetrics)
 }
 
+// handleNodePoints queues node points to be written by runPointWriter. The
+// message is acked after the points are written.
 func (st *Store) handleNodePoints(msg *nats.Msg) {
 	start := time.Now()
-	defer func() {
-		t := time.Since(start).Milliseconds()
-		err := st.metricCycleNodePoint.AddSample(float64(t))
-		if err != nil {
-			log.Println("Error stopping metrics:", err)
-		}
-	}()
 
 	nodeID, points, err := client.DecodeNodePointsMsg(msg)
 
@@ -260,25 +358,20 @@ func (st *Store) handleNodePoints(msg *nats.Msg) {
 		return
 	}
 
-	// write points to database
-	err = st.db.nodePoints(nodeID, points)
-
+	// passwords are only stored as hashes
+	err = hashPasswordPoints(points)
 	if err != nil {
-		// TODO track error stats
-		log.Printf("Error writing nodeID (%v) to Db: %v", nodeID, err)
-		log.Println("msg subject:", msg.Subject)
+		log.Println("Error hashing password:", err)
 		st.reply(msg.Reply, err)
 		return
 	}
 
-	// process point in upstream nodes
-	err = st.processPointsUpstream(nodeID, nodeID, points)
-	if err != nil {
-		// TODO track error stats
-		log.Println("Error processing point in upstream nodes:", err)
+	select {
+	case st.chPointWrites <- pointWrite{nodeID: nodeID, points: points,
+		reply: msg.Reply, start: start}:
+	case <-st.chStop:
+		st.reply(msg.Reply, errors.New("store stopped"))
 	}
-
-	st.reply(msg.Reply, nil)
 }
 
 func (st *Store) handleEdgePoints(msg *nats.Msg) {
@@ -299,6 +392,12 @@ func (st *Store) handleEdgePoints(msg *nats.Msg) {
 		return
 	}
 
+	// the edge before the write is needed to determine the node event
+	before, err := st.db.getNodes(parentID, nodeID, "", true)
+	if err != nil {
+		log.Println("Error getting edge:", err)
+	}
+
 	// write points to database. Its important that we write to the DB
 	// before sending points upstream, or clients may do a rescan and not
 	// see the node is deleted.
@@ -308,6 +407,8 @@ func (st *Store) handleEdgePoints(msg *nats.Msg) {
 		// TODO track error stats
 		log.Printf("Error writing edge points (%v:%v) to Db: %v", nodeID, parentID, err)
 		st.reply(msg.Reply, err)
+	} else {
+		st.publishNodeEvent(nodeID, parentID, before, points)
 	}
 
 	// process point in upstream nodes. We need to do this before writing
@@ -365,7 +466,8 @@ func (st *Store) handleNodesRequest(msg *nats.Msg) {
 		}
 	}
 
-	nodes, err = st.db.getNodes(nil, parent, nodeID, nodeType, includeDel)
+	nodes, err = st.db.getNodes(parent, nodeID, nodeType, includeDel)
+	removePasswordNodes(nodes)
 
 	if err != nil {
 		if err != data.ErrDocumentNotFound {
@@ -393,6 +495,32 @@ handleNodeDone:
 	}
 }
 
+func (st *Store) handleNodesQuery(msg *nats.Msg) {
+	query := new(data.NodeQuery)
+	results := new(data.NodeQueryResults)
+
+	err := json.Unmarshal(msg.Data, query)
+	if err != nil {
+		results.ErrorMessage = "parsing query: " + err.Error()
+	} else {
+		results.Nodes, err = st.db.queryNodes(*query)
+		if err != nil {
+			results.ErrorMessage = err.Error()
+		}
+		removePasswordNodes(results.Nodes)
+	}
+
+	res, err := json.Marshal(results)
+	if err != nil {
+		res = []byte(`{"error":"error encoding response"}`)
+	}
+
+	err = msg.Respond(res)
+	if err != nil {
+		log.Println("NATS: Error responding to nodes query:", err)
+	}
+}
+
 // TODO, maybe someday we should return error node instead of no data
 func (st *Store) handleAuthUser(msg *nats.Msg) {
 	var points data.Points
@@ -443,6 +571,8 @@ func (st *Store) handleAuthUser(msg *nats.Msg) {
 
 	user, err := data.NodeToUser(nodes[0].ToNode())
 
+	removePasswordNodes(nodes)
+
 	token, err := st.authorizer.NewToken(user.ID)
 	if err != nil {
 		log.Println("Error creating token")
@@ -512,12 +642,279 @@ func (st *Store) handleStoreMaint(msg *nats.Msg) {
 		ret = hashErr.Error()
 	}
 
+	if hashErr == nil && (st.params.TombstoneRetention > 0 || st.params.RevisionRetention > 0) {
+		_, err := st.gc(st.params.TombstoneRetention)
+		if err != nil {
+			ret = err.Error()
+		}
+	}
+
 	err := st.nc.Publish(msg.Reply, []byte(ret))
 	if err != nil {
 		log.Println("NATS: Error publishing response to node request:", err)
 	}
 }
 
+// gc purges tombstones older than retention and revisions older than the
+// configured revision retention. Nothing is purged for a zero retention.
+func (st *Store) gc(retention time.Duration) (data.GCResults, error) {
+	now := time.Now()
+	var before, revisionsBefore time.Time
+
+	if retention > 0 {
+		before = now.Add(-retention)
+	}
+
+	if st.params.RevisionRetention > 0 {
+		revisionsBefore = now.Add(-st.params.RevisionRetention)
+	}
+
+	results, err := st.db.gc(before, revisionsBefore)
+	if err != nil {
+		return results, err
+	}
+
+	if results.Total() > 0 {
+		log.Println("STORE: purged tombstones:", results)
+		st.publishRescan()
+	}
+
+	return results, nil
+}
+
+// handleStoreGC purges tombstones and compacts the store. The payload can
+// optionally contain a retention duration (ex: 720h), otherwise the configured
+// retention is used.
+func (st *Store) handleStoreGC(msg *nats.Msg) {
+	var results data.GCResults
+	var err error
+
+	retention := st.params.TombstoneRetention
+
+	if len(msg.Data) > 0 {
+		retention, err = time.ParseDuration(string(msg.Data))
+		if err != nil {
+			err = fmt.Errorf("invalid retention: %v", err)
+		}
+	}
+
+	if err == nil && retention <= 0 {
+		err = errors.New("tombstone retention is not set")
+	}
+
+	if err == nil {
+		results, err = st.gc(retention)
+	}
+
+	if err == nil {
+		err = st.db.compact()
+	}
+
+	if err != nil {
+		results.ErrorMessage = err.Error()
+	}
+
+	res, err := json.Marshal(results)
+	if err != nil {
+		res = []byte(`{"error":"error encoding response"}`)
+	}
+
+	err = msg.Respond(res)
+	if err != nil {
+		log.Println("NATS: Error responding to store gc request:", err)
+	}
+}
+
+// handleStoreBackup creates a snapshot of the store and sends it in chunks to
+// the reply subject
+func (st *Store) handleStoreBackup(msg *nats.Msg) {
+	file, cleanup, err := snapshotFile()
+	if err != nil {
+		log.Println("Error creating backup file:", err)
+		return
+	}
+	defer cleanup()
+
+	var r io.Reader
+
+	err = st.db.backup(file)
+	if err == nil {
+		var f *os.File
+		f, err = os.Open(file)
+		if err == nil {
+			defer f.Close()
+			r = f
+		}
+	}
+
+	if err != nil {
+		// send the error to the receiver
+		r = errReader{err}
+	}
+
+	err = client.SendFileChunks(st.nc, msg.Reply, r, "backup", time.Minute)
+	if err != nil {
+		log.Println("Error sending backup:", err)
+	}
+}
+
+// handleStoreRestore receives a snapshot in chunks and restores it when the
+// last chunk is received
+func (st *Store) handleStoreRestore(msg *nats.Msg) {
+	reply := func(err error) {
+		r := "OK"
+		if err != nil {
+			r = err.Error()
+		}
+		if e := msg.Respond([]byte(r)); e != nil {
+			log.Println("Error replying to restore:", e)
+		}
+	}
+
+	chunk := &pb.FileChunk{}
+	err := proto.Unmarshal(msg.Data, chunk)
+	if err != nil {
+		reply(fmt.Errorf("Error decoding restore chunk: %v", err))
+		return
+	}
+
+	if chunk.Seq == 0 {
+		// start of a new restore, discard any previous partial one
+		st.restoreDone()
+
+		file, cleanup, err := snapshotFile()
+		if err != nil {
+			reply(err)
+			return
+		}
+
+		st.restoreFile, err = os.Create(file)
+		if err != nil {
+			cleanup()
+			reply(err)
+			return
+		}
+
+		st.restoreCleanup = cleanup
+		st.restoreSeq = 0
+	}
+
+	if st.restoreFile == nil {
+		reply(errors.New("restore not started"))
+		return
+	}
+
+	done, err := client.ReceiveFileChunk(msg, st.restoreFile, st.restoreSeq)
+	if err != nil {
+		st.restoreDone()
+		reply(err)
+		return
+	}
+
+	st.restoreSeq++
+
+	if !done {
+		reply(nil)
+		return
+	}
+
+	file := st.restoreFile.Name()
+	err = st.restoreFile.Close()
+	if err == nil {
+		log.Println("STORE: restoring snapshot")
+		err = st.db.restore(file)
+	}
+
+	st.restoreDone()
+
+	if err != nil {
+		log.Println("STORE: restore failed:", err)
+	} else {
+		log.Println("STORE: restore complete")
+		st.publishRescan()
+	}
+
+	reply(err)
+}
+
+// restoreDone cleans up the files used for a restore
+func (st *Store) restoreDone() {
+	if st.restoreFile != nil {
+		st.restoreFile.Close()
+		st.restoreFile = nil
+	}
+
+	if st.restoreCleanup != nil {
+		st.restoreCleanup()
+		st.restoreCleanup = nil
+	}
+}
+
+func (st *Store) handleRevisions(msg *nats.Msg) {
+	results := new(data.RevisionResults)
+
+	chunks := strings.Split(msg.Subject, ".")
+	if len(chunks) < 2 {
+		results.ErrorMessage = "invalid revisions subject: " + msg.Subject
+	} else {
+		var err error
+		results.Revisions, err = st.db.revisions(chunks[1])
+		if err != nil {
+			results.ErrorMessage = err.Error()
+		}
+	}
+
+	res, err := json.Marshal(results)
+	if err != nil {
+		res = []byte(`{"error":"error encoding response"}`)
+	}
+
+	err = msg.Respond(res)
+	if err != nil {
+		log.Println("Error responding to revisions request:", err)
+	}
+}
+
+// handleHistory answers history queries sent to history.<id>. Queries sent to
+// the root node return the history of all nodes, and queries sent to other
+// nodes return the history of the node and its descendants. Queries sent to
+// db nodes are left for the Influx db client to answer.
+func (st *Store) handleHistory(msg *nats.Msg) {
+	query := new(data.HistoryQuery)
+	results := new(data.HistoryResults)
+
+	chunks := strings.Split(msg.Subject, ".")
+	if len(chunks) < 2 {
+		results.ErrorMessage = "invalid history subject: " + msg.Subject
+	} else if err := json.Unmarshal(msg.Data, query); err != nil {
+		results.ErrorMessage = "parsing query: " + err.Error()
+	} else if id := chunks[1]; id == st.db.rootNodeID() {
+		st.db.historyQuery(*query, "", results)
+	} else {
+		nodes, err := st.db.getNodes("all", id, "", false)
+		switch {
+		case err != nil:
+			results.ErrorMessage = "getting node: " + err.Error()
+		case len(nodes) < 1:
+			results.ErrorMessage = "node not found: " + id
+		case nodes[0].Type == data.NodeTypeDb:
+			return
+		default:
+			st.db.historyQuery(*query, id, results)
+		}
+	}
+
+	res, err := json.Marshal(results)
+	if err != nil {
+		res = []byte(`{"error":"error encoding response"}`)
+	}
+
+	err = msg.Respond(res)
+	if err != nil {
+		log.Println("NATS: Error responding to history query:", err)
+	}
+}
+
 // used for messages that want an ACK
 func (st *Store) reply(subject string, err error) {
 	if subject == "" {
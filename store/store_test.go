@@ -188,3 +188,68 @@ func TestDontAllowDeleteRootNode(t *testing.T) {
 		t.Fatal("Root node was deleted")
 	}
 }
+
+func TestStorePasswordHash(t *testing.T) {
+	nc, root, stop, err := server.TestServer()
+
+	if err != nil {
+		t.Fatal("Error starting test server: ", err)
+	}
+
+	defer stop()
+
+	users, err := client.GetNodes(nc, root.ID, "all", data.NodeTypeUser, false)
+	if err != nil {
+		t.Fatal("Error getting users: ", err)
+	}
+
+	if len(users) < 1 {
+		t.Fatal("admin user not found")
+	}
+
+	if _, ok := users[0].Points.Find(data.PointTypePass, ""); ok {
+		t.Fatal("password point should not be returned")
+	}
+
+	// hashing can take longer than the ack timeout with the race detector,
+	// so wait for the new password to work instead
+	err = client.SendNodePoint(nc, users[0].ID, data.Point{Type: data.PointTypePass,
+		Text: "newpass"}, false)
+	if err != nil {
+		t.Fatal("Error sending password: ", err)
+	}
+
+	var nodes []data.NodeEdge
+	start := time.Now()
+	for {
+		nodes, err = client.UserCheck(nc, "admin@admin.com", "newpass")
+		if err != nil {
+			t.Fatal("Error checking user: ", err)
+		}
+
+		if len(nodes) >= 2 {
+			break
+		}
+
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("new password did not work")
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	oldNodes, err := client.UserCheck(nc, "admin@admin.com", "admin")
+	if err != nil {
+		t.Fatal("Error checking user: ", err)
+	}
+
+	if len(oldNodes) > 0 {
+		t.Fatal("old password should not work")
+	}
+
+	for _, n := range nodes {
+		if _, ok := n.Points.Find(data.PointTypePass, ""); ok {
+			t.Fatal("auth response should not include password")
+		}
+	}
+}